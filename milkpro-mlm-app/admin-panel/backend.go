@@ -0,0 +1,132 @@
+package main
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/http/httputil"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    // staffTokenIssuer must match what the backend's admin API expects.
+    staffTokenIssuer = "milkpro-admin-panel"
+    // staffTokenTTL is kept short because a token is minted for every call.
+    staffTokenTTL = time.Minute
+)
+
+// errBackendNotFound is returned by get when the backend answers 404.
+var errBackendNotFound = errors.New("not found in backend")
+
+// backendClient calls the backend's JSON admin API as the signed-in staff
+// account, authenticating with a short-lived HS256 token signed with
+// ADMIN_API_SECRET.
+type backendClient struct {
+    baseURL *url.URL
+    secret  []byte
+    http    *http.Client
+}
+
+func newBackendClient() (*backendClient, error) {
+    raw := os.Getenv("BACKEND_URL")
+    if raw == "" {
+        raw = "http://localhost:8081"
+    }
+    baseURL, err := url.Parse(raw)
+    if err != nil {
+        return nil, fmt.Errorf("invalid BACKEND_URL: %w", err)
+    }
+    secret := os.Getenv("ADMIN_API_SECRET")
+    if len(secret) < 32 {
+        return nil, fmt.Errorf("ADMIN_API_SECRET must be set to at least 32 random characters")
+    }
+    return &backendClient{
+        baseURL: baseURL,
+        secret:  []byte(secret),
+        http:    &http.Client{Timeout: 10 * time.Second},
+    }, nil
+}
+
+// token signs a staff token for u. The backend reads the role from it to
+// apply the same permissions the panel does.
+func (c *backendClient) token(u *User) (string, error) {
+    now := time.Now()
+    header, err := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+    if err != nil {
+        return "", err
+    }
+    payload, err := json.Marshal(map[string]interface{}{
+        "iss":  staffTokenIssuer,
+        "sub":  strconv.Itoa(u.ID),
+        "role": u.Role,
+        "iat":  now.Unix(),
+        "exp":  now.Add(staffTokenTTL).Unix(),
+    })
+    if err != nil {
+        return "", err
+    }
+
+    signingInput := base64.RawURLEncoding.EncodeToString(header) + "." +
+        base64.RawURLEncoding.EncodeToString(payload)
+    mac := hmac.New(sha256.New, c.secret)
+    mac.Write([]byte(signingInput))
+    return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// get fetches path from the admin API as u and decodes the JSON response into v.
+func (c *backendClient) get(ctx context.Context, u *User, path string, v interface{}) error {
+    token, err := c.token(u)
+    if err != nil {
+        return err
+    }
+    req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL.String()+"/admin/api"+path, nil)
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Authorization", "Bearer "+token)
+
+    res, err := c.http.Do(req)
+    if err != nil {
+        return err
+    }
+    defer res.Body.Close()
+    if res.StatusCode == http.StatusNotFound {
+        return errBackendNotFound
+    }
+    if res.StatusCode != http.StatusOK {
+        return fmt.Errorf("GET %s: backend returned %s", path, res.Status)
+    }
+    return json.NewDecoder(res.Body).Decode(v)
+}
+
+// proxy forwards /admin/api/ requests from the panel's JavaScript to the
+// backend, replacing the session cookie with a staff token. It must run
+// behind authMiddleware.
+func (c *backendClient) proxy() http.Handler {
+    rp := httputil.NewSingleHostReverseProxy(c.baseURL)
+    director := rp.Director
+    rp.Director = func(r *http.Request) {
+        director(r)
+        r.Header.Del("Cookie")
+        r.Header.Del("Authorization")
+        if token, err := c.token(currentUser(r)); err == nil {
+            r.Header.Set("Authorization", "Bearer "+token)
+        }
+    }
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !strings.HasPrefix(r.URL.Path, "/admin/api/") {
+            http.NotFound(w, r)
+            return
+        }
+        rp.ServeHTTP(w, r)
+    })
+}
@@ -0,0 +1,616 @@
+package main
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "unicode/utf8"
+
+    "github.com/gorilla/websocket"
+)
+
+const (
+    // chatTokenIssuer is what the backend puts in the tokens it hands app
+    // users for /ws/chat.
+    chatTokenIssuer = "milkpro-backend"
+    chatTokenLeeway = 30 * time.Second
+
+    maxChatMessage = 2000 // characters
+    maxChatFrame   = 8 << 10
+
+    // chatSendBuffer frames may wait for a client; one that falls further
+    // behind is disconnected and replays what it missed when it reconnects.
+    chatSendBuffer   = 64
+    chatWriteWait    = 10 * time.Second
+    chatPongWait     = 60 * time.Second
+    chatPingPeriod   = chatPongWait * 9 / 10
+    chatStoreTimeout = 5 * time.Second
+)
+
+// Events the hub sends to clients.
+const (
+    eventSession = "session" // the session as it stands; sent on join and when staff pick it up
+    eventHistory = "history" // messages after the client's ?after=, sent once on join
+    eventMessage = "message"
+    eventTyping  = "typing"
+    eventRead    = "read"
+    eventEnded   = "ended"
+    eventError   = "error"
+
+    // Sent to staff whose session has been transferred or escalated away
+    // from them, before they are disconnected.
+    eventTransferred = "transferred"
+
+    // Sent over the lobby socket: the queue and who is online, and a
+    // session just assigned to the recipient.
+    eventLobby    = "lobby"
+    eventAssigned = "assigned"
+)
+
+// Commands clients send to the hub.
+const (
+    commandMessage = "message"
+    commandTyping  = "typing"
+    commandRead    = "read"
+    commandEnd     = "end"
+
+    // Staff only.
+    commandTransfer = "transfer"
+    commandEscalate = "escalate"
+)
+
+type chatEvent struct {
+    Type       string        `json:"type"`
+    Session    *ChatSession  `json:"session,omitempty"`
+    Messages   []ChatMessage `json:"messages,omitempty"`
+    Message    *ChatMessage  `json:"message,omitempty"`
+    SenderType string        `json:"sender_type,omitempty"`
+    MessageID  int           `json:"message_id,omitempty"`
+    EndedAt    *time.Time    `json:"ended_at,omitempty"`
+    Error      string        `json:"error,omitempty"`
+    Lobby      *chatLobby    `json:"lobby,omitempty"`
+}
+
+type chatCommand struct {
+    Type      string `json:"type"`
+    Message   string `json:"message"`
+    MessageID int    `json:"message_id"`
+    StaffID   int    `json:"staff_id"`
+}
+
+// chatHub connects app users and staff to the live chats they are in. Each
+// session with someone connected has a room; everything said in a room is
+// stored before it is sent, so a client that reconnects with the ID of the
+// last message it saw gets exactly what it missed.
+type chatHub struct {
+    store  chatStore
+    secret []byte
+    now    func() time.Time
+
+    // userUpgrader accepts any origin since app users authenticate with a
+    // token; staffUpgrader keeps the default same-origin check because staff
+    // authenticate with the session cookie.
+    userUpgrader  websocket.Upgrader
+    staffUpgrader websocket.Upgrader
+
+    // maxPerAgent caps how many active sessions the queue gives one staff
+    // member.
+    maxPerAgent int
+
+    mu          sync.Mutex
+    rooms       map[int]*chatRoom
+    online      map[int]*chatPresence
+    assignments uint64 // sessions given out by the queue, for chatPresence.lastAssigned
+
+    // lobby holds the staff watching the queue; see chat_queue.go.
+    lobby *chatRoom
+    // dispatchMu serialises assigning queued sessions.
+    dispatchMu sync.Mutex
+}
+
+// chatRoom holds the clients connected to one session. Storing a message and
+// sending it happen under mu, so every client sees messages in the order
+// they were stored and a client joining never misses one or sees it twice.
+type chatRoom struct {
+    id   int
+    refs int // connections using the room, guarded by chatHub.mu
+
+    mu      sync.Mutex
+    clients map[*chatClient]bool
+}
+
+type chatClient struct {
+    conn *websocket.Conn
+    send chan []byte
+    side string // senderUser or senderStaff
+    id   int    // the app user's or staff member's ID
+    user *User  // the staff member, nil for app users
+}
+
+func newChatHub(store chatStore, secret []byte, maxPerAgent int) *chatHub {
+    return &chatHub{
+        store:  store,
+        secret: secret,
+        now:    time.Now,
+        userUpgrader: websocket.Upgrader{
+            CheckOrigin: func(r *http.Request) bool { return true },
+        },
+        maxPerAgent: maxPerAgent,
+        rooms:       map[int]*chatRoom{},
+        online:      map[int]*chatPresence{},
+        lobby:       &chatRoom{clients: map[*chatClient]bool{}},
+    }
+}
+
+// serveUser is /ws/chat for app users: ?token= from the backend's
+// POST /api/v1/me/chat/token, and optionally ?session= and ?after= to resume.
+// Without a session the user's active chat is resumed or a new one started.
+func (h *chatHub) serveUser(w http.ResponseWriter, r *http.Request) {
+    userID, err := h.verifyChatToken(r.URL.Query().Get("token"))
+    if err != nil {
+        http.Error(w, "Invalid chat token", http.StatusUnauthorized)
+        return
+    }
+    after, ok := chatAfter(w, r)
+    if !ok {
+        return
+    }
+
+    ctx, cancel := context.WithTimeout(r.Context(), chatStoreTimeout)
+    defer cancel()
+    var session ChatSession
+    if raw := r.URL.Query().Get("session"); raw != "" {
+        id, convErr := strconv.Atoi(raw)
+        if convErr != nil {
+            http.Error(w, "Invalid session", http.StatusBadRequest)
+            return
+        }
+        session, err = h.store.Session(ctx, id)
+        if err == nil && session.UserID != userID {
+            err = errChatNotFound
+        }
+    } else {
+        session, err = h.store.OpenSession(ctx, userID)
+    }
+    if err == errChatNotFound {
+        http.Error(w, "Chat session not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        log.Printf("Opening chat for user %d: %v", userID, err)
+        http.Error(w, "Database error", http.StatusInternalServerError)
+        return
+    }
+
+    conn, err := h.userUpgrader.Upgrade(w, r, nil)
+    if err != nil {
+        return
+    }
+    h.serve(&chatClient{conn: conn, send: make(chan []byte, chatSendBuffer), side: senderUser, id: userID},
+        session.ID, after, false)
+}
+
+// serveStaff is /ws/chat/{id}?after= for staff, behind authMiddleware. Joining
+// a queued session assigns it to the caller, whatever the cap; only admins
+// may pick up escalated sessions.
+func (h *chatHub) serveStaff(w http.ResponseWriter, r *http.Request) {
+    id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/ws/chat/"))
+    if err != nil {
+        http.NotFound(w, r)
+        return
+    }
+    after, ok := chatAfter(w, r)
+    if !ok {
+        return
+    }
+    user := currentUser(r)
+
+    ctx, cancel := context.WithTimeout(r.Context(), chatStoreTimeout)
+    defer cancel()
+    session, err := h.store.Session(ctx, id)
+    claimed := false
+    if err == nil && session.StaffID == 0 && session.Status == chatActive && canJoinChat(user, session) {
+        session, err = h.store.Assign(ctx, id, user.ID, 0)
+        claimed = err == nil
+        if err == errChatConflict || err == errChatEnded {
+            err = nil
+        }
+    }
+    if err == errChatNotFound {
+        http.NotFound(w, r)
+        return
+    }
+    if err != nil {
+        log.Printf("Joining chat %d: %v", id, err)
+        http.Error(w, "Database error", http.StatusInternalServerError)
+        return
+    }
+    if !canJoinChat(user, session) {
+        http.Error(w, "This chat is assigned to someone else", http.StatusForbidden)
+        return
+    }
+
+    conn, err := h.staffUpgrader.Upgrade(w, r, nil)
+    if err != nil {
+        return
+    }
+    h.serve(&chatClient{conn: conn, send: make(chan []byte, chatSendBuffer), side: senderStaff, id: user.ID, user: user},
+        id, after, claimed)
+}
+
+// canJoinChat reports whether u may see a session: their own, or one waiting
+// in the queue unless it has been escalated. Staff who can assign tickets may
+// join any session.
+func canJoinChat(u *User, s ChatSession) bool {
+    return s.StaffID == u.ID || (s.StaffID == 0 && !s.Escalated) || u.Can(permTicketsAssign)
+}
+
+func chatAfter(w http.ResponseWriter, r *http.Request) (int, bool) {
+    raw := r.URL.Query().Get("after")
+    if raw == "" {
+        return 0, true
+    }
+    after, err := strconv.Atoi(raw)
+    if err != nil || after < 0 {
+        http.Error(w, "Invalid after", http.StatusBadRequest)
+        return 0, false
+    }
+    return after, true
+}
+
+// verifyChatToken checks an HS256 chat token signed with ADMIN_API_SECRET
+// and returns the app user it was issued to.
+func (h *chatHub) verifyChatToken(token string) (int, error) {
+    parts := strings.Split(token, ".")
+    if len(parts) != 3 {
+        return 0, errors.New("malformed token")
+    }
+    sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil {
+        return 0, errors.New("malformed signature")
+    }
+    mac := hmac.New(sha256.New, h.secret)
+    mac.Write([]byte(parts[0] + "." + parts[1]))
+    if !hmac.Equal(sig, mac.Sum(nil)) {
+        return 0, errors.New("bad signature")
+    }
+
+    var header struct {
+        Alg string `json:"alg"`
+    }
+    var claims struct {
+        Issuer   string `json:"iss"`
+        Subject  string `json:"sub"`
+        IssuedAt int64  `json:"iat"`
+        Expires  int64  `json:"exp"`
+    }
+    if err := decodeTokenPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+        return 0, errors.New("unsupported token header")
+    }
+    if err := decodeTokenPart(parts[1], &claims); err != nil {
+        return 0, errors.New("malformed claims")
+    }
+    now := h.now()
+    if claims.Issuer != chatTokenIssuer {
+        return 0, errors.New("wrong issuer")
+    }
+    if claims.Expires == 0 || now.After(time.Unix(claims.Expires, 0).Add(chatTokenLeeway)) {
+        return 0, errors.New("token expired")
+    }
+    if time.Unix(claims.IssuedAt, 0).After(now.Add(chatTokenLeeway)) {
+        return 0, errors.New("token issued in the future")
+    }
+    userID, err := strconv.Atoi(claims.Subject)
+    if err != nil || userID <= 0 {
+        return 0, errors.New("bad subject")
+    }
+    return userID, nil
+}
+
+func decodeTokenPart(part string, v interface{}) error {
+    raw, err := base64.RawURLEncoding.DecodeString(part)
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(raw, v)
+}
+
+// serve runs a connected client until it disconnects or the session ends.
+// announce tells the others in the room that staff have picked the session up.
+// Staff count as online while connected.
+func (h *chatHub) serve(c *chatClient, sessionID, after int, announce bool) {
+    room := h.acquire(sessionID)
+    defer h.release(room)
+
+    go c.writePump()
+    if !room.join(h.store, c, after, announce) {
+        // The session has ended, or could not be loaded: writePump closes
+        // the connection once it has sent what join queued.
+        c.drain()
+        return
+    }
+    if c.user != nil {
+        h.arrive(c.user)
+        defer h.depart(c.user)
+    }
+    // A new session is queued, and a newly online agent can take one.
+    h.refresh()
+    h.readPump(room, c)
+    room.leave(c)
+}
+
+func (h *chatHub) acquire(sessionID int) *chatRoom {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    room := h.rooms[sessionID]
+    if room == nil {
+        room = &chatRoom{id: sessionID, clients: map[*chatClient]bool{}}
+        h.rooms[sessionID] = room
+    }
+    room.refs++
+    return room
+}
+
+func (h *chatHub) release(room *chatRoom) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    room.refs--
+    if room.refs == 0 {
+        delete(h.rooms, room.id)
+    }
+}
+
+// join sends c the session and its history after afterID, then adds it to
+// the room. It reports false, having queued an ended or error event and
+// closed c.send, if c should not stay.
+func (room *chatRoom) join(store chatStore, c *chatClient, afterID int, announce bool) bool {
+    room.mu.Lock()
+    defer room.mu.Unlock()
+
+    ctx, cancel := context.WithTimeout(context.Background(), chatStoreTimeout)
+    defer cancel()
+    session, err := store.Session(ctx, room.id)
+    var messages []ChatMessage
+    if err == nil {
+        messages, err = store.Messages(ctx, room.id, afterID)
+    }
+    if err != nil {
+        log.Printf("Loading chat %d: %v", room.id, err)
+        c.send <- encodeChatEvent(chatEvent{Type: eventError, Error: "Failed to load chat"})
+        close(c.send)
+        return false
+    }
+
+    c.send <- encodeChatEvent(chatEvent{Type: eventSession, Session: &session})
+    c.send <- encodeChatEvent(chatEvent{Type: eventHistory, Messages: messages})
+    if session.Status != chatActive {
+        c.send <- encodeChatEvent(chatEvent{Type: eventEnded, EndedAt: session.EndedAt})
+        close(c.send)
+        return false
+    }
+    if announce {
+        room.broadcast(chatEvent{Type: eventSession, Session: &session}, nil)
+    }
+    room.clients[c] = true
+    return true
+}
+
+// leave removes c if it is still in the room, closing its send channel.
+func (room *chatRoom) leave(c *chatClient) {
+    room.mu.Lock()
+    defer room.mu.Unlock()
+    room.remove(c)
+}
+
+// remove must be called with mu held.
+func (room *chatRoom) remove(c *chatClient) {
+    if room.clients[c] {
+        delete(room.clients, c)
+        close(c.send)
+    }
+}
+
+// broadcast queues ev for every client but except. A client whose buffer is
+// full is dropped rather than holding up the room. It must be called with
+// mu held.
+func (room *chatRoom) broadcast(ev chatEvent, except *chatClient) {
+    frame := encodeChatEvent(ev)
+    for c := range room.clients {
+        if c != except {
+            room.deliver(c, frame)
+        }
+    }
+}
+
+// deliver must be called with mu held.
+func (room *chatRoom) deliver(c *chatClient, frame []byte) {
+    if !room.clients[c] {
+        return
+    }
+    select {
+    case c.send <- frame:
+    default:
+        room.remove(c)
+    }
+}
+
+// reply sends ev to c alone.
+func (room *chatRoom) reply(c *chatClient, ev chatEvent) {
+    room.mu.Lock()
+    defer room.mu.Unlock()
+    room.deliver(c, encodeChatEvent(ev))
+}
+
+func encodeChatEvent(ev chatEvent) []byte {
+    frame, err := json.Marshal(ev)
+    if err != nil {
+        // chatEvent holds nothing json.Marshal can fail on.
+        panic(err)
+    }
+    return frame
+}
+
+// prepareRead limits what c may send and drops it if pongs stop arriving.
+func (c *chatClient) prepareRead() {
+    c.conn.SetReadLimit(maxChatFrame)
+    c.conn.SetReadDeadline(time.Now().Add(chatPongWait))
+    c.conn.SetPongHandler(func(string) error {
+        return c.conn.SetReadDeadline(time.Now().Add(chatPongWait))
+    })
+}
+
+// readPump handles c's commands until the connection closes.
+func (h *chatHub) readPump(room *chatRoom, c *chatClient) {
+    c.prepareRead()
+    for {
+        _, frame, err := c.conn.ReadMessage()
+        if err != nil {
+            return
+        }
+        var cmd chatCommand
+        if err := json.Unmarshal(frame, &cmd); err != nil {
+            room.reply(c, chatEvent{Type: eventError, Error: "Commands must be JSON"})
+            continue
+        }
+        switch cmd.Type {
+        case commandMessage:
+            room.post(h.store, c, cmd.Message)
+        case commandTyping:
+            room.mu.Lock()
+            room.broadcast(chatEvent{Type: eventTyping, SenderType: c.side}, c)
+            room.mu.Unlock()
+        case commandRead:
+            room.markRead(h.store, c, cmd.MessageID)
+        case commandEnd:
+            room.end(h.store, c)
+            h.refresh()
+        case commandTransfer:
+            if h.transfer(room, c, cmd.StaffID) {
+                h.refresh()
+            }
+        case commandEscalate:
+            if h.escalate(room, c) {
+                h.refresh()
+            }
+        default:
+            room.reply(c, chatEvent{Type: eventError, Error: "Unknown command"})
+        }
+    }
+}
+
+// post stores a message and sends it to everyone in the room, the sender
+// included, so all of them learn its ID.
+func (room *chatRoom) post(store chatStore, c *chatClient, text string) {
+    text = strings.TrimSpace(text)
+    if text == "" || utf8.RuneCountInString(text) > maxChatMessage {
+        room.reply(c, chatEvent{Type: eventError, Error: "Messages must be 1 to 2000 characters"})
+        return
+    }
+
+    room.mu.Lock()
+    defer room.mu.Unlock()
+    ctx, cancel := context.WithTimeout(context.Background(), chatStoreTimeout)
+    defer cancel()
+    m, err := store.AddMessage(ctx, ChatMessage{SessionID: room.id, SenderType: c.side, SenderID: c.id, Message: text})
+    if err == errChatEnded {
+        room.deliver(c, encodeChatEvent(chatEvent{Type: eventError, Error: "This chat has ended"}))
+        return
+    }
+    if err != nil {
+        log.Printf("Storing chat %d message: %v", room.id, err)
+        room.deliver(c, encodeChatEvent(chatEvent{Type: eventError, Error: "Failed to send message"}))
+        return
+    }
+    room.broadcast(chatEvent{Type: eventMessage, Message: &m}, nil)
+}
+
+// markRead records how far c has read and tells the other side.
+func (room *chatRoom) markRead(store chatStore, c *chatClient, messageID int) {
+    if messageID <= 0 {
+        room.reply(c, chatEvent{Type: eventError, Error: "message_id is required"})
+        return
+    }
+
+    room.mu.Lock()
+    defer room.mu.Unlock()
+    ctx, cancel := context.WithTimeout(context.Background(), chatStoreTimeout)
+    defer cancel()
+    readID, err := store.MarkRead(ctx, room.id, c.side, messageID)
+    if err != nil {
+        log.Printf("Marking chat %d read: %v", room.id, err)
+        return
+    }
+    room.broadcast(chatEvent{Type: eventRead, SenderType: c.side, MessageID: readID}, c)
+}
+
+// end ends the session for everyone and disconnects them.
+func (room *chatRoom) end(store chatStore, c *chatClient) {
+    room.mu.Lock()
+    defer room.mu.Unlock()
+    ctx, cancel := context.WithTimeout(context.Background(), chatStoreTimeout)
+    defer cancel()
+    endedAt, err := store.End(ctx, room.id)
+    if err != nil && err != errChatEnded {
+        log.Printf("Ending chat %d: %v", room.id, err)
+        room.deliver(c, encodeChatEvent(chatEvent{Type: eventError, Error: "Failed to end chat"}))
+        return
+    }
+    ev := chatEvent{Type: eventEnded, SenderType: c.side}
+    if err == nil {
+        ev.EndedAt = &endedAt
+    }
+    room.broadcast(ev, nil)
+    for other := range room.clients {
+        room.remove(other)
+    }
+}
+
+// writePump is the only writer to c.conn. It closes the connection once
+// c.send is closed.
+func (c *chatClient) writePump() {
+    ticker := time.NewTicker(chatPingPeriod)
+    defer func() {
+        ticker.Stop()
+        c.conn.Close()
+    }()
+
+    for {
+        select {
+        case frame, ok := <-c.send:
+            c.conn.SetWriteDeadline(time.Now().Add(chatWriteWait))
+            if !ok {
+                c.conn.WriteMessage(websocket.CloseMessage,
+                    websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+                return
+            }
+            if err := c.conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+                return
+            }
+        case <-ticker.C:
+            c.conn.SetWriteDeadline(time.Now().Add(chatWriteWait))
+            if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+                return
+            }
+        }
+    }
+}
+
+// drain reads from a client that has been refused until writePump closes the
+// connection, so the close handshake can complete.
+func (c *chatClient) drain() {
+    c.conn.SetReadDeadline(time.Now().Add(chatWriteWait))
+    for {
+        if _, _, err := c.conn.NextReader(); err != nil {
+            return
+        }
+    }
+}
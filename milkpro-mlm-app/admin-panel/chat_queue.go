@@ -0,0 +1,375 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "net/http"
+    "sort"
+    "time"
+)
+
+// defaultChatsPerAgent is the cap on sessions the queue gives one staff
+// member when CHAT_MAX_SESSIONS is not set.
+const defaultChatsPerAgent = 3
+
+// chatPresence is a staff member with at least one chat or lobby socket open.
+// Only online staff are given sessions from the queue.
+type chatPresence struct {
+    user  *User
+    conns int
+    // lastAssigned orders agents with equally few sessions, so the queue
+    // takes turns between them.
+    lastAssigned uint64
+}
+
+type chatAgent struct {
+    ID             int    `json:"id"`
+    Username       string `json:"username"`
+    Role           string `json:"role"`
+    ActiveSessions int    `json:"active_sessions"`
+}
+
+// chatLobby is what the support page shows: every active session in queue
+// order, those without staff being the queue, and the staff online.
+type chatLobby struct {
+    Now         time.Time     `json:"now"`
+    MaxPerAgent int           `json:"max_per_agent"`
+    Sessions    []ChatSession `json:"sessions"`
+    Agents      []chatAgent   `json:"agents"`
+}
+
+// serveLobby is /ws/chat/lobby for staff, behind authMiddleware. It sends a
+// lobby event whenever the queue, the sessions or who is online change, and
+// an assigned event when the queue gives the caller a session.
+func (h *chatHub) serveLobby(w http.ResponseWriter, r *http.Request) {
+    user := currentUser(r)
+    conn, err := h.staffUpgrader.Upgrade(w, r, nil)
+    if err != nil {
+        return
+    }
+    c := &chatClient{conn: conn, send: make(chan []byte, chatSendBuffer), side: senderStaff, id: user.ID, user: user}
+    go c.writePump()
+
+    h.lobby.mu.Lock()
+    h.lobby.clients[c] = true
+    h.lobby.mu.Unlock()
+    h.arrive(user)
+    h.refresh()
+
+    // The lobby takes no commands; reading only notices the socket closing.
+    c.prepareRead()
+    for {
+        if _, _, err := c.conn.NextReader(); err != nil {
+            break
+        }
+    }
+    h.lobby.leave(c)
+    h.depart(user)
+}
+
+func (h *chatHub) arrive(u *User) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    p := h.online[u.ID]
+    if p == nil {
+        p = &chatPresence{}
+        h.online[u.ID] = p
+    }
+    p.user = u
+    p.conns++
+}
+
+// depart marks one of u's sockets closed and tells the lobby if that was
+// their last.
+func (h *chatHub) depart(u *User) {
+    h.mu.Lock()
+    p := h.online[u.ID]
+    gone := p != nil && p.conns == 1
+    if gone {
+        delete(h.online, u.ID)
+    } else if p != nil {
+        p.conns--
+    }
+    h.mu.Unlock()
+    if gone {
+        h.refresh()
+    }
+}
+
+// onlineAgent returns the staff member if they are online.
+func (h *chatHub) onlineAgent(id int) *User {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if p := h.online[id]; p != nil {
+        return p.user
+    }
+    return nil
+}
+
+// agents lists the staff online, with how many sessions each has in load.
+func (h *chatHub) agents(load map[int]int) []chatAgent {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    agents := []chatAgent{}
+    for _, p := range h.online {
+        agents = append(agents, chatAgent{
+            ID: p.user.ID, Username: p.user.Username, Role: p.user.Role, ActiveSessions: load[p.user.ID],
+        })
+    }
+    sort.Slice(agents, func(i, j int) bool { return agents[i].ID < agents[j].ID })
+    return agents
+}
+
+// onlineAgents is agents with the load read from the store, for pages.
+func (h *chatHub) onlineAgents(ctx context.Context) ([]chatAgent, error) {
+    sessions, err := h.store.ActiveSessions(ctx)
+    if err != nil {
+        return nil, err
+    }
+    return h.agents(chatLoad(sessions)), nil
+}
+
+// chatLoad counts the sessions assigned to each staff member.
+func chatLoad(sessions []ChatSession) map[int]int {
+    load := map[int]int{}
+    for _, s := range sessions {
+        if s.StaffID != 0 {
+            load[s.StaffID]++
+        }
+    }
+    return load
+}
+
+// pickAgent chooses who gets the next queued session: the online staff
+// member with the fewest sessions under the cap, taking turns on a tie.
+// Escalated sessions only go to admins. The agent keeps their turn until
+// tookTurn records that the session is theirs.
+func (h *chatHub) pickAgent(load map[int]int, escalated bool) *User {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    var best *chatPresence
+    for _, p := range h.online {
+        if load[p.user.ID] >= h.maxPerAgent || (escalated && !p.user.Can(permTicketsAssign)) {
+            continue
+        }
+        if best == nil || load[p.user.ID] < load[best.user.ID] ||
+            (load[p.user.ID] == load[best.user.ID] && (p.lastAssigned < best.lastAssigned ||
+                (p.lastAssigned == best.lastAssigned && p.user.ID < best.user.ID))) {
+            best = p
+        }
+    }
+    if best == nil {
+        return nil
+    }
+    return best.user
+}
+
+// tookTurn sends a staff member to the back of the queue's turns after it
+// gave them a session.
+func (h *chatHub) tookTurn(id int) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if p := h.online[id]; p != nil {
+        h.assignments++
+        p.lastAssigned = h.assignments
+    }
+}
+
+// refresh assigns what it can from the queue and sends the lobby the
+// result. It is called after anything that can change either: a session
+// starting or ending, staff coming online or leaving, a transfer or an
+// escalation. It must not be called with a room's mu held.
+func (h *chatHub) refresh() {
+    h.dispatchMu.Lock()
+    defer h.dispatchMu.Unlock()
+    ctx, cancel := context.WithTimeout(context.Background(), chatStoreTimeout)
+    defer cancel()
+
+    sessions, err := h.store.ActiveSessions(ctx)
+    if err != nil {
+        log.Printf("Loading chat queue: %v", err)
+        return
+    }
+    load := chatLoad(sessions)
+    for i, s := range sessions {
+        if s.StaffID != 0 {
+            continue
+        }
+        agent := h.pickAgent(load, s.Escalated)
+        if agent == nil {
+            continue
+        }
+        assigned, err := h.store.Assign(ctx, s.ID, agent.ID, 0)
+        if err == errChatConflict || err == errChatEnded {
+            // Picked up by hand or ended since the queue was read. Only
+            // the first adds to anyone's load, and the agent keeps their turn.
+            sessions[i] = assigned
+            if err == errChatConflict && assigned.StaffID != 0 {
+                load[assigned.StaffID]++
+            }
+            continue
+        }
+        if err != nil {
+            log.Printf("Assigning chat %d: %v", s.ID, err)
+            break
+        }
+        sessions[i] = assigned
+        load[agent.ID]++
+        h.tookTurn(agent.ID)
+        h.notifyRoom(assigned)
+        h.notifyAgent(agent.ID, chatEvent{Type: eventAssigned, Session: &assigned})
+    }
+
+    lobby := &chatLobby{Now: h.now(), MaxPerAgent: h.maxPerAgent, Sessions: []ChatSession{}, Agents: h.agents(load)}
+    for _, s := range sessions {
+        if s.Status == chatActive {
+            lobby.Sessions = append(lobby.Sessions, s)
+        }
+    }
+    h.lobby.mu.Lock()
+    h.lobby.broadcast(chatEvent{Type: eventLobby, Lobby: lobby}, nil)
+    h.lobby.mu.Unlock()
+}
+
+// notifyRoom sends a session's new state to whoever is in it.
+func (h *chatHub) notifyRoom(s ChatSession) {
+    h.mu.Lock()
+    room := h.rooms[s.ID]
+    h.mu.Unlock()
+    if room == nil {
+        return
+    }
+    room.mu.Lock()
+    defer room.mu.Unlock()
+    room.broadcast(chatEvent{Type: eventSession, Session: &s}, nil)
+}
+
+// notifyAgent sends ev to a staff member's lobby sockets.
+func (h *chatHub) notifyAgent(staffID int, ev chatEvent) {
+    h.lobby.mu.Lock()
+    defer h.lobby.mu.Unlock()
+    frame := encodeChatEvent(ev)
+    for c := range h.lobby.clients {
+        if c.id == staffID {
+            h.lobby.deliver(c, frame)
+        }
+    }
+}
+
+// transfer hands the room's session to another online staff member below
+// the cap. The assigned agent and admins may transfer a session. It reports
+// whether the session moved.
+func (h *chatHub) transfer(room *chatRoom, c *chatClient, to int) bool {
+    if c.user == nil {
+        room.reply(c, chatEvent{Type: eventError, Error: "Only staff can transfer chats"})
+        return false
+    }
+    target := h.onlineAgent(to)
+    if target == nil {
+        room.reply(c, chatEvent{Type: eventError, Error: "That agent is not online"})
+        return false
+    }
+
+    room.mu.Lock()
+    defer room.mu.Unlock()
+    ctx, cancel := context.WithTimeout(context.Background(), chatStoreTimeout)
+    defer cancel()
+    session, ok := room.managedSession(ctx, h.store, c, "transfer")
+    if !ok {
+        return false
+    }
+    if session.StaffID == to {
+        room.deliver(c, encodeChatEvent(chatEvent{Type: eventError, Error: "The chat is already assigned to " + target.Username}))
+        return false
+    }
+    sessions, err := h.store.ActiveSessions(ctx)
+    if err != nil {
+        log.Printf("Transferring chat %d: %v", room.id, err)
+        room.deliver(c, encodeChatEvent(chatEvent{Type: eventError, Error: "Failed to transfer chat"}))
+        return false
+    }
+    if chatLoad(sessions)[to] >= h.maxPerAgent {
+        room.deliver(c, encodeChatEvent(chatEvent{Type: eventError,
+            Error: fmt.Sprintf("%s already has %d chats", target.Username, h.maxPerAgent)}))
+        return false
+    }
+
+    updated, err := h.store.Assign(ctx, room.id, to, session.StaffID)
+    if !room.checkReassign(c, err, "transfer") {
+        return false
+    }
+    room.reassigned(updated)
+    h.notifyAgent(to, chatEvent{Type: eventAssigned, Session: &updated})
+    return true
+}
+
+// escalate puts the room's session back in the queue for an admin. It
+// reports whether the session moved.
+func (h *chatHub) escalate(room *chatRoom, c *chatClient) bool {
+    if c.user == nil {
+        room.reply(c, chatEvent{Type: eventError, Error: "Only staff can escalate chats"})
+        return false
+    }
+
+    room.mu.Lock()
+    defer room.mu.Unlock()
+    ctx, cancel := context.WithTimeout(context.Background(), chatStoreTimeout)
+    defer cancel()
+    if _, ok := room.managedSession(ctx, h.store, c, "escalate"); !ok {
+        return false
+    }
+    updated, err := h.store.Requeue(ctx, room.id, true)
+    if !room.checkReassign(c, err, "escalate") {
+        return false
+    }
+    room.reassigned(updated)
+    return true
+}
+
+// managedSession loads the room's session for c to transfer or escalate,
+// which only the assigned agent and admins may do. It must be called with
+// mu held.
+func (room *chatRoom) managedSession(ctx context.Context, store chatStore, c *chatClient, action string) (ChatSession, bool) {
+    session, err := store.Session(ctx, room.id)
+    if err != nil {
+        log.Printf("Loading chat %d: %v", room.id, err)
+        room.deliver(c, encodeChatEvent(chatEvent{Type: eventError, Error: "Failed to " + action + " chat"}))
+        return session, false
+    }
+    if session.StaffID != c.id && !c.user.Can(permTicketsAssign) {
+        room.deliver(c, encodeChatEvent(chatEvent{Type: eventError,
+            Error: "Only the assigned agent or an admin can " + action + " this chat"}))
+        return session, false
+    }
+    return session, true
+}
+
+// checkReassign reports the outcome of a transfer or escalation to c. It
+// must be called with mu held.
+func (room *chatRoom) checkReassign(c *chatClient, err error, action string) bool {
+    switch {
+    case err == errChatEnded:
+        room.deliver(c, encodeChatEvent(chatEvent{Type: eventError, Error: "This chat has ended"}))
+    case err == errChatConflict:
+        room.deliver(c, encodeChatEvent(chatEvent{Type: eventError, Error: "This chat was reassigned; try again"}))
+    case err != nil:
+        log.Printf("Reassigning chat %d: %v", room.id, err)
+        room.deliver(c, encodeChatEvent(chatEvent{Type: eventError, Error: "Failed to " + action + " chat"}))
+    default:
+        return true
+    }
+    return false
+}
+
+// reassigned tells the room about the session's new staff and disconnects
+// staff who may no longer be in it. It must be called with mu held.
+func (room *chatRoom) reassigned(s ChatSession) {
+    room.broadcast(chatEvent{Type: eventSession, Session: &s}, nil)
+    for c := range room.clients {
+        if c.user != nil && !canJoinChat(c.user, s) {
+            room.deliver(c, encodeChatEvent(chatEvent{Type: eventTransferred, Session: &s}))
+            room.remove(c)
+        }
+    }
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "time"
+)
+
+// Chat session statuses, matching chat_sessions.status.
+const (
+    chatActive = "active"
+    chatEnded  = "ended"
+)
+
+// Who sent a chat message: the app user or a support_staff account.
+const (
+    senderUser  = "user"
+    senderStaff = "staff"
+)
+
+var (
+    errChatNotFound = errors.New("chat session not found")
+    errChatEnded    = errors.New("chat session has ended")
+    errChatConflict = errors.New("chat session was reassigned")
+)
+
+// ChatSession is a live chat between an app user and, once it is assigned,
+// one staff member. Until then it waits in the queue, where QueuedAt orders
+// it. The read IDs are the last message each side has seen.
+type ChatSession struct {
+    ID          int        `json:"id"`
+    UserID      int        `json:"user_id"`
+    UserName    string     `json:"user_name"`
+    UserEmail   string     `json:"user_email"`
+    StaffID     int        `json:"staff_id,omitempty"`
+    StaffName   string     `json:"staff_name,omitempty"`
+    Status      string     `json:"status"`
+    Escalated   bool       `json:"escalated"`
+    UserReadID  int        `json:"user_read_id"`
+    StaffReadID int        `json:"staff_read_id"`
+    CreatedAt   time.Time  `json:"created_at"`
+    QueuedAt    time.Time  `json:"queued_at"`
+    EndedAt     *time.Time `json:"ended_at,omitempty"`
+}
+
+type ChatMessage struct {
+    ID         int       `json:"id"`
+    SessionID  int       `json:"session_id"`
+    SenderType string    `json:"sender_type"`
+    SenderID   int       `json:"sender_id"`
+    Message    string    `json:"message"`
+    CreatedAt  time.Time `json:"created_at"`
+}
+
+// chatStore persists live chat. pgChatStore is the only implementation
+// outside tests.
+type chatStore interface {
+    // OpenSession returns the user's active session, starting one if they
+    // have none.
+    OpenSession(ctx context.Context, userID int) (ChatSession, error)
+    Session(ctx context.Context, id int) (ChatSession, error)
+    // ActiveSessions lists sessions nobody has ended in queue order:
+    // escalated first, then by QueuedAt.
+    ActiveSessions(ctx context.Context) ([]ChatSession, error)
+    // Assign hands an active session from staff member from (0 for the
+    // queue) to staffID. It returns errChatConflict if the session is no
+    // longer assigned to from, and errChatEnded if it has ended.
+    Assign(ctx context.Context, id, staffID, from int) (ChatSession, error)
+    // Requeue unassigns an active session and puts it at the back of the
+    // queue, escalating it if escalate is set. An escalated session stays
+    // escalated.
+    Requeue(ctx context.Context, id int, escalate bool) (ChatSession, error)
+    // AddMessage stores m, returning errChatEnded if the session has ended.
+    AddMessage(ctx context.Context, m ChatMessage) (ChatMessage, error)
+    // Messages returns a session's messages after afterID, oldest first.
+    Messages(ctx context.Context, sessionID, afterID int) ([]ChatMessage, error)
+    // MarkRead records that side has seen the session's messages up to
+    // messageID and returns the resulting read position, which never moves
+    // backwards.
+    MarkRead(ctx context.Context, sessionID int, side string, messageID int) (int, error)
+    // End ends an active session and returns when, or errChatEnded.
+    End(ctx context.Context, id int) (time.Time, error)
+}
+
+// pgChatStore keeps chat in the chat_sessions and chat_messages tables the
+// backend migrates.
+type pgChatStore struct {
+    db *sql.DB
+}
+
+const chatSessionColumns = `s.id, s.user_id, COALESCE(u.name, ''), COALESCE(u.email, ''), COALESCE(s.staff_id, 0),
+    COALESCE(st.username, ''), s.status, s.escalated, s.user_read_id, s.staff_read_id, s.created_at, s.queued_at,
+    s.ended_at`
+
+const chatSessionFrom = `
+    FROM chat_sessions s
+    JOIN users u ON s.user_id = u.id
+    LEFT JOIN support_staff st ON s.staff_id = st.id`
+
+func scanChatSession(row interface{ Scan(...interface{}) error }, s *ChatSession) error {
+    var endedAt sql.NullTime
+    err := row.Scan(&s.ID, &s.UserID, &s.UserName, &s.UserEmail, &s.StaffID, &s.StaffName, &s.Status, &s.Escalated,
+        &s.UserReadID, &s.StaffReadID, &s.CreatedAt, &s.QueuedAt, &endedAt)
+    if endedAt.Valid {
+        s.EndedAt = &endedAt.Time
+    }
+    return err
+}
+
+func (c pgChatStore) OpenSession(ctx context.Context, userID int) (ChatSession, error) {
+    _, err := c.db.ExecContext(ctx, `
+        INSERT INTO chat_sessions (user_id, status)
+        VALUES ($1, 'active')
+        ON CONFLICT (user_id) WHERE status = 'active' DO NOTHING`, userID)
+    if err != nil {
+        return ChatSession{}, err
+    }
+    var s ChatSession
+    err = scanChatSession(c.db.QueryRowContext(ctx,
+        "SELECT "+chatSessionColumns+chatSessionFrom+" WHERE s.user_id = $1 AND s.status = 'active'", userID), &s)
+    return s, err
+}
+
+func (c pgChatStore) Session(ctx context.Context, id int) (ChatSession, error) {
+    var s ChatSession
+    err := scanChatSession(c.db.QueryRowContext(ctx,
+        "SELECT "+chatSessionColumns+chatSessionFrom+" WHERE s.id = $1", id), &s)
+    if err == sql.ErrNoRows {
+        return s, errChatNotFound
+    }
+    return s, err
+}
+
+func (c pgChatStore) ActiveSessions(ctx context.Context) ([]ChatSession, error) {
+    rows, err := c.db.QueryContext(ctx,
+        "SELECT "+chatSessionColumns+chatSessionFrom+" WHERE s.status = 'active' ORDER BY s.escalated DESC, s.queued_at, s.id")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var sessions []ChatSession
+    for rows.Next() {
+        var s ChatSession
+        if err := scanChatSession(rows, &s); err != nil {
+            return nil, err
+        }
+        sessions = append(sessions, s)
+    }
+    return sessions, rows.Err()
+}
+
+func (c pgChatStore) Assign(ctx context.Context, id, staffID, from int) (ChatSession, error) {
+    res, err := c.db.ExecContext(ctx, `
+        UPDATE chat_sessions SET staff_id = $2
+        WHERE id = $1 AND status = 'active' AND COALESCE(staff_id, 0) = $3`,
+        id, staffID, from)
+    if err != nil {
+        return ChatSession{}, err
+    }
+    return c.afterUpdate(ctx, id, res)
+}
+
+func (c pgChatStore) Requeue(ctx context.Context, id int, escalate bool) (ChatSession, error) {
+    res, err := c.db.ExecContext(ctx, `
+        UPDATE chat_sessions SET staff_id = NULL, queued_at = NOW(), escalated = escalated OR $2
+        WHERE id = $1 AND status = 'active'`,
+        id, escalate)
+    if err != nil {
+        return ChatSession{}, err
+    }
+    return c.afterUpdate(ctx, id, res)
+}
+
+// afterUpdate reloads a session after an update that only applies to active
+// sessions, explaining why it did not apply if it did not.
+func (c pgChatStore) afterUpdate(ctx context.Context, id int, res sql.Result) (ChatSession, error) {
+    n, err := res.RowsAffected()
+    if err != nil {
+        return ChatSession{}, err
+    }
+    s, err := c.Session(ctx, id)
+    if err != nil {
+        return s, err
+    }
+    if n == 0 {
+        if s.Status != chatActive {
+            return s, errChatEnded
+        }
+        return s, errChatConflict
+    }
+    return s, nil
+}
+
+func (c pgChatStore) AddMessage(ctx context.Context, m ChatMessage) (ChatMessage, error) {
+    err := c.db.QueryRowContext(ctx, `
+        INSERT INTO chat_messages (session_id, sender_type, sender_id, message)
+        SELECT id, $2, $3, $4 FROM chat_sessions WHERE id = $1 AND status = 'active'
+        RETURNING id, created_at`,
+        m.SessionID, m.SenderType, m.SenderID, m.Message).Scan(&m.ID, &m.CreatedAt)
+    if err == sql.ErrNoRows {
+        return m, errChatEnded
+    }
+    return m, err
+}
+
+func (c pgChatStore) Messages(ctx context.Context, sessionID, afterID int) ([]ChatMessage, error) {
+    rows, err := c.db.QueryContext(ctx, `
+        SELECT id, session_id, sender_type, sender_id, message, created_at
+        FROM chat_messages
+        WHERE session_id = $1 AND id > $2
+        ORDER BY id`, sessionID, afterID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var messages []ChatMessage
+    for rows.Next() {
+        var m ChatMessage
+        if err := rows.Scan(&m.ID, &m.SessionID, &m.SenderType, &m.SenderID, &m.Message, &m.CreatedAt); err != nil {
+            return nil, err
+        }
+        messages = append(messages, m)
+    }
+    return messages, rows.Err()
+}
+
+// MarkRead caps messageID at the session's last message, so a client cannot
+// mark messages read before they exist.
+func (c pgChatStore) MarkRead(ctx context.Context, sessionID int, side string, messageID int) (int, error) {
+    column := "user_read_id"
+    if side == senderStaff {
+        column = "staff_read_id"
+    }
+    var readID int
+    err := c.db.QueryRowContext(ctx, `
+        UPDATE chat_sessions
+        SET `+column+` = GREATEST(`+column+`,
+            LEAST($2, (SELECT COALESCE(MAX(id), 0) FROM chat_messages WHERE session_id = $1)))
+        WHERE id = $1
+        RETURNING `+column, sessionID, messageID).Scan(&readID)
+    if err == sql.ErrNoRows {
+        return 0, errChatNotFound
+    }
+    return readID, err
+}
+
+func (c pgChatStore) End(ctx context.Context, id int) (time.Time, error) {
+    var endedAt time.Time
+    err := c.db.QueryRowContext(ctx, `
+        UPDATE chat_sessions SET status = 'ended', ended_at = NOW()
+        WHERE id = $1 AND status = 'active'
+        RETURNING ended_at`, id).Scan(&endedAt)
+    if err == sql.ErrNoRows {
+        if _, err := c.Session(ctx, id); err != nil {
+            return endedAt, err
+        }
+        return endedAt, errChatEnded
+    }
+    return endedAt, err
+}
@@ -0,0 +1,706 @@
+package main
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+var testChatSecret = []byte("0123456789abcdef0123456789abcdef")
+
+// memChatStore is a chatStore kept in memory.
+type memChatStore struct {
+    mu       sync.Mutex
+    sessions map[int]*ChatSession
+    messages []ChatMessage
+    nextID   int
+}
+
+func newMemChatStore() *memChatStore {
+    return &memChatStore{sessions: map[int]*ChatSession{}}
+}
+
+func (m *memChatStore) OpenSession(ctx context.Context, userID int) (ChatSession, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    for _, s := range m.sessions {
+        if s.UserID == userID && s.Status == chatActive {
+            return *s, nil
+        }
+    }
+    m.nextID++
+    now := time.Now()
+    s := &ChatSession{ID: m.nextID, UserID: userID, UserName: fmt.Sprintf("User %d", userID),
+        Status: chatActive, CreatedAt: now, QueuedAt: now}
+    m.sessions[s.ID] = s
+    return *s, nil
+}
+
+func (m *memChatStore) Session(ctx context.Context, id int) (ChatSession, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    s, ok := m.sessions[id]
+    if !ok {
+        return ChatSession{}, errChatNotFound
+    }
+    return *s, nil
+}
+
+func (m *memChatStore) ActiveSessions(ctx context.Context) ([]ChatSession, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    var active []ChatSession
+    for _, s := range m.sessions {
+        if s.Status == chatActive {
+            active = append(active, *s)
+        }
+    }
+    sort.Slice(active, func(i, j int) bool {
+        if active[i].Escalated != active[j].Escalated {
+            return active[i].Escalated
+        }
+        if !active[i].QueuedAt.Equal(active[j].QueuedAt) {
+            return active[i].QueuedAt.Before(active[j].QueuedAt)
+        }
+        return active[i].ID < active[j].ID
+    })
+    return active, nil
+}
+
+func (m *memChatStore) Assign(ctx context.Context, id, staffID, from int) (ChatSession, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    s, ok := m.sessions[id]
+    switch {
+    case !ok:
+        return ChatSession{}, errChatNotFound
+    case s.Status != chatActive:
+        return *s, errChatEnded
+    case s.StaffID != from:
+        return *s, errChatConflict
+    }
+    s.StaffID = staffID
+    s.StaffName = fmt.Sprintf("staff%d", staffID)
+    return *s, nil
+}
+
+func (m *memChatStore) Requeue(ctx context.Context, id int, escalate bool) (ChatSession, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    s, ok := m.sessions[id]
+    switch {
+    case !ok:
+        return ChatSession{}, errChatNotFound
+    case s.Status != chatActive:
+        return *s, errChatEnded
+    }
+    s.StaffID, s.StaffName = 0, ""
+    s.QueuedAt = time.Now()
+    s.Escalated = s.Escalated || escalate
+    return *s, nil
+}
+
+func (m *memChatStore) AddMessage(ctx context.Context, msg ChatMessage) (ChatMessage, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    s, ok := m.sessions[msg.SessionID]
+    if !ok || s.Status != chatActive {
+        return msg, errChatEnded
+    }
+    m.nextID++
+    msg.ID = m.nextID
+    msg.CreatedAt = time.Now()
+    m.messages = append(m.messages, msg)
+    return msg, nil
+}
+
+func (m *memChatStore) Messages(ctx context.Context, sessionID, afterID int) ([]ChatMessage, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    var messages []ChatMessage
+    for _, msg := range m.messages {
+        if msg.SessionID == sessionID && msg.ID > afterID {
+            messages = append(messages, msg)
+        }
+    }
+    return messages, nil
+}
+
+func (m *memChatStore) MarkRead(ctx context.Context, sessionID int, side string, messageID int) (int, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    s, ok := m.sessions[sessionID]
+    if !ok {
+        return 0, errChatNotFound
+    }
+    last := 0
+    for _, msg := range m.messages {
+        if msg.SessionID == sessionID {
+            last = msg.ID
+        }
+    }
+    if messageID > last {
+        messageID = last
+    }
+    readID := &s.UserReadID
+    if side == senderStaff {
+        readID = &s.StaffReadID
+    }
+    if messageID > *readID {
+        *readID = messageID
+    }
+    return *readID, nil
+}
+
+func (m *memChatStore) End(ctx context.Context, id int) (time.Time, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    s, ok := m.sessions[id]
+    if !ok {
+        return time.Time{}, errChatNotFound
+    }
+    if s.Status != chatActive {
+        return time.Time{}, errChatEnded
+    }
+    now := time.Now()
+    s.Status = chatEnded
+    s.EndedAt = &now
+    return now, nil
+}
+
+// newChatServer serves the hub the way main does, except that staff are
+// named by the X-Staff-ID and X-Staff-Role headers instead of a session.
+func newChatServer(t *testing.T, maxPerAgent int) (*httptest.Server, *memChatStore) {
+    t.Helper()
+    store := newMemChatStore()
+    hub := newChatHub(store, testChatSecret, maxPerAgent)
+
+    asStaff := func(next http.HandlerFunc) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+            id, _ := strconv.Atoi(r.Header.Get("X-Staff-ID"))
+            user := &User{ID: id, Username: "staff" + strconv.Itoa(id), Role: r.Header.Get("X-Staff-Role")}
+            requirePermission(permSupportChat, next)(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, user)))
+        }
+    }
+    mux := http.NewServeMux()
+    mux.HandleFunc("/ws/chat", hub.serveUser)
+    mux.HandleFunc("/ws/chat/", asStaff(hub.serveStaff))
+    mux.HandleFunc("/ws/chat/lobby", asStaff(hub.serveLobby))
+    srv := httptest.NewServer(mux)
+    t.Cleanup(srv.Close)
+    return srv, store
+}
+
+// signTestChatToken signs a token the way the backend's chat token endpoint does.
+func signTestChatToken(t *testing.T, userID int, expires time.Time) string {
+    t.Helper()
+    header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+    payload, _ := json.Marshal(map[string]interface{}{
+        "iss": chatTokenIssuer,
+        "sub": strconv.Itoa(userID),
+        "iat": time.Now().Unix(),
+        "exp": expires.Unix(),
+    })
+    input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+    mac := hmac.New(sha256.New, testChatSecret)
+    mac.Write([]byte(input))
+    return input + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func wsURL(srv *httptest.Server, path string) string {
+    return "ws" + strings.TrimPrefix(srv.URL, "http") + path
+}
+
+type testChatConn struct {
+    t    *testing.T
+    conn *websocket.Conn
+}
+
+func dialUser(t *testing.T, srv *httptest.Server, userID int, query string) *testChatConn {
+    t.Helper()
+    url := wsURL(srv, "/ws/chat?token="+signTestChatToken(t, userID, time.Now().Add(time.Minute))+query)
+    conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+    if err != nil {
+        t.Fatalf("dialling as user %d: %v", userID, err)
+    }
+    t.Cleanup(func() { conn.Close() })
+    return &testChatConn{t: t, conn: conn}
+}
+
+func dialStaff(t *testing.T, srv *httptest.Server, staffID int, role string, sessionID int, query string) *testChatConn {
+    t.Helper()
+    return dialStaffPath(t, srv, staffID, role, fmt.Sprintf("/ws/chat/%d%s", sessionID, query))
+}
+
+func dialStaffPath(t *testing.T, srv *httptest.Server, staffID int, role string, path string) *testChatConn {
+    t.Helper()
+    header := http.Header{}
+    header.Set("X-Staff-ID", strconv.Itoa(staffID))
+    header.Set("X-Staff-Role", role)
+    conn, _, err := websocket.DefaultDialer.Dial(wsURL(srv, path), header)
+    if err != nil {
+        t.Fatalf("dialling as staff %d: %v", staffID, err)
+    }
+    t.Cleanup(func() { conn.Close() })
+    return &testChatConn{t: t, conn: conn}
+}
+
+func (c *testChatConn) send(cmd chatCommand) {
+    c.t.Helper()
+    if err := c.conn.WriteJSON(cmd); err != nil {
+        c.t.Fatalf("sending %s: %v", cmd.Type, err)
+    }
+}
+
+// next reads the next event, failing the test if it is not of type want.
+func (c *testChatConn) next(want string) chatEvent {
+    c.t.Helper()
+    c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    var ev chatEvent
+    if err := c.conn.ReadJSON(&ev); err != nil {
+        c.t.Fatalf("waiting for %s event: %v", want, err)
+    }
+    if ev.Type != want {
+        c.t.Fatalf("got %s event %+v, want %s", ev.Type, ev, want)
+    }
+    return ev
+}
+
+// until reads events, skipping any that are not of type want or that match
+// does not accept, and returns the first that is.
+func (c *testChatConn) until(want string, match func(chatEvent) bool) chatEvent {
+    c.t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        c.conn.SetReadDeadline(deadline)
+        var ev chatEvent
+        if err := c.conn.ReadJSON(&ev); err != nil {
+            c.t.Fatalf("waiting for %s event: %v", want, err)
+        }
+        if ev.Type == want && (match == nil || match(ev)) {
+            return ev
+        }
+    }
+}
+
+// joined reads the session and history events sent on joining.
+func (c *testChatConn) joined() (ChatSession, []ChatMessage) {
+    c.t.Helper()
+    session := c.next(eventSession).Session
+    return *session, c.next(eventHistory).Messages
+}
+
+// expectClosed fails the test unless the server closes the connection.
+func (c *testChatConn) expectClosed() {
+    c.t.Helper()
+    c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    _, _, err := c.conn.ReadMessage()
+    if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+        c.t.Fatalf("got %v, want the connection closed", err)
+    }
+}
+
+// startChat connects user 7 and staff 3 to a new session.
+func startChat(t *testing.T, srv *httptest.Server) (user, staff *testChatConn, sessionID int) {
+    t.Helper()
+    user = dialUser(t, srv, 7, "")
+    session, _ := user.joined()
+    staff = dialStaff(t, srv, 3, roleSupport, session.ID, "")
+    if s, _ := staff.joined(); s.StaffID != 3 {
+        t.Fatalf("staff joined session assigned to %d, want 3", s.StaffID)
+    }
+    if s := user.next(eventSession).Session; s.StaffID != 3 {
+        t.Fatalf("user was told session is assigned to %d, want 3", s.StaffID)
+    }
+    return user, staff, session.ID
+}
+
+func TestChatMessagesReachBothSidesAndAreStored(t *testing.T) {
+    srv, store := newChatServer(t, defaultChatsPerAgent)
+    user, staff, sessionID := startChat(t, srv)
+
+    user.send(chatCommand{Type: commandMessage, Message: "  Where is my order?  "})
+    for _, c := range []*testChatConn{user, staff} {
+        m := c.next(eventMessage).Message
+        if m.Message != "Where is my order?" || m.SenderType != senderUser || m.SenderID != 7 {
+            t.Fatalf("got message %+v", m)
+        }
+    }
+    staff.send(chatCommand{Type: commandMessage, Message: "Let me check"})
+    user.next(eventMessage)
+    staff.next(eventMessage)
+
+    stored, _ := store.Messages(context.Background(), sessionID, 0)
+    if len(stored) != 2 || stored[1].SenderType != senderStaff || stored[1].SenderID != 3 {
+        t.Fatalf("stored %+v", stored)
+    }
+
+    user.send(chatCommand{Type: commandMessage, Message: "   "})
+    if ev := user.next(eventError); ev.Error == "" {
+        t.Fatal("empty message was not refused")
+    }
+}
+
+func TestChatTypingAndReadReceipts(t *testing.T) {
+    srv, store := newChatServer(t, defaultChatsPerAgent)
+    user, staff, sessionID := startChat(t, srv)
+
+    user.send(chatCommand{Type: commandTyping})
+    if ev := staff.next(eventTyping); ev.SenderType != senderUser {
+        t.Fatalf("typing from %q, want user", ev.SenderType)
+    }
+
+    staff.send(chatCommand{Type: commandMessage, Message: "Hello"})
+    m := user.next(eventMessage).Message
+    staff.next(eventMessage)
+
+    // Reading beyond the last message only counts up to it.
+    user.send(chatCommand{Type: commandRead, MessageID: m.ID + 100})
+    if ev := staff.next(eventRead); ev.SenderType != senderUser || ev.MessageID != m.ID {
+        t.Fatalf("got read receipt %+v, want user read %d", ev, m.ID)
+    }
+    s, _ := store.Session(context.Background(), sessionID)
+    if s.UserReadID != m.ID || s.StaffReadID != 0 {
+        t.Fatalf("read positions user %d staff %d", s.UserReadID, s.StaffReadID)
+    }
+}
+
+func TestChatEndClosesEveryone(t *testing.T) {
+    srv, store := newChatServer(t, defaultChatsPerAgent)
+    user, staff, sessionID := startChat(t, srv)
+
+    staff.send(chatCommand{Type: commandEnd})
+    for _, c := range []*testChatConn{user, staff} {
+        if ev := c.next(eventEnded); ev.EndedAt == nil || ev.SenderType != senderStaff {
+            t.Fatalf("got ended event %+v", ev)
+        }
+        c.expectClosed()
+    }
+    s, _ := store.Session(context.Background(), sessionID)
+    if s.Status != chatEnded || s.EndedAt == nil {
+        t.Fatalf("session %+v was not ended", s)
+    }
+
+    // Rejoining an ended session shows it and closes; a new connection
+    // without a session starts a new one.
+    again := dialUser(t, srv, 7, fmt.Sprintf("&session=%d", sessionID))
+    again.joined()
+    again.next(eventEnded)
+    again.expectClosed()
+    next, _ := dialUser(t, srv, 7, "").joined()
+    if next.ID == sessionID || next.Status != chatActive {
+        t.Fatalf("got session %+v, want a new one", next)
+    }
+}
+
+func TestChatReconnectReplaysMissedMessages(t *testing.T) {
+    srv, _ := newChatServer(t, defaultChatsPerAgent)
+    user, staff, sessionID := startChat(t, srv)
+
+    user.send(chatCommand{Type: commandMessage, Message: "first"})
+    seen := user.next(eventMessage).Message.ID
+    staff.next(eventMessage)
+    user.conn.Close()
+
+    staff.send(chatCommand{Type: commandMessage, Message: "second"})
+    staff.next(eventMessage)
+    staff.send(chatCommand{Type: commandMessage, Message: "third"})
+    staff.next(eventMessage)
+
+    user = dialUser(t, srv, 7, fmt.Sprintf("&session=%d&after=%d", sessionID, seen))
+    session, missed := user.joined()
+    if session.ID != sessionID {
+        t.Fatalf("rejoined session %d, want %d", session.ID, sessionID)
+    }
+    if len(missed) != 2 || missed[0].Message != "second" || missed[1].Message != "third" {
+        t.Fatalf("replayed %+v, want second and third", missed)
+    }
+}
+
+func TestChatConcurrentSendersSeeOneOrder(t *testing.T) {
+    srv, store := newChatServer(t, defaultChatsPerAgent)
+    user, staff, sessionID := startChat(t, srv)
+    const perSide = 25
+
+    // Each side reads everything sent while both send at once.
+    received := make([][]int, 2)
+    var readers sync.WaitGroup
+    for i, c := range []*testChatConn{user, staff} {
+        readers.Add(1)
+        go func(i int, c *testChatConn) {
+            defer readers.Done()
+            for len(received[i]) < 2*perSide {
+                c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+                var ev chatEvent
+                if err := c.conn.ReadJSON(&ev); err != nil {
+                    return
+                }
+                if ev.Type == eventMessage {
+                    received[i] = append(received[i], ev.Message.ID)
+                }
+            }
+        }(i, c)
+    }
+    var senders sync.WaitGroup
+    for _, c := range []*testChatConn{user, staff} {
+        senders.Add(1)
+        go func(c *testChatConn) {
+            defer senders.Done()
+            for n := 0; n < perSide; n++ {
+                if err := c.conn.WriteJSON(chatCommand{Type: commandMessage, Message: strconv.Itoa(n)}); err != nil {
+                    return
+                }
+            }
+        }(c)
+    }
+    senders.Wait()
+    readers.Wait()
+
+    stored, _ := store.Messages(context.Background(), sessionID, 0)
+    if len(stored) != 2*perSide {
+        t.Fatalf("stored %d messages, want %d", len(stored), 2*perSide)
+    }
+    for i, ids := range received {
+        if len(ids) != len(stored) {
+            t.Fatalf("client %d got %d messages, want %d", i, len(ids), len(stored))
+        }
+        for n, m := range stored {
+            if ids[n] != m.ID {
+                t.Fatalf("client %d got message %d at %d, want %d", i, ids[n], n, m.ID)
+            }
+        }
+    }
+}
+
+func TestChatRefusesBadTokensAndOtherStaff(t *testing.T) {
+    srv, _ := newChatServer(t, defaultChatsPerAgent)
+    _, _, sessionID := startChat(t, srv)
+
+    for name, token := range map[string]string{
+        "missing": "",
+        "expired": signTestChatToken(t, 7, time.Now().Add(-time.Hour)),
+        "forged":  signTestChatToken(t, 7, time.Now().Add(time.Minute)) + "x",
+    } {
+        _, res, err := websocket.DefaultDialer.Dial(wsURL(srv, "/ws/chat?token="+token), nil)
+        if err == nil || res.StatusCode != http.StatusUnauthorized {
+            t.Errorf("%s token: got %v, want 401", name, res.Status)
+        }
+    }
+
+    // Another user cannot join this user's session.
+    _, res, err := websocket.DefaultDialer.Dial(wsURL(srv, fmt.Sprintf("/ws/chat?token=%s&session=%d",
+        signTestChatToken(t, 8, time.Now().Add(time.Minute)), sessionID)), nil)
+    if err == nil || res.StatusCode != http.StatusNotFound {
+        t.Errorf("other user: got %v, want 404", res.Status)
+    }
+
+    // Another agent cannot join a session staff 3 picked up, but an admin can.
+    header := http.Header{"X-Staff-Id": {"4"}, "X-Staff-Role": {roleSupport}}
+    _, res, err = websocket.DefaultDialer.Dial(wsURL(srv, fmt.Sprintf("/ws/chat/%d", sessionID)), header)
+    if err == nil || res.StatusCode != http.StatusForbidden {
+        t.Errorf("other agent: got %v, want 403", res.Status)
+    }
+    if s, _ := dialStaff(t, srv, 5, roleAdmin, sessionID, "").joined(); s.StaffID != 3 {
+        t.Errorf("admin joining reassigned the session to %d", s.StaffID)
+    }
+}
+
+func dialLobby(t *testing.T, srv *httptest.Server, staffID int, role string) *testChatConn {
+    t.Helper()
+    c := dialStaffPath(t, srv, staffID, role, "/ws/chat/lobby")
+    c.until(eventLobby, func(ev chatEvent) bool { return lobbyAgent(ev.Lobby, staffID) != nil })
+    return c
+}
+
+func lobbyAgent(l *chatLobby, staffID int) *chatAgent {
+    for i := range l.Agents {
+        if l.Agents[i].ID == staffID {
+            return &l.Agents[i]
+        }
+    }
+    return nil
+}
+
+func lobbySession(l *chatLobby, id int) *ChatSession {
+    for i := range l.Sessions {
+        if l.Sessions[i].ID == id {
+            return &l.Sessions[i]
+        }
+    }
+    return nil
+}
+
+func TestChatQueueAssignsLeastBusyAgentUpToCap(t *testing.T) {
+    srv, _ := newChatServer(t, 2)
+    lobby3 := dialLobby(t, srv, 3, roleSupport)
+    dialLobby(t, srv, 4, roleSupport)
+
+    users := map[int]*testChatConn{}
+    for i, want := range []int{3, 4, 3, 4} {
+        userID := 7 + i
+        users[userID] = dialUser(t, srv, userID, "")
+        users[userID].joined()
+        if s := users[userID].next(eventSession).Session; s.StaffID != want {
+            t.Fatalf("user %d was assigned to %d, want %d", userID, s.StaffID, want)
+        }
+    }
+
+    // Both agents are at the cap, so the next chat waits.
+    waiting := dialUser(t, srv, 11, "")
+    queued, _ := waiting.joined()
+    ev := lobby3.until(eventLobby, func(ev chatEvent) bool {
+        s := lobbySession(ev.Lobby, queued.ID)
+        return s != nil && s.StaffID == 0
+    })
+    if a := lobbyAgent(ev.Lobby, 3); a.ActiveSessions != 2 || ev.Lobby.MaxPerAgent != 2 {
+        t.Fatalf("lobby shows agent %+v with cap %d", a, ev.Lobby.MaxPerAgent)
+    }
+
+    // Ending one of agent 3's chats gives them the waiting one.
+    users[7].send(chatCommand{Type: commandEnd})
+    users[7].next(eventEnded)
+    if s := waiting.next(eventSession).Session; s.StaffID != 3 {
+        t.Fatalf("queued chat went to %d, want 3", s.StaffID)
+    }
+    if ev := lobby3.until(eventAssigned, nil); ev.Session.ID != queued.ID {
+        t.Fatalf("agent 3 was told about session %d, want %d", ev.Session.ID, queued.ID)
+    }
+}
+
+// racingChatStore calls race before assigning a session, standing in for
+// whatever changed the session since the queue was read.
+type racingChatStore struct {
+    *memChatStore
+    race func(id int)
+}
+
+func (s racingChatStore) Assign(ctx context.Context, id, staffID, from int) (ChatSession, error) {
+    s.race(id)
+    return s.memChatStore.Assign(ctx, id, staffID, from)
+}
+
+func TestChatQueueKeepsTurnsAndLoadWhenAssignRaces(t *testing.T) {
+    ctx := context.Background()
+    queue := func(maxPerAgent int, race func(store *memChatStore, id int), agents ...int) *memChatStore {
+        store := newMemChatStore()
+        raced := false
+        hub := newChatHub(racingChatStore{store, func(id int) {
+            if !raced {
+                raced = true
+                race(store, id)
+            }
+        }}, testChatSecret, maxPerAgent)
+        for _, id := range agents {
+            hub.arrive(&User{ID: id, Username: "staff" + strconv.Itoa(id), Role: roleSupport})
+        }
+        for userID := 7; userID <= 8; userID++ {
+            if _, err := store.OpenSession(ctx, userID); err != nil {
+                t.Fatal(err)
+            }
+        }
+        hub.refresh()
+        return store
+    }
+    staffOf := func(store *memChatStore, id int) int {
+        s, err := store.Session(ctx, id)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return s.StaffID
+    }
+
+    // Staff 9 picks up the first session by hand, so agent 3, whose turn it
+    // was, still gets the next one.
+    store := queue(defaultChatsPerAgent, func(store *memChatStore, id int) {
+        store.Assign(ctx, id, 9, 0)
+    }, 3, 4)
+    if got := staffOf(store, 1); got != 9 {
+        t.Errorf("session picked up by hand is assigned to %d", got)
+    }
+    if got := staffOf(store, 2); got != 3 {
+        t.Errorf("after a conflict the next session went to %d, want 3", got)
+    }
+
+    // The first session ends before the queue assigns it; it does not count
+    // towards the load of the agent who had it.
+    store = queue(1, func(store *memChatStore, id int) {
+        store.Assign(ctx, id, 3, 0)
+        store.End(ctx, id)
+    }, 3)
+    if got := staffOf(store, 2); got != 3 {
+        t.Errorf("after an ended session the next went to %d, want 3", got)
+    }
+}
+
+func TestChatTransferAndEscalate(t *testing.T) {
+    srv, _ := newChatServer(t, defaultChatsPerAgent)
+    dialLobby(t, srv, 3, roleSupport)
+    lobby4 := dialLobby(t, srv, 4, roleSupport)
+
+    user := dialUser(t, srv, 7, "")
+    session, _ := user.joined()
+    if s := user.next(eventSession).Session; s.StaffID != 3 {
+        t.Fatalf("assigned to %d, want 3", s.StaffID)
+    }
+    agent3 := dialStaff(t, srv, 3, roleSupport, session.ID, "")
+    agent3.joined()
+
+    agent3.send(chatCommand{Type: commandTransfer, StaffID: 9})
+    if ev := agent3.next(eventError); !strings.Contains(ev.Error, "not online") {
+        t.Fatalf("transfer to an offline agent: %q", ev.Error)
+    }
+
+    agent3.send(chatCommand{Type: commandTransfer, StaffID: 4})
+    if s := user.next(eventSession).Session; s.StaffID != 4 {
+        t.Fatalf("transferred to %d, want 4", s.StaffID)
+    }
+    agent3.next(eventSession)
+    agent3.next(eventTransferred)
+    agent3.expectClosed()
+    if ev := lobby4.until(eventAssigned, nil); ev.Session.ID != session.ID {
+        t.Fatalf("agent 4 was told about session %d", ev.Session.ID)
+    }
+
+    // Escalating requeues the chat for admins only; other chats still flow.
+    agent4 := dialStaff(t, srv, 4, roleSupport, session.ID, "")
+    agent4.joined()
+    agent4.send(chatCommand{Type: commandEscalate})
+    if s := user.next(eventSession).Session; s.StaffID != 0 || !s.Escalated {
+        t.Fatalf("escalated session is %+v", s)
+    }
+    agent4.next(eventSession)
+    agent4.next(eventTransferred)
+    agent4.expectClosed()
+
+    other := dialUser(t, srv, 8, "")
+    other.joined()
+    if s := other.next(eventSession).Session; s.StaffID == 0 {
+        t.Fatal("a new chat was not assigned while an escalated one waited")
+    }
+    _, res, err := websocket.DefaultDialer.Dial(wsURL(srv, fmt.Sprintf("/ws/chat/%d", session.ID)),
+        http.Header{"X-Staff-Id": {"3"}, "X-Staff-Role": {roleSupport}})
+    if err == nil || res.StatusCode != http.StatusForbidden {
+        t.Fatalf("agent picking up an escalated chat: got %v, want 403", err)
+    }
+
+    lobby5 := dialStaffPath(t, srv, 5, roleAdmin, "/ws/chat/lobby")
+    if ev := lobby5.until(eventAssigned, nil); ev.Session.ID != session.ID {
+        t.Fatalf("admin was assigned session %d, want %d", ev.Session.ID, session.ID)
+    }
+    if s := user.next(eventSession).Session; s.StaffID != 5 {
+        t.Fatalf("escalated chat went to %d, want 5", s.StaffID)
+    }
+}
@@ -5,6 +5,8 @@ go 1.19
 require (
 	github.com/gorilla/sessions v1.2.1
 	github.com/gorilla/websocket v1.5.3
+	github.com/lib/pq v1.10.9
+	golang.org/x/crypto v0.14.0
 )
 
 require github.com/gorilla/securecookie v1.1.1 // indirect
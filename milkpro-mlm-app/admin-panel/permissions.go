@@ -0,0 +1,64 @@
+package main
+
+import "net/http"
+
+// Permission names an action a staff role may take. The backend admin API
+// uses the same names.
+type Permission string
+
+const (
+    permDashboardView  Permission = "dashboard:view"
+    permUsersView      Permission = "users:view"
+    permKYCReview      Permission = "kyc:review"
+    permProductsWrite  Permission = "products:write"
+    permProjectsWrite  Permission = "projects:write"
+    permOrdersFulfil   Permission = "orders:fulfil"
+    permTicketsAssign  Permission = "tickets:assign"
+    permPayoutsApprove Permission = "payouts:approve"
+    permSupportChat    Permission = "support:chat"
+)
+
+// rolePermissions maps each support_staff.role to what it may do. Support
+// agents work tickets and chats only; admins can do everything.
+var rolePermissions = map[string][]Permission{
+    roleSupport: {permSupportChat},
+    roleAdmin: {
+        permDashboardView, permUsersView, permKYCReview, permProductsWrite,
+        permProjectsWrite, permOrdersFulfil, permTicketsAssign, permPayoutsApprove, permSupportChat,
+    },
+}
+
+// Can reports whether u's role grants p. Templates call it as
+// {{ if .User.Can "products:write" }}.
+func (u *User) Can(p Permission) bool {
+    if u == nil {
+        return false
+    }
+    for _, granted := range rolePermissions[u.Role] {
+        if granted == p {
+            return true
+        }
+    }
+    return false
+}
+
+// homePath is where u lands after signing in: the first page their role
+// can open.
+func (u *User) homePath() string {
+    if u.Can(permDashboardView) {
+        return "/admin/dashboard"
+    }
+    return "/admin/support"
+}
+
+// requirePermission wraps a handler that runs behind authMiddleware and
+// refuses callers whose role lacks p.
+func requirePermission(p Permission, next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if !currentUser(r).Can(p) {
+            http.Error(w, "Forbidden", http.StatusForbidden)
+            return
+        }
+        next.ServeHTTP(w, r)
+    }
+}
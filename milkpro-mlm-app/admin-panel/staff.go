@@ -0,0 +1,234 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "database/sql"
+    "errors"
+    "flag"
+    "fmt"
+    "os"
+    "strings"
+    "time"
+
+    "golang.org/x/crypto/bcrypt"
+)
+
+// Staff roles, matching support_staff.role.
+const (
+    roleSupport = "support"
+    roleAdmin   = "admin"
+)
+
+const (
+    // maxFailedLogins wrong passwords in a row lock the account for lockoutDuration.
+    maxFailedLogins = 5
+    lockoutDuration = 15 * time.Minute
+
+    minPasswordLength = 10
+)
+
+var (
+    errInvalidLogin  = errors.New("invalid username or password")
+    errAccountLocked = errors.New("account is locked")
+    errStaffNotFound = errors.New("staff account not found")
+)
+
+// dummyHash is compared against when the username does not exist, so a
+// login attempt takes about as long whether or not the account is real.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not-a-real-password"), bcrypt.DefaultCost)
+
+// staffByID loads an active staff account. Deactivated accounts are treated as
+// missing so that their sessions stop working immediately.
+func staffByID(ctx context.Context, id int) (*User, error) {
+    u := &User{}
+    err := db.QueryRowContext(ctx,
+        "SELECT id, username, role FROM support_staff WHERE id = $1 AND is_active",
+        id,
+    ).Scan(&u.ID, &u.Username, &u.Role)
+    if err == sql.ErrNoRows {
+        return nil, errStaffNotFound
+    }
+    if err != nil {
+        return nil, err
+    }
+    return u, nil
+}
+
+// loginState is an account's run of failed logins and any lock it earned.
+type loginState struct {
+    FailedLogins int
+    LockedUntil  sql.NullTime
+}
+
+func (l loginState) locked(now time.Time) bool {
+    return l.LockedUntil.Valid && l.LockedUntil.Time.After(now)
+}
+
+// fail counts a wrong password. The count restarts once the lock is set, so
+// the next lock needs another maxFailedLogins attempts.
+func (l *loginState) fail(now time.Time) {
+    l.FailedLogins++
+    if l.FailedLogins >= maxFailedLogins {
+        l.FailedLogins = 0
+        l.LockedUntil = sql.NullTime{Time: now.Add(lockoutDuration), Valid: true}
+    }
+}
+
+// authenticateStaff checks username and password against support_staff and
+// records the outcome: a failure counts towards the lockout, a success resets it.
+// The row stays locked until then, so concurrent attempts are counted one by one.
+func authenticateStaff(ctx context.Context, username, password string) (*User, error) {
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, err
+    }
+    defer tx.Rollback()
+
+    var (
+        u      User
+        hash   string
+        active bool
+        login  loginState
+    )
+    err = tx.QueryRowContext(ctx, `
+        SELECT id, username, role, password_hash, COALESCE(is_active, FALSE), failed_logins, locked_until
+        FROM support_staff
+        WHERE username = $1
+        FOR UPDATE`,
+        username,
+    ).Scan(&u.ID, &u.Username, &u.Role, &hash, &active, &login.FailedLogins, &login.LockedUntil)
+    if err == sql.ErrNoRows {
+        bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+        return nil, errInvalidLogin
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    // locked_until has no time zone and is kept in UTC.
+    now := time.Now().UTC()
+    if login.locked(now) {
+        return nil, errAccountLocked
+    }
+
+    if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+        login.fail(now)
+        _, err := tx.ExecContext(ctx,
+            "UPDATE support_staff SET failed_logins = $2, locked_until = $3 WHERE id = $1",
+            u.ID, login.FailedLogins, login.LockedUntil,
+        )
+        if err == nil {
+            err = tx.Commit()
+        }
+        if err != nil {
+            return nil, err
+        }
+        return nil, errInvalidLogin
+    }
+    if !active {
+        return nil, errInvalidLogin
+    }
+
+    _, err = tx.ExecContext(ctx, `
+        UPDATE support_staff
+        SET failed_logins = 0, locked_until = NULL, last_login_at = NOW()
+        WHERE id = $1`,
+        u.ID,
+    )
+    if err == nil {
+        err = tx.Commit()
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &u, nil
+}
+
+func hashPassword(password string) (string, error) {
+    if len(password) < minPasswordLength {
+        return "", fmt.Errorf("password must be at least %d characters", minPasswordLength)
+    }
+    hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+    return string(hash), err
+}
+
+func createStaff(ctx context.Context, username, password, role string) (int, error) {
+    if role != roleSupport && role != roleAdmin {
+        return 0, fmt.Errorf("role must be %q or %q", roleSupport, roleAdmin)
+    }
+    hash, err := hashPassword(password)
+    if err != nil {
+        return 0, err
+    }
+    var id int
+    err = db.QueryRowContext(ctx,
+        "INSERT INTO support_staff (username, password_hash, role) VALUES ($1, $2, $3) RETURNING id",
+        username, hash, role,
+    ).Scan(&id)
+    return id, err
+}
+
+// resetStaffPassword sets a new password and clears any lockout.
+func resetStaffPassword(ctx context.Context, username, password string) error {
+    hash, err := hashPassword(password)
+    if err != nil {
+        return err
+    }
+    res, err := db.ExecContext(ctx, `
+        UPDATE support_staff
+        SET password_hash = $2, failed_logins = 0, locked_until = NULL
+        WHERE username = $1`,
+        username, hash,
+    )
+    if err != nil {
+        return err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return errStaffNotFound
+    }
+    return nil
+}
+
+// runStaffCommand implements "admin-panel staff create|reset-password". The
+// password is read from -password or, when that is empty, from the first line
+// of standard input.
+func runStaffCommand(ctx context.Context, args []string) error {
+    if len(args) == 0 {
+        return errors.New("usage: staff create -username NAME [-role support|admin] | reset-password -username NAME")
+    }
+    flags := flag.NewFlagSet("staff "+args[0], flag.ExitOnError)
+    username := flags.String("username", "", "staff username")
+    role := flags.String("role", roleSupport, "role for a new account (create only)")
+    password := flags.String("password", "", "password; read from stdin when empty")
+    flags.Parse(args[1:])
+
+    if *username == "" {
+        return errors.New("staff: -username is required")
+    }
+    if *password == "" {
+        fmt.Fprint(os.Stderr, "Password: ")
+        line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+        if err != nil && line == "" {
+            return fmt.Errorf("reading password: %w", err)
+        }
+        *password = strings.TrimRight(line, "\r\n")
+    }
+
+    switch args[0] {
+    case "create":
+        id, err := createStaff(ctx, *username, *password, *role)
+        if err != nil {
+            return err
+        }
+        fmt.Printf("Created %s account %q with id %d\n", *role, *username, id)
+    case "reset-password":
+        if err := resetStaffPassword(ctx, *username, *password); err != nil {
+            return err
+        }
+        fmt.Printf("Password reset for %q\n", *username)
+    default:
+        return fmt.Errorf("staff: unknown command %q", args[0])
+    }
+    return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestLoginLockout(t *testing.T) {
+    now := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+    var login loginState
+
+    for i := 1; i < maxFailedLogins; i++ {
+        login.fail(now)
+        if login.locked(now) {
+            t.Fatalf("locked after %d failed logins, want %d", i, maxFailedLogins)
+        }
+    }
+    login.fail(now)
+    if !login.locked(now) {
+        t.Fatalf("not locked after %d failed logins", maxFailedLogins)
+    }
+    if !login.locked(now.Add(lockoutDuration - time.Second)) {
+        t.Errorf("unlocked before %v", lockoutDuration)
+    }
+    unlocked := now.Add(lockoutDuration)
+    if login.locked(unlocked) {
+        t.Errorf("still locked after %v", lockoutDuration)
+    }
+
+    // Once the lock has run out the count starts again.
+    for i := 1; i < maxFailedLogins; i++ {
+        login.fail(unlocked)
+    }
+    if login.locked(unlocked) {
+        t.Errorf("locked again before another %d failed logins", maxFailedLogins)
+    }
+    login.fail(unlocked)
+    if !login.locked(unlocked) || !login.LockedUntil.Time.Equal(unlocked.Add(lockoutDuration)) {
+        t.Errorf("got %+v after another %d failed logins", login, maxFailedLogins)
+    }
+}
@@ -3,193 +3,198 @@ package main
 import (
     "encoding/json"
     "net/http"
+    "strconv"
+    "time"
+
+    "github.com/gorilla/mux"
 )
 
-func adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+// adminMiddleware authenticates admin API callers. The admin panel sends a
+// staff token signed with ADMIN_API_SECRET; an app user's ID token is also
+// accepted when that user is flagged is_admin.
+func (s *server) adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
-        authHeader := r.Header.Get("Authorization")
-        if authHeader == "" {
-            http.Error(w, "No authorization header", http.StatusUnauthorized)
+        bearer, ok := bearerToken(r)
+        if !ok {
+            writeError(w, http.StatusUnauthorized, "No authorization header")
+            return
+        }
+
+        if p, err := s.staffTokens.Verify(bearer); err == nil {
+            next.ServeHTTP(w, r.WithContext(withStaff(r.Context(), p)))
             return
         }
 
-        token, err := verifyFirebaseToken(authHeader)
+        token, err := s.verifyIDToken(r.Context(), bearer)
         if err != nil {
-            http.Error(w, "Invalid token", http.StatusUnauthorized)
+            writeError(w, http.StatusUnauthorized, "Invalid token")
             return
         }
 
         // Check if user is admin
-        var isAdmin bool
-        err = db.QueryRow("SELECT is_admin FROM users WHERE id = $1", token.UID).Scan(&isAdmin)
-        if err != nil || !isAdmin {
-            http.Error(w, "Unauthorized", http.StatusForbidden)
+        user, err := userForToken(r.Context(), s.store, token)
+        if err != nil || !user.IsAdmin {
+            writeError(w, http.StatusForbidden, "Unauthorized")
             return
         }
 
-        next.ServeHTTP(w, r)
-    }
-}
-
-func getDashboardStatsHandler(w http.ResponseWriter, r *http.Request) {
-    var stats struct {
-        TotalUsers        int     `json:"total_users"`
-        PendingKYC       int     `json:"pending_kyc"`
-        TotalInvestments float64 `json:"total_investments"`
-        TotalProducts    int     `json:"total_products"`
-    }
-
-    err := db.QueryRow(`
-        SELECT 
-            (SELECT COUNT(*) FROM users),
-            (SELECT COUNT(*) FROM users WHERE kyc_status = 'pending'),
-            COALESCE((SELECT SUM(amount) FROM investments), 0),
-            (SELECT COUNT(*) FROM products)
-    `).Scan(&stats.TotalUsers, &stats.PendingKYC, &stats.TotalInvestments, &stats.TotalProducts)
-
-    if err != nil {
-        http.Error(w, "Failed to fetch dashboard stats", http.StatusInternalServerError)
-        return
+        p := &StaffPrincipal{UserID: user.ID, Role: roleAdmin}
+        next.ServeHTTP(w, r.WithContext(withStaff(r.Context(), p)))
     }
-
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(stats)
 }
 
-func listUsersHandler(w http.ResponseWriter, r *http.Request) {
-    rows, err := db.Query(`
-        SELECT 
-            u.id, u.phone, u.name, u.email, u.kyc_status,
-            COALESCE((SELECT SUM(amount) FROM investments WHERE user_id = u.id), 0) as total_invested,
-            COALESCE((SELECT COUNT(*) FROM referrals WHERE user_id = u.id), 0) as total_referrals
-        FROM users u
-        ORDER BY u.created_at DESC
-    `)
+func (s *server) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+    list, err := s.store.Users().List(r.Context())
     if err != nil {
-        http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
+        writeError(w, http.StatusInternalServerError, "Failed to fetch users")
         return
     }
-    defer rows.Close()
 
-    var users []struct {
+    type user struct {
         ID             int     `json:"id"`
         Phone         string  `json:"phone"`
         Name          *string `json:"name"`
         Email         *string `json:"email"`
+        ProfileImage  *string `json:"profile_image_url"`
         KYCStatus     string  `json:"kyc_status"`
-        TotalInvested float64 `json:"total_invested"`
+        Region        *string `json:"region"`
+        PriceTier     *string `json:"price_tier"`
+        TotalInvested Money   `json:"total_invested"`
         TotalReferrals int    `json:"total_referrals"`
     }
 
-    for rows.Next() {
-        var user struct {
-            ID             int     `json:"id"`
-            Phone         string  `json:"phone"`
-            Name          *string `json:"name"`
-            Email         *string `json:"email"`
-            KYCStatus     string  `json:"kyc_status"`
-            TotalInvested float64 `json:"total_invested"`
-            TotalReferrals int    `json:"total_referrals"`
-        }
-        err := rows.Scan(&user.ID, &user.Phone, &user.Name, &user.Email, &user.KYCStatus,
-            &user.TotalInvested, &user.TotalReferrals)
-        if err != nil {
-            http.Error(w, "Error reading users", http.StatusInternalServerError)
-            return
-        }
-        users = append(users, user)
+    var users []user
+    for _, u := range list {
+        users = append(users, user{u.ID, u.Phone, nullable(u.Name), nullable(u.Email),
+            nullable(u.ProfileImageURL), u.KYCStatus, nullable(u.Region), nullable(u.PriceTier),
+            u.TotalInvested, u.TotalReferrals})
     }
 
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(users)
 }
 
-func updateKycStatusHandler(w http.ResponseWriter, r *http.Request) {
-    var req struct {
-        UserID int    `json:"user_id"`
-        Status string `json:"status"` // approved or rejected
+// userPricingHandler sets the region and pricing tier whose price overrides
+// a user trades at. Empty values put the user back on the default prices.
+func (s *server) userPricingHandler(w http.ResponseWriter, r *http.Request) {
+    userID, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid user ID")
+        return
     }
 
+    var req struct {
+        Region string `json:"region"`
+        Tier   string `json:"tier"`
+    }
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        writeError(w, http.StatusBadRequest, "Invalid request body")
+        return
+    }
+    scope, errs := priceScope(req.Region, req.Tier)
+    if len(errs) > 0 {
+        writeValidationErrors(w, errs)
         return
     }
 
-    if req.Status != "approved" && req.Status != "rejected" {
-        http.Error(w, "Invalid status", http.StatusBadRequest)
+    err = s.store.Users().SetPriceScope(r.Context(), userID, scope)
+    if err == errNotFound {
+        writeError(w, http.StatusNotFound, "User not found")
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to update user pricing")
         return
     }
 
-    result, err := db.Exec("UPDATE users SET kyc_status = $1 WHERE id = $2", req.Status, req.UserID)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "id": userID,
+        "message": "User pricing updated successfully",
+    })
+}
+
+// productIDFromPath parses the {id} route variable, answering 400 when it is
+// not a number.
+func productIDFromPath(w http.ResponseWriter, r *http.Request) (int, bool) {
+    productID, err := strconv.Atoi(mux.Vars(r)["id"])
     if err != nil {
-        http.Error(w, "Failed to update KYC status", http.StatusInternalServerError)
+        writeError(w, http.StatusBadRequest, "Invalid product ID")
+        return 0, false
+    }
+    return productID, true
+}
+
+func (s *server) getProductHandler(w http.ResponseWriter, r *http.Request) {
+    productID, ok := productIDFromPath(w, r)
+    if !ok {
         return
     }
 
-    rowsAffected, err := result.RowsAffected()
-    if err != nil || rowsAffected == 0 {
-        http.Error(w, "User not found", http.StatusNotFound)
+    p, err := s.store.Products().Get(r.Context(), productID)
+    if err == errNotFound {
+        writeError(w, http.StatusNotFound, "Product not found")
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch product")
         return
     }
 
-    w.WriteHeader(http.StatusOK)
-    json.NewEncoder(w).Encode(map[string]string{"message": "KYC status updated successfully"})
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(newAdminProductResponse(p))
 }
 
-func manageProductHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) manageProductHandler(w http.ResponseWriter, r *http.Request) {
     switch r.Method {
     case "GET":
-        rows, err := db.Query("SELECT id, name, type, price FROM products ORDER BY type, name")
+        // Archived products are listed too with ?archived=true.
+        list, err := s.store.Products().List(r.Context(), r.URL.Query().Get("archived") == "true")
         if err != nil {
-            http.Error(w, "Failed to fetch products", http.StatusInternalServerError)
+            writeError(w, http.StatusInternalServerError, "Failed to fetch products")
             return
         }
-        defer rows.Close()
-
-        var products []struct {
-            ID    int     `json:"id"`
-            Name  string  `json:"name"`
-            Type  string  `json:"type"`
-            Price float64 `json:"price"`
-        }
 
-        for rows.Next() {
-            var p struct {
-                ID    int     `json:"id"`
-                Name  string  `json:"name"`
-                Type  string  `json:"type"`
-                Price float64 `json:"price"`
-            }
-            if err := rows.Scan(&p.ID, &p.Name, &p.Type, &p.Price); err != nil {
-                http.Error(w, "Error reading products", http.StatusInternalServerError)
-                return
-            }
-            products = append(products, p)
+        products := []adminProductResponse{}
+        for _, p := range list {
+            products = append(products, newAdminProductResponse(p))
         }
 
         w.Header().Set("Content-Type", "application/json")
         json.NewEncoder(w).Encode(products)
 
     case "POST":
-        var product struct {
-            Name  string  `json:"name"`
-            Type  string  `json:"type"`
-            Price float64 `json:"price"`
+        var product productInput
+        if err := json.NewDecoder(r.Body).Decode(&product); err != nil {
+            writeError(w, http.StatusBadRequest, "Invalid request body")
+            return
+        }
+        if errs := product.validate(); len(errs) > 0 {
+            writeValidationErrors(w, errs)
+            return
         }
 
-        if err := json.NewDecoder(r.Body).Decode(&product); err != nil {
-            http.Error(w, "Invalid request body", http.StatusBadRequest)
+        p := product.applyTo(Product{})
+        priced := product.priceUnits(Product{})
+        if len(priced) == 0 {
+            writeValidationErrors(w, ValidationErrors{{"prices", "required", "at least one unit price is required"}})
+            return
+        }
+        if errs := checkDensity(p, priced); len(errs) > 0 {
+            writeValidationErrors(w, errs)
             return
         }
 
         var productID int
-        err := db.QueryRow(
-            "INSERT INTO products (name, type, price) VALUES ($1, $2, $3) RETURNING id",
-            product.Name, product.Type, product.Price,
-        ).Scan(&productID)
-
+        err := s.store.WithTx(r.Context(), func(tx Store) error {
+            var err error
+            productID, err = tx.Products().Create(r.Context(), p)
+            if err != nil {
+                return err
+            }
+            return setDefaultPrices(r.Context(), tx, productID, product)
+        })
         if err != nil {
-            http.Error(w, "Failed to create product", http.StatusInternalServerError)
+            writeError(w, http.StatusInternalServerError, "Failed to create product")
             return
         }
 
@@ -201,50 +206,192 @@ func manageProductHandler(w http.ResponseWriter, r *http.Request) {
     }
 }
 
-func manageProjectHandler(w http.ResponseWriter, r *http.Request) {
+// updateProductHandler replaces a product's name, type and any stock settings
+// sent, and adds a new default price version, effective now, for each price
+// that changed. A price sent as null is removed by a zero version, after
+// which the product cannot be traded that way except at an override price.
+// Transactions already recorded keep the price they were made at.
+func (s *server) updateProductHandler(w http.ResponseWriter, r *http.Request) {
+    productID, ok := productIDFromPath(w, r)
+    if !ok {
+        return
+    }
+
+    var product productInput
+    if err := json.NewDecoder(r.Body).Decode(&product); err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid request body")
+        return
+    }
+    if errs := product.validate(); len(errs) > 0 {
+        writeValidationErrors(w, errs)
+        return
+    }
+
+    var errs ValidationErrors
+    err := s.store.WithTx(r.Context(), func(tx Store) error {
+        current, err := tx.Products().Get(r.Context(), productID)
+        if err != nil {
+            return err
+        }
+        p := product.applyTo(current)
+        if errs = checkDensity(p, product.priceUnits(current)); len(errs) > 0 {
+            return errs
+        }
+        if err := tx.Products().Update(r.Context(), p); err != nil {
+            return err
+        }
+        return setDefaultPrices(r.Context(), tx, productID, product)
+    })
+    if len(errs) > 0 {
+        writeValidationErrors(w, errs)
+        return
+    }
+    if err == errStockUnitInUse {
+        writeValidationErrors(w, ValidationErrors{{"stock_unit", "in_use",
+            "stock_unit can only change while the product has no stock"}})
+        return
+    }
+    if err == errNotFound {
+        writeError(w, http.StatusNotFound, "Product not found")
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to update product")
+        return
+    }
+
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "id": productID,
+        "message": "Product updated successfully",
+    })
+}
+
+// archiveProductHandler withdraws a product from sale. Products are never
+// deleted because transactions reference them.
+func (s *server) archiveProductHandler(w http.ResponseWriter, r *http.Request) {
+    productID, ok := productIDFromPath(w, r)
+    if !ok {
+        return
+    }
+
+    err := s.store.Products().Archive(r.Context(), productID)
+    if err == errNotFound {
+        writeError(w, http.StatusNotFound, "Product not found")
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to archive product")
+        return
+    }
+
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "id": productID,
+        "message": "Product archived successfully",
+    })
+}
+
+// listPricesHandler returns a product's whole price book, overrides and
+// superseded versions included, latest first.
+func (s *server) listPricesHandler(w http.ResponseWriter, r *http.Request) {
+    productID, ok := productIDFromPath(w, r)
+    if !ok {
+        return
+    }
+
+    if _, err := s.store.Products().Get(r.Context(), productID); err == errNotFound {
+        writeError(w, http.StatusNotFound, "Product not found")
+        return
+    }
+    history, err := s.store.PriceBook().History(r.Context(), productID)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch prices")
+        return
+    }
+
+    versions := []priceVersionResponse{}
+    for _, v := range history {
+        versions = append(versions, newPriceVersionResponse(v))
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(versions)
+}
+
+// addPriceHandler adds a version to a product's price book, optionally for a
+// region and/or pricing tier only and optionally starting or ending later.
+func (s *server) addPriceHandler(w http.ResponseWriter, r *http.Request) {
+    productID, ok := productIDFromPath(w, r)
+    if !ok {
+        return
+    }
+
+    var input priceVersionInput
+    if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid request body")
+        return
+    }
+    version, errs := input.version(productID, time.Now())
+    if len(errs) > 0 {
+        writeValidationErrors(w, errs)
+        return
+    }
+
+    var versionID int
+    err := s.store.WithTx(r.Context(), func(tx Store) error {
+        p, err := tx.Products().Get(r.Context(), productID)
+        if err != nil {
+            return err
+        }
+        if errs = checkDensity(p, []string{version.Unit}); len(errs) > 0 {
+            return errs
+        }
+        versionID, err = tx.PriceBook().Add(r.Context(), version)
+        return err
+    })
+    if len(errs) > 0 {
+        writeValidationErrors(w, errs)
+        return
+    }
+    if err == errNotFound {
+        writeError(w, http.StatusNotFound, "Product not found")
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to add price")
+        return
+    }
+
+    writeJSON(w, http.StatusCreated, map[string]interface{}{
+        "id":      versionID,
+        "message": "Price added successfully",
+    })
+}
+
+func (s *server) manageProjectHandler(w http.ResponseWriter, r *http.Request) {
     switch r.Method {
     case "GET":
-        rows, err := db.Query(`
-            SELECT 
-                id, name, description, lock_days, profit_percent, 
-                min_investment, max_investment, status
-            FROM projects 
-            ORDER BY created_at DESC
-        `)
+        list, err := s.store.Projects().List(r.Context())
         if err != nil {
-            http.Error(w, "Failed to fetch projects", http.StatusInternalServerError)
+            writeError(w, http.StatusInternalServerError, "Failed to fetch projects")
             return
         }
-        defer rows.Close()
 
-        var projects []struct {
+        type project struct {
             ID            int     `json:"id"`
             Name          string  `json:"name"`
             Description   string  `json:"description"`
             LockDays      int     `json:"lock_days"`
-            ProfitPercent float64 `json:"profit_percent"`
-            MinInvestment float64 `json:"min_investment"`
-            MaxInvestment float64 `json:"max_investment"`
+            ProfitPercent Percent `json:"profit_percent"`
+            MinInvestment Money   `json:"min_investment"`
+            MaxInvestment Money   `json:"max_investment"`
+            FundingCap    *Money  `json:"funding_cap"`
             Status        string  `json:"status"`
         }
 
-        for rows.Next() {
-            var p struct {
-                ID            int     `json:"id"`
-                Name          string  `json:"name"`
-                Description   string  `json:"description"`
-                LockDays      int     `json:"lock_days"`
-                ProfitPercent float64 `json:"profit_percent"`
-                MinInvestment float64 `json:"min_investment"`
-                MaxInvestment float64 `json:"max_investment"`
-                Status        string  `json:"status"`
-            }
-            if err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.LockDays,
-                &p.ProfitPercent, &p.MinInvestment, &p.MaxInvestment, &p.Status); err != nil {
-                http.Error(w, "Error reading projects", http.StatusInternalServerError)
-                return
-            }
-            projects = append(projects, p)
+        var projects []project
+        for _, p := range list {
+            projects = append(projects, project{p.ID, p.Name, p.Description, p.LockDays,
+                p.ProfitPercent, p.MinInvestment, p.MaxInvestment, p.FundingCap, p.Status})
         }
 
         w.Header().Set("Content-Type", "application/json")
@@ -255,28 +402,47 @@ func manageProjectHandler(w http.ResponseWriter, r *http.Request) {
             Name          string  `json:"name"`
             Description   string  `json:"description"`
             LockDays      int     `json:"lock_days"`
-            ProfitPercent float64 `json:"profit_percent"`
-            MinInvestment float64 `json:"min_investment"`
-            MaxInvestment float64 `json:"max_investment"`
+            ProfitPercent Percent `json:"profit_percent"`
+            MinInvestment Money   `json:"min_investment"`
+            MaxInvestment Money   `json:"max_investment"`
+            FundingCap    *Money  `json:"funding_cap"`
         }
 
         if err := json.NewDecoder(r.Body).Decode(&project); err != nil {
-            http.Error(w, "Invalid request body", http.StatusBadRequest)
+            writeError(w, http.StatusBadRequest, "Invalid request body")
             return
         }
 
-        var projectID int
-        err := db.QueryRow(`
-            INSERT INTO projects 
-            (name, description, lock_days, profit_percent, min_investment, max_investment, status, created_at)
-            VALUES ($1, $2, $3, $4, $5, $6, 'active', NOW())
-            RETURNING id
-        `, project.Name, project.Description, project.LockDays,
-            project.ProfitPercent, project.MinInvestment, project.MaxInvestment,
-        ).Scan(&projectID)
+        var errs ValidationErrors
+        if project.Name == "" {
+            errs = append(errs, FieldError{"name", "required", "name is required"})
+        }
+        if project.LockDays <= 0 {
+            errs = append(errs, FieldError{"lock_days", "invalid", "lock_days must be positive"})
+        }
+        if project.MinInvestment <= 0 || project.MaxInvestment < project.MinInvestment {
+            errs = append(errs, FieldError{"max_investment", "invalid",
+                "min_investment must be positive and no more than max_investment"})
+        }
+        if project.FundingCap != nil && *project.FundingCap < project.MaxInvestment {
+            errs = append(errs, FieldError{"funding_cap", "invalid", "funding_cap must be at least max_investment"})
+        }
+        if len(errs) > 0 {
+            writeValidationErrors(w, errs)
+            return
+        }
 
+        projectID, err := s.store.Projects().Create(r.Context(), Project{
+            Name:          project.Name,
+            Description:   project.Description,
+            LockDays:      project.LockDays,
+            ProfitPercent: project.ProfitPercent,
+            MinInvestment: project.MinInvestment,
+            MaxInvestment: project.MaxInvestment,
+            FundingCap:    project.FundingCap,
+        })
         if err != nil {
-            http.Error(w, "Failed to create project", http.StatusInternalServerError)
+            writeError(w, http.StatusInternalServerError, "Failed to create project")
             return
         }
 
@@ -287,3 +453,128 @@ func manageProjectHandler(w http.ResponseWriter, r *http.Request) {
         })
     }
 }
+
+// walletAdjustmentHandler records money entering or leaving a user's wallet
+// outside the app: a deposit credits it from cash, a withdrawal pays it out.
+func (s *server) walletAdjustmentHandler(w http.ResponseWriter, r *http.Request) {
+    var req struct {
+        UserID int    `json:"user_id"`
+        Kind   string `json:"kind"` // deposit or withdrawal
+        Amount Money  `json:"amount"`
+        Memo   string `json:"memo"`
+    }
+
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == 0 || req.Amount <= 0 {
+        writeError(w, http.StatusBadRequest, "Invalid request body")
+        return
+    }
+
+    amount := req.Amount
+    switch req.Kind {
+    case entryDeposit:
+    case entryWithdrawal:
+        amount = -amount
+    default:
+        writeError(w, http.StatusBadRequest, "Invalid kind")
+        return
+    }
+
+    _, err := s.store.Users().Get(r.Context(), req.UserID)
+    if err == errNotFound {
+        writeError(w, http.StatusNotFound, "User not found")
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Database error")
+        return
+    }
+
+    staff := staffFromContext(r.Context())
+    var entryID int
+    err = s.store.WithTx(r.Context(), func(tx Store) error {
+        var err error
+        entryID, err = postEntry(r.Context(), tx, JournalEntry{
+            Kind:           req.Kind,
+            Memo:           req.Memo,
+            CreatedBy:      staff.UserID,
+            CreatedByStaff: staff.StaffID,
+            Postings: []Posting{
+                {UserID: req.UserID, Amount: amount},
+                {Account: accountCash, Amount: -amount},
+            },
+        })
+        return err
+    })
+    if err == errInsufficientFunds {
+        writeError(w, http.StatusUnprocessableEntity, "Insufficient wallet balance")
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to record wallet adjustment")
+        return
+    }
+
+    writeJSON(w, http.StatusCreated, map[string]interface{}{
+        "entry_id": entryID,
+        "message": "Wallet adjustment recorded",
+    })
+}
+
+func (s *server) walletAuditHandler(w http.ResponseWriter, r *http.Request) {
+    audit, err := s.store.Wallet().Audit(r.Context())
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to audit wallets")
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "ok": audit.OK(),
+        "unbalanced_entries": audit.UnbalancedEntries,
+        "mismatches": audit.Mismatches,
+    })
+}
+
+// commissionPlansHandler lists the active commission plans and replaces the
+// plan for one level and scope. Replaced plans are deactivated rather than
+// edited so that recorded commissions keep pointing at the plan they used.
+func (s *server) commissionPlansHandler(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case "GET":
+        active, err := s.store.Commissions().ActivePlans(r.Context())
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, "Failed to fetch commission plans")
+            return
+        }
+
+        writeJSON(w, http.StatusOK, append([]CommissionPlan{}, active...))
+
+    case "POST":
+        var plan CommissionPlan
+        if err := json.NewDecoder(r.Body).Decode(&plan); err != nil {
+            writeError(w, http.StatusBadRequest, "Invalid request body")
+            return
+        }
+        if plan.Level < 1 || plan.Level > maxReferralDepth || plan.Percent < 0 || plan.Percent > 100*100 ||
+            (plan.ProductID != 0 && plan.ProjectID != 0) {
+            writeError(w, http.StatusBadRequest, "Invalid commission plan")
+            return
+        }
+
+        var planID int
+        err := s.store.WithTx(r.Context(), func(tx Store) error {
+            var err error
+            planID, err = tx.Commissions().ReplacePlan(r.Context(), plan)
+            return err
+        })
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, "Failed to save commission plan")
+            return
+        }
+
+        writeJSON(w, http.StatusCreated, map[string]interface{}{
+            "id":      planID,
+            "message": "Commission plan saved successfully",
+        })
+    }
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strings"
+
+    "firebase.google.com/go/auth"
+)
+
+// Principal is the authenticated app user a request is acting for.
+type Principal struct {
+    UserID int
+    UID    string
+    Phone  string
+}
+
+type principalContextKey struct{}
+
+var errMissingPhoneClaim = errors.New("token has no phone_number claim")
+
+func withPrincipal(ctx context.Context, p *Principal) context.Context {
+    return context.WithValue(ctx, principalContextKey{}, p)
+}
+
+func principalFromContext(ctx context.Context) (*Principal, bool) {
+    p, ok := ctx.Value(principalContextKey{}).(*Principal)
+    return p, ok && p != nil
+}
+
+// mustPrincipal returns the principal stored by requireUser. Handlers that
+// call it must only be mounted behind that middleware.
+func mustPrincipal(r *http.Request) *Principal {
+    p, ok := principalFromContext(r.Context())
+    if !ok {
+        panic("mustPrincipal called on a route without requireUser")
+    }
+    return p
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer <token>" header.
+func bearerToken(r *http.Request) (string, bool) {
+    authHeader := r.Header.Get("Authorization")
+    if !strings.HasPrefix(authHeader, "Bearer ") {
+        return "", false
+    }
+    token := strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer "))
+    return token, token != ""
+}
+
+func phoneFromToken(token *auth.Token) (string, error) {
+    phone, _ := token.Claims["phone_number"].(string)
+    if phone == "" {
+        return "", errMissingPhoneClaim
+    }
+    return phone, nil
+}
+
+// userForToken finds the user a verified ID token belongs to, by its UID.
+// Users registered before UIDs were recorded are matched once by the token's
+// verified phone number and linked to the UID from then on.
+func userForToken(ctx context.Context, s Store, token *auth.Token) (User, error) {
+    user, err := s.Users().GetByFirebaseUID(ctx, token.UID)
+    if err != errNotFound {
+        return user, err
+    }
+
+    phone, err := phoneFromToken(token)
+    if err != nil {
+        return User{}, errNotFound
+    }
+    user, err = s.Users().GetByPhone(ctx, phone)
+    if err != nil {
+        return User{}, err
+    }
+    if user.FirebaseUID != "" {
+        // The phone number belongs to an account linked to another UID.
+        return User{}, errNotFound
+    }
+    if err := s.Users().SetFirebaseUID(ctx, user.ID, token.UID); err != nil {
+        return User{}, err
+    }
+    user.FirebaseUID = token.UID
+    return user, nil
+}
+
+// requireUser verifies the caller's ID token with the configured verifier,
+// resolves it to a row in users once, and stores the result in the request
+// context.
+func (s *server) requireUser(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        idToken, ok := bearerToken(r)
+        if !ok {
+            writeError(w, http.StatusUnauthorized, "Missing or invalid Authorization header")
+            return
+        }
+
+        token, err := s.verifyIDToken(r.Context(), idToken)
+        if err != nil {
+            writeError(w, http.StatusUnauthorized, "Invalid ID token")
+            return
+        }
+
+        phone, err := phoneFromToken(token)
+        if err != nil {
+            writeError(w, http.StatusUnauthorized, "Token is not bound to a phone number")
+            return
+        }
+
+        user, err := userForToken(r.Context(), s.store, token)
+        if err == errNotFound {
+            writeError(w, http.StatusNotFound, "User not found")
+            return
+        }
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, "Database error")
+            return
+        }
+
+        p := &Principal{UserID: user.ID, UID: token.UID, Phone: phone}
+        next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), p)))
+    })
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+    writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "path"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// BlobStore keeps uploaded files, such as KYC documents, under keys the
+// server chooses. Keys are slash-separated paths like "kyc/12/3f9c.jpg".
+type BlobStore interface {
+    Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+    Delete(ctx context.Context, key string) error
+    // SignedURL returns a URL that downloads key without further
+    // authentication until ttl has passed.
+    SignedURL(key string, ttl time.Duration) (string, error)
+}
+
+var errInvalidBlobKey = errors.New("invalid blob key")
+
+// newBlobStoreFromEnv selects the store with BLOB_STORE: local (default),
+// files under BLOB_DIR served by this server, or s3.
+func newBlobStoreFromEnv() (BlobStore, error) {
+    switch mode := os.Getenv("BLOB_STORE"); mode {
+    case "", "local":
+        return newLocalBlobStoreFromEnv()
+    case "s3":
+        return newS3BlobStoreFromEnv()
+    default:
+        return nil, fmt.Errorf("unknown BLOB_STORE %q", mode)
+    }
+}
+
+// validBlobKey accepts only clean relative paths, so a key can never name a
+// file outside the store.
+func validBlobKey(key string) bool {
+    return key != "" && !strings.HasPrefix(key, "/") && path.Clean(key) == key &&
+        key != ".." && !strings.HasPrefix(key, "../")
+}
+
+// randomHex returns n random bytes as hex, for unguessable blob keys.
+func randomHex(n int) (string, error) {
+    b := make([]byte, n)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(b), nil
+}
+
+// localBlobStore keeps files in a directory and serves them itself. Its
+// signed URLs carry an expiry and an HMAC of the key and expiry, which
+// ServeHTTP checks; mount it at /files/.
+type localBlobStore struct {
+    dir     string
+    baseURL string // prefix of signed URLs, e.g. https://api.example.com
+    secret  []byte
+    now     func() time.Time
+}
+
+func newLocalBlobStore(dir, baseURL string, secret []byte) (*localBlobStore, error) {
+    if len(secret) < localTokenMinSecret {
+        return nil, fmt.Errorf("blob URL secret must be at least %d bytes", localTokenMinSecret)
+    }
+    if err := os.MkdirAll(dir, 0o750); err != nil {
+        return nil, err
+    }
+    return &localBlobStore{dir: dir, baseURL: baseURL, secret: secret, now: time.Now}, nil
+}
+
+// newLocalBlobStoreFromEnv reads BLOB_DIR (default "uploads"),
+// BLOB_PUBLIC_URL and BLOB_URL_SECRET. Without a secret a random one is
+// used, and signed URLs stop working when the server restarts.
+func newLocalBlobStoreFromEnv() (*localBlobStore, error) {
+    dir := os.Getenv("BLOB_DIR")
+    if dir == "" {
+        dir = "uploads"
+    }
+    secret := []byte(os.Getenv("BLOB_URL_SECRET"))
+    if len(secret) == 0 {
+        log.Println("Warning: BLOB_URL_SECRET is not set, document links will not survive a restart")
+        key, err := randomHex(localTokenMinSecret)
+        if err != nil {
+            return nil, err
+        }
+        secret = []byte(key)
+    }
+    return newLocalBlobStore(dir, os.Getenv("BLOB_PUBLIC_URL"), secret)
+}
+
+func (b *localBlobStore) path(key string) (string, error) {
+    if !validBlobKey(key) {
+        return "", errInvalidBlobKey
+    }
+    return filepath.Join(b.dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes to a temporary file beside the target and renames it, so a
+// failed upload never leaves a partial file under key.
+func (b *localBlobStore) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+    p, err := b.path(key)
+    if err != nil {
+        return err
+    }
+    if err := os.MkdirAll(filepath.Dir(p), 0o750); err != nil {
+        return err
+    }
+    f, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(f.Name())
+
+    n, err := io.Copy(f, body)
+    if closeErr := f.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        return err
+    }
+    if n != size {
+        return fmt.Errorf("blob %s: wrote %d bytes, expected %d", key, n, size)
+    }
+    return os.Rename(f.Name(), p)
+}
+
+func (b *localBlobStore) Delete(ctx context.Context, key string) error {
+    p, err := b.path(key)
+    if err != nil {
+        return err
+    }
+    if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    return nil
+}
+
+func (b *localBlobStore) signature(key string, expires int64) []byte {
+    return hs256(b.secret, key+"\n"+strconv.FormatInt(expires, 10))
+}
+
+func (b *localBlobStore) SignedURL(key string, ttl time.Duration) (string, error) {
+    if !validBlobKey(key) {
+        return "", errInvalidBlobKey
+    }
+    expires := b.now().Add(ttl).Unix()
+    q := url.Values{}
+    q.Set("expires", strconv.FormatInt(expires, 10))
+    q.Set("signature", hex.EncodeToString(b.signature(key, expires)))
+    return b.baseURL + "/files/" + key + "?" + q.Encode(), nil
+}
+
+// ServeHTTP serves a file for a request to a URL from SignedURL, with the
+// /files/ prefix stripped. Bad, expired and unknown links all answer 404.
+func (b *localBlobStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    key := r.URL.Path
+    expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+    signature, sigErr := hex.DecodeString(r.URL.Query().Get("signature"))
+    if err != nil || sigErr != nil || !hmac.Equal(signature, b.signature(key, expires)) || b.now().Unix() > expires {
+        writeError(w, http.StatusNotFound, "File not found")
+        return
+    }
+    p, err := b.path(key)
+    if err != nil {
+        writeError(w, http.StatusNotFound, "File not found")
+        return
+    }
+    f, err := os.Open(p)
+    if err != nil {
+        writeError(w, http.StatusNotFound, "File not found")
+        return
+    }
+    defer f.Close()
+    info, err := f.Stat()
+    if err != nil || info.IsDir() {
+        writeError(w, http.StatusNotFound, "File not found")
+        return
+    }
+
+    w.Header().Set("Cache-Control", "private, no-store")
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    http.ServeContent(w, r, path.Base(key), info.ModTime(), f)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    sigV4Algorithm      = "AWS4-HMAC-SHA256"
+    sigV4UnsignedBody   = "UNSIGNED-PAYLOAD"
+    s3MaxPresignExpires = 7 * 24 * time.Hour
+)
+
+// s3BlobStore keeps files in a bucket of S3 or a compatible service such as
+// MinIO, addressed path-style (endpoint/bucket/key) and signed with AWS
+// Signature Version 4.
+type s3BlobStore struct {
+    endpoint  *url.URL
+    region    string
+    bucket    string
+    accessKey string
+    secretKey string
+    client    *http.Client
+    now       func() time.Time
+}
+
+// newS3BlobStoreFromEnv reads S3_BUCKET, S3_ACCESS_KEY_ID and
+// S3_SECRET_ACCESS_KEY, S3_REGION (default us-east-1) and S3_ENDPOINT
+// (default the region's AWS endpoint).
+func newS3BlobStoreFromEnv() (*s3BlobStore, error) {
+    region := os.Getenv("S3_REGION")
+    if region == "" {
+        region = "us-east-1"
+    }
+    endpoint := os.Getenv("S3_ENDPOINT")
+    if endpoint == "" {
+        endpoint = "https://s3." + region + ".amazonaws.com"
+    }
+    u, err := url.Parse(endpoint)
+    if err != nil || u.Host == "" {
+        return nil, fmt.Errorf("invalid S3_ENDPOINT %q", endpoint)
+    }
+    b := &s3BlobStore{
+        endpoint:  u,
+        region:    region,
+        bucket:    os.Getenv("S3_BUCKET"),
+        accessKey: os.Getenv("S3_ACCESS_KEY_ID"),
+        secretKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+        client:    &http.Client{Timeout: time.Minute},
+        now:       time.Now,
+    }
+    if b.bucket == "" || b.accessKey == "" || b.secretKey == "" {
+        return nil, fmt.Errorf("BLOB_STORE=s3 needs S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY")
+    }
+    return b, nil
+}
+
+func (b *s3BlobStore) objectURL(key string) (*url.URL, error) {
+    if !validBlobKey(key) {
+        return nil, errInvalidBlobKey
+    }
+    u := *b.endpoint
+    u.Path = strings.TrimSuffix(u.Path, "/") + "/" + b.bucket + "/" + key
+    u.RawQuery = ""
+    return &u, nil
+}
+
+// Put uploads with an unsigned payload so the body can be streamed; S3
+// still checks Content-Length.
+func (b *s3BlobStore) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+    u, err := b.objectURL(key)
+    if err != nil {
+        return err
+    }
+    req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), body)
+    if err != nil {
+        return err
+    }
+    req.ContentLength = size
+    req.Header.Set("Content-Type", contentType)
+    return b.do(req, http.StatusOK)
+}
+
+func (b *s3BlobStore) Delete(ctx context.Context, key string) error {
+    u, err := b.objectURL(key)
+    if err != nil {
+        return err
+    }
+    req, err := http.NewRequestWithContext(ctx, http.MethodDelete, u.String(), nil)
+    if err != nil {
+        return err
+    }
+    return b.do(req, http.StatusNoContent)
+}
+
+func (b *s3BlobStore) do(req *http.Request, want int) error {
+    b.sign(req, b.now())
+    resp, err := b.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != want {
+        msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+        return fmt.Errorf("s3 %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+    }
+    return nil
+}
+
+// SignedURL presigns a GET. S3 refuses presigned URLs valid for more than
+// a week.
+func (b *s3BlobStore) SignedURL(key string, ttl time.Duration) (string, error) {
+    if ttl > s3MaxPresignExpires {
+        ttl = s3MaxPresignExpires
+    }
+    u, err := b.objectURL(key)
+    if err != nil {
+        return "", err
+    }
+    return b.presign(http.MethodGet, u, b.now(), ttl), nil
+}
+
+// sign adds the Signature Version 4 Authorization header to req, signing
+// the host and every header already set.
+func (b *s3BlobStore) sign(req *http.Request, t time.Time) {
+    amzDate := t.UTC().Format("20060102T150405Z")
+    req.Header.Set("X-Amz-Date", amzDate)
+    if req.Header.Get("X-Amz-Content-Sha256") == "" {
+        req.Header.Set("X-Amz-Content-Sha256", sigV4UnsignedBody)
+    }
+
+    headers := map[string]string{"host": req.URL.Host}
+    for name, values := range req.Header {
+        headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+    }
+    names := make([]string, 0, len(headers))
+    for name := range headers {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    var canonical strings.Builder
+    for _, name := range names {
+        canonical.WriteString(name + ":" + headers[name] + "\n")
+    }
+    signedHeaders := strings.Join(names, ";")
+
+    scope := b.scope(t)
+    signature := b.signature(t, scope, strings.Join([]string{
+        req.Method,
+        sigV4EscapePath(req.URL.Path),
+        sigV4Query(req.URL.Query()),
+        canonical.String(),
+        signedHeaders,
+        req.Header.Get("X-Amz-Content-Sha256"),
+    }, "\n"))
+    req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+        sigV4Algorithm, b.accessKey, scope, signedHeaders, signature))
+}
+
+// presign returns u with query-string authentication for method, valid for
+// ttl from t. Only the host is signed.
+func (b *s3BlobStore) presign(method string, u *url.URL, t time.Time, ttl time.Duration) string {
+    scope := b.scope(t)
+    q := u.Query()
+    q.Set("X-Amz-Algorithm", sigV4Algorithm)
+    q.Set("X-Amz-Credential", b.accessKey+"/"+scope)
+    q.Set("X-Amz-Date", t.UTC().Format("20060102T150405Z"))
+    q.Set("X-Amz-Expires", strconv.Itoa(int(ttl/time.Second)))
+    q.Set("X-Amz-SignedHeaders", "host")
+
+    signature := b.signature(t, scope, strings.Join([]string{
+        method,
+        sigV4EscapePath(u.Path),
+        sigV4Query(q),
+        "host:" + u.Host + "\n",
+        "host",
+        sigV4UnsignedBody,
+    }, "\n"))
+
+    signed := *u
+    signed.RawQuery = sigV4Query(q) + "&X-Amz-Signature=" + signature
+    return signed.String()
+}
+
+func (b *s3BlobStore) scope(t time.Time) string {
+    return t.UTC().Format("20060102") + "/" + b.region + "/s3/aws4_request"
+}
+
+// signature signs canonicalRequest with the key derived for t's date, the
+// region and the s3 service.
+func (b *s3BlobStore) signature(t time.Time, scope, canonicalRequest string) string {
+    hash := sha256.Sum256([]byte(canonicalRequest))
+    stringToSign := strings.Join([]string{
+        sigV4Algorithm, t.UTC().Format("20060102T150405Z"), scope, hex.EncodeToString(hash[:]),
+    }, "\n")
+
+    key := hs256([]byte("AWS4"+b.secretKey), t.UTC().Format("20060102"))
+    key = hs256(key, b.region)
+    key = hs256(key, "s3")
+    key = hs256(key, "aws4_request")
+    return hex.EncodeToString(hs256(key, stringToSign))
+}
+
+// sigV4Escape percent-encodes everything but the unreserved characters, as
+// Signature Version 4 requires.
+func sigV4Escape(s string) string {
+    var sb strings.Builder
+    for i := 0; i < len(s); i++ {
+        c := s[i]
+        if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+            c == '-' || c == '_' || c == '.' || c == '~' {
+            sb.WriteByte(c)
+        } else {
+            fmt.Fprintf(&sb, "%%%02X", c)
+        }
+    }
+    return sb.String()
+}
+
+func sigV4EscapePath(p string) string {
+    if p == "" {
+        return "/"
+    }
+    segments := strings.Split(p, "/")
+    for i, s := range segments {
+        segments[i] = sigV4Escape(s)
+    }
+    return strings.Join(segments, "/")
+}
+
+// sigV4Query is the canonical query string: escaped pairs sorted by name.
+func sigV4Query(q url.Values) string {
+    var pairs []string
+    for name, values := range q {
+        for _, v := range values {
+            pairs = append(pairs, sigV4Escape(name)+"="+sigV4Escape(v))
+        }
+    }
+    sort.Strings(pairs)
+    return strings.Join(pairs, "&")
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// Live chat runs in the admin panel, which has no way to check an app
+// user's ID token. Instead the app asks this server for a chat token and
+// presents it to the panel's /ws/chat socket; the panel verifies it with the
+// shared ADMIN_API_SECRET.
+const (
+    chatTokenIssuer = "milkpro-backend"
+    // chatTokenTTL only needs to cover opening the socket; the app asks for
+    // a new token each time it reconnects.
+    chatTokenTTL = 2 * time.Minute
+)
+
+type chatClaims struct {
+    Issuer   string `json:"iss"`
+    Subject  string `json:"sub"`
+    IssuedAt int64  `json:"iat"`
+    Expires  int64  `json:"exp"`
+}
+
+// signChat issues a chat token for an app user. It lives on the staff token
+// verifier because both kinds of token are signed with the panel's secret.
+func (v *staffTokenVerifier) signChat(userID int, ttl time.Duration) (string, time.Time, error) {
+    now := v.now()
+    expires := now.Add(ttl)
+    token, err := signHS256(v.secret, chatClaims{
+        Issuer:   chatTokenIssuer,
+        Subject:  strconv.Itoa(userID),
+        IssuedAt: now.Unix(),
+        Expires:  expires.Unix(),
+    })
+    return token, expires, err
+}
+
+// chatTokenHandler hands the caller a token to open a live chat with.
+func (s *server) chatTokenHandler(w http.ResponseWriter, r *http.Request) {
+    if s.staffTokens == nil {
+        writeError(w, http.StatusServiceUnavailable, "Live chat is not available")
+        return
+    }
+    token, expires, err := s.staffTokens.signChat(mustPrincipal(r).UserID, chatTokenTTL)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to issue chat token")
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]interface{}{
+        "token":      token,
+        "expires_at": expires.UTC(),
+    })
+}
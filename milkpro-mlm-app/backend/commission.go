@@ -0,0 +1,110 @@
+package main
+
+import (
+    "context"
+    "fmt"
+)
+
+// maxReferralDepth is how far up (for commissions) and down (for
+// listReferralsHandler) the sponsor tree is followed.
+const maxReferralDepth = 3
+
+// Commission sources.
+const (
+    sourceInvestment  = "investment"
+    sourceTransaction = "transaction"
+)
+
+// CommissionSource is a purchase or investment that pays commission to the
+// buyer's upline. ProductID or ProjectID selects any scoped plan.
+type CommissionSource struct {
+    Type      string
+    ID        int
+    UserID    int
+    Amount    Money
+    ProductID int
+    ProjectID int
+}
+
+// Commission is one immutable payment to an upline member.
+type Commission struct {
+    ID            int
+    BeneficiaryID int
+    Level         int
+    Percent       Percent
+    Amount        Money
+    PlanID        int
+}
+
+// commissionPlansFor picks the plan for each level that applies to src,
+// preferring a plan scoped to its product or project over the default plan.
+func commissionPlansFor(plans []CommissionPlan, src CommissionSource) map[int]CommissionPlan {
+    chosen := make(map[int]CommissionPlan)
+    for _, plan := range plans {
+        isDefault := plan.ProductID == 0 && plan.ProjectID == 0
+        applies := isDefault ||
+            plan.ProductID != 0 && plan.ProductID == src.ProductID ||
+            plan.ProjectID != 0 && plan.ProjectID == src.ProjectID
+        if !applies {
+            continue
+        }
+        if _, ok := chosen[plan.Level]; ok && isDefault {
+            continue
+        }
+        chosen[plan.Level] = plan
+    }
+    return chosen
+}
+
+// applyCommissions pays commission on src to each member of the buyer's
+// upline, crediting their wallets from the commission expense account. Call
+// it inside the Store.WithTx that records src.
+func applyCommissions(ctx context.Context, s Store, src CommissionSource) ([]Commission, error) {
+    if src.Amount <= 0 {
+        return nil, nil
+    }
+
+    upline, err := s.Referrals().Upline(ctx, src.UserID)
+    if err != nil || len(upline) == 0 {
+        return nil, err
+    }
+    active, err := s.Commissions().ActivePlans(ctx)
+    if err != nil {
+        return nil, err
+    }
+    plans := commissionPlansFor(active, src)
+
+    var paid []Commission
+    for i, beneficiaryID := range upline {
+        level := i + 1
+        plan, ok := plans[level]
+        if !ok {
+            continue
+        }
+        amount := src.Amount.Percent(plan.Percent)
+        if amount <= 0 {
+            continue
+        }
+
+        c := Commission{BeneficiaryID: beneficiaryID, Level: level, Percent: plan.Percent, Amount: amount, PlanID: plan.ID}
+        c.ID, err = s.Commissions().Record(ctx, src, c)
+        if err != nil {
+            return nil, fmt.Errorf("recording level %d commission: %w", level, err)
+        }
+
+        _, err = postEntry(ctx, s, JournalEntry{
+            Kind:          entryCommission,
+            ReferenceType: "commission",
+            ReferenceID:   c.ID,
+            Postings: []Posting{
+                {UserID: beneficiaryID, Amount: amount},
+                {Account: accountCommissionExpense, Amount: -amount},
+            },
+        })
+        if err != nil {
+            return nil, fmt.Errorf("paying level %d commission: %w", level, err)
+        }
+        paid = append(paid, c)
+    }
+    return paid, nil
+}
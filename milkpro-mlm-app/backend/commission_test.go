@@ -0,0 +1,52 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "testing"
+)
+
+func TestReplaceCommissionPlan(t *testing.T) {
+    ts := newTestServer(t)
+    adminID := ts.createUser(t, "+15550001", 0)
+    admin := ts.mem.root.users[adminID]
+    admin.IsAdmin = true
+    ts.mem.root.users[adminID] = admin
+    token := ts.token(t, "+15550001")
+
+    w := ts.request("POST", "/admin/api/commission-plans", token, `{"level": 1, "percent": 4.5}`)
+    if w.Code != http.StatusCreated {
+        t.Fatalf("replacing a plan: got %d: %s", w.Code, w.Body.String())
+    }
+    if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+        t.Errorf("replacing a plan: response has Content-Type %q", ct)
+    }
+    var saved struct {
+        ID int `json:"id"`
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &saved); err != nil {
+        t.Fatal(err)
+    }
+
+    w = ts.request("GET", "/admin/api/commission-plans", token, "")
+    var plans []CommissionPlan
+    if err := json.Unmarshal(w.Body.Bytes(), &plans); err != nil {
+        t.Fatalf("listing plans: %v: %s", err, w.Body.String())
+    }
+    var level1 []CommissionPlan
+    for _, p := range plans {
+        if p.Level == 1 {
+            level1 = append(level1, p)
+        }
+    }
+    if len(level1) != 1 || level1[0].ID != saved.ID || level1[0].Percent != 450 {
+        t.Errorf("got level 1 plans %+v, want only plan %d at 4.5%%", level1, saved.ID)
+    }
+
+    for _, body := range []string{`{"level": 0, "percent": 1}`, `{"level": 1, "percent": 101}`,
+        `{"level": 1, "percent": 1, "product_id": 1, "project_id": 1}`} {
+        if w := ts.request("POST", "/admin/api/commission-plans", token, body); w.Code != http.StatusBadRequest {
+            t.Errorf("%s: got %d: %s", body, w.Code, w.Body.String())
+        }
+    }
+}
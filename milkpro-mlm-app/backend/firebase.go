@@ -2,37 +2,36 @@ package main
 
 import (
     "context"
+    "os"
+
     firebase "firebase.google.com/go"
     "firebase.google.com/go/auth"
     "google.golang.org/api/option"
 )
 
-var firebaseAuth *auth.Client
+// firebaseVerifier checks ID tokens issued by Firebase Authentication.
+type firebaseVerifier struct {
+    client *auth.Client
+}
 
-func initFirebase() error {
-    ctx := context.Background()
-    
-    // Initialize Firebase app with credentials
-    // In production, use a service account key file
-    app, err := firebase.NewApp(ctx, nil, option.WithCredentialsFile("firebase-credentials.json"))
-    if err != nil {
-        return err
+func newFirebaseVerifier(ctx context.Context) (*firebaseVerifier, error) {
+    credentialsFile := os.Getenv("FIREBASE_CREDENTIALS_FILE")
+    if credentialsFile == "" {
+        credentialsFile = "firebase-credentials.json"
     }
 
-    // Initialize Firebase Auth client
-    firebaseAuth, err = app.Auth(ctx)
+    app, err := firebase.NewApp(ctx, nil, option.WithCredentialsFile(credentialsFile))
     if err != nil {
-        return err
+        return nil, err
     }
 
-    return nil
-}
-
-func verifyFirebaseToken(tokenString string) (*auth.Token, error) {
-    ctx := context.Background()
-    token, err := firebaseAuth.VerifyIDToken(ctx, tokenString)
+    client, err := app.Auth(ctx)
     if err != nil {
         return nil, err
     }
-    return token, nil
+    return &firebaseVerifier{client: client}, nil
+}
+
+func (v *firebaseVerifier) VerifyIDToken(ctx context.Context, idToken string) (*auth.Token, error) {
+    return v.client.VerifyIDToken(ctx, idToken)
 }
@@ -1,624 +1,500 @@
 package main
 
 import (
-    "database/sql"
+    "context"
     "encoding/json"
+    "fmt"
     "net/http"
-    "os"
-    "strings"
-
-    firebase "firebase.google.com/go"
-    "firebase.google.com/go/auth"
-    "golang.org/x/net/context"
-    "google.golang.org/api/option"
+    "time"
 )
 
-var firebaseApp *firebase.App
-var firebaseAuthClient *auth.Client
-
-func initFirebase() error {
-    ctx := context.Background()
-    sa := option.WithCredentialsFile(os.Getenv("FIREBASE_CREDENTIALS_FILE"))
-    app, err := firebase.NewApp(ctx, nil, sa)
-    if err != nil {
-        return err
-    }
-    firebaseApp = app
-
-    client, err := app.Auth(ctx)
-    if err != nil {
-        return err
+// nullable returns nil for "" so optional columns still encode as null.
+func nullable(s string) *string {
+    if s == "" {
+        return nil
     }
-    firebaseAuthClient = client
-    return nil
+    return &s
 }
 
-func verifyFirebaseToken(idToken string) (*auth.Token, error) {
-    ctx := context.Background()
-    token, err := firebaseAuthClient.VerifyIDToken(ctx, idToken)
+func (s *server) productsHandler(w http.ResponseWriter, r *http.Request) {
+    list, err := s.store.Products().List(r.Context(), false)
     if err != nil {
-        return nil, err
-    }
-    return token, nil
-}
-
-func userRegisterHandler(w http.ResponseWriter, r *http.Request) {
-    type request struct {
-        FirebaseToken string `json:"firebase_token"`
-        Name          string `json:"name"`
-        Email         string `json:"email"`
-    }
-    var req request
-    err := json.NewDecoder(r.Body).Decode(&req)
-    if err != nil {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
-        return
-    }
-
-    token, err := verifyFirebaseToken(req.FirebaseToken)
-    if err != nil {
-        http.Error(w, "Invalid Firebase token", http.StatusUnauthorized)
-        return
-    }
-
-    phone := token.Claims["phone_number"].(string)
-
-    // Check if user exists
-    var userID int
-    err = db.QueryRow("SELECT id FROM users WHERE phone=$1", phone).Scan(&userID)
-    if err != nil && err != sql.ErrNoRows {
-        http.Error(w, "Database error", http.StatusInternalServerError)
+        writeError(w, http.StatusInternalServerError, "Failed to fetch products")
         return
     }
 
-    if err == sql.ErrNoRows {
-        // Insert new user
-        err = db.QueryRow(
-            "INSERT INTO users (phone, name, email) VALUES ($1, $2, $3) RETURNING id",
-            phone, req.Name, req.Email).Scan(&userID)
-        if err != nil {
-            http.Error(w, "Failed to create user", http.StatusInternalServerError)
-            return
-        }
+    products := []productResponse{}
+    for _, p := range list {
+        products = append(products, newProductResponse(p))
     }
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "user_id": userID,
-        "phone":   phone,
-        "name":    req.Name,
-        "email":   req.Email,
+    writeJSON(w, http.StatusOK, map[string]interface{}{
+        "products": products,
+        "total":    len(products),
     })
 }
 
-func userProfileHandler(w http.ResponseWriter, r *http.Request) {
-    // Expect Authorization: Bearer <FirebaseToken>
-    authHeader := r.Header.Get("Authorization")
-    if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
-        http.Error(w, "Missing or invalid Authorization header", http.StatusUnauthorized)
+// legacyRegisterHandler registers a user from an unverified phone number.
+func (s *server) legacyRegisterHandler(w http.ResponseWriter, r *http.Request) {
+    var req RegisterRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid request body")
         return
     }
-    idToken := strings.TrimPrefix(authHeader, "Bearer ")
 
-    token, err := verifyFirebaseToken(idToken)
-    if err != nil {
-        http.Error(w, "Invalid Firebase token", http.StatusUnauthorized)
+    // Validate required fields
+    if req.PhoneNumber == "" || req.Name == "" {
+        writeError(w, http.StatusBadRequest, "Phone number and name are required")
         return
     }
 
-    phone := token.Claims["phone_number"].(string)
-
-    var user struct {
-        ID          int     `json:"id"`
-        Phone       string  `json:"phone"`
-        Name        *string `json:"name"`
-        Email       *string `json:"email"`
-        ProfileImage *string `json:"profile_image_url"`
-        KYCStatus   string  `json:"kyc_status"`
-    }
-
-    err = db.QueryRow("SELECT id, phone, name, email, profile_image_url, kyc_status FROM users WHERE phone=$1", phone).
-        Scan(&user.ID, &user.Phone, &user.Name, &user.Email, &user.ProfileImage, &user.KYCStatus)
-    if err != nil {
-        http.Error(w, "User not found", http.StatusNotFound)
+    // Insert user into database, linked to their sponsor when a code was given
+    userID, _, err := registerUser(r.Context(), s.store, NewUser{
+        Phone:        req.PhoneNumber,
+        Name:         req.Name,
+        Email:        req.Email,
+        ReferralCode: req.ReferralCode,
+    })
+    if err == errPhoneTaken {
+        writeError(w, http.StatusConflict, "User already exists")
         return
     }
-
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(user)
-}
-
-func uploadKycDocumentHandler(w http.ResponseWriter, r *http.Request) {
-    // Expect Authorization: Bearer <FirebaseToken>
-    authHeader := r.Header.Get("Authorization")
-    if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
-        http.Error(w, "Missing or invalid Authorization header", http.StatusUnauthorized)
+    if err == errUnknownReferralCode {
+        writeError(w, http.StatusBadRequest, "Unknown referral code")
         return
     }
-    idToken := strings.TrimPrefix(authHeader, "Bearer ")
-
-    token, err := verifyFirebaseToken(idToken)
     if err != nil {
-        http.Error(w, "Invalid Firebase token", http.StatusUnauthorized)
+        writeError(w, http.StatusInternalServerError, "Failed to create user")
         return
     }
 
-    phone := token.Claims["phone_number"].(string)
-
-    var userID int
-    err = db.QueryRow("SELECT id FROM users WHERE phone=$1", phone).Scan(&userID)
+    // Fetch the created user
+    created, err := s.store.Users().Get(r.Context(), userID)
     if err != nil {
-        http.Error(w, "User not found", http.StatusNotFound)
-        return
-    }
-
-    type request struct {
-        DocumentURL string `json:"document_url"`
-    }
-    var req request
-    err = json.NewDecoder(r.Body).Decode(&req)
-    if err != nil || req.DocumentURL == "" {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        writeError(w, http.StatusInternalServerError, "Failed to fetch created user")
         return
     }
 
-    _, err = db.Exec("INSERT INTO kyc_documents (user_id, document_url, status) VALUES ($1, $2, 'pending')", userID, req.DocumentURL)
-    if err != nil {
-        http.Error(w, "Failed to upload KYC document", http.StatusInternalServerError)
-        return
-    }
+    user := struct {
+        ID           int       `json:"id"`
+        Phone        string    `json:"phone"`
+        Name         string    `json:"name"`
+        Email        string    `json:"email"`
+        ReferralCode string    `json:"referral_code"`
+        CreatedAt    time.Time `json:"created_at"`
+    }{created.ID, created.Phone, created.Name, created.Email, created.ReferralCode, created.CreatedAt}
 
-    w.WriteHeader(http.StatusCreated)
-    w.Write([]byte(`{"message":"KYC document uploaded successfully"}`))
+    writeJSON(w, http.StatusCreated, map[string]interface{}{
+        "message": "User registered successfully",
+        "user":    user,
+    })
 }
 
-func getKycDocumentsHandler(w http.ResponseWriter, r *http.Request) {
-    // Expect Authorization: Bearer <FirebaseToken>
-    authHeader := r.Header.Get("Authorization")
-    if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
-        http.Error(w, "Missing or invalid Authorization header", http.StatusUnauthorized)
-        return
+func (s *server) userRegisterHandler(w http.ResponseWriter, r *http.Request) {
+    type request struct {
+        FirebaseToken string `json:"firebase_token"`
+        Name          string `json:"name"`
+        Email         string `json:"email"`
+        ReferralCode  string `json:"referral_code"`
     }
-    idToken := strings.TrimPrefix(authHeader, "Bearer ")
-
-    token, err := verifyFirebaseToken(idToken)
+    var req request
+    err := json.NewDecoder(r.Body).Decode(&req)
     if err != nil {
-        http.Error(w, "Invalid Firebase token", http.StatusUnauthorized)
+        writeError(w, http.StatusBadRequest, "Invalid request body")
         return
     }
 
-    phone := token.Claims["phone_number"].(string)
-
-    var userID int
-    err = db.QueryRow("SELECT id FROM users WHERE phone=$1", phone).Scan(&userID)
+    token, err := s.verifyIDToken(r.Context(), req.FirebaseToken)
     if err != nil {
-        http.Error(w, "User not found", http.StatusNotFound)
+        writeError(w, http.StatusUnauthorized, "Invalid ID token")
         return
     }
 
-    rows, err := db.Query("SELECT id, document_url, status, uploaded_at FROM kyc_documents WHERE user_id=$1", userID)
+    phone, err := phoneFromToken(token)
     if err != nil {
-        http.Error(w, "Failed to fetch KYC documents", http.StatusInternalServerError)
+        writeError(w, http.StatusUnauthorized, "Token is not bound to a phone number")
         return
     }
-    defer rows.Close()
 
-    type KycDocument struct {
-        ID          int    `json:"id"`
-        DocumentURL string `json:"document_url"`
-        Status      string `json:"status"`
-        UploadedAt  string `json:"uploaded_at"`
-    }
-
-    var docs []KycDocument
-    for rows.Next() {
-        var doc KycDocument
-        err := rows.Scan(&doc.ID, &doc.DocumentURL, &doc.Status, &doc.UploadedAt)
+    // Check if user exists
+    user, err := userForToken(r.Context(), s.store, token)
+    if err != nil && err != errNotFound {
+        writeError(w, http.StatusInternalServerError, "Database error")
+        return
+    }
+    userID, referralCode := user.ID, user.ReferralCode
+
+    if err == errNotFound {
+        // Insert new user, linked to their sponsor when a code was given
+        userID, referralCode, err = registerUser(r.Context(), s.store, NewUser{
+            Phone:        phone,
+            FirebaseUID:  token.UID,
+            Name:         req.Name,
+            Email:        req.Email,
+            ReferralCode: req.ReferralCode,
+        })
+        if err == errUnknownReferralCode {
+            writeError(w, http.StatusBadRequest, "Unknown referral code")
+            return
+        }
+        if err == errPhoneTaken {
+            writeError(w, http.StatusConflict, "User already exists")
+            return
+        }
         if err != nil {
-            http.Error(w, "Error reading KYC documents", http.StatusInternalServerError)
+            writeError(w, http.StatusInternalServerError, "Failed to create user")
             return
         }
-        docs = append(docs, doc)
     }
 
     w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(docs)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "user_id":       userID,
+        "phone":         phone,
+        "name":          req.Name,
+        "email":         req.Email,
+        "referral_code": referralCode,
+    })
 }
 
-func createInvestmentHandler(w http.ResponseWriter, r *http.Request) {
-    // Expect Authorization: Bearer <FirebaseToken>
-    authHeader := r.Header.Get("Authorization")
-    if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
-        http.Error(w, "Missing or invalid Authorization header", http.StatusUnauthorized)
-        return
-    }
-    idToken := strings.TrimPrefix(authHeader, "Bearer ")
+func (s *server) userProfileHandler(w http.ResponseWriter, r *http.Request) {
+    userID := mustPrincipal(r).UserID
 
-    token, err := verifyFirebaseToken(idToken)
+    u, err := s.store.Users().Get(r.Context(), userID)
     if err != nil {
-        http.Error(w, "Invalid Firebase token", http.StatusUnauthorized)
+        writeError(w, http.StatusInternalServerError, "Failed to fetch profile")
         return
     }
 
-    phone := token.Claims["phone_number"].(string)
+    user := struct {
+        ID          int     `json:"id"`
+        Phone       string  `json:"phone"`
+        Name        *string `json:"name"`
+        Email       *string `json:"email"`
+        ProfileImage *string `json:"profile_image_url"`
+        KYCStatus   string  `json:"kyc_status"`
+        ReferralCode *string `json:"referral_code"`
+    }{u.ID, u.Phone, nullable(u.Name), nullable(u.Email), nullable(u.ProfileImageURL), u.KYCStatus, nullable(u.ReferralCode)}
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(user)
+}
 
-    var userID int
-    err = db.QueryRow("SELECT id FROM users WHERE phone=$1", phone).Scan(&userID)
-    if err != nil {
-        http.Error(w, "User not found", http.StatusNotFound)
-        return
-    }
+func (s *server) createInvestmentHandler(w http.ResponseWriter, r *http.Request) {
+    userID := mustPrincipal(r).UserID
 
     type request struct {
         ProjectID    int     `json:"project_id"`
-        Amount       float64 `json:"amount"`
+        Amount       Money   `json:"amount"`
         Reinvest     bool    `json:"reinvest"`
     }
     var req request
-    err = json.NewDecoder(r.Body).Decode(&req)
-    if err != nil || req.ProjectID == 0 || req.Amount <= 0 {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid request body")
         return
     }
-
-    // Get project details for lock_days and profit_percent
-    var lockDays int
-    var profitPercent float64
-    err = db.QueryRow("SELECT lock_days, profit_percent FROM projects WHERE id=$1", req.ProjectID).Scan(&lockDays, &profitPercent)
-    if err != nil {
-        http.Error(w, "Project not found", http.StatusBadRequest)
+    if req.ProjectID == 0 {
+        writeValidationErrors(w, ValidationErrors{{"project_id", "required", "project_id is required"}})
         return
     }
 
-    // Calculate lock_end_date
-    var lockEndDate string
-    err = db.QueryRow("SELECT NOW() + INTERVAL '$1 day'", lockDays).Scan(&lockEndDate)
-    if err != nil {
-        // fallback to NULL if error
-        lockEndDate = ""
-    }
+    // The investment row, the wallet debit that funds it and the commissions
+    // it pays commit together.
+    var invalid ValidationErrors
+    err := s.store.WithTx(r.Context(), func(tx Store) error {
+        project, err := tx.Projects().LockForInvestment(r.Context(), req.ProjectID)
+        if err == errNotFound {
+            invalid = ValidationErrors{{"project_id", "not_found", "project does not exist"}}
+            return invalid
+        }
+        if err != nil {
+            return err
+        }
+        if invalid = project.validateInvestment(req.Amount); len(invalid) > 0 {
+            return invalid
+        }
 
-    _, err = db.Exec("INSERT INTO investments (user_id, project_id, amount, lock_end_date, profit_percent, reinvest, invested_at) VALUES ($1, $2, $3, NOW() + INTERVAL '$4 day', $5, $6, NOW())",
-        userID, req.ProjectID, req.Amount, lockDays, profitPercent, req.Reinvest)
-    if err != nil {
-        http.Error(w, "Failed to create investment", http.StatusInternalServerError)
-        return
-    }
+        investmentID, err := tx.Investments().Create(r.Context(), project.newInvestment(userID, req.Amount, req.Reinvest, 0))
+        if err != nil {
+            return err
+        }
 
-    w.WriteHeader(http.StatusCreated)
-    w.Write([]byte(`{"message":"Investment created successfully"}`))
-}
+        _, err = postEntry(r.Context(), tx, JournalEntry{
+            Kind:          entryInvestment,
+            ReferenceType: "investment",
+            ReferenceID:   investmentID,
+            Postings: []Posting{
+                {UserID: userID, Amount: -req.Amount},
+                {Account: accountInvestmentsHeld, Amount: req.Amount},
+            },
+        })
+        if err != nil {
+            return err
+        }
 
-func listInvestmentsHandler(w http.ResponseWriter, r *http.Request) {
-    // Expect Authorization: Bearer <FirebaseToken>
-    authHeader := r.Header.Get("Authorization")
-    if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
-        http.Error(w, "Missing or invalid Authorization header", http.StatusUnauthorized)
+        _, err = applyCommissions(r.Context(), tx, CommissionSource{
+            Type:      sourceInvestment,
+            ID:        investmentID,
+            UserID:    userID,
+            Amount:    req.Amount,
+            ProjectID: req.ProjectID,
+        })
+        return err
+    })
+    if len(invalid) > 0 {
+        writeValidationErrors(w, invalid)
         return
     }
-    idToken := strings.TrimPrefix(authHeader, "Bearer ")
-
-    token, err := verifyFirebaseToken(idToken)
-    if err != nil {
-        http.Error(w, "Invalid Firebase token", http.StatusUnauthorized)
+    if err == errInsufficientFunds {
+        writeError(w, http.StatusUnprocessableEntity, "Insufficient wallet balance")
         return
     }
-
-    phone := token.Claims["phone_number"].(string)
-
-    var userID int
-    err = db.QueryRow("SELECT id FROM users WHERE phone=$1", phone).Scan(&userID)
     if err != nil {
-        http.Error(w, "User not found", http.StatusNotFound)
+        writeError(w, http.StatusInternalServerError, "Failed to create investment")
         return
     }
 
-    rows, err := db.Query(`
-        SELECT i.id, i.amount, i.invested_at, i.lock_end_date, i.profit_percent, i.reinvest, p.name
-        FROM investments i
-        JOIN projects p ON i.project_id = p.id
-        WHERE i.user_id = $1
-        ORDER BY i.invested_at DESC
-    `, userID)
+    writeJSON(w, http.StatusCreated, map[string]string{
+        "message": "Investment created successfully",
+    })
+}
+
+func (s *server) listInvestmentsHandler(w http.ResponseWriter, r *http.Request) {
+    userID := mustPrincipal(r).UserID
+
+    list, err := s.store.Investments().ListByUser(r.Context(), userID)
     if err != nil {
-        http.Error(w, "Failed to fetch investments", http.StatusInternalServerError)
+        writeError(w, http.StatusInternalServerError, "Failed to fetch investments")
         return
     }
-    defer rows.Close()
 
     type Investment struct {
-        ID           int     `json:"id"`
-        Amount       float64 `json:"amount"`
-        InvestedAt   string  `json:"invested_at"`
-        LockEndDate  string  `json:"lock_end_date"`
-        ProfitPercent float64 `json:"profit_percent"`
-        Reinvest     bool    `json:"reinvest"`
-        ProjectName  string  `json:"project_name"`
+        ID           int       `json:"id"`
+        Amount       Money     `json:"amount"`
+        InvestedAt   time.Time `json:"invested_at"`
+        LockEndDate  time.Time `json:"lock_end_date"`
+        ProfitPercent Percent  `json:"profit_percent"`
+        Reinvest     bool      `json:"reinvest"`
+        ProjectName  string    `json:"project_name"`
+        Status       string    `json:"status"`
     }
 
     var investments []Investment
-    for rows.Next() {
-        var inv Investment
-        err := rows.Scan(&inv.ID, &inv.Amount, &inv.InvestedAt, &inv.LockEndDate, &inv.ProfitPercent, &inv.Reinvest, &inv.ProjectName)
-        if err != nil {
-            http.Error(w, "Error reading investments", http.StatusInternalServerError)
-            return
-        }
-        investments = append(investments, inv)
+    for _, inv := range list {
+        investments = append(investments, Investment{
+            inv.ID, inv.Amount, inv.InvestedAt, inv.LockEndDate, inv.ProfitPercent, inv.Reinvest, inv.ProjectName, inv.Status,
+        })
     }
 
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(investments)
 }
 
-func createTransactionHandler(w http.ResponseWriter, r *http.Request) {
-    // Expect Authorization: Bearer <FirebaseToken>
-    authHeader := r.Header.Get("Authorization")
-    if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
-        http.Error(w, "Missing or invalid Authorization header", http.StatusUnauthorized)
-        return
+// recordTransaction records t, moves its stock and settles it through the
+// wallet, paying commissions on purchases. It returns the transaction's ID
+// and total, or errInsufficientStock, errNoDensity or errInsufficientFunds,
+// leaving the caller to roll back. Call it inside WithTx.
+func recordTransaction(ctx context.Context, tx Store, t Transaction) (int, Money, error) {
+    total := t.Price.MulQuantity(t.Quantity)
+    if total <= 0 {
+        return 0, 0, errNoPrice
     }
-    idToken := strings.TrimPrefix(authHeader, "Bearer ")
 
-    token, err := verifyFirebaseToken(idToken)
+    id, err := tx.Transactions().Create(ctx, t)
     if err != nil {
-        http.Error(w, "Invalid Firebase token", http.StatusUnauthorized)
-        return
-    }
-
-    phone := token.Claims["phone_number"].(string)
-
-    var userID int
-    err = db.QueryRow("SELECT id FROM users WHERE phone=$1", phone).Scan(&userID)
-    if err != nil {
-        http.Error(w, "User not found", http.StatusNotFound)
-        return
-    }
-
-    type request struct {
-        ProductID int     `json:"product_id"`
-        Type      string  `json:"type"` // buy or sell
-        Quantity  float64 `json:"quantity"`
-        Unit      string  `json:"unit"` // kg or litre
-        Price     float64 `json:"price"`
-    }
-    var req request
-    err = json.NewDecoder(r.Body).Decode(&req)
-    if err != nil || (req.Type != "buy" && req.Type != "sell") || req.Quantity <= 0 || req.Price <= 0 {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
-        return
+        return 0, 0, err
     }
 
-    // Verify product exists
-    var productExists bool
-    err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM products WHERE id = $1)", req.ProductID).Scan(&productExists)
-    if err != nil || !productExists {
-        http.Error(w, "Product not found", http.StatusBadRequest)
-        return
+    // Stock goes out when users buy and comes in when they sell to us.
+    traded := t.Quantity
+    if t.Type == sideBuy {
+        traded = -traded
     }
-
-    _, err = db.Exec(`
-        INSERT INTO transactions 
-        (user_id, product_id, type, quantity, unit, price, transaction_date) 
-        VALUES ($1, $2, $3, $4, $5, $6, NOW())`,
-        userID, req.ProductID, req.Type, req.Quantity, req.Unit, req.Price)
+    _, err = tx.Inventory().Move(ctx, StockMovement{
+        ProductID:      t.ProductID,
+        Kind:           stockTransaction,
+        TransactionID:  id,
+        TradedQuantity: traded,
+        TradedUnit:     t.Unit,
+    })
     if err != nil {
-        http.Error(w, "Failed to create transaction", http.StatusInternalServerError)
-        return
+        return 0, 0, err
+    }
+
+    // Produce sold to us is paid into the wallet.
+    if t.Type == sideSell {
+        _, err = postEntry(ctx, tx, JournalEntry{
+            Kind:          entrySale,
+            ReferenceType: "transaction",
+            ReferenceID:   id,
+            Postings: []Posting{
+                {UserID: t.UserID, Amount: total},
+                {Account: accountPurchases, Amount: -total},
+            },
+        })
+        return id, total, err
+    }
+
+    // Purchases are paid from the wallet.
+    _, err = postEntry(ctx, tx, JournalEntry{
+        Kind:          entryPurchase,
+        ReferenceType: "transaction",
+        ReferenceID:   id,
+        Postings: []Posting{
+            {UserID: t.UserID, Amount: -total},
+            {Account: accountSales, Amount: total},
+        },
+    })
+    if err != nil {
+        return 0, 0, err
     }
 
-    w.WriteHeader(http.StatusCreated)
-    w.Write([]byte(`{"message":"Transaction created successfully"}`))
+    _, err = applyCommissions(ctx, tx, CommissionSource{
+        Type:      sourceTransaction,
+        ID:        id,
+        UserID:    t.UserID,
+        Amount:    total,
+        ProductID: t.ProductID,
+    })
+    return id, total, err
 }
 
-func listTransactionsHandler(w http.ResponseWriter, r *http.Request) {
-    // Expect Authorization: Bearer <FirebaseToken>
-    authHeader := r.Header.Get("Authorization")
-    if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
-        http.Error(w, "Missing or invalid Authorization header", http.StatusUnauthorized)
-        return
-    }
-    idToken := strings.TrimPrefix(authHeader, "Bearer ")
+func (s *server) createTransactionHandler(w http.ResponseWriter, r *http.Request) {
+    userID := mustPrincipal(r).UserID
 
-    token, err := verifyFirebaseToken(idToken)
-    if err != nil {
-        http.Error(w, "Invalid Firebase token", http.StatusUnauthorized)
-        return
+    // The price is looked up in the product's price book. A client may send
+    // the price it showed the user, and the transaction is refused if the
+    // book no longer agrees.
+    type request struct {
+        ProductID int      `json:"product_id"`
+        Type      string   `json:"type"` // buy or sell
+        Quantity  Quantity `json:"quantity"`
+        Unit      string   `json:"unit"` // kg or litre
+        Price     *Money   `json:"price"`
     }
-
-    phone := token.Claims["phone_number"].(string)
-
-    var userID int
-    err = db.QueryRow("SELECT id FROM users WHERE phone=$1", phone).Scan(&userID)
-    if err != nil {
-        http.Error(w, "User not found", http.StatusNotFound)
+    var req request
+    err := json.NewDecoder(r.Body).Decode(&req)
+    if err != nil || !contains(sides, req.Type) || req.Quantity <= 0 {
+        writeError(w, http.StatusBadRequest, "Invalid request body")
         return
     }
 
-    rows, err := db.Query(`
-        SELECT t.id, t.type, t.quantity, t.unit, t.price, t.transaction_date, p.name, p.type as product_type
-        FROM transactions t
-        JOIN products p ON t.product_id = p.id
-        WHERE t.user_id = $1
-        ORDER BY t.transaction_date DESC
-    `, userID)
-    if err != nil {
-        http.Error(w, "Failed to fetch transactions", http.StatusInternalServerError)
+    // Verify product exists and is on sale
+    product, err := s.store.Products().Get(r.Context(), req.ProductID)
+    if err != nil || product.ArchivedAt != nil {
+        writeError(w, http.StatusBadRequest, "Product not found")
         return
     }
-    defer rows.Close()
 
-    type Transaction struct {
-        ID              int     `json:"id"`
-        Type            string  `json:"type"`
-        Quantity        float64 `json:"quantity"`
-        Unit            string  `json:"unit"`
-        Price           float64 `json:"price"`
-        TransactionDate string  `json:"transaction_date"`
-        ProductName     string  `json:"product_name"`
-        ProductType     string  `json:"product_type"`
-        TotalAmount     float64 `json:"total_amount"`
-    }
-
-    var transactions []Transaction
-    for rows.Next() {
-        var tr Transaction
-        err := rows.Scan(&tr.ID, &tr.Type, &tr.Quantity, &tr.Unit, &tr.Price, &tr.TransactionDate, &tr.ProductName, &tr.ProductType)
+    var version PriceVersion
+    var transactionID int
+    var total Money
+    err = s.store.WithTx(r.Context(), func(tx Store) error {
+        user, err := tx.Users().Get(r.Context(), userID)
         if err != nil {
-            http.Error(w, "Error reading transactions", http.StatusInternalServerError)
-            return
+            return err
+        }
+        // Resolved in the same transaction that stamps transaction_date, so
+        // the version is the one in effect at the transaction time.
+        version, err = tx.PriceBook().Resolve(r.Context(), req.ProductID, req.Unit, req.Type, user.PriceScope())
+        if err == errNotFound {
+            return errNoPrice
+        }
+        if err != nil {
+            return err
+        }
+        if req.Price != nil && *req.Price != version.Price {
+            return errPriceChanged
         }
-        tr.TotalAmount = tr.Quantity * tr.Price
-        transactions = append(transactions, tr)
-    }
-
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(transactions)
-}
-
-func createReferralHandler(w http.ResponseWriter, r *http.Request) {
-    // Expect Authorization: Bearer <FirebaseToken>
-    authHeader := r.Header.Get("Authorization")
-    if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
-        http.Error(w, "Missing or invalid Authorization header", http.StatusUnauthorized)
-        return
-    }
-    idToken := strings.TrimPrefix(authHeader, "Bearer ")
-
-    token, err := verifyFirebaseToken(idToken)
-    if err != nil {
-        http.Error(w, "Invalid Firebase token", http.StatusUnauthorized)
-        return
-    }
-
-    phone := token.Claims["phone_number"].(string)
 
-    var userID int
-    err = db.QueryRow("SELECT id FROM users WHERE phone=$1", phone).Scan(&userID)
-    if err != nil {
-        http.Error(w, "User not found", http.StatusNotFound)
+        transactionID, total, err = recordTransaction(r.Context(), tx, Transaction{
+            UserID:         userID,
+            ProductID:      req.ProductID,
+            Type:           req.Type,
+            Quantity:       req.Quantity,
+            Unit:           req.Unit,
+            Price:          version.Price,
+            PriceVersionID: version.ID,
+        })
+        return err
+    })
+    switch {
+    case err == errNoPrice:
+        writeValidationErrors(w, ValidationErrors{{"unit", "unit_not_offered",
+            fmt.Sprintf("product has no %s price in unit %q", req.Type, req.Unit)}})
         return
-    }
-
-    type request struct {
-        ReferredPhone string  `json:"referred_phone"`
-        Level        int     `json:"level"`
-        Commission   float64 `json:"commission"`
-    }
-    var req request
-    err = json.NewDecoder(r.Body).Decode(&req)
-    if err != nil || req.Level < 1 || req.Level > 3 || req.Commission < 0 {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
+    case err == errPriceChanged:
+        writeJSON(w, http.StatusConflict, map[string]interface{}{
+            "error": "Price has changed",
+            "price": version.Price,
+        })
         return
-    }
-
-    // Get referred user ID
-    var referredUserID int
-    err = db.QueryRow("SELECT id FROM users WHERE phone=$1", req.ReferredPhone).Scan(&referredUserID)
-    if err != nil {
-        http.Error(w, "Referred user not found", http.StatusNotFound)
+    case err == errInsufficientStock:
+        writeValidationErrors(w, ValidationErrors{{"quantity", "insufficient_stock",
+            "not enough stock to fill this order"}})
         return
-    }
-
-    // Check if referral already exists
-    var exists bool
-    err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM referrals WHERE user_id=$1 AND referred_user_id=$2)", 
-        userID, referredUserID).Scan(&exists)
-    if err != nil {
-        http.Error(w, "Database error", http.StatusInternalServerError)
+    case err == errNoDensity:
+        writeValidationErrors(w, ValidationErrors{{"unit", "unit_not_offered",
+            fmt.Sprintf("product cannot be traded in unit %q", req.Unit)}})
         return
-    }
-    if exists {
-        http.Error(w, "Referral already exists", http.StatusConflict)
+    case err == errInsufficientFunds:
+        writeError(w, http.StatusUnprocessableEntity, "Insufficient wallet balance")
         return
-    }
-
-    _, err = db.Exec(`
-        INSERT INTO referrals (user_id, referred_user_id, level, commission, created_at)
-        VALUES ($1, $2, $3, $4, NOW())`,
-        userID, referredUserID, req.Level, req.Commission)
-    if err != nil {
-        http.Error(w, "Failed to create referral", http.StatusInternalServerError)
+    case err != nil:
+        writeError(w, http.StatusInternalServerError, "Failed to create transaction")
         return
     }
 
-    w.WriteHeader(http.StatusCreated)
-    w.Write([]byte(`{"message":"Referral created successfully"}`))
+    writeJSON(w, http.StatusCreated, map[string]interface{}{
+        "id":               transactionID,
+        "price":            version.Price,
+        "price_version_id": version.ID,
+        "total_amount":     total,
+        "message":          "Transaction created successfully",
+    })
 }
 
-func listReferralsHandler(w http.ResponseWriter, r *http.Request) {
-    // Expect Authorization: Bearer <FirebaseToken>
-    authHeader := r.Header.Get("Authorization")
-    if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
-        http.Error(w, "Missing or invalid Authorization header", http.StatusUnauthorized)
-        return
-    }
-    idToken := strings.TrimPrefix(authHeader, "Bearer ")
+func (s *server) listTransactionsHandler(w http.ResponseWriter, r *http.Request) {
+    userID := mustPrincipal(r).UserID
 
-    token, err := verifyFirebaseToken(idToken)
+    list, err := s.store.Transactions().ListByUser(r.Context(), userID)
     if err != nil {
-        http.Error(w, "Invalid Firebase token", http.StatusUnauthorized)
+        writeError(w, http.StatusInternalServerError, "Failed to fetch transactions")
         return
     }
 
-    phone := token.Claims["phone_number"].(string)
-
-    var userID int
-    err = db.QueryRow("SELECT id FROM users WHERE phone=$1", phone).Scan(&userID)
-    if err != nil {
-        http.Error(w, "User not found", http.StatusNotFound)
-        return
+    type Transaction struct {
+        ID              int       `json:"id"`
+        Type            string    `json:"type"`
+        Quantity        Quantity  `json:"quantity"`
+        Unit            string    `json:"unit"`
+        Price           Money     `json:"price"`
+        PriceVersionID  int       `json:"price_version_id,omitempty"`
+        OrderID         int       `json:"order_id,omitempty"`
+        TransactionDate time.Time `json:"transaction_date"`
+        ProductName     string    `json:"product_name"`
+        ProductType     string    `json:"product_type"`
+        TotalAmount     Money     `json:"total_amount"`
     }
 
-    rows, err := db.Query(`
-        WITH RECURSIVE referral_tree AS (
-            -- Base case: direct referrals (level 1)
-            SELECT r.id, r.user_id, r.referred_user_id, r.level, r.commission, r.created_at,
-                   u.phone, u.name, 1 as depth
-            FROM referrals r
-            JOIN users u ON r.referred_user_id = u.id
-            WHERE r.user_id = $1
-
-            UNION ALL
-
-            -- Recursive case: next level referrals
-            SELECT r.id, r.user_id, r.referred_user_id, r.level, r.commission, r.created_at,
-                   u.phone, u.name, rt.depth + 1
-            FROM referrals r
-            JOIN users u ON r.referred_user_id = u.id
-            JOIN referral_tree rt ON r.user_id = rt.referred_user_id
-            WHERE rt.depth < 3  -- Limit to 3 levels
-        )
-        SELECT * FROM referral_tree
-        ORDER BY depth, created_at;
-    `, userID)
-    if err != nil {
-        http.Error(w, "Failed to fetch referrals", http.StatusInternalServerError)
-        return
+    var transactions []Transaction
+    for _, t := range list {
+        transactions = append(transactions, Transaction{
+            t.ID, t.Type, t.Quantity, t.Unit, t.Price, t.PriceVersionID, t.OrderID, t.Date, t.ProductName, t.ProductType, t.Price.MulQuantity(t.Quantity),
+        })
     }
-    defer rows.Close()
 
-    type Referral struct {
-        ID              int     `json:"id"`
-        ReferredPhone   string  `json:"referred_phone"`
-        ReferredName    string  `json:"referred_name"`
-        Level           int     `json:"level"`
-        Commission      float64 `json:"commission"`
-        CreatedAt       string  `json:"created_at"`
-        Depth           int     `json:"depth"`
-    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(transactions)
+}
 
-    var referrals []Referral
-    for rows.Next() {
-        var r Referral
-        var userID, referredUserID int
-        err := rows.Scan(&r.ID, &userID, &referredUserID, &r.Level, &r.Commission, &r.CreatedAt,
-            &r.ReferredPhone, &r.ReferredName, &r.Depth)
-        if err != nil {
-            http.Error(w, "Error reading referrals", http.StatusInternalServerError)
-            return
-        }
-        referrals = append(referrals, r)
+func (s *server) listReferralsHandler(w http.ResponseWriter, r *http.Request) {
+    userID := mustPrincipal(r).UserID
+
+    referrals, err := s.store.Referrals().Downline(r.Context(), userID)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch referrals")
+        return
     }
 
     w.Header().Set("Content-Type", "application/json")
@@ -628,8 +504,8 @@ func listReferralsHandler(w http.ResponseWriter, r *http.Request) {
     })
 }
 
-func calculateTotalCommission(referrals []Referral) float64 {
-    var total float64
+func calculateTotalCommission(referrals []Referral) Money {
+    var total Money
     for _, r := range referrals {
         total += r.Commission
     }
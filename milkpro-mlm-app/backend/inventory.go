@@ -0,0 +1,265 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Stock movement kinds. Transactions move stock automatically; adjustments
+// are made by staff and always carry a reason.
+const (
+    stockTransaction = "transaction"
+    stockAdjustment  = "adjustment"
+)
+
+// maxStockMovements caps how much of the stock ledger one request returns.
+const maxStockMovements = 200
+
+var (
+    errInsufficientStock = errors.New("insufficient stock")
+    errNoDensity         = errors.New("product has no density to convert between kg and litres")
+)
+
+// defaultStockUnit is the unit stock is kept in when an admin does not say:
+// milk by the litre and everything else by the kg.
+func defaultStockUnit(productType string) string {
+    if productType == "milk" {
+        return unitLitre
+    }
+    return unitKg
+}
+
+// convertQuantity converts q from one unit to another at density d, rounding
+// half away from zero but never to zero.
+func convertQuantity(q Quantity, from, to string, d Density) (Quantity, error) {
+    switch {
+    case from == to:
+        return q, nil
+    case d <= 0:
+        return 0, errNoDensity
+    }
+
+    var converted int64
+    switch {
+    case from == unitLitre && to == unitKg:
+        converted = divRound(int64(q)*int64(d), 100)
+    case from == unitKg && to == unitLitre:
+        converted = divRound(int64(q)*100, int64(d))
+    default:
+        return 0, fmt.Errorf("cannot convert %s to %s", from, to)
+    }
+    if converted == 0 && q > 0 {
+        converted = 1
+    } else if converted == 0 && q < 0 {
+        converted = -1
+    }
+    return Quantity(converted), nil
+}
+
+// applyStock returns the stock movement m makes to a product holding stock
+// of unit at density d.
+func applyStock(m StockMovement, stock Quantity, unit string, d Density) (StockMovement, error) {
+    q, err := convertQuantity(m.TradedQuantity, m.TradedUnit, unit, d)
+    if err != nil {
+        return m, err
+    }
+    m.Quantity = q
+    m.Unit = unit
+    m.Balance = stock + q
+    if m.Balance < 0 {
+        return m, errInsufficientStock
+    }
+    return m, nil
+}
+
+// checkDensity rejects a product that is priced in a unit other than its
+// stock unit without a density to convert trades with.
+func checkDensity(p Product, priceUnits []string) ValidationErrors {
+    if p.Density > 0 {
+        return nil
+    }
+    for _, unit := range priceUnits {
+        if unit != p.StockUnit {
+            return ValidationErrors{{"density", "required",
+                fmt.Sprintf("density is required to trade in %s while stock is kept in %s", unit, p.StockUnit)}}
+        }
+    }
+    return nil
+}
+
+// stockMovementResponse is how stock ledger entries are returned by the API.
+type stockMovementResponse struct {
+    ID             int       `json:"id"`
+    Kind           string    `json:"kind"`
+    TransactionID  int       `json:"transaction_id,omitempty"`
+    TradedQuantity Quantity  `json:"traded_quantity"`
+    TradedUnit     string    `json:"traded_unit"`
+    Quantity       Quantity  `json:"quantity"`
+    Unit           string    `json:"unit"`
+    Balance        Quantity  `json:"balance"`
+    Reason         string    `json:"reason,omitempty"`
+    StaffID        int       `json:"staff_id,omitempty"`
+    AdminUserID    int       `json:"admin_user_id,omitempty"`
+    CreatedAt      time.Time `json:"created_at"`
+}
+
+func newStockMovementResponse(m StockMovement) stockMovementResponse {
+    return stockMovementResponse{m.ID, m.Kind, m.TransactionID, m.TradedQuantity, m.TradedUnit,
+        m.Quantity, m.Unit, m.Balance, m.Reason, m.StaffID, m.AdminUserID, m.CreatedAt}
+}
+
+// stockLevel is a product's stock as shown to admins.
+type stockLevel struct {
+    ProductID         int       `json:"product_id"`
+    Name              string    `json:"name"`
+    Stock             Quantity  `json:"stock"`
+    Unit              string    `json:"unit"`
+    LowStockThreshold *Quantity `json:"low_stock_threshold"`
+}
+
+func newStockLevel(p Product) stockLevel {
+    return stockLevel{p.ID, p.Name, p.Stock, p.StockUnit, p.LowStockThreshold}
+}
+
+// stockHandler returns a product's stock and its latest movements, up to
+// ?limit= (default 50).
+func (s *server) stockHandler(w http.ResponseWriter, r *http.Request) {
+    productID, ok := productIDFromPath(w, r)
+    if !ok {
+        return
+    }
+    limit := 50
+    if v := r.URL.Query().Get("limit"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n <= 0 || n > maxStockMovements {
+            writeError(w, http.StatusBadRequest, "Invalid limit")
+            return
+        }
+        limit = n
+    }
+
+    p, err := s.store.Products().Get(r.Context(), productID)
+    if err == errNotFound {
+        writeError(w, http.StatusNotFound, "Product not found")
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch stock")
+        return
+    }
+    list, err := s.store.Inventory().Movements(r.Context(), productID, limit)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch stock")
+        return
+    }
+
+    movements := []stockMovementResponse{}
+    for _, m := range list {
+        movements = append(movements, newStockMovementResponse(m))
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "stock":     newStockLevel(p),
+        "movements": movements,
+    })
+}
+
+// adjustStockHandler records a stock count, delivery, spoilage and so on. The
+// quantity is signed and defaults to the product's stock unit.
+func (s *server) adjustStockHandler(w http.ResponseWriter, r *http.Request) {
+    productID, ok := productIDFromPath(w, r)
+    if !ok {
+        return
+    }
+
+    var req struct {
+        Quantity Quantity `json:"quantity"`
+        Unit     string   `json:"unit"`
+        Reason   string   `json:"reason"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid request body")
+        return
+    }
+    req.Reason = strings.TrimSpace(req.Reason)
+    var errs ValidationErrors
+    if req.Quantity == 0 {
+        errs = append(errs, FieldError{"quantity", "required", "quantity must not be zero"})
+    }
+    if req.Unit != "" && !contains(units, req.Unit) {
+        errs = append(errs, FieldError{"unit", "invalid_unit",
+            fmt.Sprintf("unit must be one of %s", strings.Join(units, ", "))})
+    }
+    if req.Reason == "" {
+        errs = append(errs, FieldError{"reason", "required", "reason is required"})
+    }
+    if len(errs) > 0 {
+        writeValidationErrors(w, errs)
+        return
+    }
+
+    staff := staffFromContext(r.Context())
+    var movement StockMovement
+    err := s.store.WithTx(r.Context(), func(tx Store) error {
+        p, err := tx.Products().Get(r.Context(), productID)
+        if err != nil {
+            return err
+        }
+        unit := req.Unit
+        if unit == "" {
+            unit = p.StockUnit
+        }
+        movement, err = tx.Inventory().Move(r.Context(), StockMovement{
+            ProductID:      productID,
+            Kind:           stockAdjustment,
+            TradedQuantity: req.Quantity,
+            TradedUnit:     unit,
+            Reason:         req.Reason,
+            StaffID:        staff.StaffID,
+            AdminUserID:    staff.UserID,
+        })
+        return err
+    })
+    switch {
+    case err == errNotFound:
+        writeError(w, http.StatusNotFound, "Product not found")
+        return
+    case err == errInsufficientStock:
+        writeValidationErrors(w, ValidationErrors{{"quantity", "insufficient_stock",
+            "adjustment would take stock below zero"}})
+        return
+    case err == errNoDensity:
+        writeValidationErrors(w, ValidationErrors{{"unit", "no_density",
+            "product has no density to convert this unit into its stock unit"}})
+        return
+    case err != nil:
+        writeError(w, http.StatusInternalServerError, "Failed to adjust stock")
+        return
+    }
+
+    writeJSON(w, http.StatusCreated, newStockMovementResponse(movement))
+}
+
+// lowStockHandler lists the products on sale at or below their low stock
+// threshold, for the dashboard.
+func (s *server) lowStockHandler(w http.ResponseWriter, r *http.Request) {
+    list, err := s.store.Inventory().LowStock(r.Context())
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch stock")
+        return
+    }
+
+    levels := []stockLevel{}
+    for _, p := range list {
+        levels = append(levels, newStockLevel(p))
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(levels)
+}
@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestConvertQuantity(t *testing.T) {
+    tests := []struct {
+        name     string
+        q        Quantity
+        from, to string
+        d        Density
+        want     Quantity
+        wantErr  error
+    }{
+        {"same unit", 1000, unitKg, unitKg, 0, 1000, nil},
+        {"litres to kg", 1000, unitLitre, unitKg, 103, 1030, nil},
+        {"kg to litres", 103, unitKg, unitLitre, 103, 100, nil},
+        {"litres to kg rounds down", 15, unitLitre, unitKg, 103, 15, nil},
+        {"litres to kg rounds half up", 50, unitLitre, unitKg, 103, 52, nil},
+        {"litres to kg rounds half away from zero", -50, unitLitre, unitKg, 103, -52, nil},
+        {"kg to litres rounds down", 100, unitKg, unitLitre, 103, 97, nil},
+        {"kg to litres rounds half up", 1, unitKg, unitLitre, 40, 3, nil},
+        {"kg to litres rounds half away from zero", -1, unitKg, unitLitre, 40, -3, nil},
+        {"never rounds to zero", 1, unitLitre, unitKg, 40, 1, nil},
+        {"never rounds a sale to zero", -1, unitLitre, unitKg, 40, -1, nil},
+        {"zero stays zero", 0, unitLitre, unitKg, 103, 0, nil},
+        {"no density to kg", 1000, unitLitre, unitKg, 0, 0, errNoDensity},
+        {"no density to litres", 1000, unitKg, unitLitre, 0, 0, errNoDensity},
+        {"negative density", 1000, unitKg, unitLitre, -103, 0, errNoDensity},
+    }
+    for _, tt := range tests {
+        got, err := convertQuantity(tt.q, tt.from, tt.to, tt.d)
+        if err != tt.wantErr || got != tt.want {
+            t.Errorf("%s: got %v, %v; want %v, %v", tt.name, got, err, tt.want, tt.wantErr)
+        }
+    }
+
+    if _, err := convertQuantity(1000, unitKg, "gallon", 103); err == nil {
+        t.Error("converted to an unknown unit")
+    }
+}
+
+func TestApplyStock(t *testing.T) {
+    tests := []struct {
+        name        string
+        stock       Quantity
+        traded      Quantity
+        tradedUnit  string
+        wantQ       Quantity
+        wantBalance Quantity
+        wantErr     error
+    }{
+        {"purchase from a user", 1000, 1000, unitLitre, 1030, 2030, nil},
+        {"sale in the stock unit", 1000, -400, unitKg, -400, 600, nil},
+        {"sale of all the stock", 1030, -1000, unitLitre, -1030, 0, nil},
+        {"sale below zero", 1000, -1000, unitLitre, -1030, -30, errInsufficientStock},
+        {"sale with no stock", 0, -1, unitKg, -1, -1, errInsufficientStock},
+    }
+    for _, tt := range tests {
+        m, err := applyStock(StockMovement{TradedQuantity: tt.traded, TradedUnit: tt.tradedUnit}, tt.stock, unitKg, 103)
+        if err != tt.wantErr || m.Quantity != tt.wantQ || m.Balance != tt.wantBalance || m.Unit != unitKg {
+            t.Errorf("%s: got %v %s to %v, %v; want %v %s to %v, %v", tt.name, m.Quantity, m.Unit, m.Balance, err,
+                tt.wantQ, unitKg, tt.wantBalance, tt.wantErr)
+        }
+    }
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// KYC document statuses. Reviewers decide on pending documents only; a
+// rejected document is answered by uploading a new one of the same type.
+const (
+    kycPending  = "pending"
+    kycApproved = "approved"
+    kycRejected = "rejected"
+)
+
+// kycIncomplete is the user status while a required document has never been
+// uploaded. The other user statuses share the document status names.
+const kycIncomplete = "incomplete"
+
+// KYC document types. A user is verified once the latest document of every
+// type has been approved.
+const (
+    kycIDFront      = "id_front"
+    kycIDBack       = "id_back"
+    kycAddressProof = "address_proof"
+    kycSelfie       = "selfie"
+)
+
+var kycDocumentTypes = []string{kycIDFront, kycIDBack, kycAddressProof, kycSelfie}
+
+// maxKYCQueue caps how many pending documents the review queue returns.
+const maxKYCQueue = 100
+
+// kycLatest returns the newest document of each type. Documents without a
+// type, uploaded before types existed, are left out.
+func kycLatest(docs []KYCDocument) map[string]KYCDocument {
+    latest := make(map[string]KYCDocument)
+    for _, d := range docs {
+        if d.Type != "" && d.ID > latest[d.Type].ID {
+            latest[d.Type] = d
+        }
+    }
+    return latest
+}
+
+// kycStatusOf derives a user's KYC status from their documents: rejected if
+// any required document must be uploaded again, incomplete if one was never
+// uploaded, pending while any awaits review, and approved otherwise.
+func kycStatusOf(docs []KYCDocument) string {
+    latest := kycLatest(docs)
+    status := kycApproved
+    for _, t := range kycDocumentTypes {
+        d, ok := latest[t]
+        switch {
+        case ok && d.Status == kycRejected:
+            return kycRejected
+        case !ok:
+            status = kycIncomplete
+        case d.Status == kycPending && status == kycApproved:
+            status = kycPending
+        }
+    }
+    return status
+}
+
+// kycMissing lists the document types the user still has to upload.
+func kycMissing(docs []KYCDocument) []string {
+    latest := kycLatest(docs)
+    missing := []string{}
+    for _, t := range kycDocumentTypes {
+        if d, ok := latest[t]; !ok || d.Status == kycRejected {
+            missing = append(missing, t)
+        }
+    }
+    return missing
+}
+
+// checkKYCUpload says whether a document of docType may be uploaded next to
+// docs, returning the rejected document it replaces, if any.
+func checkKYCUpload(docs []KYCDocument, docType string) (int, ValidationErrors) {
+    latest, ok := kycLatest(docs)[docType]
+    switch {
+    case !ok:
+        return 0, nil
+    case latest.Status == kycPending:
+        return 0, kycUnderReview(docType)
+    case latest.Status == kycApproved:
+        return 0, ValidationErrors{{"document_type", "already_approved",
+            fmt.Sprintf("the %s document has already been approved", docType)}}
+    }
+    return latest.ID, nil
+}
+
+func kycUnderReview(docType string) ValidationErrors {
+    return ValidationErrors{{"document_type", "under_review",
+        fmt.Sprintf("the %s document is already awaiting review", docType)}}
+}
+
+// refreshKYCStatus stores the status derived from docs, which must be the
+// user's documents as of the end of tx.
+func refreshKYCStatus(ctx context.Context, tx Store, userID int, docs []KYCDocument) (string, error) {
+    status := kycStatusOf(docs)
+    return status, tx.Users().SetKYCStatus(ctx, userID, status)
+}
+
+// validateKYCReview checks a reviewer's decision; a rejection must say why
+// so the user knows what to upload instead.
+func validateKYCReview(status, reason string) ValidationErrors {
+    var errs ValidationErrors
+    if status != kycApproved && status != kycRejected {
+        errs = append(errs, FieldError{"status", "invalid", "status must be approved or rejected"})
+    }
+    if status == kycRejected && strings.TrimSpace(reason) == "" {
+        errs = append(errs, FieldError{"reason", "required", "reason is required when rejecting"})
+    }
+    return errs
+}
+
+// reviewKYCDocuments records rv's decision on each of ids, which must be
+// pending documents of rv.UserID, and returns the user's new status. If any
+// has been reviewed already, none is.
+func reviewKYCDocuments(ctx context.Context, tx Store, rv KYCReview, ids []int) (string, ValidationErrors, error) {
+    docs, err := tx.KYC().Lock(ctx, rv.UserID)
+    if err != nil {
+        return "", nil, err
+    }
+    for _, id := range ids {
+        for _, d := range docs {
+            if d.ID == id && d.Status != kycPending {
+                return "", ValidationErrors{{"status", "already_reviewed",
+                    fmt.Sprintf("document %d has already been %s", d.ID, d.Status)}}, nil
+            }
+        }
+    }
+    for _, id := range ids {
+        for i, d := range docs {
+            if d.ID != id {
+                continue
+            }
+            rv.DocumentID = id
+            if err := tx.KYC().Review(ctx, rv); err != nil {
+                return "", nil, err
+            }
+            docs[i].Status, docs[i].Reason = rv.Status, rv.Reason
+        }
+    }
+    status, err := refreshKYCStatus(ctx, tx, rv.UserID, docs)
+    return status, nil, err
+}
+
+// kycDocumentResponse is how documents are returned by the API.
+// document_type is omitted for documents uploaded before types existed.
+// download_url is signed and expires after signedURLTTL.
+type kycDocumentResponse struct {
+    ID           int        `json:"id"`
+    UserID       int        `json:"user_id"`
+    DocumentType string     `json:"document_type,omitempty"`
+    DownloadURL  string     `json:"download_url,omitempty"`
+    ContentType  string     `json:"content_type,omitempty"`
+    SizeBytes    int64      `json:"size_bytes,omitempty"`
+    Status       string     `json:"status"`
+    Reason       string     `json:"reason,omitempty"`
+    ReplacesID   int        `json:"replaces_id,omitempty"`
+    ReviewedAt   *time.Time `json:"reviewed_at,omitempty"`
+    UploadedAt   time.Time  `json:"uploaded_at"`
+}
+
+func (s *server) newKYCDocumentResponse(d KYCDocument) kycDocumentResponse {
+    resp := kycDocumentResponse{d.ID, d.UserID, d.Type, s.downloadURL(d.StorageKey), d.ContentType, d.Size,
+        d.Status, d.Reason, d.ReplacesID, nil, d.UploadedAt}
+    if !d.ReviewedAt.IsZero() {
+        resp.ReviewedAt = &d.ReviewedAt
+    }
+    return resp
+}
+
+// kycReviewResponse is one entry of the review audit trail. actor is staff
+// or admin, as in order history.
+type kycReviewResponse struct {
+    ID         int       `json:"id"`
+    DocumentID int       `json:"document_id"`
+    Status     string    `json:"status"`
+    Reason     string    `json:"reason,omitempty"`
+    Actor      string    `json:"actor"`
+    ActorID    int       `json:"actor_id"`
+    CreatedAt  time.Time `json:"created_at"`
+}
+
+// kycResponse is a user's KYC as a whole. missing lists the types still to
+// be uploaded, including any whose latest document was rejected.
+type kycResponse struct {
+    UserID    int                   `json:"user_id"`
+    KYCStatus string                `json:"kyc_status"`
+    Required  []string              `json:"required"`
+    Missing   []string              `json:"missing"`
+    Documents []kycDocumentResponse `json:"documents"`
+    Reviews   []kycReviewResponse   `json:"reviews,omitempty"`
+}
+
+func (s *server) newKYCResponse(u User, docs []KYCDocument, reviews []KYCReview) kycResponse {
+    resp := kycResponse{
+        UserID:    u.ID,
+        KYCStatus: u.KYCStatus,
+        Required:  kycDocumentTypes,
+        Missing:   kycMissing(docs),
+        Documents: []kycDocumentResponse{},
+    }
+    for _, d := range docs {
+        resp.Documents = append(resp.Documents, s.newKYCDocumentResponse(d))
+    }
+    for _, rv := range reviews {
+        review := kycReviewResponse{rv.ID, rv.DocumentID, rv.Status, rv.Reason, "staff", rv.StaffID, rv.CreatedAt}
+        if rv.StaffID == 0 {
+            review.Actor, review.ActorID = "admin", rv.AdminID
+        }
+        resp.Reviews = append(resp.Reviews, review)
+    }
+    return resp
+}
+
+func (s *server) getKycDocumentsHandler(w http.ResponseWriter, r *http.Request) {
+    s.writeKYC(w, r, mustPrincipal(r).UserID, false)
+}
+
+// writeKYC answers with a user's KYC, with the review trail for staff.
+func (s *server) writeKYC(w http.ResponseWriter, r *http.Request, userID int, withReviews bool) {
+    u, err := s.store.Users().Get(r.Context(), userID)
+    if err == errNotFound {
+        writeError(w, http.StatusNotFound, "User not found")
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch KYC documents")
+        return
+    }
+    docs, err := s.store.KYC().ListByUser(r.Context(), userID)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch KYC documents")
+        return
+    }
+    var reviews []KYCReview
+    if withReviews {
+        if reviews, err = s.store.KYC().Reviews(r.Context(), userID); err != nil {
+            writeError(w, http.StatusInternalServerError, "Failed to fetch KYC reviews")
+            return
+        }
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(s.newKYCResponse(u, docs, reviews))
+}
+
+// uploadKycDocumentHandler takes a multipart form with a document_type and
+// the file. A type may be uploaded again only after its latest document was
+// rejected; the new document records which one it replaces. The file is
+// stored before the document row and removed again if the row is refused.
+func (s *server) uploadKycDocumentHandler(w http.ResponseWriter, r *http.Request) {
+    userID := mustPrincipal(r).UserID
+
+    if !parseUploadForm(w, r, "file") {
+        return
+    }
+    defer r.MultipartForm.RemoveAll()
+
+    docType := r.FormValue("document_type")
+    var errs ValidationErrors
+    if !contains(kycDocumentTypes, docType) {
+        errs = append(errs, FieldError{"document_type", "invalid",
+            "document_type must be one of " + strings.Join(kycDocumentTypes, ", ")})
+    }
+    file, header, err := r.FormFile("file")
+    if err != nil {
+        errs = append(errs, FieldError{"file", "required", "file is required"})
+    } else {
+        defer file.Close()
+    }
+    var contentType string
+    if file != nil {
+        contentType, errs = checkUploadFile(file, header, "file", errs)
+    }
+    if len(errs) > 0 {
+        writeValidationErrors(w, errs)
+        return
+    }
+
+    // Refuse early what the transaction below would refuse, before storing
+    // the file.
+    docs, err := s.store.KYC().ListByUser(r.Context(), userID)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to upload KYC document")
+        return
+    }
+    if _, errs := checkKYCUpload(docs, docType); len(errs) > 0 {
+        writeValidationErrors(w, errs)
+        return
+    }
+
+    key, err := newBlobKey(fmt.Sprintf("kyc/%d", userID), contentType)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to upload KYC document")
+        return
+    }
+    doc := KYCDocument{
+        UserID:      userID,
+        Type:        docType,
+        StorageKey:  key,
+        ContentType: contentType,
+        Size:        header.Size,
+    }
+    if err := s.blobs.Put(r.Context(), doc.StorageKey, file, doc.Size, contentType); err != nil {
+        log.Printf("Error storing KYC document %s: %v", doc.StorageKey, err)
+        writeError(w, http.StatusInternalServerError, "Failed to upload KYC document")
+        return
+    }
+
+    var status string
+    err = s.store.WithTx(r.Context(), func(tx Store) error {
+        docs, err := tx.KYC().Lock(r.Context(), userID)
+        if err != nil {
+            return err
+        }
+        if doc.ReplacesID, errs = checkKYCUpload(docs, doc.Type); len(errs) > 0 {
+            return errs
+        }
+        if doc.ID, err = tx.KYC().Create(r.Context(), doc); err != nil {
+            return err
+        }
+        doc.Status = kycPending
+        status, err = refreshKYCStatus(r.Context(), tx, userID, append(docs, doc))
+        return err
+    })
+    if err != nil {
+        if err := s.blobs.Delete(context.Background(), doc.StorageKey); err != nil {
+            log.Printf("Error removing KYC document %s: %v", doc.StorageKey, err)
+        }
+    }
+    switch {
+    case len(errs) > 0:
+        writeValidationErrors(w, errs)
+        return
+    case err == errKYCDocumentExists:
+        writeValidationErrors(w, kycUnderReview(doc.Type))
+        return
+    case err != nil:
+        writeError(w, http.StatusInternalServerError, "Failed to upload KYC document")
+        return
+    }
+
+    writeJSON(w, http.StatusCreated, map[string]interface{}{
+        "id":         doc.ID,
+        "kyc_status": status,
+        "message":    "KYC document uploaded successfully",
+    })
+}
+
+// kycQueueHandler lists documents awaiting review, oldest first.
+func (s *server) kycQueueHandler(w http.ResponseWriter, r *http.Request) {
+    list, err := s.store.KYC().Pending(r.Context(), maxKYCQueue)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch KYC documents")
+        return
+    }
+
+    docs := []kycDocumentResponse{}
+    for _, d := range list {
+        docs = append(docs, s.newKYCDocumentResponse(d))
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(docs)
+}
+
+func (s *server) userKycHandler(w http.ResponseWriter, r *http.Request) {
+    userID, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid user ID")
+        return
+    }
+    s.writeKYC(w, r, userID, true)
+}
+
+// reviewKycDocumentHandler approves or rejects one pending document.
+func (s *server) reviewKycDocumentHandler(w http.ResponseWriter, r *http.Request) {
+    docID, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid document ID")
+        return
+    }
+
+    var req struct {
+        Status string `json:"status"`
+        Reason string `json:"reason"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid request body")
+        return
+    }
+    if errs := validateKYCReview(req.Status, req.Reason); len(errs) > 0 {
+        writeValidationErrors(w, errs)
+        return
+    }
+
+    doc, err := s.store.KYC().Get(r.Context(), docID)
+    if err == errNotFound {
+        writeError(w, http.StatusNotFound, "Document not found")
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch KYC document")
+        return
+    }
+
+    staff := staffFromContext(r.Context())
+    rv := KYCReview{UserID: doc.UserID, Status: req.Status, Reason: strings.TrimSpace(req.Reason),
+        StaffID: staff.StaffID, AdminID: staff.UserID}
+    s.reviewKYCAndRespond(w, r, rv, []int{docID})
+}
+
+// updateKycStatusHandler approves or rejects every pending document of a
+// user at once, as the admin panel's user list does.
+func (s *server) updateKycStatusHandler(w http.ResponseWriter, r *http.Request) {
+    var req struct {
+        UserID int    `json:"user_id"`
+        Status string `json:"status"` // approved or rejected
+        Reason string `json:"reason"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid request body")
+        return
+    }
+    if errs := validateKYCReview(req.Status, req.Reason); len(errs) > 0 {
+        writeValidationErrors(w, errs)
+        return
+    }
+
+    if _, err := s.store.Users().Get(r.Context(), req.UserID); err == errNotFound {
+        writeError(w, http.StatusNotFound, "User not found")
+        return
+    }
+    docs, err := s.store.KYC().ListByUser(r.Context(), req.UserID)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch KYC documents")
+        return
+    }
+    var ids []int
+    for _, d := range docs {
+        if d.Status == kycPending {
+            ids = append(ids, d.ID)
+        }
+    }
+    if len(ids) == 0 {
+        writeValidationErrors(w, ValidationErrors{{"user_id", "nothing_to_review",
+            "the user has no documents awaiting review"}})
+        return
+    }
+
+    staff := staffFromContext(r.Context())
+    rv := KYCReview{UserID: req.UserID, Status: req.Status, Reason: strings.TrimSpace(req.Reason),
+        StaffID: staff.StaffID, AdminID: staff.UserID}
+    s.reviewKYCAndRespond(w, r, rv, ids)
+}
+
+func (s *server) reviewKYCAndRespond(w http.ResponseWriter, r *http.Request, rv KYCReview, ids []int) {
+    var status string
+    var errs ValidationErrors
+    err := s.store.WithTx(r.Context(), func(tx Store) error {
+        var err error
+        if status, errs, err = reviewKYCDocuments(r.Context(), tx, rv, ids); len(errs) > 0 {
+            return errs
+        }
+        return err
+    })
+    switch {
+    case len(errs) > 0:
+        writeValidationErrors(w, errs)
+        return
+    case err == errNotFound:
+        writeError(w, http.StatusNotFound, "User not found")
+        return
+    case err != nil:
+        writeError(w, http.StatusInternalServerError, "Failed to update KYC status")
+        return
+    }
+
+    writeJSON(w, http.StatusOK, map[string]interface{}{
+        "user_id":    rv.UserID,
+        "kyc_status": status,
+        "message":    "KYC status updated successfully",
+    })
+}
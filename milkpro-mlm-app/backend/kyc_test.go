@@ -0,0 +1,143 @@
+package main
+
+import (
+    "context"
+    "reflect"
+    "testing"
+)
+
+// kycDocs builds documents with IDs in upload order from type/status pairs.
+func kycDocs(typeStatus ...string) []KYCDocument {
+    var docs []KYCDocument
+    for i := 0; i+1 < len(typeStatus); i += 2 {
+        docs = append(docs, KYCDocument{ID: len(docs) + 1, UserID: 1, Type: typeStatus[i], Status: typeStatus[i+1]})
+    }
+    return docs
+}
+
+func TestKYCStatusOf(t *testing.T) {
+    allApproved := []string{kycIDFront, kycApproved, kycIDBack, kycApproved, kycAddressProof, kycApproved,
+        kycSelfie, kycApproved}
+    tests := []struct {
+        name string
+        docs []KYCDocument
+        want string
+    }{
+        {"nothing uploaded", nil, kycIncomplete},
+        {"all approved", kycDocs(allApproved...), kycApproved},
+        {"one pending", kycDocs(append(allApproved, kycSelfie, kycPending)...), kycPending},
+        {"type missing", kycDocs(kycIDFront, kycApproved, kycIDBack, kycApproved, kycAddressProof, kycApproved),
+            kycIncomplete},
+        {"type missing beats pending", kycDocs(kycIDFront, kycPending, kycIDBack, kycPending), kycIncomplete},
+        {"rejected beats pending", kycDocs(kycIDFront, kycPending, kycIDBack, kycRejected, kycAddressProof, kycPending,
+            kycSelfie, kycPending), kycRejected},
+        {"rejected beats type missing", kycDocs(kycIDFront, kycRejected), kycRejected},
+        {"rejected then uploaded again", kycDocs(append(allApproved[:6], kycSelfie, kycRejected, kycSelfie, kycPending)...),
+            kycPending},
+        {"legacy documents ignored", kycDocs(append(allApproved, "", kycRejected, "", kycPending)...), kycApproved},
+        {"only legacy documents", kycDocs("", kycApproved, "", kycApproved), kycIncomplete},
+    }
+    for _, tt := range tests {
+        if got := kycStatusOf(tt.docs); got != tt.want {
+            t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+        }
+    }
+}
+
+func TestCheckKYCUpload(t *testing.T) {
+    tests := []struct {
+        name     string
+        docs     []KYCDocument
+        replaces int
+        code     string
+    }{
+        {"first upload", nil, 0, ""},
+        {"other type uploaded", kycDocs(kycIDBack, kycPending), 0, ""},
+        {"legacy document", kycDocs("", kycRejected), 0, ""},
+        {"pending", kycDocs(kycIDFront, kycPending), 0, "under_review"},
+        {"approved", kycDocs(kycIDFront, kycApproved), 0, "already_approved"},
+        {"rejected", kycDocs(kycIDBack, kycApproved, kycIDFront, kycRejected), 2, ""},
+        {"rejected then uploaded again", kycDocs(kycIDFront, kycRejected, kycIDFront, kycPending), 0, "under_review"},
+        {"rejected twice", kycDocs(kycIDFront, kycRejected, kycIDFront, kycRejected), 2, ""},
+    }
+    for _, tt := range tests {
+        replaces, errs := checkKYCUpload(tt.docs, kycIDFront)
+        code := ""
+        if len(errs) > 0 {
+            code = errs[0].Code
+        }
+        if replaces != tt.replaces || code != tt.code || len(errs) > 1 {
+            t.Errorf("%s: got %d, %v; want %d, %q", tt.name, replaces, errs, tt.replaces, tt.code)
+        }
+    }
+}
+
+func TestReviewKYCDocuments(t *testing.T) {
+    ctx := context.Background()
+    s := newMemoryStore()
+    userID, err := s.Users().Create(ctx, User{Phone: "+15550001"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    otherID, err := s.Users().Create(ctx, User{Phone: "+15550002"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    ids := make(map[string]int)
+    for _, docType := range kycDocumentTypes {
+        if ids[docType], err = s.KYC().Create(ctx, KYCDocument{UserID: userID, Type: docType}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    othersDoc, err := s.KYC().Create(ctx, KYCDocument{UserID: otherID, Type: kycSelfie})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    review := func(status string, ids ...int) (string, ValidationErrors) {
+        t.Helper()
+        var got string
+        var errs ValidationErrors
+        err := s.WithTx(ctx, func(tx Store) error {
+            var err error
+            got, errs, err = reviewKYCDocuments(ctx, tx, KYCReview{UserID: userID, Status: status, Reason: "blurry",
+                StaffID: 3}, ids)
+            return err
+        })
+        if err != nil {
+            t.Fatal(err)
+        }
+        return got, errs
+    }
+
+    // Another user's document is never touched by a review of this user.
+    status, errs := review(kycApproved, ids[kycIDFront], ids[kycIDBack], othersDoc)
+    if status != kycPending || errs != nil {
+        t.Errorf("approving two documents: got %s, %v", status, errs)
+    }
+    if d, _ := s.KYC().Get(ctx, othersDoc); d.Status != kycPending {
+        t.Errorf("another user's document is %s", d.Status)
+    }
+
+    status, errs = review(kycRejected, ids[kycSelfie])
+    if status != kycRejected || errs != nil {
+        t.Errorf("rejecting the selfie: got %s, %v", status, errs)
+    }
+    if u, _ := s.Users().Get(ctx, userID); u.KYCStatus != kycRejected {
+        t.Errorf("user's stored status is %q, want %s", u.KYCStatus, kycRejected)
+    }
+
+    // A reviewed document cannot be reviewed again, and nothing is recorded.
+    before, _ := s.KYC().Reviews(ctx, userID)
+    status, errs = review(kycApproved, ids[kycAddressProof], ids[kycSelfie])
+    want := ValidationErrors{{"status", "already_reviewed", "document 4 has already been rejected"}}
+    if status != "" || !reflect.DeepEqual(errs, want) {
+        t.Errorf("reviewing again: got %q, %v; want %v", status, errs, want)
+    }
+    if after, _ := s.KYC().Reviews(ctx, userID); len(after) != len(before) {
+        t.Errorf("reviewing again recorded %d reviews", len(after)-len(before))
+    }
+    if d, _ := s.KYC().Get(ctx, ids[kycAddressProof]); d.Status != kycPending {
+        t.Errorf("address proof is %s after a refused review", d.Status)
+    }
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "os"
+    "time"
+)
+
+// Investment statuses.
+const (
+    investmentActive     = "active"
+    investmentMatured    = "matured"
+    investmentReinvested = "reinvested"
+)
+
+const defaultMaturityInterval = time.Minute
+
+// envInterval reads the environment variable name as a Go duration such as
+// "30s", falling back to def.
+func envInterval(name string, def time.Duration) time.Duration {
+    if v := os.Getenv(name); v != "" {
+        d, err := time.ParseDuration(v)
+        if err == nil && d > 0 {
+            return d
+        }
+        log.Printf("Invalid %s %q, using %s", name, v, def)
+    }
+    return def
+}
+
+// runMaturityScheduler matures due investments every interval until ctx is
+// cancelled. Several instances may run at once: each investment is claimed
+// with a row lock, so it is settled by exactly one of them.
+func runMaturityScheduler(ctx context.Context, s Store, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        n, err := matureDueInvestments(ctx, s)
+        if err != nil {
+            log.Printf("Maturity scheduler: %v", err)
+        } else if n > 0 {
+            log.Printf("Maturity scheduler: settled %d investments", n)
+        }
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+// matureDueInvestments settles every active investment whose lock period has
+// ended and returns how many it settled. Each investment is settled in its
+// own transaction together with its status change, so a crash or restart
+// never pays an investment twice. An investment that cannot be settled is
+// logged, skipped for the rest of the run and retried on the next one.
+func matureDueInvestments(ctx context.Context, s Store) (int, error) {
+    settled := 0
+    var failed []int
+    for {
+        id, err := matureNextInvestment(ctx, s, failed)
+        switch {
+        case err != nil && id == 0:
+            return settled, err
+        case err != nil:
+            log.Printf("Investment %d: %v", id, err)
+            failed = append(failed, id)
+        case id == 0:
+            return settled, nil
+        default:
+            settled++
+        }
+    }
+}
+
+// matureNextInvestment claims one due investment not in skip, skipping rows
+// another instance has locked, and settles it. It returns the ID of the
+// investment it claimed, or 0 when none are due.
+func matureNextInvestment(ctx context.Context, s Store, skip []int) (int, error) {
+    claimed := 0
+    err := s.WithTx(ctx, func(tx Store) error {
+        inv, err := tx.Investments().ClaimDue(ctx, skip)
+        if err == errNotFound {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        claimed = inv.ID
+        return settleInvestment(ctx, tx, inv)
+    })
+    return claimed, err
+}
+
+// settleInvestment pays the principal and profit of inv into the owner's
+// wallet and, when inv.Reinvest is set, immediately invests the total in the
+// same project again.
+func settleInvestment(ctx context.Context, s Store, inv Investment) error {
+    profit := inv.Amount.Percent(inv.ProfitPercent)
+    total := inv.Amount + profit
+
+    postings := []Posting{
+        {UserID: inv.UserID, Amount: total},
+        {Account: accountInvestmentsHeld, Amount: -inv.Amount},
+    }
+    if profit != 0 {
+        postings = append(postings, Posting{Account: accountInvestmentProfit, Amount: -profit})
+    }
+    _, err := postEntry(ctx, s, JournalEntry{
+        Kind:          entryPayout,
+        ReferenceType: "investment",
+        ReferenceID:   inv.ID,
+        Memo:          fmt.Sprintf("Principal %s plus profit %s", inv.Amount, profit),
+        Postings:      postings,
+    })
+    if err != nil {
+        return err
+    }
+
+    // Mark the investment matured before any reinvestment so its principal no
+    // longer counts towards the project's funding cap.
+    err = s.Investments().SetStatus(ctx, inv.ID, investmentMatured)
+    if err != nil || !inv.Reinvest {
+        return err
+    }
+
+    reinvested, err := reinvest(ctx, s, inv, total)
+    if err != nil || !reinvested {
+        return err
+    }
+    return s.Investments().SetStatus(ctx, inv.ID, investmentReinvested)
+}
+
+// reinvest rolls amount into a new investment in inv's project on the
+// project's current terms. If the project no longer accepts that investment
+// (it is paused or closed, or amount is outside its limits) the money stays
+// in the wallet and reinvest reports false. No commission is paid: the money
+// was already commissioned when it was first invested.
+func reinvest(ctx context.Context, s Store, inv Investment, amount Money) (bool, error) {
+    project, err := s.Projects().LockForInvestment(ctx, inv.ProjectID)
+    if err != nil {
+        return false, fmt.Errorf("loading project %d: %w", inv.ProjectID, err)
+    }
+    if errs := project.validateInvestment(amount); len(errs) > 0 {
+        log.Printf("Investment %d paid out instead of reinvested: %v", inv.ID, errs)
+        return false, nil
+    }
+
+    newID, err := s.Investments().Create(ctx, project.newInvestment(inv.UserID, amount, true, inv.ID))
+    if err != nil {
+        return false, err
+    }
+
+    _, err = postEntry(ctx, s, JournalEntry{
+        Kind:          entryInvestment,
+        ReferenceType: "investment",
+        ReferenceID:   newID,
+        Memo:          fmt.Sprintf("Reinvested from investment %d", inv.ID),
+        Postings: []Posting{
+            {UserID: inv.UserID, Amount: -amount},
+            {Account: accountInvestmentsHeld, Amount: amount},
+        },
+    })
+    return err == nil, err
+}
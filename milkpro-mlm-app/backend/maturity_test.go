@@ -0,0 +1,76 @@
+package main
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+func TestMaturitySkipsInvestmentsThatFailToSettle(t *testing.T) {
+    ctx := context.Background()
+    s := newMemoryStore()
+    now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+    s.now = func() time.Time { return now }
+
+    userID, err := s.Users().Create(ctx, User{Phone: "+15550001", Name: "Investor"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    project := Project{Name: "Dairy", LockDays: 30, ProfitPercent: 1000, MinInvestment: 100, MaxInvestment: 1000000}
+    brokenID, err := s.Projects().Create(ctx, project)
+    if err != nil {
+        t.Fatal(err)
+    }
+    healthyID, err := s.Projects().Create(ctx, project)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // The investment due first reinvests into a project that has gone, so
+    // settling it fails every time.
+    failingID, err := s.Investments().Create(ctx, NewInvestment{UserID: userID, ProjectID: brokenID, Amount: 10000,
+        LockDays: 30, ProfitPercent: 1000, Reinvest: true})
+    if err != nil {
+        t.Fatal(err)
+    }
+    now = now.Add(time.Hour)
+    healthyInvID, err := s.Investments().Create(ctx, NewInvestment{UserID: userID, ProjectID: healthyID, Amount: 20000,
+        LockDays: 30, ProfitPercent: 1000})
+    if err != nil {
+        t.Fatal(err)
+    }
+    delete(s.root.projects, brokenID)
+    now = now.AddDate(0, 0, 31)
+
+    for run := 1; run <= 2; run++ {
+        n, err := matureDueInvestments(ctx, s)
+        if err != nil {
+            t.Fatalf("run %d: %v", run, err)
+        }
+        if want := 2 - run; n != want {
+            t.Errorf("run %d settled %d investments, want %d", run, n, want)
+        }
+    }
+
+    investments, err := s.Investments().ListByUser(ctx, userID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, inv := range investments {
+        want := investmentMatured
+        if inv.ID == failingID {
+            want = investmentActive
+        }
+        if inv.Status != want {
+            t.Errorf("investment %d is %s, want %s", inv.ID, inv.Status, want)
+        }
+    }
+    user, err := s.Users().Get(ctx, userID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // Only the healthy investment paid out: 200.00 plus 10% profit.
+    if user.Balance != 22000 {
+        t.Errorf("balance is %v after settling investment %d, want 220.00", user.Balance, healthyInvID)
+    }
+}
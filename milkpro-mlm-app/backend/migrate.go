@@ -0,0 +1,299 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "embed"
+    "errors"
+    "flag"
+    "fmt"
+    "io/fs"
+    "log"
+    "path"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Migrations are compiled into the binary. Each version has an up file and a
+// down file named <version>_<name>.up.sql and <version>_<name>.down.sql.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+//go:embed seeds/seed.sql
+var seedSQL string
+
+// migrationLockID is the pg_advisory_lock key held while migrating, so two
+// processes never apply migrations at the same time.
+const migrationLockID = 72_650_001
+
+type migration struct {
+    Version int
+    Name    string
+    Up      string
+    Down    string
+}
+
+// loadMigrations reads the embedded migrations in version order.
+func loadMigrations() ([]migration, error) {
+    entries, err := fs.ReadDir(migrationFiles, "migrations")
+    if err != nil {
+        return nil, err
+    }
+
+    byVersion := make(map[int]*migration)
+    for _, e := range entries {
+        file := e.Name()
+        base, direction, ok := strings.Cut(strings.TrimSuffix(file, ".sql"), ".")
+        if !ok || (direction != "up" && direction != "down") {
+            return nil, fmt.Errorf("migration %s: expected <version>_<name>.up.sql or .down.sql", file)
+        }
+        versionText, name, _ := strings.Cut(base, "_")
+        version, err := strconv.Atoi(versionText)
+        if err != nil || version <= 0 {
+            return nil, fmt.Errorf("migration %s: invalid version", file)
+        }
+
+        body, err := fs.ReadFile(migrationFiles, path.Join("migrations", file))
+        if err != nil {
+            return nil, err
+        }
+        m := byVersion[version]
+        if m == nil {
+            m = &migration{Version: version, Name: name}
+            byVersion[version] = m
+        } else if m.Name != name {
+            return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.Name, name)
+        }
+        if direction == "up" {
+            m.Up = string(body)
+        } else {
+            m.Down = string(body)
+        }
+    }
+
+    migrations := make([]migration, 0, len(byVersion))
+    for _, m := range byVersion {
+        if m.Up == "" {
+            return nil, fmt.Errorf("migration %d_%s has no up file", m.Version, m.Name)
+        }
+        migrations = append(migrations, *m)
+    }
+    sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+    return migrations, nil
+}
+
+// migrator applies migrations over a single connection, which holds the
+// advisory lock for as long as the migrator is open.
+type migrator struct {
+    conn       *sql.Conn
+    migrations []migration
+}
+
+func openMigrator(ctx context.Context, db *sql.DB) (*migrator, error) {
+    migrations, err := loadMigrations()
+    if err != nil {
+        return nil, err
+    }
+    conn, err := db.Conn(ctx)
+    if err != nil {
+        return nil, err
+    }
+    if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+        conn.Close()
+        return nil, err
+    }
+    _, err = conn.ExecContext(ctx, `
+        CREATE TABLE IF NOT EXISTS schema_migrations (
+            version INTEGER PRIMARY KEY,
+            name VARCHAR(255) NOT NULL,
+            applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+        )`)
+    if err != nil {
+        conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockID)
+        conn.Close()
+        return nil, err
+    }
+    return &migrator{conn: conn, migrations: migrations}, nil
+}
+
+func (m *migrator) Close() error {
+    m.conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID)
+    return m.conn.Close()
+}
+
+// applied returns the applied versions and when each was applied.
+func (m *migrator) applied(ctx context.Context) (map[int]time.Time, error) {
+    rows, err := m.conn.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    applied := make(map[int]time.Time)
+    for rows.Next() {
+        var version int
+        var at time.Time
+        if err := rows.Scan(&version, &at); err != nil {
+            return nil, err
+        }
+        applied[version] = at
+    }
+    return applied, rows.Err()
+}
+
+// Up applies every pending migration in order, each in its own transaction,
+// and returns how many it applied.
+func (m *migrator) Up(ctx context.Context) (int, error) {
+    applied, err := m.applied(ctx)
+    if err != nil {
+        return 0, err
+    }
+
+    n := 0
+    for _, mig := range m.migrations {
+        if _, ok := applied[mig.Version]; ok {
+            continue
+        }
+        err := m.run(ctx, mig.Up,
+            "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", mig.Version, mig.Name)
+        if err != nil {
+            return n, fmt.Errorf("applying migration %d_%s: %w", mig.Version, mig.Name, err)
+        }
+        log.Printf("Applied migration %d_%s", mig.Version, mig.Name)
+        n++
+    }
+    return n, nil
+}
+
+// Down reverts the latest steps applied migrations, newest first.
+func (m *migrator) Down(ctx context.Context, steps int) (int, error) {
+    applied, err := m.applied(ctx)
+    if err != nil {
+        return 0, err
+    }
+
+    n := 0
+    for i := len(m.migrations) - 1; i >= 0 && n < steps; i-- {
+        mig := m.migrations[i]
+        if _, ok := applied[mig.Version]; !ok {
+            continue
+        }
+        if mig.Down == "" {
+            return n, fmt.Errorf("migration %d_%s has no down file", mig.Version, mig.Name)
+        }
+        err := m.run(ctx, mig.Down, "DELETE FROM schema_migrations WHERE version = $1", mig.Version)
+        if err != nil {
+            return n, fmt.Errorf("reverting migration %d_%s: %w", mig.Version, mig.Name, err)
+        }
+        log.Printf("Reverted migration %d_%s", mig.Version, mig.Name)
+        n++
+    }
+    return n, nil
+}
+
+// run executes a migration script and its schema_migrations bookkeeping in
+// one transaction.
+func (m *migrator) run(ctx context.Context, script, record string, args ...interface{}) error {
+    tx, err := m.conn.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    if _, err := tx.ExecContext(ctx, script); err != nil {
+        return err
+    }
+    if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// pendingMigrations reports how many embedded migrations have not been
+// applied. It does not take the migration lock.
+func pendingMigrations(ctx context.Context, db *sql.DB) (int, error) {
+    migrations, err := loadMigrations()
+    if err != nil {
+        return 0, err
+    }
+    var exists bool
+    err = db.QueryRowContext(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists)
+    if err != nil || !exists {
+        return len(migrations), err
+    }
+
+    var latest int
+    err = db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&latest)
+    if err != nil {
+        return 0, err
+    }
+    pending := 0
+    for _, m := range migrations {
+        if m.Version > latest {
+            pending++
+        }
+    }
+    return pending, nil
+}
+
+// runMigrateCommand implements "backend migrate up|down|status".
+func runMigrateCommand(ctx context.Context, db *sql.DB, args []string) error {
+    if len(args) == 0 {
+        return errors.New("usage: migrate up | down [-steps N] | status")
+    }
+    flags := flag.NewFlagSet("migrate "+args[0], flag.ExitOnError)
+    steps := flags.Int("steps", 1, "number of migrations to revert (down only)")
+    flags.Parse(args[1:])
+
+    m, err := openMigrator(ctx, db)
+    if err != nil {
+        return err
+    }
+    defer m.Close()
+
+    switch args[0] {
+    case "up":
+        n, err := m.Up(ctx)
+        if err == nil {
+            log.Printf("%d migrations applied", n)
+        }
+        return err
+    case "down":
+        if *steps <= 0 {
+            return errors.New("migrate down: -steps must be positive")
+        }
+        n, err := m.Down(ctx, *steps)
+        if err == nil {
+            log.Printf("%d migrations reverted", n)
+        }
+        return err
+    case "status":
+        applied, err := m.applied(ctx)
+        if err != nil {
+            return err
+        }
+        for _, mig := range m.migrations {
+            status := "pending"
+            if at, ok := applied[mig.Version]; ok {
+                status = "applied " + at.Format(time.RFC3339)
+            }
+            fmt.Printf("%04d_%s\t%s\n", mig.Version, mig.Name, status)
+        }
+        return nil
+    default:
+        return fmt.Errorf("migrate: unknown command %q", args[0])
+    }
+}
+
+// runSeedCommand implements "backend seed": it loads the optional sample
+// admin user, products and project into a migrated database.
+func runSeedCommand(ctx context.Context, db *sql.DB) error {
+    if _, err := db.ExecContext(ctx, seedSQL); err != nil {
+        return fmt.Errorf("seeding: %w", err)
+    }
+    log.Println("Seed data loaded")
+    return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+    "io/fs"
+    "strings"
+    "testing"
+)
+
+func TestMigrationsAreContiguous(t *testing.T) {
+    migrations, err := loadMigrations()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(migrations) == 0 {
+        t.Fatal("no migrations are embedded")
+    }
+    for i, m := range migrations {
+        if m.Version != i+1 {
+            t.Fatalf("migration %d_%s: want version %d; versions must run from 1 without gaps", m.Version, m.Name, i+1)
+        }
+        if strings.TrimSpace(m.Up) == "" {
+            t.Errorf("migration %d_%s has an empty up file", m.Version, m.Name)
+        }
+        if strings.TrimSpace(m.Down) == "" {
+            t.Errorf("migration %d_%s has no down file", m.Version, m.Name)
+        }
+    }
+
+    // Versions are written with four digits so the files sort in order.
+    entries, err := fs.ReadDir(migrationFiles, "migrations")
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, e := range entries {
+        version := e.Name()[:strings.Index(e.Name()+"_", "_")]
+        if len(version) != 4 {
+            t.Errorf("migration %s: version %q is not four digits", e.Name(), version)
+        }
+    }
+    if want := 2 * len(migrations); len(entries) != want {
+        t.Errorf("got %d migration files, want %d", len(entries), want)
+    }
+}
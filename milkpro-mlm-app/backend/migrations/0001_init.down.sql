@@ -0,0 +1,18 @@
+DROP TABLE IF EXISTS chat_messages;
+DROP TABLE IF EXISTS chat_sessions;
+DROP TABLE IF EXISTS ticket_messages;
+DROP TABLE IF EXISTS support_tickets;
+DROP TABLE IF EXISTS support_staff;
+DROP TABLE IF EXISTS journal_postings;
+DROP TABLE IF EXISTS journal_entries;
+DROP TABLE IF EXISTS wallet_accounts;
+DROP TABLE IF EXISTS commissions;
+DROP TABLE IF EXISTS commission_plans;
+DROP TABLE IF EXISTS referrals;
+DROP TABLE IF EXISTS kyc_documents;
+DROP TABLE IF EXISTS transactions;
+DROP TABLE IF EXISTS investments;
+DROP TABLE IF EXISTS projects;
+DROP TABLE IF EXISTS products;
+DROP TABLE IF EXISTS users;
+DROP FUNCTION IF EXISTS reject_ledger_change();
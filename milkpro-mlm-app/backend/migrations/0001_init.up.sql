@@ -33,7 +33,8 @@ CREATE TABLE projects (
     profit_percent DECIMAL(5,2) NOT NULL,
     min_investment DECIMAL(10,2) NOT NULL,
     max_investment DECIMAL(10,2) NOT NULL,
-    status VARCHAR(20) DEFAULT 'active',
+    funding_cap DECIMAL(15,2), -- optional limit on principal held in active investments
+    status VARCHAR(20) DEFAULT 'active' CHECK (status IN ('active', 'paused', 'closed')),
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
@@ -46,8 +47,10 @@ CREATE TABLE investments (
     lock_end_date TIMESTAMP NOT NULL,
     profit_percent DECIMAL(5,2) NOT NULL,
     reinvest BOOLEAN DEFAULT FALSE,
-    status VARCHAR(20) DEFAULT 'active',
-    invested_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    status VARCHAR(20) DEFAULT 'active', -- active, matured or reinvested
+    invested_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    matured_at TIMESTAMP,
+    reinvested_from INTEGER REFERENCES investments(id)
 );
 
 -- Transactions table
@@ -71,17 +74,98 @@ CREATE TABLE kyc_documents (
     uploaded_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
--- Referrals table
+-- Referrals table: the sponsor tree as a closure table. Signup writes one row
+-- per ancestor within 3 levels, with level as the distance to that ancestor.
 CREATE TABLE referrals (
     id SERIAL PRIMARY KEY,
     user_id INTEGER REFERENCES users(id),
     referred_user_id INTEGER REFERENCES users(id),
     level INTEGER NOT NULL CHECK (level BETWEEN 1 AND 3),
-    commission DECIMAL(10,2) NOT NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    UNIQUE(user_id, referred_user_id)
+    UNIQUE(user_id, referred_user_id),
+    UNIQUE(referred_user_id, level) -- one sponsor per user per level
 );
 
+-- Commission plans: the percentage of a purchase or investment paid to the
+-- upline member at each level. Unscoped rows are the default plan; a row
+-- scoped to a product or project overrides it for that level.
+CREATE TABLE commission_plans (
+    id SERIAL PRIMARY KEY,
+    level INTEGER NOT NULL CHECK (level BETWEEN 1 AND 3),
+    percent DECIMAL(5,2) NOT NULL CHECK (percent >= 0),
+    product_id INTEGER REFERENCES products(id),
+    project_id INTEGER REFERENCES projects(id),
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CHECK (product_id IS NULL OR project_id IS NULL)
+);
+
+-- Commissions paid to upline members. Rows are immutable.
+CREATE TABLE commissions (
+    id SERIAL PRIMARY KEY,
+    beneficiary_id INTEGER NOT NULL REFERENCES users(id),
+    source_user_id INTEGER NOT NULL REFERENCES users(id),
+    level INTEGER NOT NULL CHECK (level BETWEEN 1 AND 3),
+    source_type VARCHAR(20) NOT NULL, -- 'investment' or 'transaction'
+    source_id INTEGER NOT NULL,
+    base_amount DECIMAL(15,2) NOT NULL,
+    percent DECIMAL(5,2) NOT NULL,
+    amount DECIMAL(15,2) NOT NULL CHECK (amount > 0),
+    plan_id INTEGER NOT NULL REFERENCES commission_plans(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(source_type, source_id, level)
+);
+
+-- Wallet accounts: one per user plus named system accounts. users.balance is a
+-- projection of the user's account and must always equal the sum of its postings.
+CREATE TABLE wallet_accounts (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER UNIQUE REFERENCES users(id),
+    code VARCHAR(50) UNIQUE, -- system accounts: 'cash', 'investments_held', 'investment_profit', 'commission_expense', 'sales'
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CHECK ((user_id IS NULL) <> (code IS NULL))
+);
+
+-- Journal entries group postings that move money between accounts
+CREATE TABLE journal_entries (
+    id SERIAL PRIMARY KEY,
+    kind VARCHAR(30) NOT NULL, -- 'deposit', 'withdrawal', 'investment', 'payout', 'commission', 'purchase'
+    reference_type VARCHAR(30), -- e.g. 'investment', 'transaction'
+    reference_id INTEGER,
+    memo TEXT,
+    created_by INTEGER REFERENCES users(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Journal postings: positive amounts credit an account, negative amounts debit
+-- it. The postings of one entry always sum to zero.
+CREATE TABLE journal_postings (
+    id SERIAL PRIMARY KEY,
+    entry_id INTEGER NOT NULL REFERENCES journal_entries(id),
+    account_id INTEGER NOT NULL REFERENCES wallet_accounts(id),
+    amount DECIMAL(15,2) NOT NULL CHECK (amount <> 0),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- The ledger is append-only; corrections are made with new entries
+CREATE FUNCTION reject_ledger_change() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION '% is append-only', TG_TABLE_NAME;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER journal_entries_append_only
+    BEFORE UPDATE OR DELETE ON journal_entries
+    FOR EACH ROW EXECUTE FUNCTION reject_ledger_change();
+
+CREATE TRIGGER journal_postings_append_only
+    BEFORE UPDATE OR DELETE ON journal_postings
+    FOR EACH ROW EXECUTE FUNCTION reject_ledger_change();
+
+CREATE TRIGGER commissions_append_only
+    BEFORE UPDATE OR DELETE ON commissions
+    FOR EACH ROW EXECUTE FUNCTION reject_ledger_change();
+
 -- Support staff table
 CREATE TABLE support_staff (
     id SERIAL PRIMARY KEY,
@@ -148,28 +232,29 @@ CREATE INDEX idx_chat_messages_session_id ON chat_messages(session_id);
 CREATE INDEX idx_users_phone ON users(phone);
 CREATE INDEX idx_users_referral_code ON users(referral_code);
 CREATE INDEX idx_investments_user_id ON investments(user_id);
+CREATE INDEX idx_investments_due ON investments(lock_end_date) WHERE status = 'active';
 CREATE INDEX idx_transactions_user_id ON transactions(user_id);
 CREATE INDEX idx_kyc_documents_user_id ON kyc_documents(user_id);
 CREATE INDEX idx_referrals_user_id ON referrals(user_id);
 CREATE INDEX idx_referrals_referred_user_id ON referrals(referred_user_id);
+CREATE INDEX idx_commissions_beneficiary_id ON commissions(beneficiary_id);
+CREATE UNIQUE INDEX idx_commission_plans_active_scope
+    ON commission_plans(level, COALESCE(product_id, 0), COALESCE(project_id, 0))
+    WHERE is_active;
+CREATE INDEX idx_journal_postings_account_id ON journal_postings(account_id);
+CREATE INDEX idx_journal_postings_entry_id ON journal_postings(entry_id);
+CREATE INDEX idx_journal_entries_reference ON journal_entries(reference_type, reference_id);
 
--- Insert default admin user
-INSERT INTO users (phone, name, email, is_admin, kyc_status)
-VALUES ('+1234567890', 'Admin User', 'admin@milkpro.com', TRUE, 'approved');
-
--- Insert sample products
-INSERT INTO products (name, type, price) VALUES
-('Fresh Milk', 'milk', 2.50),
-('Yogurt', 'dairy', 3.00),
-('Cattle Feed', 'feed', 15.00);
-
--- Insert sample investment project
-INSERT INTO projects (name, description, lock_days, profit_percent, min_investment, max_investment)
-VALUES (
-    'Dairy Farm Expansion',
-    'Investment opportunity in expanding our dairy farm operations',
-    90,
-    15.00,
-    1000.00,
-    50000.00
-);
+-- System wallet accounts
+INSERT INTO wallet_accounts (code) VALUES
+('cash'),
+('investments_held'),
+('investment_profit'),
+('commission_expense'),
+('sales');
+
+-- Default commission plan
+INSERT INTO commission_plans (level, percent) VALUES
+(1, 5.00),
+(2, 3.00),
+(3, 1.00);
@@ -0,0 +1,5 @@
+ALTER TABLE support_staff
+    DROP CONSTRAINT support_staff_role_check,
+    DROP COLUMN last_login_at,
+    DROP COLUMN locked_until,
+    DROP COLUMN failed_logins;
@@ -0,0 +1,7 @@
+-- Login bookkeeping for the admin panel. After too many failed attempts an
+-- account is locked until locked_until; a successful login resets the count.
+ALTER TABLE support_staff
+    ADD COLUMN failed_logins INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN locked_until TIMESTAMP,
+    ADD COLUMN last_login_at TIMESTAMP,
+    ADD CONSTRAINT support_staff_role_check CHECK (role IN ('support', 'admin'));
@@ -0,0 +1,3 @@
+-- The Firebase UID a user signs in with. Users registered before this column
+-- existed are linked the first time they present a token for their phone.
+ALTER TABLE users ADD COLUMN firebase_uid VARCHAR(128) UNIQUE;
@@ -0,0 +1,18 @@
+ALTER TABLE transactions DROP CONSTRAINT transactions_unit_check;
+
+ALTER TABLE products
+    DROP CONSTRAINT products_type_check,
+    DROP COLUMN archived_at,
+    DROP COLUMN updated_at,
+    ADD COLUMN price DECIMAL(10,2);
+
+-- Keep one price per product, preferring the unit it was originally sold by.
+UPDATE products p
+SET price = COALESCE(
+    (SELECT pp.price FROM product_prices pp WHERE pp.product_id = p.id
+     ORDER BY (pp.unit = CASE WHEN p.type = 'milk' THEN 'litre' ELSE 'kg' END) DESC LIMIT 1),
+    0);
+
+ALTER TABLE products ALTER COLUMN price SET NOT NULL;
+
+DROP TABLE product_prices;
@@ -0,0 +1,24 @@
+-- Products are priced per unit of measure instead of with a single price, and
+-- are archived rather than deleted because transactions reference them.
+-- Transactions keep the price recorded when they were made.
+CREATE TABLE product_prices (
+    product_id INTEGER NOT NULL REFERENCES products(id),
+    unit VARCHAR(10) NOT NULL CHECK (unit IN ('kg', 'litre')),
+    price DECIMAL(10,2) NOT NULL CHECK (price > 0),
+    PRIMARY KEY (product_id, unit)
+);
+
+-- Milk has always been sold by the litre and everything else by the kg.
+INSERT INTO product_prices (product_id, unit, price)
+SELECT id, CASE WHEN type = 'milk' THEN 'litre' ELSE 'kg' END, price
+FROM products
+WHERE price > 0;
+
+ALTER TABLE products
+    DROP COLUMN price,
+    ADD COLUMN updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    ADD COLUMN archived_at TIMESTAMP,
+    ADD CONSTRAINT products_type_check CHECK (type IN ('milk', 'dairy', 'feed'));
+
+ALTER TABLE transactions
+    ADD CONSTRAINT transactions_unit_check CHECK (unit IN ('kg', 'litre'));
@@ -0,0 +1,31 @@
+-- Fails, leaving everything in place, once sales have been paid from the
+-- purchases account.
+DELETE FROM wallet_accounts WHERE code = 'purchases';
+
+ALTER TABLE users
+    DROP COLUMN price_tier,
+    DROP COLUMN region;
+
+ALTER TABLE transactions DROP COLUMN price_version_id;
+
+CREATE TABLE product_prices (
+    product_id INTEGER NOT NULL REFERENCES products(id),
+    unit VARCHAR(10) NOT NULL CHECK (unit IN ('kg', 'litre')),
+    price DECIMAL(10,2) NOT NULL CHECK (price > 0),
+    PRIMARY KEY (product_id, unit)
+);
+
+-- Keep the default buy price in effect now, unless it has been withdrawn.
+INSERT INTO product_prices (product_id, unit, price)
+SELECT product_id, unit, price
+FROM (
+    SELECT DISTINCT ON (product_id, unit) product_id, unit, price
+    FROM price_versions
+    WHERE side = 'buy' AND region IS NULL AND tier IS NULL
+      AND effective_from <= CURRENT_TIMESTAMP
+      AND (effective_until IS NULL OR effective_until > CURRENT_TIMESTAMP)
+    ORDER BY product_id, unit, effective_from DESC, id DESC
+) current
+WHERE price > 0;
+
+DROP TABLE price_versions;
@@ -0,0 +1,42 @@
+-- Prices move into a price book: every price is an immutable version with a
+-- side (buy: what a user pays us, sell: what we pay a user for their
+-- produce), an effective date range, and an optional region and/or pricing
+-- tier it overrides the default for. Transactions record the version they
+-- were priced from. A default version with a price of zero withdraws the
+-- price for its unit and side: from its effective_from nothing can be traded
+-- that way at the default price, while overrides still apply.
+CREATE TABLE price_versions (
+    id SERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL REFERENCES products(id),
+    unit VARCHAR(10) NOT NULL CHECK (unit IN ('kg', 'litre')),
+    side VARCHAR(4) NOT NULL CHECK (side IN ('buy', 'sell')),
+    region VARCHAR(50),
+    tier VARCHAR(20),
+    price DECIMAL(10,2) NOT NULL CHECK (price >= 0),
+    effective_from TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    effective_until TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CHECK (effective_until IS NULL OR effective_until > effective_from)
+);
+
+CREATE INDEX idx_price_versions_lookup ON price_versions(product_id, unit, side, effective_from DESC);
+
+-- The unit prices so far were list prices users paid. There is no sell price
+-- yet, so nothing can be sold until an admin sets one.
+INSERT INTO price_versions (product_id, unit, side, price, effective_from)
+SELECT pp.product_id, pp.unit, 'buy', pp.price, COALESCE(p.created_at, CURRENT_TIMESTAMP)
+FROM product_prices pp
+JOIN products p ON p.id = pp.product_id;
+
+DROP TABLE product_prices;
+
+ALTER TABLE transactions
+    ADD COLUMN price_version_id INTEGER REFERENCES price_versions(id);
+
+-- Which overrides apply to a user. NULL means the default prices.
+ALTER TABLE users
+    ADD COLUMN region VARCHAR(50),
+    ADD COLUMN price_tier VARCHAR(20);
+
+-- Pays users for the produce they sell us.
+INSERT INTO wallet_accounts (code) VALUES ('purchases');
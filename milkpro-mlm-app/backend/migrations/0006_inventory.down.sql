@@ -0,0 +1,7 @@
+DROP TABLE stock_movements;
+
+ALTER TABLE products
+    DROP COLUMN low_stock_threshold,
+    DROP COLUMN stock,
+    DROP COLUMN density,
+    DROP COLUMN stock_unit;
@@ -0,0 +1,38 @@
+-- Stock is kept per product in its stock unit. products.stock is a projection
+-- of the append-only stock_movements ledger, updated in the same database
+-- transaction as each movement, like users.balance and the wallet ledger.
+-- density (kg per litre) converts trades in the other unit.
+ALTER TABLE products
+    ADD COLUMN stock_unit VARCHAR(10) CHECK (stock_unit IN ('kg', 'litre')),
+    ADD COLUMN density DECIMAL(6,2) CHECK (density > 0),
+    ADD COLUMN stock DECIMAL(12,2) NOT NULL DEFAULT 0,
+    ADD COLUMN low_stock_threshold DECIMAL(12,2) CHECK (low_stock_threshold >= 0);
+
+UPDATE products SET stock_unit = CASE WHEN type = 'milk' THEN 'litre' ELSE 'kg' END;
+UPDATE products SET density = 1.03 WHERE type = 'milk';
+
+ALTER TABLE products ALTER COLUMN stock_unit SET NOT NULL;
+
+CREATE TABLE stock_movements (
+    id SERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL REFERENCES products(id),
+    kind VARCHAR(20) NOT NULL CHECK (kind IN ('transaction', 'adjustment')),
+    transaction_id INTEGER REFERENCES transactions(id),
+    traded_quantity DECIMAL(12,2) NOT NULL, -- as bought, sold or adjusted; negative out of stock
+    traded_unit VARCHAR(10) NOT NULL CHECK (traded_unit IN ('kg', 'litre')),
+    quantity DECIMAL(12,2) NOT NULL CHECK (quantity <> 0), -- traded_quantity in unit
+    unit VARCHAR(10) NOT NULL CHECK (unit IN ('kg', 'litre')),
+    balance DECIMAL(12,2) NOT NULL, -- products.stock after this movement
+    reason TEXT,
+    created_by_staff_id INTEGER REFERENCES support_staff(id),
+    created_by_user_id INTEGER REFERENCES users(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CHECK ((kind = 'transaction') = (transaction_id IS NOT NULL)),
+    CHECK (kind <> 'adjustment' OR reason IS NOT NULL)
+);
+
+CREATE INDEX idx_stock_movements_product_id ON stock_movements(product_id, id DESC);
+
+CREATE TRIGGER stock_movements_append_only
+    BEFORE UPDATE OR DELETE ON stock_movements
+    FOR EACH ROW EXECUTE FUNCTION reject_ledger_change();
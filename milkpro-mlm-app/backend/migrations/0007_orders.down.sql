@@ -0,0 +1,5 @@
+ALTER TABLE transactions DROP COLUMN order_id;
+
+DROP TABLE order_events;
+DROP TABLE order_items;
+DROP TABLE orders;
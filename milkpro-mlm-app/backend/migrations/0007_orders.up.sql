@@ -0,0 +1,51 @@
+-- Orders group several purchases into one cart with a delivery lifecycle.
+-- Items are priced from the price book when the order is placed; confirming
+-- the order records one transaction per item at that price, which is when
+-- the wallet is charged and stock moves.
+CREATE TABLE orders (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    status VARCHAR(20) NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'confirmed', 'dispatched', 'delivered', 'cancelled')),
+    total_amount DECIMAL(12,2) NOT NULL CHECK (total_amount > 0),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_orders_user_id ON orders(user_id, id DESC);
+CREATE INDEX idx_orders_status ON orders(status, id DESC);
+
+CREATE TABLE order_items (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES orders(id),
+    product_id INTEGER NOT NULL REFERENCES products(id),
+    quantity DECIMAL(10,2) NOT NULL CHECK (quantity > 0),
+    unit VARCHAR(10) NOT NULL CHECK (unit IN ('kg', 'litre')),
+    price DECIMAL(10,2) NOT NULL CHECK (price > 0),
+    price_version_id INTEGER NOT NULL REFERENCES price_versions(id),
+    UNIQUE (order_id, product_id, unit)
+);
+
+-- Every status an order has been in, with who moved it there: the customer
+-- or an admin app user (created_by_user_id), a support_staff account, or
+-- neither for the system. actor is the role they acted in, since an admin
+-- acting on their own order is not acting as its customer.
+CREATE TABLE order_events (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES orders(id),
+    status VARCHAR(20) NOT NULL
+        CHECK (status IN ('pending', 'confirmed', 'dispatched', 'delivered', 'cancelled')),
+    note TEXT,
+    actor VARCHAR(10) NOT NULL CHECK (actor IN ('customer', 'admin', 'staff', 'system')),
+    created_by_staff_id INTEGER REFERENCES support_staff(id),
+    created_by_user_id INTEGER REFERENCES users(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_order_events_order_id ON order_events(order_id, id);
+
+CREATE TRIGGER order_events_append_only
+    BEFORE UPDATE OR DELETE ON order_events
+    FOR EACH ROW EXECUTE FUNCTION reject_ledger_change();
+
+ALTER TABLE transactions ADD COLUMN order_id INTEGER REFERENCES orders(id);
@@ -0,0 +1,6 @@
+ALTER TABLE orders
+    DROP COLUMN delivery_date,
+    DROP COLUMN subscription_id;
+
+DROP TABLE subscription_skips;
+DROP TABLE subscriptions;
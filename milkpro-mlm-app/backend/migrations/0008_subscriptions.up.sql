@@ -0,0 +1,35 @@
+-- Recurring deliveries. delivery_days is a bitmask of weekdays, bit 0 being
+-- Sunday as in EXTRACT(DOW). The scheduler turns each delivery due on a date
+-- into a pending order; orders.subscription_id and delivery_date make that
+-- happen at most once per subscription and date.
+CREATE TABLE subscriptions (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    product_id INTEGER NOT NULL REFERENCES products(id),
+    quantity DECIMAL(10,2) NOT NULL CHECK (quantity > 0), -- per delivery
+    unit VARCHAR(10) NOT NULL CHECK (unit IN ('kg', 'litre')),
+    delivery_days SMALLINT NOT NULL CHECK (delivery_days BETWEEN 1 AND 127),
+    status VARCHAR(20) NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'paused', 'cancelled')),
+    start_date DATE NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_subscriptions_user_id ON subscriptions(user_id, id DESC);
+CREATE INDEX idx_subscriptions_active ON subscriptions(start_date) WHERE status = 'active';
+
+-- Single days a customer does not want their delivery.
+CREATE TABLE subscription_skips (
+    subscription_id INTEGER NOT NULL REFERENCES subscriptions(id),
+    skip_date DATE NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (subscription_id, skip_date)
+);
+
+ALTER TABLE orders
+    ADD COLUMN subscription_id INTEGER REFERENCES subscriptions(id),
+    ADD COLUMN delivery_date DATE,
+    ADD CHECK ((subscription_id IS NULL) = (delivery_date IS NULL));
+
+CREATE UNIQUE INDEX idx_orders_subscription_delivery ON orders(subscription_id, delivery_date);
+CREATE INDEX idx_orders_delivery_date ON orders(delivery_date) WHERE delivery_date IS NOT NULL;
@@ -0,0 +1,14 @@
+UPDATE users SET kyc_status = 'pending' WHERE kyc_status = 'incomplete';
+ALTER TABLE users ALTER COLUMN kyc_status SET DEFAULT 'pending';
+
+DROP TABLE kyc_reviews;
+
+DROP INDEX idx_kyc_documents_pending;
+DROP INDEX idx_kyc_documents_current;
+ALTER TABLE kyc_documents
+    DROP CONSTRAINT kyc_documents_status_check,
+    ALTER COLUMN status DROP NOT NULL,
+    DROP COLUMN reviewed_at,
+    DROP COLUMN replaces_id,
+    DROP COLUMN reason,
+    DROP COLUMN document_type;
@@ -0,0 +1,48 @@
+-- KYC documents are typed and reviewed one at a time. A rejected document is
+-- replaced by uploading a new one of the same type, which points back to it;
+-- users.kyc_status is derived from the latest document of each required type.
+ALTER TABLE kyc_documents
+    ADD COLUMN document_type VARCHAR(20)
+        CHECK (document_type IN ('id_front', 'id_back', 'address_proof', 'selfie')),
+    ADD COLUMN reason TEXT,
+    ADD COLUMN replaces_id INTEGER REFERENCES kyc_documents(id),
+    ADD COLUMN reviewed_at TIMESTAMP;
+
+-- Documents uploaded before types existed keep a NULL document_type and do
+-- not count towards the required set.
+UPDATE kyc_documents SET status = 'pending' WHERE status IS NULL;
+ALTER TABLE kyc_documents
+    ALTER COLUMN status SET NOT NULL,
+    ADD CONSTRAINT kyc_documents_status_check CHECK (status IN ('pending', 'approved', 'rejected'));
+
+-- At most one document of each type is under review or approved at a time.
+CREATE UNIQUE INDEX idx_kyc_documents_current
+    ON kyc_documents(user_id, document_type) WHERE status <> 'rejected';
+CREATE INDEX idx_kyc_documents_pending ON kyc_documents(id) WHERE status = 'pending';
+
+-- Every review decision, with who made it: a support_staff account or an
+-- admin app user.
+CREATE TABLE kyc_reviews (
+    id SERIAL PRIMARY KEY,
+    document_id INTEGER NOT NULL REFERENCES kyc_documents(id),
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    status VARCHAR(20) NOT NULL CHECK (status IN ('approved', 'rejected')),
+    reason TEXT,
+    reviewed_by_staff_id INTEGER REFERENCES support_staff(id),
+    reviewed_by_user_id INTEGER REFERENCES users(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CHECK (status = 'approved' OR reason IS NOT NULL)
+);
+
+CREATE INDEX idx_kyc_reviews_user_id ON kyc_reviews(user_id, id);
+
+CREATE TRIGGER kyc_reviews_append_only
+    BEFORE UPDATE OR DELETE ON kyc_reviews
+    FOR EACH ROW EXECUTE FUNCTION reject_ledger_change();
+
+-- Users who have not uploaded anything yet are incomplete rather than
+-- waiting for review.
+ALTER TABLE users ALTER COLUMN kyc_status SET DEFAULT 'incomplete';
+UPDATE users SET kyc_status = 'incomplete'
+WHERE COALESCE(kyc_status, 'pending') = 'pending'
+  AND NOT EXISTS (SELECT 1 FROM kyc_documents d WHERE d.user_id = users.id);
@@ -0,0 +1,4 @@
+ALTER TABLE kyc_documents
+    DROP COLUMN size_bytes,
+    DROP COLUMN content_type;
+ALTER TABLE kyc_documents RENAME COLUMN storage_key TO document_url;
@@ -0,0 +1,7 @@
+-- KYC files are uploaded to the blob store; documents keep the storage key
+-- and hand out short-lived signed URLs. Rows from before uploads hold the
+-- external URL the client sent instead of a key.
+ALTER TABLE kyc_documents RENAME COLUMN document_url TO storage_key;
+ALTER TABLE kyc_documents
+    ADD COLUMN content_type VARCHAR(100),
+    ADD COLUMN size_bytes BIGINT CHECK (size_bytes > 0);
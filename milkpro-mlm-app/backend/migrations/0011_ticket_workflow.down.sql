@@ -0,0 +1,11 @@
+ALTER TABLE ticket_messages
+    DROP CONSTRAINT ticket_messages_sender_type_check,
+    ALTER COLUMN ticket_id DROP NOT NULL;
+ALTER TABLE ticket_messages RENAME COLUMN attachment_key TO attachment_url;
+
+DROP INDEX idx_support_tickets_status;
+ALTER TABLE support_tickets
+    DROP CONSTRAINT support_tickets_priority_check,
+    DROP CONSTRAINT support_tickets_status_check,
+    ALTER COLUMN updated_at DROP NOT NULL,
+    ALTER COLUMN user_id DROP NOT NULL;
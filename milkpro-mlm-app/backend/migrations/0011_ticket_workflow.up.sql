@@ -0,0 +1,22 @@
+-- Tickets are worked through the API by users and staff. Statuses and
+-- priorities are enforced, messages may come from an admin app user as well
+-- as a support_staff account, and attachments live in the blob store like
+-- KYC files, so messages keep the storage key rather than a URL.
+UPDATE support_tickets SET status = 'open' WHERE status NOT IN ('open', 'in_progress', 'resolved', 'closed');
+UPDATE support_tickets SET priority = 'medium' WHERE priority NOT IN ('low', 'medium', 'high', 'urgent');
+UPDATE support_tickets SET updated_at = created_at WHERE updated_at IS NULL;
+ALTER TABLE support_tickets
+    ALTER COLUMN user_id SET NOT NULL,
+    ALTER COLUMN updated_at SET NOT NULL,
+    ADD CONSTRAINT support_tickets_status_check
+        CHECK (status IN ('open', 'in_progress', 'resolved', 'closed')),
+    ADD CONSTRAINT support_tickets_priority_check
+        CHECK (priority IN ('low', 'medium', 'high', 'urgent'));
+
+-- The staff queue lists tickets by status, most recently updated first.
+CREATE INDEX idx_support_tickets_status ON support_tickets(status, updated_at DESC);
+
+ALTER TABLE ticket_messages RENAME COLUMN attachment_url TO attachment_key;
+ALTER TABLE ticket_messages
+    ALTER COLUMN ticket_id SET NOT NULL,
+    ADD CONSTRAINT ticket_messages_sender_type_check CHECK (sender_type IN ('user', 'staff', 'admin'));
@@ -0,0 +1,13 @@
+ALTER TABLE chat_messages
+    DROP CONSTRAINT chat_messages_sender_type_check,
+    ALTER COLUMN created_at DROP NOT NULL,
+    ALTER COLUMN session_id DROP NOT NULL;
+
+DROP INDEX idx_chat_sessions_active_user;
+ALTER TABLE chat_sessions
+    DROP CONSTRAINT chat_sessions_ended_check,
+    DROP CONSTRAINT chat_sessions_status_check,
+    DROP COLUMN staff_read_id,
+    DROP COLUMN user_read_id,
+    ALTER COLUMN created_at DROP NOT NULL,
+    ALTER COLUMN user_id DROP NOT NULL;
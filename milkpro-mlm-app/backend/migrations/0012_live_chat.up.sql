@@ -0,0 +1,23 @@
+-- Live chat is run by the admin panel's chat hub, which stores every message
+-- and how far each side has read (the ID of the last message it has seen).
+-- A session is active until either side ends it, which sets ended_at.
+UPDATE chat_sessions SET status = 'ended' WHERE status <> 'active' OR ended_at IS NOT NULL;
+UPDATE chat_sessions SET ended_at = created_at WHERE status = 'ended' AND ended_at IS NULL;
+ALTER TABLE chat_sessions
+    ALTER COLUMN user_id SET NOT NULL,
+    ALTER COLUMN created_at SET NOT NULL,
+    ADD COLUMN user_read_id INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN staff_read_id INTEGER NOT NULL DEFAULT 0,
+    ADD CONSTRAINT chat_sessions_status_check CHECK (status IN ('active', 'ended')),
+    ADD CONSTRAINT chat_sessions_ended_check CHECK ((status = 'ended') = (ended_at IS NOT NULL));
+
+-- A user has at most one active session; connecting again resumes it.
+UPDATE chat_sessions s SET status = 'ended', ended_at = CURRENT_TIMESTAMP
+WHERE status = 'active' AND EXISTS (
+    SELECT 1 FROM chat_sessions n WHERE n.user_id = s.user_id AND n.status = 'active' AND n.id > s.id);
+CREATE UNIQUE INDEX idx_chat_sessions_active_user ON chat_sessions(user_id) WHERE status = 'active';
+
+ALTER TABLE chat_messages
+    ALTER COLUMN session_id SET NOT NULL,
+    ALTER COLUMN created_at SET NOT NULL,
+    ADD CONSTRAINT chat_messages_sender_type_check CHECK (sender_type IN ('user', 'staff'));
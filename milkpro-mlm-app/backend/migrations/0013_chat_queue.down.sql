@@ -0,0 +1,4 @@
+DROP INDEX idx_chat_sessions_queue;
+ALTER TABLE chat_sessions
+    DROP COLUMN escalated,
+    DROP COLUMN queued_at;
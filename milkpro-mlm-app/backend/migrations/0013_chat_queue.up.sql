@@ -0,0 +1,13 @@
+-- Sessions without staff wait in a queue, oldest first, until the admin
+-- panel assigns them. queued_at is reset whenever a session goes back in the
+-- queue; escalated sessions go first and only to admins.
+ALTER TABLE chat_sessions
+    ADD COLUMN queued_at TIMESTAMP,
+    ADD COLUMN escalated BOOLEAN NOT NULL DEFAULT FALSE;
+UPDATE chat_sessions SET queued_at = created_at;
+ALTER TABLE chat_sessions
+    ALTER COLUMN queued_at SET NOT NULL,
+    ALTER COLUMN queued_at SET DEFAULT CURRENT_TIMESTAMP;
+
+CREATE INDEX idx_chat_sessions_queue ON chat_sessions(escalated DESC, queued_at)
+    WHERE status = 'active' AND staff_id IS NULL;
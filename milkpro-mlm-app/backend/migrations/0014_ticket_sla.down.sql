@@ -0,0 +1,12 @@
+DROP INDEX idx_support_tickets_resolution_due;
+DROP INDEX idx_support_tickets_response_due;
+ALTER TABLE support_tickets
+    DROP COLUMN resolution_staff_id,
+    DROP COLUMN response_staff_id,
+    DROP COLUMN resolution_breached_at,
+    DROP COLUMN response_breached_at,
+    DROP COLUMN resolved_at,
+    DROP COLUMN first_response_at,
+    DROP COLUMN resolution_due,
+    DROP COLUMN first_response_due;
+DROP TABLE ticket_sla_policies;
@@ -0,0 +1,72 @@
+-- Each priority has a first-response and a resolution target, in minutes.
+-- Tickets keep the due times worked out from them, when each target was met
+-- or breached, and the staff member accountable for it.
+CREATE TABLE ticket_sla_policies (
+    priority VARCHAR(20) PRIMARY KEY CHECK (priority IN ('low', 'medium', 'high', 'urgent')),
+    first_response_minutes INTEGER NOT NULL CHECK (first_response_minutes > 0),
+    resolution_minutes INTEGER NOT NULL CHECK (resolution_minutes > 0),
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+INSERT INTO ticket_sla_policies (priority, first_response_minutes, resolution_minutes) VALUES
+    ('urgent', 30, 240),
+    ('high', 120, 1440),
+    ('medium', 480, 4320),
+    ('low', 1440, 10080);
+
+ALTER TABLE support_tickets
+    ADD COLUMN first_response_due TIMESTAMP,
+    ADD COLUMN resolution_due TIMESTAMP,
+    ADD COLUMN first_response_at TIMESTAMP,
+    ADD COLUMN resolved_at TIMESTAMP,
+    ADD COLUMN response_breached_at TIMESTAMP,
+    ADD COLUMN resolution_breached_at TIMESTAMP,
+    ADD COLUMN response_staff_id INTEGER REFERENCES support_staff(id),
+    ADD COLUMN resolution_staff_id INTEGER REFERENCES support_staff(id);
+
+-- Existing tickets get targets from their priority, are answered by their
+-- first staff or admin message and resolved when they were last updated.
+-- Targets they have already missed are recorded as breached when they fell
+-- due, so the checker does not escalate the whole backlog at once.
+UPDATE support_tickets t
+SET first_response_due = t.created_at + p.first_response_minutes * INTERVAL '1 minute',
+    resolution_due = t.created_at + p.resolution_minutes * INTERVAL '1 minute'
+FROM ticket_sla_policies p
+WHERE p.priority = t.priority;
+
+UPDATE support_tickets t
+SET first_response_at = m.created_at,
+    response_staff_id = CASE WHEN m.sender_type = 'staff' THEN m.sender_id END
+FROM (
+    SELECT DISTINCT ON (ticket_id) ticket_id, sender_type, sender_id, created_at
+    FROM ticket_messages
+    WHERE sender_type IN ('staff', 'admin')
+    ORDER BY ticket_id, id
+) m
+WHERE m.ticket_id = t.id;
+
+UPDATE support_tickets
+SET resolved_at = updated_at,
+    resolution_staff_id = assigned_to,
+    first_response_at = COALESCE(first_response_at, updated_at),
+    response_staff_id = CASE WHEN first_response_at IS NULL THEN assigned_to ELSE response_staff_id END
+WHERE status IN ('resolved', 'closed');
+
+UPDATE support_tickets
+SET response_breached_at = first_response_due,
+    response_staff_id = CASE WHEN first_response_at IS NULL THEN assigned_to ELSE response_staff_id END
+WHERE COALESCE(first_response_at, NOW()) > first_response_due;
+
+UPDATE support_tickets
+SET resolution_breached_at = resolution_due,
+    resolution_staff_id = CASE WHEN resolved_at IS NULL THEN assigned_to ELSE resolution_staff_id END
+WHERE COALESCE(resolved_at, NOW()) > resolution_due;
+
+ALTER TABLE support_tickets
+    ALTER COLUMN first_response_due SET NOT NULL,
+    ALTER COLUMN resolution_due SET NOT NULL;
+
+-- The checker looks for open targets that have fallen due.
+CREATE INDEX idx_support_tickets_response_due ON support_tickets(first_response_due)
+    WHERE first_response_at IS NULL AND response_breached_at IS NULL;
+CREATE INDEX idx_support_tickets_resolution_due ON support_tickets(resolution_due)
+    WHERE resolved_at IS NULL AND resolution_breached_at IS NULL;
@@ -0,0 +1 @@
+ALTER TABLE journal_entries DROP COLUMN created_by_staff_id;
@@ -0,0 +1,4 @@
+-- Manual wallet adjustments record who made them. created_by only holds app
+-- users (admins), so adjustments made from the admin panel name the
+-- support_staff account here instead.
+ALTER TABLE journal_entries ADD COLUMN created_by_staff_id INTEGER REFERENCES support_staff(id);
@@ -0,0 +1,240 @@
+package main
+
+import (
+    "database/sql/driver"
+    "errors"
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+)
+
+// The DECIMAL columns in the schema all have a scale of two: currency amounts,
+// quantities and percentages. They are held in Go as integers counting
+// hundredths so that sums and products are exact, and only rounded at the
+// points documented below.
+//
+// Rounding rule: whenever a product has to be reduced back to two decimal
+// places it is rounded half away from zero (0.005 -> 0.01, -0.005 -> -0.01).
+
+// Money is a currency amount in cents.
+type Money int64
+
+// Quantity is an amount of product (kg or litre) in hundredths of a unit.
+type Quantity int64
+
+// Percent is a percentage in hundredths of a percent, so 15.25% is 1525.
+type Percent int64
+
+// Density is the mass of a litre of product in hundredths of a kg, so milk at
+// 1.03 kg/l is 103. It converts quantities between kg and litres.
+type Density int64
+
+var errDecimalFormat = errors.New("invalid decimal: expected at most 2 decimal places")
+
+// parseHundredths parses a plain decimal string such as "-12.5" into
+// hundredths. Exponents and more than two fractional digits are rejected.
+func parseHundredths(s string) (int64, error) {
+    s = strings.TrimSpace(s)
+    neg := false
+    switch {
+    case strings.HasPrefix(s, "-"):
+        neg = true
+        s = s[1:]
+    case strings.HasPrefix(s, "+"):
+        s = s[1:]
+    }
+
+    whole, frac, hasPoint := strings.Cut(s, ".")
+    if whole == "" && frac == "" || hasPoint && frac == "" || len(frac) > 2 {
+        return 0, errDecimalFormat
+    }
+    for len(frac) < 2 {
+        frac += "0"
+    }
+    if whole == "" {
+        whole = "0"
+    }
+    for _, c := range whole + frac {
+        if c < '0' || c > '9' {
+            return 0, errDecimalFormat
+        }
+    }
+
+    v, err := strconv.ParseInt(whole+frac, 10, 64)
+    if err != nil {
+        return 0, errDecimalFormat
+    }
+    if neg {
+        v = -v
+    }
+    return v, nil
+}
+
+func formatHundredths(v int64) string {
+    sign := ""
+    u := uint64(v)
+    if v < 0 {
+        sign = "-"
+        u = uint64(-v)
+    }
+    return fmt.Sprintf("%s%d.%02d", sign, u/100, u%100)
+}
+
+// divRound divides n by d (d > 0), rounding half away from zero.
+func divRound(n, d int64) int64 {
+    if n < 0 {
+        return -((-n + d/2) / d)
+    }
+    return (n + d/2) / d
+}
+
+// scanHundredths converts a NUMERIC value from database/sql into hundredths.
+func scanHundredths(src interface{}) (int64, error) {
+    switch v := src.(type) {
+    case []byte:
+        return parseDBNumeric(string(v))
+    case string:
+        return parseDBNumeric(v)
+    case int64:
+        return v * 100, nil
+    case float64:
+        return int64(math.Round(v * 100)), nil
+    case nil:
+        return 0, errors.New("cannot scan NULL into a decimal; use a pointer")
+    default:
+        return 0, fmt.Errorf("cannot scan %T into a decimal", src)
+    }
+}
+
+// parseDBNumeric accepts NUMERIC text from Postgres. Aggregates such as AVG
+// can return more than two places, so those are rounded rather than rejected.
+func parseDBNumeric(s string) (int64, error) {
+    if v, err := parseHundredths(s); err == nil {
+        return v, nil
+    }
+    whole, frac, _ := strings.Cut(strings.TrimSpace(s), ".")
+    if len(frac) <= 2 {
+        return 0, errDecimalFormat
+    }
+    for _, c := range frac[2:] {
+        if c < '0' || c > '9' {
+            return 0, errDecimalFormat
+        }
+    }
+    v, err := parseHundredths(whole + "." + frac[:2])
+    if err != nil {
+        return 0, err
+    }
+    if frac[2] >= '5' {
+        if strings.HasPrefix(whole, "-") {
+            v--
+        } else {
+            v++
+        }
+    }
+    return v, nil
+}
+
+func unmarshalHundredths(data []byte) (int64, error) {
+    s := string(data)
+    if s == "null" {
+        return 0, nil
+    }
+    s = strings.Trim(s, `"`)
+    return parseHundredths(s)
+}
+
+// ParseMoney parses a decimal string such as "12.50".
+func ParseMoney(s string) (Money, error) {
+    v, err := parseHundredths(s)
+    return Money(v), err
+}
+
+func (m Money) String() string { return formatHundredths(int64(m)) }
+
+// MulQuantity returns the price of q units at m per unit, rounded to the cent.
+func (m Money) MulQuantity(q Quantity) Money {
+    return Money(divRound(int64(m)*int64(q), 100))
+}
+
+// Percent returns p percent of m, rounded to the cent.
+func (m Money) Percent(p Percent) Money {
+    return Money(divRound(int64(m)*int64(p), 100*100))
+}
+
+func (m *Money) Scan(src interface{}) error {
+    v, err := scanHundredths(src)
+    *m = Money(v)
+    return err
+}
+
+func (m Money) Value() (driver.Value, error) { return m.String(), nil }
+
+func (m Money) MarshalJSON() ([]byte, error) { return []byte(m.String()), nil }
+
+func (m *Money) UnmarshalJSON(data []byte) error {
+    v, err := unmarshalHundredths(data)
+    *m = Money(v)
+    return err
+}
+
+func (q Quantity) String() string { return formatHundredths(int64(q)) }
+
+func (q *Quantity) Scan(src interface{}) error {
+    v, err := scanHundredths(src)
+    *q = Quantity(v)
+    return err
+}
+
+func (q Quantity) Value() (driver.Value, error) { return q.String(), nil }
+
+func (q Quantity) MarshalJSON() ([]byte, error) { return []byte(q.String()), nil }
+
+func (q *Quantity) UnmarshalJSON(data []byte) error {
+    v, err := unmarshalHundredths(data)
+    *q = Quantity(v)
+    return err
+}
+
+// ParsePercent parses a percentage such as "15.25".
+func ParsePercent(s string) (Percent, error) {
+    v, err := parseHundredths(s)
+    return Percent(v), err
+}
+
+func (p Percent) String() string { return formatHundredths(int64(p)) }
+
+func (p *Percent) Scan(src interface{}) error {
+    v, err := scanHundredths(src)
+    *p = Percent(v)
+    return err
+}
+
+func (p Percent) Value() (driver.Value, error) { return p.String(), nil }
+
+func (p Percent) MarshalJSON() ([]byte, error) { return []byte(p.String()), nil }
+
+func (p *Percent) UnmarshalJSON(data []byte) error {
+    v, err := unmarshalHundredths(data)
+    *p = Percent(v)
+    return err
+}
+
+func (d Density) String() string { return formatHundredths(int64(d)) }
+
+func (d *Density) Scan(src interface{}) error {
+    v, err := scanHundredths(src)
+    *d = Density(v)
+    return err
+}
+
+func (d Density) Value() (driver.Value, error) { return d.String(), nil }
+
+func (d Density) MarshalJSON() ([]byte, error) { return []byte(d.String()), nil }
+
+func (d *Density) UnmarshalJSON(data []byte) error {
+    v, err := unmarshalHundredths(data)
+    *d = Density(v)
+    return err
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+    "encoding/json"
+    "math"
+    "testing"
+)
+
+func TestParseHundredths(t *testing.T) {
+    tests := []struct {
+        in      string
+        want    int64
+        wantErr bool
+    }{
+        {"12.50", 1250, false},
+        {"12.5", 1250, false},
+        {"12", 1200, false},
+        {".5", 50, false},
+        {"0.05", 5, false},
+        {"-12.5", -1250, false},
+        {"-0.01", -1, false},
+        {"+3.10", 310, false},
+        {" 7.25 ", 725, false},
+        {"92233720368547758.07", math.MaxInt64, false},
+        {"-92233720368547758.07", -math.MaxInt64, false},
+        {"92233720368547758.08", 0, true},
+        {"100000000000000000000", 0, true},
+        {"1.005", 0, true},
+        {"12.345", 0, true},
+        {"0.001", 0, true},
+        {"1e5", 0, true},
+        {"1.", 0, true},
+        {".", 0, true},
+        {"-", 0, true},
+        {"", 0, true},
+        {"1.2.3", 0, true},
+        {"--1", 0, true},
+        {"1,5", 0, true},
+        {"abc", 0, true},
+    }
+    for _, tt := range tests {
+        got, err := parseHundredths(tt.in)
+        if (err != nil) != tt.wantErr || got != tt.want {
+            t.Errorf("parseHundredths(%q) = %d, %v; want %d, error %v", tt.in, got, err, tt.want, tt.wantErr)
+        }
+    }
+}
+
+func TestFormatHundredths(t *testing.T) {
+    tests := []struct {
+        in   int64
+        want string
+    }{
+        {0, "0.00"},
+        {5, "0.05"},
+        {1250, "12.50"},
+        {-1, "-0.01"},
+        {-1250, "-12.50"},
+        {math.MaxInt64, "92233720368547758.07"},
+        {math.MinInt64, "-92233720368547758.08"},
+    }
+    for _, tt := range tests {
+        if got := formatHundredths(tt.in); got != tt.want {
+            t.Errorf("formatHundredths(%d) = %q, want %q", tt.in, got, tt.want)
+        }
+    }
+}
+
+func TestDivRoundHalfAwayFromZero(t *testing.T) {
+    tests := []struct {
+        n, d, want int64
+    }{
+        {0, 100, 0},
+        {149, 100, 1},
+        {150, 100, 2},
+        {151, 100, 2},
+        {250, 100, 3},
+        {-149, 100, -1},
+        {-150, 100, -2},
+        {-250, 100, -3},
+        {4999, 10000, 0},
+        {5000, 10000, 1},
+        {-5000, 10000, -1},
+        {-4999, 10000, 0},
+    }
+    for _, tt := range tests {
+        if got := divRound(tt.n, tt.d); got != tt.want {
+            t.Errorf("divRound(%d, %d) = %d, want %d", tt.n, tt.d, got, tt.want)
+        }
+    }
+}
+
+func TestMoneyArithmeticRounds(t *testing.T) {
+    tests := []struct {
+        name string
+        got  Money
+        want Money
+    }{
+        // 0.33 * 1.50 = 0.495
+        {"quantity half up", Money(33).MulQuantity(150), 50},
+        {"quantity negative half", Money(-33).MulQuantity(150), -50},
+        // 10.01 * 0.33 = 3.3033
+        {"quantity below half", Money(1001).MulQuantity(33), 330},
+        // 5% of 0.10 = 0.005
+        {"percent half up", Money(10).Percent(500), 1},
+        {"percent negative half", Money(-10).Percent(500), -1},
+        // 2.5% of 0.19 = 0.00475
+        {"percent below half", Money(19).Percent(250), 0},
+        {"percent of whole", Money(12345).Percent(10000), 12345},
+    }
+    for _, tt := range tests {
+        if tt.got != tt.want {
+            t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+        }
+    }
+}
+
+func TestScanHundredths(t *testing.T) {
+    tests := []struct {
+        name    string
+        src     interface{}
+        want    int64
+        wantErr bool
+    }{
+        {"bytes", []byte("12.50"), 1250, false},
+        {"string", "-3.07", -307, false},
+        {"bytes whole", []byte("42"), 4200, false},
+        {"int64", int64(42), 4200, false},
+        {"float64", 12.5, 1250, false},
+        {"float64 negative half", -0.125, -13, false},
+        {"aggregate rounds up", []byte("1.005"), 101, false},
+        {"aggregate rounds down", "1.00499", 100, false},
+        {"aggregate negative", "-1.005", -101, false},
+        {"aggregate negative below one", "-0.005", -1, false},
+        {"aggregate carries", "0.999", 100, false},
+        {"aggregate long", "33.3333333333333333", 3333, false},
+        {"garbage after the cents", "1.00x", 0, true},
+        {"garbage", []byte("abc"), 0, true},
+        {"overflow", "92233720368547758.08", 0, true},
+        {"null", nil, 0, true},
+        {"other type", true, 0, true},
+    }
+    for _, tt := range tests {
+        got, err := scanHundredths(tt.src)
+        if (err != nil) != tt.wantErr || (err == nil && got != tt.want) {
+            t.Errorf("%s: scanHundredths(%v) = %d, %v; want %d, error %v", tt.name, tt.src, got, err, tt.want, tt.wantErr)
+        }
+    }
+
+    var m Money
+    if err := m.Scan([]byte("19.99")); err != nil || m != 1999 {
+        t.Errorf("Money.Scan: got %v, %v", m, err)
+    }
+}
+
+func TestMoneyJSON(t *testing.T) {
+    tests := []struct {
+        in      string
+        want    Money
+        wantErr bool
+    }{
+        {`12.5`, 1250, false},
+        {`"12.50"`, 1250, false},
+        {`-0.01`, -1, false},
+        {`null`, 0, false},
+        {`12.345`, 0, true},
+        {`"1e2"`, 0, true},
+    }
+    for _, tt := range tests {
+        var m Money
+        err := json.Unmarshal([]byte(tt.in), &m)
+        if (err != nil) != tt.wantErr || (err == nil && m != tt.want) {
+            t.Errorf("unmarshalling %s: got %v, %v; want %v, error %v", tt.in, m, err, tt.want, tt.wantErr)
+        }
+    }
+
+    b, err := json.Marshal(map[string]Money{"amount": 1250})
+    if err != nil || string(b) != `{"amount":12.50}` {
+        t.Errorf("marshalling: got %s, %v", b, err)
+    }
+}
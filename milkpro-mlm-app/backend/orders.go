@@ -0,0 +1,522 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// Order statuses. A pending order has been priced but not paid for;
+// confirming it records its transactions, which charges the wallet and takes
+// the stock. Only pending orders can be cancelled.
+const (
+    orderPending    = "pending"
+    orderConfirmed  = "confirmed"
+    orderDispatched = "dispatched"
+    orderDelivered  = "delivered"
+    orderCancelled  = "cancelled"
+)
+
+var orderStatuses = []string{orderPending, orderConfirmed, orderDispatched, orderDelivered, orderCancelled}
+
+// orderTransitions lists the statuses each status may move to. Delivered and
+// cancelled are final.
+var orderTransitions = map[string][]string{
+    orderPending:    {orderConfirmed, orderCancelled},
+    orderConfirmed:  {orderDispatched},
+    orderDispatched: {orderDelivered},
+}
+
+// Who moved an order: its customer, an admin app user, a support_staff
+// account or the system.
+const (
+    actorCustomer = "customer"
+    actorAdmin    = "admin"
+    actorStaff    = "staff"
+    actorSystem   = "system"
+)
+
+func canTransitionOrder(from, to string) bool {
+    return contains(orderTransitions[from], to)
+}
+
+// maxOrderItems caps the lines on one order, and maxOrders how many orders
+// one listing returns.
+const (
+    maxOrderItems = 50
+    maxOrders     = 200
+)
+
+// orderInput is the body of the route customers place orders with. Like a
+// transaction, each item may carry the price the client showed the user.
+type orderInput struct {
+    Items []struct {
+        ProductID int      `json:"product_id"`
+        Quantity  Quantity `json:"quantity"`
+        Unit      string   `json:"unit"`
+        Price     *Money   `json:"price"`
+    } `json:"items"`
+}
+
+func (in orderInput) validate() ValidationErrors {
+    var errs ValidationErrors
+    switch {
+    case len(in.Items) == 0:
+        errs = append(errs, FieldError{"items", "required", "at least one item is required"})
+    case len(in.Items) > maxOrderItems:
+        errs = append(errs, FieldError{"items", "too_many",
+            fmt.Sprintf("an order can have at most %d items", maxOrderItems)})
+    }
+    seen := make(map[string]bool)
+    for i, item := range in.Items {
+        field := fmt.Sprintf("items.%d", i)
+        if item.Quantity <= 0 {
+            errs = append(errs, FieldError{field + ".quantity", "invalid", "quantity must be positive"})
+        }
+        if !contains(units, item.Unit) {
+            errs = append(errs, FieldError{field + ".unit", "invalid_unit",
+                fmt.Sprintf("unit must be one of %s", strings.Join(units, ", "))})
+            continue
+        }
+        key := fmt.Sprintf("%d/%s", item.ProductID, item.Unit)
+        if seen[key] {
+            errs = append(errs, FieldError{field, "duplicate", "each product and unit can only be ordered once"})
+        }
+        seen[key] = true
+    }
+    return errs
+}
+
+// priceChange is an item whose price in the book differs from the one the
+// client sent.
+type priceChange struct {
+    ProductID int    `json:"product_id"`
+    Unit      string `json:"unit"`
+    Price     Money  `json:"price"`
+}
+
+// price looks every item up in the price book for user and returns the order
+// to create. Problems with individual items come back as ValidationErrors.
+func (in orderInput) price(ctx context.Context, tx Store, user User) (Order, ValidationErrors, []priceChange, error) {
+    o := Order{UserID: user.ID}
+    var errs ValidationErrors
+    var changes []priceChange
+    for i, item := range in.Items {
+        field := fmt.Sprintf("items.%d", i)
+        p, err := tx.Products().Get(ctx, item.ProductID)
+        if err == errNotFound || (err == nil && p.ArchivedAt != nil) {
+            errs = append(errs, FieldError{field + ".product_id", "not_found", "product not found"})
+            continue
+        }
+        if err != nil {
+            return o, nil, nil, err
+        }
+
+        version, err := tx.PriceBook().Resolve(ctx, item.ProductID, item.Unit, sideBuy, user.PriceScope())
+        if err == errNotFound {
+            errs = append(errs, FieldError{field + ".unit", "unit_not_offered",
+                fmt.Sprintf("%s cannot be bought in unit %q", p.Name, item.Unit)})
+            continue
+        }
+        if err != nil {
+            return o, nil, nil, err
+        }
+        if item.Price != nil && *item.Price != version.Price {
+            changes = append(changes, priceChange{item.ProductID, item.Unit, version.Price})
+        }
+
+        o.Items = append(o.Items, OrderItem{
+            ProductID:      item.ProductID,
+            ProductName:    p.Name,
+            Quantity:       item.Quantity,
+            Unit:           item.Unit,
+            Price:          version.Price,
+            PriceVersionID: version.ID,
+        })
+        o.Total += version.Price.MulQuantity(item.Quantity)
+    }
+    return o, errs, changes, nil
+}
+
+// fillOrder records a purchase transaction for each item of o at the price
+// it was ordered at. Items that cannot be filled come back as
+// ValidationErrors; errInsufficientFunds is returned as is.
+func fillOrder(ctx context.Context, tx Store, o Order) (ValidationErrors, error) {
+    for i, item := range o.Items {
+        _, _, err := recordTransaction(ctx, tx, Transaction{
+            UserID:         o.UserID,
+            ProductID:      item.ProductID,
+            Type:           sideBuy,
+            Quantity:       item.Quantity,
+            Unit:           item.Unit,
+            Price:          item.Price,
+            PriceVersionID: item.PriceVersionID,
+            OrderID:        o.ID,
+        })
+        field := fmt.Sprintf("items.%d", i)
+        switch {
+        case err == errInsufficientStock:
+            return ValidationErrors{{field + ".quantity", "insufficient_stock",
+                fmt.Sprintf("not enough %s in stock to fill this order", item.ProductName)}}, nil
+        case err == errNoDensity:
+            return ValidationErrors{{field + ".unit", "unit_not_offered",
+                fmt.Sprintf("%s cannot be traded in unit %q", item.ProductName, item.Unit)}}, nil
+        case err != nil:
+            return nil, err
+        }
+    }
+    return nil, nil
+}
+
+// moveOrder moves order e.OrderID along orderTransitions to e.Status,
+// filling it on confirmation. A move the order does not allow, or an order
+// that cannot be filled, comes back as ValidationErrors. Call it inside
+// WithTx.
+func moveOrder(ctx context.Context, tx Store, e OrderEvent) (ValidationErrors, error) {
+    current, err := tx.Orders().LockStatus(ctx, e.OrderID)
+    if err != nil {
+        return nil, err
+    }
+    if !canTransitionOrder(current, e.Status) {
+        return ValidationErrors{{"status", "invalid_transition",
+            fmt.Sprintf("cannot change order status from %s to %q", current, e.Status)}}, nil
+    }
+
+    if e.Status == orderConfirmed {
+        o, err := tx.Orders().Get(ctx, e.OrderID)
+        if err != nil {
+            return nil, err
+        }
+        if errs, err := fillOrder(ctx, tx, o); len(errs) > 0 || err != nil {
+            return errs, err
+        }
+    }
+    return nil, tx.Orders().SetStatus(ctx, e)
+}
+
+// orderItemResponse is how order items are returned by the API.
+type orderItemResponse struct {
+    ProductID      int      `json:"product_id"`
+    ProductName    string   `json:"product_name"`
+    Quantity       Quantity `json:"quantity"`
+    Unit           string   `json:"unit"`
+    Price          Money    `json:"price"`
+    PriceVersionID int      `json:"price_version_id"`
+    TotalAmount    Money    `json:"total_amount"`
+}
+
+// orderEventResponse is one entry of an order's status history. actor is the
+// role the change was made in: customer, admin (an admin app user), staff or
+// system.
+type orderEventResponse struct {
+    Status    string    `json:"status"`
+    Note      string    `json:"note,omitempty"`
+    Actor     string    `json:"actor"`
+    ActorID   int       `json:"actor_id,omitempty"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// orderResponse is how orders are returned by the API. History is only
+// included for a single order.
+type orderResponse struct {
+    ID             int                  `json:"id"`
+    UserID         int                  `json:"user_id"`
+    Status         string               `json:"status"`
+    TotalAmount    Money                `json:"total_amount"`
+    Items          []orderItemResponse  `json:"items"`
+    History        []orderEventResponse `json:"history,omitempty"`
+    SubscriptionID int                  `json:"subscription_id,omitempty"`
+    DeliveryDate   string               `json:"delivery_date,omitempty"`
+    CreatedAt      time.Time            `json:"created_at"`
+    UpdatedAt      time.Time            `json:"updated_at"`
+}
+
+func newOrderResponse(o Order) orderResponse {
+    resp := orderResponse{
+        ID:          o.ID,
+        UserID:      o.UserID,
+        Status:      o.Status,
+        TotalAmount: o.Total,
+        Items:       []orderItemResponse{},
+        CreatedAt:   o.CreatedAt,
+        UpdatedAt:   o.UpdatedAt,
+    }
+    if o.SubscriptionID != 0 {
+        resp.SubscriptionID = o.SubscriptionID
+        resp.DeliveryDate = o.DeliveryDate.Format(dateLayout)
+    }
+    for _, item := range o.Items {
+        resp.Items = append(resp.Items, orderItemResponse{item.ProductID, item.ProductName, item.Quantity,
+            item.Unit, item.Price, item.PriceVersionID, item.Price.MulQuantity(item.Quantity)})
+    }
+    for _, e := range o.Events {
+        event := orderEventResponse{Status: e.Status, Note: e.Note, Actor: e.Actor, CreatedAt: e.CreatedAt}
+        switch e.Actor {
+        case actorStaff:
+            event.ActorID = e.StaffID
+        case actorCustomer, actorAdmin:
+            event.ActorID = e.UserID
+        }
+        resp.History = append(resp.History, event)
+    }
+    return resp
+}
+
+func orderIDFromPath(w http.ResponseWriter, r *http.Request) (int, bool) {
+    orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid order ID")
+        return 0, false
+    }
+    return orderID, true
+}
+
+// placeOrderHandler prices a cart from the price book and records it as a
+// pending order. Nothing is charged until the order is confirmed, but a
+// wallet that cannot cover the total is refused straight away.
+func (s *server) placeOrderHandler(w http.ResponseWriter, r *http.Request) {
+    userID := mustPrincipal(r).UserID
+
+    var in orderInput
+    if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid request body")
+        return
+    }
+    if errs := in.validate(); len(errs) > 0 {
+        writeValidationErrors(w, errs)
+        return
+    }
+
+    var order Order
+    var errs ValidationErrors
+    var changes []priceChange
+    err := s.store.WithTx(r.Context(), func(tx Store) error {
+        user, err := tx.Users().Get(r.Context(), userID)
+        if err != nil {
+            return err
+        }
+        order, errs, changes, err = in.price(r.Context(), tx, user)
+        switch {
+        case err != nil:
+            return err
+        case len(errs) > 0:
+            return errs
+        case len(changes) > 0:
+            return errPriceChanged
+        case user.Balance < order.Total:
+            return errInsufficientFunds
+        }
+        order.ID, err = tx.Orders().Create(r.Context(), order, OrderEvent{Actor: actorCustomer, UserID: userID})
+        return err
+    })
+    switch {
+    case len(errs) > 0:
+        writeValidationErrors(w, errs)
+        return
+    case err == errPriceChanged:
+        writeJSON(w, http.StatusConflict, map[string]interface{}{
+            "error": "Price has changed",
+            "items": changes,
+        })
+        return
+    case err == errInsufficientFunds:
+        writeError(w, http.StatusUnprocessableEntity, "Insufficient wallet balance")
+        return
+    case err != nil:
+        writeError(w, http.StatusInternalServerError, "Failed to place order")
+        return
+    }
+
+    writeJSON(w, http.StatusCreated, map[string]interface{}{
+        "id":           order.ID,
+        "status":       orderPending,
+        "total_amount": order.Total,
+        "message":      "Order placed successfully",
+    })
+}
+
+func (s *server) listOrdersHandler(w http.ResponseWriter, r *http.Request) {
+    userID := mustPrincipal(r).UserID
+
+    list, err := s.store.Orders().List(r.Context(), OrderFilter{UserID: userID, Limit: maxOrders})
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch orders")
+        return
+    }
+
+    orders := []orderResponse{}
+    for _, o := range list {
+        orders = append(orders, newOrderResponse(o))
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(orders)
+}
+
+// userOrder loads order id for its owner, answering 404 for anyone else's.
+func (s *server) userOrder(w http.ResponseWriter, r *http.Request) (Order, bool) {
+    orderID, ok := orderIDFromPath(w, r)
+    if !ok {
+        return Order{}, false
+    }
+    o, err := s.store.Orders().Get(r.Context(), orderID)
+    if err == errNotFound || (err == nil && o.UserID != mustPrincipal(r).UserID) {
+        writeError(w, http.StatusNotFound, "Order not found")
+        return o, false
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch order")
+        return o, false
+    }
+    return o, true
+}
+
+func (s *server) getOrderHandler(w http.ResponseWriter, r *http.Request) {
+    o, ok := s.userOrder(w, r)
+    if !ok {
+        return
+    }
+    writeJSON(w, http.StatusOK, newOrderResponse(o))
+}
+
+// cancelOrderHandler lets a customer cancel their own order while it is
+// still pending.
+func (s *server) cancelOrderHandler(w http.ResponseWriter, r *http.Request) {
+    o, ok := s.userOrder(w, r)
+    if !ok {
+        return
+    }
+
+    var req struct {
+        Reason string `json:"reason"`
+    }
+    if r.ContentLength != 0 {
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            writeError(w, http.StatusBadRequest, "Invalid request body")
+            return
+        }
+    }
+
+    s.moveOrderAndRespond(w, r, OrderEvent{OrderID: o.ID, Status: orderCancelled, Note: req.Reason,
+        Actor: actorCustomer, UserID: o.UserID})
+}
+
+func (s *server) adminListOrdersHandler(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+    f := OrderFilter{Status: q.Get("status"), Limit: maxOrders}
+    if f.Status != "" && !contains(orderStatuses, f.Status) {
+        writeError(w, http.StatusBadRequest, "Invalid status")
+        return
+    }
+    if v := q.Get("user_id"); v != "" {
+        id, err := strconv.Atoi(v)
+        if err != nil {
+            writeError(w, http.StatusBadRequest, "Invalid user ID")
+            return
+        }
+        f.UserID = id
+    }
+
+    list, err := s.store.Orders().List(r.Context(), f)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch orders")
+        return
+    }
+
+    orders := []orderResponse{}
+    for _, o := range list {
+        orders = append(orders, newOrderResponse(o))
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(orders)
+}
+
+func (s *server) adminGetOrderHandler(w http.ResponseWriter, r *http.Request) {
+    orderID, ok := orderIDFromPath(w, r)
+    if !ok {
+        return
+    }
+    o, err := s.store.Orders().Get(r.Context(), orderID)
+    if err == errNotFound {
+        writeError(w, http.StatusNotFound, "Order not found")
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch order")
+        return
+    }
+    writeJSON(w, http.StatusOK, newOrderResponse(o))
+}
+
+// orderStatusHandler moves an order along orderTransitions on behalf of the
+// calling staff member.
+func (s *server) orderStatusHandler(w http.ResponseWriter, r *http.Request) {
+    orderID, ok := orderIDFromPath(w, r)
+    if !ok {
+        return
+    }
+
+    var req struct {
+        Status string `json:"status"`
+        Note   string `json:"note"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid request body")
+        return
+    }
+
+    staff := staffFromContext(r.Context())
+    actor := actorAdmin
+    if staff.StaffID != 0 {
+        actor = actorStaff
+    }
+    s.moveOrderAndRespond(w, r, OrderEvent{
+        OrderID: orderID,
+        Status:  req.Status,
+        Note:    req.Note,
+        Actor:   actor,
+        StaffID: staff.StaffID,
+        UserID:  staff.UserID,
+    })
+}
+
+// moveOrderAndRespond runs moveOrder in a transaction and answers with the
+// order as it now stands.
+func (s *server) moveOrderAndRespond(w http.ResponseWriter, r *http.Request, e OrderEvent) {
+    var errs ValidationErrors
+    err := s.store.WithTx(r.Context(), func(tx Store) error {
+        var err error
+        if errs, err = moveOrder(r.Context(), tx, e); len(errs) > 0 {
+            return errs
+        }
+        return err
+    })
+    switch {
+    case len(errs) > 0:
+        writeValidationErrors(w, errs)
+        return
+    case err == errNotFound:
+        writeError(w, http.StatusNotFound, "Order not found")
+        return
+    case err == errInsufficientFunds:
+        writeError(w, http.StatusUnprocessableEntity, "Insufficient wallet balance")
+        return
+    case err != nil:
+        writeError(w, http.StatusInternalServerError, "Failed to update order")
+        return
+    }
+
+    o, err := s.store.Orders().Get(r.Context(), e.OrderID)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch order")
+        return
+    }
+    writeJSON(w, http.StatusOK, newOrderResponse(o))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "testing"
+)
+
+func TestOrderHistoryLabelsActorRoles(t *testing.T) {
+    ts := newTestServer(t)
+    ctx := context.Background()
+    adminID := ts.createUser(t, "+15550001", 0)
+    admin := ts.mem.root.users[adminID]
+    admin.IsAdmin = true
+    ts.mem.root.users[adminID] = admin
+    ts.deposit(t, adminID, 10000)
+    productID, err := ts.mem.Products().Create(ctx, Product{Name: "Milk", Type: "milk", StockUnit: unitLitre})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := ts.mem.PriceBook().Add(ctx, PriceVersion{ProductID: productID, Unit: unitLitre, Side: sideBuy,
+        Price: 250}); err != nil {
+        t.Fatal(err)
+    }
+
+    // The admin orders for themselves, then cancels the order from the
+    // admin API.
+    token := ts.token(t, "+15550001")
+    w := ts.request("POST", "/api/v1/me/orders", token,
+        fmt.Sprintf(`{"items": [{"product_id": %d, "quantity": 2, "unit": "litre"}]}`, productID))
+    if w.Code != http.StatusCreated {
+        t.Fatalf("placing the order: got %d: %s", w.Code, w.Body.String())
+    }
+    var order orderResponse
+    if err := json.Unmarshal(w.Body.Bytes(), &order); err != nil {
+        t.Fatal(err)
+    }
+    w = ts.request("POST", fmt.Sprintf("/admin/api/orders/%d/status", order.ID), token, `{"status": "cancelled"}`)
+    if w.Code != http.StatusOK {
+        t.Fatalf("cancelling the order: got %d: %s", w.Code, w.Body.String())
+    }
+
+    w = ts.request("GET", fmt.Sprintf("/api/v1/me/orders/%d", order.ID), token, "")
+    if err := json.Unmarshal(w.Body.Bytes(), &order); err != nil {
+        t.Fatal(err)
+    }
+    want := []orderEventResponse{
+        {Status: orderPending, Actor: actorCustomer, ActorID: adminID},
+        {Status: orderCancelled, Actor: actorAdmin, ActorID: adminID},
+    }
+    if len(order.History) != len(want) {
+        t.Fatalf("got history %+v", order.History)
+    }
+    for i, e := range order.History {
+        if e.Status != want[i].Status || e.Actor != want[i].Actor || e.ActorID != want[i].ActorID {
+            t.Errorf("event %d: got %s by %s %d, want %s by %s %d", i, e.Status, e.Actor, e.ActorID,
+                want[i].Status, want[i].Actor, want[i].ActorID)
+        }
+    }
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+    "context"
+    "net/http"
+)
+
+// Staff roles, matching support_staff.role in the admin panel.
+const (
+    roleSupport = "support"
+    roleAdmin   = "admin"
+)
+
+// Permission names an action on the admin API. The admin panel guards its
+// pages with the same names.
+type Permission string
+
+const (
+    permDashboardView  Permission = "dashboard:view"
+    permUsersView      Permission = "users:view"
+    permKYCReview      Permission = "kyc:review"
+    permProductsWrite  Permission = "products:write"
+    permProjectsWrite  Permission = "projects:write"
+    permOrdersFulfil   Permission = "orders:fulfil"
+    permTicketsAssign  Permission = "tickets:assign"
+    permPayoutsApprove Permission = "payouts:approve"
+    permSupportChat    Permission = "support:chat"
+)
+
+// rolePermissions maps each role to what it may do. Support agents work
+// tickets and chats only; admins can do everything.
+var rolePermissions = map[string][]Permission{
+    roleSupport: {permSupportChat},
+    roleAdmin: {
+        permDashboardView, permUsersView, permKYCReview, permProductsWrite,
+        permProjectsWrite, permOrdersFulfil, permTicketsAssign, permPayoutsApprove, permSupportChat,
+    },
+}
+
+func roleCan(role string, p Permission) bool {
+    for _, granted := range rolePermissions[role] {
+        if granted == p {
+            return true
+        }
+    }
+    return false
+}
+
+// StaffPrincipal is the authenticated caller of an admin API route: either
+// a support_staff account acting through the admin panel (StaffID set) or an
+// app user flagged is_admin (UserID set).
+type StaffPrincipal struct {
+    StaffID int
+    UserID  int
+    Role    string
+}
+
+func (p *StaffPrincipal) Can(perm Permission) bool {
+    return p != nil && roleCan(p.Role, perm)
+}
+
+type staffContextKey struct{}
+
+func withStaff(ctx context.Context, p *StaffPrincipal) context.Context {
+    return context.WithValue(ctx, staffContextKey{}, p)
+}
+
+func staffFromContext(ctx context.Context) *StaffPrincipal {
+    p, _ := ctx.Value(staffContextKey{}).(*StaffPrincipal)
+    return p
+}
+
+// requirePermission authenticates the caller with adminMiddleware and
+// refuses them unless their role grants p.
+func (s *server) requirePermission(p Permission, next http.HandlerFunc) http.HandlerFunc {
+    return s.adminMiddleware(func(w http.ResponseWriter, r *http.Request) {
+        if !staffFromContext(r.Context()).Can(p) {
+            writeError(w, http.StatusForbidden, "Forbidden")
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
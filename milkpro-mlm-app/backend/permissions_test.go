@@ -0,0 +1,97 @@
+package main
+
+import (
+    "go/ast"
+    "go/parser"
+    "go/token"
+    "reflect"
+    "sort"
+    "strconv"
+    "testing"
+)
+
+// adminPanelRolePermissions reads the admin panel's rolePermissions table
+// from its source, resolving the role and permission constants it names.
+func adminPanelRolePermissions(t *testing.T) map[string][]string {
+    t.Helper()
+    fset := token.NewFileSet()
+    var files []*ast.File
+    for _, name := range []string{"../admin-panel/permissions.go", "../admin-panel/staff.go"} {
+        f, err := parser.ParseFile(fset, name, nil, 0)
+        if err != nil {
+            t.Fatal(err)
+        }
+        files = append(files, f)
+    }
+
+    consts := make(map[string]string)
+    var table *ast.CompositeLit
+    for _, f := range files {
+        for _, decl := range f.Decls {
+            gen, ok := decl.(*ast.GenDecl)
+            if !ok {
+                continue
+            }
+            for _, spec := range gen.Specs {
+                vs, ok := spec.(*ast.ValueSpec)
+                if !ok {
+                    continue
+                }
+                for i, name := range vs.Names {
+                    if i >= len(vs.Values) {
+                        break
+                    }
+                    switch v := vs.Values[i].(type) {
+                    case *ast.BasicLit:
+                        if s, err := strconv.Unquote(v.Value); gen.Tok == token.CONST && err == nil {
+                            consts[name.Name] = s
+                        }
+                    case *ast.CompositeLit:
+                        if name.Name == "rolePermissions" {
+                            table = v
+                        }
+                    }
+                }
+            }
+        }
+    }
+    if table == nil {
+        t.Fatal("rolePermissions not found in the admin panel")
+    }
+
+    resolve := func(e ast.Expr) string {
+        t.Helper()
+        id, ok := e.(*ast.Ident)
+        if !ok || consts[id.Name] == "" {
+            t.Fatalf("admin panel rolePermissions: cannot resolve %s", fset.Position(e.Pos()))
+        }
+        return consts[id.Name]
+    }
+    roles := make(map[string][]string)
+    for _, elt := range table.Elts {
+        kv := elt.(*ast.KeyValueExpr)
+        role := resolve(kv.Key)
+        roles[role] = []string{}
+        for _, p := range kv.Value.(*ast.CompositeLit).Elts {
+            roles[role] = append(roles[role], resolve(p))
+        }
+        sort.Strings(roles[role])
+    }
+    return roles
+}
+
+// The admin panel hides pages with the same table the backend enforces, so
+// the two copies must agree.
+func TestRolePermissionsMatchAdminPanel(t *testing.T) {
+    want := make(map[string][]string)
+    for role, perms := range rolePermissions {
+        want[role] = []string{}
+        for _, p := range perms {
+            want[role] = append(want[role], string(p))
+        }
+        sort.Strings(want[role])
+    }
+    if got := adminPanelRolePermissions(t); !reflect.DeepEqual(got, want) {
+        t.Errorf("admin panel grants %v, backend grants %v", got, want)
+    }
+}
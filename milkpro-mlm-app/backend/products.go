@@ -0,0 +1,375 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "sort"
+    "strings"
+    "time"
+)
+
+// Product types, matching the products_type_check constraint.
+var productTypes = []string{"milk", "dairy", "feed"}
+
+// Units of measure products are priced and traded in.
+const (
+    unitKg    = "kg"
+    unitLitre = "litre"
+)
+
+var units = []string{unitKg, unitLitre}
+
+// Price book sides, named like transactions.type from the user's point of
+// view: the buy price is what a user pays us, the sell price what we pay a
+// user for their produce.
+const (
+    sideBuy  = "buy"
+    sideSell = "sell"
+)
+
+var sides = []string{sideBuy, sideSell}
+
+var (
+    errNoPrice      = errors.New("no price applies")
+    errPriceChanged = errors.New("price differs from the price book")
+)
+
+// Limits of users.region and users.price_tier.
+const (
+    maxRegionLength = 50
+    maxTierLength   = 20
+)
+
+func contains(list []string, s string) bool {
+    for _, v := range list {
+        if v == s {
+            return true
+        }
+    }
+    return false
+}
+
+func (p UnitPrices) get(side string) Money {
+    if side == sideSell {
+        return p.Sell
+    }
+    return p.Buy
+}
+
+func (p UnitPrices) with(side string, price Money) UnitPrices {
+    if side == sideSell {
+        p.Sell = price
+    } else {
+        p.Buy = price
+    }
+    return p
+}
+
+// productInput is the body of the admin create and update product routes.
+// Stock settings left out keep their current values, or their defaults for a
+// new product. So do prices: a unit or side left out keeps its price, and one
+// sent as null is removed, as in {"litre": {"sell": null}} or {"kg": null}.
+type productInput struct {
+    Name              string                      `json:"name"`
+    Type              string                      `json:"type"`
+    Prices            map[string]*unitPricesInput `json:"prices"`
+    StockUnit         string                      `json:"stock_unit"`
+    Density           *Density                    `json:"density"`
+    LowStockThreshold *Quantity                   `json:"low_stock_threshold"`
+}
+
+// unitPricesInput is one unit's prices in a productInput.
+type unitPricesInput struct {
+    Buy  priceInput `json:"buy"`
+    Sell priceInput `json:"sell"`
+}
+
+func (p unitPricesInput) get(side string) priceInput {
+    if side == sideSell {
+        return p.Sell
+    }
+    return p.Buy
+}
+
+// priceInput is one price in a productInput. Sent reports whether it was in
+// the body at all; Price is nil if it was sent as null.
+type priceInput struct {
+    Sent  bool
+    Price *Money
+}
+
+func (p *priceInput) UnmarshalJSON(b []byte) error {
+    p.Sent = true
+    if string(b) == "null" {
+        p.Price = nil
+        return nil
+    }
+    p.Price = new(Money)
+    return json.Unmarshal(b, p.Price)
+}
+
+func (p priceInput) valid() bool {
+    return !p.Sent || p.Price == nil || *p.Price > 0
+}
+
+func (in productInput) validate() ValidationErrors {
+    var errs ValidationErrors
+    if strings.TrimSpace(in.Name) == "" {
+        errs = append(errs, FieldError{"name", "required", "name is required"})
+    }
+    if !contains(productTypes, in.Type) {
+        errs = append(errs, FieldError{"type", "invalid",
+            fmt.Sprintf("type must be one of %s", strings.Join(productTypes, ", "))})
+    }
+    if len(in.Prices) == 0 {
+        errs = append(errs, FieldError{"prices", "required", "at least one unit price is required"})
+    }
+    for _, unit := range in.units() {
+        prices := in.Prices[unit]
+        switch {
+        case !contains(units, unit):
+            errs = append(errs, FieldError{"prices." + unit, "invalid_unit",
+                fmt.Sprintf("unit must be one of %s", strings.Join(units, ", "))})
+        case prices == nil:
+        case !prices.Buy.valid() || !prices.Sell.valid():
+            errs = append(errs, FieldError{"prices." + unit, "invalid",
+                "prices must be positive; send null to remove one"})
+        case !prices.Buy.Sent && !prices.Sell.Sent:
+            errs = append(errs, FieldError{"prices." + unit, "required", "a buy or sell price is required"})
+        }
+    }
+    if in.StockUnit != "" && !contains(units, in.StockUnit) {
+        errs = append(errs, FieldError{"stock_unit", "invalid_unit",
+            fmt.Sprintf("stock_unit must be one of %s", strings.Join(units, ", "))})
+    }
+    if in.Density != nil && *in.Density <= 0 {
+        errs = append(errs, FieldError{"density", "invalid", "density must be positive"})
+    }
+    if in.LowStockThreshold != nil && *in.LowStockThreshold < 0 {
+        errs = append(errs, FieldError{"low_stock_threshold", "invalid", "low_stock_threshold cannot be negative"})
+    }
+    return errs
+}
+
+func (in productInput) units() []string {
+    names := make([]string, 0, len(in.Prices))
+    for unit := range in.Prices {
+        names = append(names, unit)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// applyTo returns p with the fields in sets.
+func (in productInput) applyTo(p Product) Product {
+    p.Name = strings.TrimSpace(in.Name)
+    p.Type = in.Type
+    switch {
+    case in.StockUnit != "":
+        p.StockUnit = in.StockUnit
+    case p.StockUnit == "":
+        p.StockUnit = defaultStockUnit(in.Type)
+    }
+    if in.Density != nil {
+        p.Density = *in.Density
+    }
+    if in.LowStockThreshold != nil {
+        p.LowStockThreshold = in.LowStockThreshold
+    }
+    return p
+}
+
+// price returns the price in sets for unit and side, zero if it removes it,
+// and whether it says anything about it at all.
+func (in productInput) price(unit, side string) (Money, bool) {
+    prices, ok := in.Prices[unit]
+    if !ok {
+        return 0, false
+    }
+    if prices == nil {
+        return 0, true
+    }
+    p := prices.get(side)
+    if p.Price == nil {
+        return 0, p.Sent
+    }
+    return *p.Price, true
+}
+
+// priceUnits returns the units p will be priced in once in is applied.
+func (in productInput) priceUnits(p Product) []string {
+    var priced []string
+    for _, unit := range units {
+        for _, side := range sides {
+            price, ok := in.price(unit, side)
+            if !ok {
+                price = p.Prices[unit].get(side)
+            }
+            if price > 0 {
+                priced = append(priced, unit)
+                break
+            }
+        }
+    }
+    return priced
+}
+
+// priceChanges returns the default price versions, effective now, that bring
+// p's current prices in line with in: a new version for each price that
+// changed, and a zero one withdrawing each price removed. Units and sides in
+// leaves out keep their prices.
+func (in productInput) priceChanges(p Product) []PriceVersion {
+    var versions []PriceVersion
+    for _, unit := range in.units() {
+        for _, side := range sides {
+            price, ok := in.price(unit, side)
+            if ok && price != p.Prices[unit].get(side) {
+                versions = append(versions, PriceVersion{ProductID: p.ID, Unit: unit, Side: side, Price: price})
+            }
+        }
+    }
+    return versions
+}
+
+// setDefaultPrices adds the versions that make in's prices the current
+// default prices of product id.
+func setDefaultPrices(ctx context.Context, tx Store, id int, in productInput) error {
+    current, err := tx.Products().Get(ctx, id)
+    if err != nil {
+        return err
+    }
+    for _, v := range in.priceChanges(current) {
+        if _, err := tx.PriceBook().Add(ctx, v); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// productResponse is how products are returned by the API.
+type productResponse struct {
+    ID         int                   `json:"id"`
+    Name       string                `json:"name"`
+    Type       string                `json:"type"`
+    Prices     map[string]UnitPrices `json:"prices"`
+    ArchivedAt *time.Time            `json:"archived_at,omitempty"`
+
+    // Deprecated: Price is the sell price in the product's stock unit, for
+    // app releases that predate Prices. Remove it in the next release.
+    Price Money `json:"price"`
+}
+
+func newProductResponse(p Product) productResponse {
+    prices := p.Prices
+    if prices == nil {
+        prices = map[string]UnitPrices{}
+    }
+    unit := p.StockUnit
+    if unit == "" {
+        unit = defaultStockUnit(p.Type)
+    }
+    return productResponse{p.ID, p.Name, p.Type, prices, p.ArchivedAt, prices[unit].Sell}
+}
+
+// adminProductResponse adds the stock settings, which the public product list
+// does not show.
+type adminProductResponse struct {
+    productResponse
+    StockUnit         string    `json:"stock_unit"`
+    Density           *Density  `json:"density"`
+    Stock             Quantity  `json:"stock"`
+    LowStockThreshold *Quantity `json:"low_stock_threshold"`
+}
+
+func newAdminProductResponse(p Product) adminProductResponse {
+    var density *Density
+    if p.Density > 0 {
+        density = &p.Density
+    }
+    return adminProductResponse{newProductResponse(p), p.StockUnit, density, p.Stock, p.LowStockThreshold}
+}
+
+// priceScope normalises a region and tier as given by an admin. Both are
+// matched case-insensitively, so they are stored in lower case.
+func priceScope(region, tier string) (PriceScope, ValidationErrors) {
+    scope := PriceScope{
+        Region: strings.ToLower(strings.TrimSpace(region)),
+        Tier:   strings.ToLower(strings.TrimSpace(tier)),
+    }
+    var errs ValidationErrors
+    if len(scope.Region) > maxRegionLength {
+        errs = append(errs, FieldError{"region", "too_long",
+            fmt.Sprintf("region must be at most %d characters", maxRegionLength)})
+    }
+    if len(scope.Tier) > maxTierLength {
+        errs = append(errs, FieldError{"tier", "too_long",
+            fmt.Sprintf("tier must be at most %d characters", maxTierLength)})
+    }
+    return scope, errs
+}
+
+// priceVersionInput is the body of the admin route that adds a price version.
+// Without effective_from the price takes effect immediately.
+type priceVersionInput struct {
+    Unit           string     `json:"unit"`
+    Side           string     `json:"side"`
+    Region         string     `json:"region"`
+    Tier           string     `json:"tier"`
+    Price          Money      `json:"price"`
+    EffectiveFrom  *time.Time `json:"effective_from"`
+    EffectiveUntil *time.Time `json:"effective_until"`
+}
+
+// version validates in and returns the version to add to productID's price
+// book. Prices cannot be back-dated, since transactions already made were
+// priced from the book as it stood.
+func (in priceVersionInput) version(productID int, now time.Time) (PriceVersion, ValidationErrors) {
+    scope, errs := priceScope(in.Region, in.Tier)
+    if !contains(units, in.Unit) {
+        errs = append(errs, FieldError{"unit", "invalid_unit",
+            fmt.Sprintf("unit must be one of %s", strings.Join(units, ", "))})
+    }
+    if !contains(sides, in.Side) {
+        errs = append(errs, FieldError{"side", "invalid",
+            fmt.Sprintf("side must be one of %s", strings.Join(sides, ", "))})
+    }
+    if in.Price <= 0 {
+        errs = append(errs, FieldError{"price", "invalid", "price must be positive"})
+    }
+
+    v := PriceVersion{ProductID: productID, Unit: in.Unit, Side: in.Side, Scope: scope, Price: in.Price,
+        EffectiveUntil: in.EffectiveUntil}
+    start := now
+    if in.EffectiveFrom != nil {
+        if in.EffectiveFrom.Before(now) {
+            errs = append(errs, FieldError{"effective_from", "in_past", "effective_from cannot be in the past"})
+        }
+        v.EffectiveFrom = *in.EffectiveFrom
+        start = v.EffectiveFrom
+    }
+    if in.EffectiveUntil != nil && !in.EffectiveUntil.After(start) {
+        errs = append(errs, FieldError{"effective_until", "before_start",
+            "effective_until must be after effective_from"})
+    }
+    return v, errs
+}
+
+// priceVersionResponse is how price book entries are returned by the API.
+type priceVersionResponse struct {
+    ID             int        `json:"id"`
+    Unit           string     `json:"unit"`
+    Side           string     `json:"side"`
+    Region         string     `json:"region,omitempty"`
+    Tier           string     `json:"tier,omitempty"`
+    Price          Money      `json:"price"`
+    EffectiveFrom  time.Time  `json:"effective_from"`
+    EffectiveUntil *time.Time `json:"effective_until,omitempty"`
+    CreatedAt      time.Time  `json:"created_at"`
+}
+
+func newPriceVersionResponse(v PriceVersion) priceVersionResponse {
+    return priceVersionResponse{v.ID, v.Unit, v.Side, v.Scope.Region, v.Scope.Tier, v.Price,
+        v.EffectiveFrom, v.EffectiveUntil, v.CreatedAt}
+}
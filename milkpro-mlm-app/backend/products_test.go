@@ -0,0 +1,230 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "reflect"
+    "testing"
+)
+
+func TestProductInputValidate(t *testing.T) {
+    tests := []struct {
+        name   string
+        body   string
+        fields []string
+    }{
+        {"valid", `{"name": "Milk", "type": "milk", "prices": {"litre": {"buy": 2.50, "sell": 1.80}}}`, nil},
+        {"removal", `{"name": "Milk", "type": "milk", "prices": {"litre": {"buy": 2.50}, "kg": null}}`, nil},
+        {"no name", `{"name": " ", "type": "milk", "prices": {"litre": {"buy": 2.50}}}`, []string{"name"}},
+        {"unknown type", `{"name": "Milk", "type": "juice", "prices": {"litre": {"buy": 2.50}}}`, []string{"type"}},
+        {"no prices", `{"name": "Milk", "type": "milk", "prices": {}}`, []string{"prices"}},
+        {"unknown unit", `{"name": "Milk", "type": "milk", "prices": {"gallon": {"buy": 7.00}}}`,
+            []string{"prices.gallon"}},
+    }
+    for _, tt := range tests {
+        var in productInput
+        if err := json.Unmarshal([]byte(tt.body), &in); err != nil {
+            t.Fatalf("%s: %v", tt.name, err)
+        }
+        var fields []string
+        for _, e := range in.validate() {
+            fields = append(fields, e.Field)
+        }
+        if !reflect.DeepEqual(fields, tt.fields) {
+            t.Errorf("%s: got errors on %v, want %v", tt.name, fields, tt.fields)
+        }
+    }
+}
+
+func TestProductInputRemovesPrices(t *testing.T) {
+    current := Product{ID: 1, StockUnit: unitLitre, Prices: map[string]UnitPrices{
+        unitLitre: {Buy: 250, Sell: 180},
+        unitKg:    {Buy: 240},
+    }}
+    tests := []struct {
+        name   string
+        prices string
+        want   []PriceVersion
+        priced []string
+    }{
+        {"left out", `{"litre": {"buy": 2.60}}`,
+            []PriceVersion{{ProductID: 1, Unit: unitLitre, Side: sideBuy, Price: 260}},
+            []string{unitKg, unitLitre}},
+        {"unchanged", `{"litre": {"buy": 2.50, "sell": 1.80}}`, nil, []string{unitKg, unitLitre}},
+        {"one side", `{"litre": {"sell": null}}`,
+            []PriceVersion{{ProductID: 1, Unit: unitLitre, Side: sideSell, Price: 0}},
+            []string{unitKg, unitLitre}},
+        {"whole unit", `{"kg": null}`,
+            []PriceVersion{{ProductID: 1, Unit: unitKg, Side: sideBuy, Price: 0}},
+            []string{unitLitre}},
+        {"side without a price", `{"kg": {"sell": null}}`, nil, []string{unitKg, unitLitre}},
+    }
+    for _, tt := range tests {
+        var in productInput
+        body := `{"name": "Milk", "type": "milk", "prices": ` + tt.prices + `}`
+        if err := json.Unmarshal([]byte(body), &in); err != nil {
+            t.Fatalf("%s: %v", tt.name, err)
+        }
+        if errs := in.validate(); len(errs) > 0 {
+            t.Errorf("%s: %v", tt.name, errs)
+            continue
+        }
+        if got := in.priceChanges(current); !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%s: got changes %+v, want %+v", tt.name, got, tt.want)
+        }
+        if got := in.priceUnits(current); !reflect.DeepEqual(got, tt.priced) {
+            t.Errorf("%s: priced in %v, want %v", tt.name, got, tt.priced)
+        }
+    }
+
+    for _, prices := range []string{`{"litre": {"buy": 0}}`, `{"litre": {"buy": -1}}`, `{"litre": {}}`} {
+        var in productInput
+        if err := json.Unmarshal([]byte(`{"name": "Milk", "type": "milk", "prices": `+prices+`}`), &in); err != nil {
+            t.Fatal(err)
+        }
+        if errs := in.validate(); len(errs) != 1 || errs[0].Field != "prices.litre" {
+            t.Errorf("%s: got %v", prices, errs)
+        }
+    }
+}
+
+func TestProductResponseKeepsDeprecatedPrice(t *testing.T) {
+    tests := []struct {
+        name    string
+        product Product
+        want    Money
+    }{
+        {"stock unit", Product{Type: "milk", StockUnit: unitKg, Prices: map[string]UnitPrices{
+            unitLitre: {Buy: 250, Sell: 180}, unitKg: {Buy: 240, Sell: 175}}}, 175},
+        {"default unit", Product{Type: "milk", Prices: map[string]UnitPrices{
+            unitLitre: {Buy: 250, Sell: 180}, unitKg: {Buy: 240, Sell: 175}}}, 180},
+        {"not sold in the stock unit", Product{Type: "feed", StockUnit: unitKg, Prices: map[string]UnitPrices{
+            unitKg: {Buy: 900}}}, 0},
+        {"no prices", Product{Type: "dairy", StockUnit: unitKg}, 0},
+    }
+    for _, tt := range tests {
+        body, err := json.Marshal(newProductResponse(tt.product))
+        if err != nil {
+            t.Fatal(err)
+        }
+        var got struct {
+            Price *Money `json:"price"`
+        }
+        if err := json.Unmarshal(body, &got); err != nil {
+            t.Fatal(err)
+        }
+        if got.Price == nil || *got.Price != tt.want {
+            t.Errorf("%s: got %s, want price %v", tt.name, body, tt.want)
+        }
+    }
+}
+
+func TestWithdrawnPriceNoLongerApplies(t *testing.T) {
+    ctx := context.Background()
+    s := newMemoryStore()
+    id, err := s.Products().Create(ctx, Product{Name: "Milk", Type: "milk", StockUnit: unitLitre})
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, v := range []PriceVersion{
+        {ProductID: id, Unit: unitLitre, Side: sideSell, Price: 180},
+        {ProductID: id, Unit: unitLitre, Side: sideSell, Scope: PriceScope{Region: "north"}, Price: 190},
+        {ProductID: id, Unit: unitLitre, Side: sideBuy, Price: 250},
+        {ProductID: id, Unit: unitLitre, Side: sideSell, Price: 0},
+    } {
+        if _, err := s.PriceBook().Add(ctx, v); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    if _, err := s.PriceBook().Resolve(ctx, id, unitLitre, sideSell, PriceScope{}); err != errNotFound {
+        t.Errorf("resolving a withdrawn price: got %v, want %v", err, errNotFound)
+    }
+    if v, err := s.PriceBook().Resolve(ctx, id, unitLitre, sideSell, PriceScope{Region: "north"}); err != nil || v.Price != 190 {
+        t.Errorf("resolving an override: got %v, %v", v.Price, err)
+    }
+    p, err := s.Products().Get(ctx, id)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := map[string]UnitPrices{unitLitre: {Buy: 250}}; !reflect.DeepEqual(p.Prices, want) {
+        t.Errorf("got prices %+v, want %+v", p.Prices, want)
+    }
+}
+
+func TestManageProductPrices(t *testing.T) {
+    ts := newTestServer(t)
+    ctx := context.Background()
+    adminID := ts.createUser(t, "+15550001", 0)
+    admin := ts.mem.root.users[adminID]
+    admin.IsAdmin = true
+    ts.mem.root.users[adminID] = admin
+    token := ts.token(t, "+15550001")
+
+    w := ts.request("POST", "/admin/api/products", token, `{"name": "Milk", "type": "milk", "prices": {"litre": null}}`)
+    if w.Code != http.StatusUnprocessableEntity {
+        t.Errorf("creating a product without prices: got %d: %s", w.Code, w.Body.String())
+    }
+    w = ts.request("POST", "/admin/api/products", token,
+        `{"name": "Milk", "type": "milk", "density": 1.03,
+            "prices": {"litre": {"buy": 2.50, "sell": 1.80}, "kg": {"buy": 2.40}}}`)
+    if w.Code != http.StatusCreated {
+        t.Fatalf("creating: got %d: %s", w.Code, w.Body.String())
+    }
+    var created struct {
+        ID int `json:"id"`
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+        t.Fatal(err)
+    }
+
+    w = ts.request("POST", fmt.Sprintf("/admin/api/products/%d/prices", created.ID), token,
+        `{"unit": "litre", "side": "sell", "price": 1.95, "region": "north"}`)
+    if w.Code != http.StatusCreated {
+        t.Fatalf("adding a price: got %d: %s", w.Code, w.Body.String())
+    }
+    if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+        t.Errorf("adding a price: response has Content-Type %q", ct)
+    }
+    var added struct {
+        ID int `json:"id"`
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &added); err != nil {
+        t.Fatal(err)
+    }
+    if v, err := ts.mem.PriceBook().Resolve(ctx, created.ID, unitLitre, sideSell, PriceScope{Region: "north"}); err != nil ||
+        v.ID != added.ID || v.Price != 195 {
+        t.Errorf("resolving the added price: got %+v, %v", v, err)
+    }
+
+    w = ts.request("PUT", fmt.Sprintf("/admin/api/products/%d", created.ID), token,
+        `{"name": "Whole milk", "type": "milk", "prices": {"litre": {"buy": 2.60}, "kg": null}}`)
+    if w.Code != http.StatusOK {
+        t.Fatalf("updating: got %d: %s", w.Code, w.Body.String())
+    }
+    p, err := ts.mem.Products().Get(ctx, created.ID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := map[string]UnitPrices{unitLitre: {Buy: 260, Sell: 180}}; p.Name != "Whole milk" ||
+        !reflect.DeepEqual(p.Prices, want) {
+        t.Errorf("got %q priced %+v, want %+v", p.Name, p.Prices, want)
+    }
+
+    // Archived products are no longer listed to users.
+    if w := ts.request("DELETE", fmt.Sprintf("/admin/api/products/%d", created.ID), token, ""); w.Code != http.StatusOK {
+        t.Fatalf("archiving: got %d: %s", w.Code, w.Body.String())
+    }
+    var listed struct {
+        Products []productResponse `json:"products"`
+    }
+    w = ts.request("GET", "/api/products", "", "")
+    if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil {
+        t.Fatalf("listing: %v: %s", err, w.Body.String())
+    }
+    if len(listed.Products) != 0 {
+        t.Errorf("an archived product is listed: %+v", listed.Products)
+    }
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strconv"
+
+    "github.com/gorilla/mux"
+)
+
+// Project statuses. Only active projects accept investments; paused and
+// closed projects keep their rows and existing investments.
+const (
+    projectActive = "active"
+    projectPaused = "paused"
+    projectClosed = "closed"
+)
+
+// projectTransitions lists the statuses each status may move to. A paused
+// project can be resumed; closed is final.
+var projectTransitions = map[string][]string{
+    projectActive: {projectPaused},
+    projectPaused: {projectActive, projectClosed},
+}
+
+func canTransitionProject(from, to string) bool {
+    for _, s := range projectTransitions[from] {
+        if s == to {
+            return true
+        }
+    }
+    return false
+}
+
+// FieldError describes one invalid request field.
+type FieldError struct {
+    Field   string `json:"field"`
+    Code    string `json:"code"`
+    Message string `json:"message"`
+}
+
+// ValidationErrors is returned to clients as a 422 with one entry per problem.
+type ValidationErrors []FieldError
+
+func (v ValidationErrors) Error() string {
+    if len(v) == 0 {
+        return "validation failed"
+    }
+    return fmt.Sprintf("%s: %s", v[0].Field, v[0].Message)
+}
+
+func writeValidationErrors(w http.ResponseWriter, errs ValidationErrors) {
+    writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+        "error":  "Validation failed",
+        "fields": errs,
+    })
+}
+
+// projectTerms are the parts of a project an investment is created from.
+type projectTerms struct {
+    ID            int
+    LockDays      int
+    ProfitPercent Percent
+    MinInvestment Money
+    MaxInvestment Money
+    Status        string
+    FundingCap    *Money
+    Funded        Money // principal of the project's active investments
+}
+
+// validateInvestment checks amount against the project's status, bounds and
+// remaining funding.
+func (p projectTerms) validateInvestment(amount Money) ValidationErrors {
+    var errs ValidationErrors
+    if p.Status != projectActive {
+        errs = append(errs, FieldError{"project_id", "project_not_active",
+            fmt.Sprintf("project is %s and not accepting investments", p.Status)})
+    }
+    switch {
+    case amount <= 0:
+        errs = append(errs, FieldError{"amount", "invalid", "amount must be positive"})
+    case amount < p.MinInvestment:
+        errs = append(errs, FieldError{"amount", "below_minimum",
+            fmt.Sprintf("amount must be at least %s", p.MinInvestment)})
+    case amount > p.MaxInvestment:
+        errs = append(errs, FieldError{"amount", "above_maximum",
+            fmt.Sprintf("amount must be at most %s", p.MaxInvestment)})
+    }
+    if p.FundingCap != nil && p.Funded+amount > *p.FundingCap {
+        remaining := *p.FundingCap - p.Funded
+        if remaining < 0 {
+            remaining = 0
+        }
+        errs = append(errs, FieldError{"amount", "funding_cap_exceeded",
+            fmt.Sprintf("project has %s of funding remaining", remaining)})
+    }
+    return errs
+}
+
+// newInvestment describes an investment of amount on p's current terms.
+func (p projectTerms) newInvestment(userID int, amount Money, reinvest bool, reinvestedFrom int) NewInvestment {
+    return NewInvestment{
+        UserID:         userID,
+        ProjectID:      p.ID,
+        Amount:         amount,
+        LockDays:       p.LockDays,
+        ProfitPercent:  p.ProfitPercent,
+        Reinvest:       reinvest,
+        ReinvestedFrom: reinvestedFrom,
+    }
+}
+
+// projectStatusHandler moves a project along projectTransitions.
+func (s *server) projectStatusHandler(w http.ResponseWriter, r *http.Request) {
+    projectID, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid project ID")
+        return
+    }
+
+    var req struct {
+        Status string `json:"status"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid request body")
+        return
+    }
+
+    var invalid ValidationErrors
+    err = s.store.WithTx(r.Context(), func(tx Store) error {
+        current, err := tx.Projects().LockStatus(r.Context(), projectID)
+        if err != nil {
+            return err
+        }
+        if !canTransitionProject(current, req.Status) {
+            invalid = ValidationErrors{{"status", "invalid_transition",
+                fmt.Sprintf("cannot change project status from %s to %q", current, req.Status)}}
+            return invalid
+        }
+        return tx.Projects().SetStatus(r.Context(), projectID, req.Status)
+    })
+    if invalid != nil {
+        writeValidationErrors(w, invalid)
+        return
+    }
+    if err == errNotFound {
+        writeError(w, http.StatusNotFound, "Project not found")
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to update project")
+        return
+    }
+
+    writeJSON(w, http.StatusOK, map[string]interface{}{
+        "id":     projectID,
+        "status": req.Status,
+    })
+}
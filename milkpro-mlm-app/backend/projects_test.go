@@ -0,0 +1,70 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestValidateInvestment(t *testing.T) {
+    capped := func(funded Money) projectTerms {
+        limit := Money(1000000)
+        return projectTerms{Status: projectActive, MinInvestment: 10000, MaxInvestment: 500000,
+            FundingCap: &limit, Funded: funded}
+    }
+    closed := capped(0)
+    closed.Status = projectClosed
+    paused := capped(0)
+    paused.Status = projectPaused
+    uncapped := capped(5000000)
+    uncapped.FundingCap = nil
+
+    tests := []struct {
+        name   string
+        terms  projectTerms
+        amount Money
+        want   ValidationErrors
+    }{
+        {"within limits", capped(0), 100000, nil},
+        {"exactly at the cap", capped(900000), 100000, nil},
+        {"0.01 over the cap", capped(900000), 100001, ValidationErrors{
+            {"amount", "funding_cap_exceeded", "project has 1000.00 of funding remaining"}}},
+        {"cap already passed", capped(1000500), 10000, ValidationErrors{
+            {"amount", "funding_cap_exceeded", "project has 0.00 of funding remaining"}}},
+        {"no cap", uncapped, 500000, nil},
+        {"at the minimum", capped(0), 10000, nil},
+        {"below the minimum", capped(0), 9999, ValidationErrors{
+            {"amount", "below_minimum", "amount must be at least 100.00"}}},
+        {"above the maximum", capped(0), 500001, ValidationErrors{
+            {"amount", "above_maximum", "amount must be at most 5000.00"}}},
+        {"zero", capped(0), 0, ValidationErrors{{"amount", "invalid", "amount must be positive"}}},
+        {"closed", closed, 100000, ValidationErrors{
+            {"project_id", "project_not_active", "project is closed and not accepting investments"}}},
+        {"paused and over the cap", paused, 100001, ValidationErrors{
+            {"project_id", "project_not_active", "project is paused and not accepting investments"}}},
+    }
+    for _, tt := range tests {
+        if got := tt.terms.validateInvestment(tt.amount); !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+        }
+    }
+}
+
+func TestProjectTransitions(t *testing.T) {
+    tests := []struct {
+        from, to string
+        want     bool
+    }{
+        {projectActive, projectPaused, true},
+        {projectActive, projectClosed, false},
+        {projectPaused, projectActive, true},
+        {projectPaused, projectClosed, true},
+        {projectClosed, projectActive, false},
+        {projectClosed, projectPaused, false},
+        {projectActive, projectActive, false},
+    }
+    for _, tt := range tests {
+        if got := canTransitionProject(tt.from, tt.to); got != tt.want {
+            t.Errorf("%s to %s: got %v, want %v", tt.from, tt.to, got, tt.want)
+        }
+    }
+}
@@ -0,0 +1,65 @@
+-- Sample data for development. Safe to run more than once.
+
+-- Default admin user
+INSERT INTO users (phone, name, email, is_admin, kyc_status)
+VALUES ('+1234567890', 'Admin User', 'admin@milkpro.com', TRUE, 'approved')
+ON CONFLICT (phone) DO NOTHING;
+
+-- Sample products
+INSERT INTO products (name, type)
+SELECT v.name, v.type
+FROM (VALUES
+    ('Fresh Milk', 'milk'),
+    ('Yogurt', 'dairy'),
+    ('Cattle Feed', 'feed')
+) AS v(name, type)
+WHERE NOT EXISTS (SELECT 1 FROM products p WHERE p.name = v.name);
+
+-- Default prices. Farmers sell us milk; everything is for sale to users.
+INSERT INTO price_versions (product_id, unit, side, price)
+SELECT p.id, v.unit, v.side, v.price
+FROM (VALUES
+    ('Fresh Milk', 'litre', 'buy', 2.50),
+    ('Fresh Milk', 'litre', 'sell', 1.80),
+    ('Yogurt', 'kg', 'buy', 3.00),
+    ('Cattle Feed', 'kg', 'buy', 15.00)
+) AS v(name, unit, side, price)
+JOIN products p ON p.name = v.name
+WHERE NOT EXISTS (
+    SELECT 1 FROM price_versions pv
+    WHERE pv.product_id = p.id AND pv.unit = v.unit AND pv.side = v.side
+      AND pv.region IS NULL AND pv.tier IS NULL
+);
+
+-- Opening stock, recorded as an adjustment for products with no stock ledger yet
+WITH opening AS (
+    SELECT p.id, v.quantity, v.threshold
+    FROM (VALUES
+        ('Fresh Milk', 500.00, 100.00),
+        ('Yogurt', 100.00, 20.00),
+        ('Cattle Feed', 1000.00, 200.00)
+    ) AS v(name, quantity, threshold)
+    JOIN products p ON p.name = v.name
+    WHERE NOT EXISTS (SELECT 1 FROM stock_movements sm WHERE sm.product_id = p.id)
+), stocked AS (
+    UPDATE products p
+    SET stock = p.stock + o.quantity, low_stock_threshold = COALESCE(p.low_stock_threshold, o.threshold)
+    FROM opening o
+    WHERE p.id = o.id
+    RETURNING p.id, p.stock, p.stock_unit
+)
+INSERT INTO stock_movements (product_id, kind, traded_quantity, traded_unit, quantity, unit, balance, reason)
+SELECT s.id, 'adjustment', o.quantity, s.stock_unit, o.quantity, s.stock_unit, s.stock, 'Opening stock'
+FROM stocked s
+JOIN opening o ON o.id = s.id;
+
+-- Sample investment project
+INSERT INTO projects (name, description, lock_days, profit_percent, min_investment, max_investment)
+SELECT
+    'Dairy Farm Expansion',
+    'Investment opportunity in expanding our dairy farm operations',
+    90,
+    15.00,
+    1000.00,
+    50000.00
+WHERE NOT EXISTS (SELECT 1 FROM projects WHERE name = 'Dairy Farm Expansion');
@@ -0,0 +1,132 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// server holds what the HTTP handlers depend on. Handlers are methods on it,
+// so tests can build one over newMemoryStore and a localVerifier.
+type server struct {
+    store       Store
+    verifier    TokenVerifier
+    staffTokens *staffTokenVerifier // nil unless ADMIN_API_SECRET is set
+    blobs       BlobStore
+    deliveryTZ  *time.Location      // whose calendar delivery dates follow
+    stats       *statsCache         // dashboard aggregates
+}
+
+func newServer(store Store, verifier TokenVerifier, staffTokens *staffTokenVerifier, blobs BlobStore) *server {
+    return &server{store: store, verifier: verifier, staffTokens: staffTokens, blobs: blobs, deliveryTZ: time.UTC,
+        stats: newStatsCache(defaultStatsCacheTTL)}
+}
+
+// routes builds the API router.
+func (s *server) routes() *mux.Router {
+    r := mux.NewRouter()
+
+    // Health check endpoint
+    r.HandleFunc("/api/health", func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusOK)
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "status": "ok",
+            "timestamp": time.Now().Format(time.RFC3339),
+            "version": "1.0.0",
+        })
+    }).Methods("GET")
+
+    r.HandleFunc("/api/products", s.productsHandler).Methods("GET")
+
+    // A local blob store serves the files behind its own signed URLs.
+    if files, ok := s.blobs.(http.Handler); ok {
+        r.PathPrefix("/files/").Handler(http.StripPrefix("/files/", files)).Methods("GET", "HEAD")
+    }
+    r.HandleFunc("/api/register", s.legacyRegisterHandler).Methods("POST")
+
+    // Authenticated user API. requireUser resolves the caller once and
+    // stores a *Principal in the request context for every /me route.
+    v1 := r.PathPrefix("/api/v1").Subrouter()
+    v1.HandleFunc("/register", s.userRegisterHandler).Methods("POST")
+
+    me := v1.PathPrefix("/me").Subrouter()
+    me.Use(s.requireUser)
+    me.HandleFunc("", s.userProfileHandler).Methods("GET")
+    me.HandleFunc("/wallet", s.walletHandler).Methods("GET")
+    me.HandleFunc("/kyc", s.getKycDocumentsHandler).Methods("GET")
+    me.HandleFunc("/kyc", s.uploadKycDocumentHandler).Methods("POST")
+    me.HandleFunc("/investments", s.listInvestmentsHandler).Methods("GET")
+    me.HandleFunc("/investments", s.createInvestmentHandler).Methods("POST")
+    me.HandleFunc("/transactions", s.listTransactionsHandler).Methods("GET")
+    me.HandleFunc("/transactions", s.createTransactionHandler).Methods("POST")
+    me.HandleFunc("/orders", s.listOrdersHandler).Methods("GET")
+    me.HandleFunc("/orders", s.placeOrderHandler).Methods("POST")
+    me.HandleFunc("/orders/{id}", s.getOrderHandler).Methods("GET")
+    me.HandleFunc("/orders/{id}/cancel", s.cancelOrderHandler).Methods("POST")
+    me.HandleFunc("/subscriptions", s.listSubscriptionsHandler).Methods("GET")
+    me.HandleFunc("/subscriptions", s.createSubscriptionHandler).Methods("POST")
+    me.HandleFunc("/subscriptions/{id}/pause", s.subscriptionStatusHandler(subscriptionPaused)).Methods("POST")
+    me.HandleFunc("/subscriptions/{id}/resume", s.subscriptionStatusHandler(subscriptionActive)).Methods("POST")
+    me.HandleFunc("/subscriptions/{id}/cancel", s.subscriptionStatusHandler(subscriptionCancelled)).Methods("POST")
+    me.HandleFunc("/subscriptions/{id}/skips", s.skipDeliveryHandler).Methods("POST")
+    me.HandleFunc("/subscriptions/{id}/skips/{date}", s.unskipDeliveryHandler).Methods("DELETE")
+    me.HandleFunc("/referrals", s.listReferralsHandler).Methods("GET")
+    me.HandleFunc("/tickets", s.listTicketsHandler).Methods("GET")
+    me.HandleFunc("/tickets", s.openTicketHandler).Methods("POST")
+    me.HandleFunc("/tickets/{id}", s.getTicketHandler).Methods("GET")
+    me.HandleFunc("/tickets/{id}/messages", s.postTicketMessageHandler).Methods("POST")
+    me.HandleFunc("/chat/token", s.chatTokenHandler).Methods("POST")
+
+    s.adminRoutes(r.PathPrefix("/admin/api").Subrouter())
+
+    return r
+}
+
+// adminRoutes registers the JSON admin API on r. Every route names the
+// permission it needs; reads and writes of the same resource are guarded
+// separately.
+func (s *server) adminRoutes(r *mux.Router) {
+    r.HandleFunc("/dashboard", s.requirePermission(permDashboardView, s.getDashboardStatsHandler)).Methods("GET")
+    r.HandleFunc("/dashboard/series", s.requirePermission(permDashboardView, s.statsSeriesHandler)).Methods("GET")
+    r.HandleFunc("/users", s.requirePermission(permUsersView, s.listUsersHandler)).Methods("GET")
+    r.HandleFunc("/users/{id}/pricing", s.requirePermission(permProductsWrite, s.userPricingHandler)).Methods("PUT")
+    r.HandleFunc("/users/{id}/kyc", s.requirePermission(permKYCReview, s.userKycHandler)).Methods("GET")
+    r.HandleFunc("/kyc", s.requirePermission(permKYCReview, s.kycQueueHandler)).Methods("GET")
+    r.HandleFunc("/kyc/{id}/review", s.requirePermission(permKYCReview, s.reviewKycDocumentHandler)).Methods("POST")
+    r.HandleFunc("/kyc/update", s.requirePermission(permKYCReview, s.updateKycStatusHandler)).Methods("POST")
+    r.HandleFunc("/products", s.requirePermission(permDashboardView, s.manageProductHandler)).Methods("GET")
+    r.HandleFunc("/products/{id}", s.requirePermission(permDashboardView, s.getProductHandler)).Methods("GET")
+    r.HandleFunc("/products/{id}", s.requirePermission(permProductsWrite, s.updateProductHandler)).Methods("PUT")
+    r.HandleFunc("/products/{id}", s.requirePermission(permProductsWrite, s.archiveProductHandler)).Methods("DELETE")
+    r.HandleFunc("/products", s.requirePermission(permProductsWrite, s.manageProductHandler)).Methods("POST")
+    r.HandleFunc("/products/{id}/prices", s.requirePermission(permDashboardView, s.listPricesHandler)).Methods("GET")
+    r.HandleFunc("/products/{id}/prices", s.requirePermission(permProductsWrite, s.addPriceHandler)).Methods("POST")
+    r.HandleFunc("/products/{id}/stock", s.requirePermission(permDashboardView, s.stockHandler)).Methods("GET")
+    r.HandleFunc("/products/{id}/stock", s.requirePermission(permProductsWrite, s.adjustStockHandler)).Methods("POST")
+    r.HandleFunc("/inventory/low-stock", s.requirePermission(permDashboardView, s.lowStockHandler)).Methods("GET")
+    r.HandleFunc("/orders", s.requirePermission(permDashboardView, s.adminListOrdersHandler)).Methods("GET")
+    r.HandleFunc("/orders/{id}", s.requirePermission(permDashboardView, s.adminGetOrderHandler)).Methods("GET")
+    r.HandleFunc("/orders/{id}/status", s.requirePermission(permOrdersFulfil, s.orderStatusHandler)).Methods("POST")
+    r.HandleFunc("/subscriptions", s.requirePermission(permDashboardView, s.adminListSubscriptionsHandler)).Methods("GET")
+    r.HandleFunc("/deliveries", s.requirePermission(permDashboardView, s.deliveryManifestHandler)).Methods("GET")
+    r.HandleFunc("/tickets", s.requirePermission(permSupportChat, s.adminListTicketsHandler)).Methods("GET")
+    r.HandleFunc("/tickets/{id}", s.requirePermission(permSupportChat, s.adminGetTicketHandler)).Methods("GET")
+    r.HandleFunc("/tickets/{id}/messages", s.requirePermission(permSupportChat, s.staffTicketMessageHandler)).Methods("POST")
+    r.HandleFunc("/tickets/{id}/status", s.requirePermission(permSupportChat, s.ticketStatusHandler)).Methods("POST")
+    r.HandleFunc("/tickets/{id}/priority", s.requirePermission(permTicketsAssign, s.ticketPriorityHandler)).Methods("POST")
+    r.HandleFunc("/tickets/{id}/assign", s.requirePermission(permTicketsAssign, s.assignTicketHandler)).Methods("POST")
+    r.HandleFunc("/staff", s.requirePermission(permTicketsAssign, s.listStaffHandler)).Methods("GET")
+    r.HandleFunc("/sla-policies", s.requirePermission(permSupportChat, s.listSLAPoliciesHandler)).Methods("GET")
+    r.HandleFunc("/sla-policies/{priority}", s.requirePermission(permTicketsAssign, s.setSLAPolicyHandler)).Methods("PUT")
+    r.HandleFunc("/sla-report", s.requirePermission(permDashboardView, s.slaReportHandler)).Methods("GET")
+    r.HandleFunc("/projects", s.requirePermission(permDashboardView, s.manageProjectHandler)).Methods("GET")
+    r.HandleFunc("/projects", s.requirePermission(permProjectsWrite, s.manageProjectHandler)).Methods("POST")
+    r.HandleFunc("/projects/{id}/status", s.requirePermission(permProjectsWrite, s.projectStatusHandler)).Methods("POST")
+    r.HandleFunc("/wallet/adjustments", s.requirePermission(permPayoutsApprove, s.walletAdjustmentHandler)).Methods("POST")
+    r.HandleFunc("/wallet/audit", s.requirePermission(permPayoutsApprove, s.walletAuditHandler)).Methods("GET")
+    r.HandleFunc("/commission-plans", s.requirePermission(permDashboardView, s.commissionPlansHandler)).Methods("GET")
+    r.HandleFunc("/commission-plans", s.requirePermission(permPayoutsApprove, s.commissionPlansHandler)).Methods("POST")
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+// testServer is a server over a fresh memory store that accepts tokens from
+// its local verifier.
+type testServer struct {
+    *server
+    mem      *storeMemory
+    verifier *localVerifier
+    handler  http.Handler
+}
+
+func newTestServer(t *testing.T) *testServer {
+    t.Helper()
+    verifier, err := newLocalVerifier(testLocalSecret)
+    if err != nil {
+        t.Fatal(err)
+    }
+    mem := newMemoryStore()
+    srv := newServer(mem, verifier, nil, nil)
+    return &testServer{server: srv, mem: mem, verifier: verifier, handler: srv.routes()}
+}
+
+// createUser adds a user with phone, sponsored by sponsorID unless it is 0.
+func (ts *testServer) createUser(t *testing.T, phone string, sponsorID int) int {
+    t.Helper()
+    ctx := context.Background()
+    id, err := ts.mem.Users().Create(ctx, User{Phone: phone, Name: "User " + phone})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if sponsorID != 0 {
+        if err := ts.mem.Referrals().Link(ctx, id, sponsorID); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return id
+}
+
+// deposit credits a user's wallet from cash.
+func (ts *testServer) deposit(t *testing.T, userID int, amount Money) {
+    t.Helper()
+    err := ts.mem.WithTx(context.Background(), func(tx Store) error {
+        _, err := postEntry(context.Background(), tx, JournalEntry{Kind: entryDeposit, Postings: []Posting{
+            {UserID: userID, Amount: amount},
+            {Account: accountCash, Amount: -amount},
+        }})
+        return err
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+}
+
+func (ts *testServer) balance(t *testing.T, userID int) Money {
+    t.Helper()
+    u, err := ts.mem.Users().Get(context.Background(), userID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return u.Balance
+}
+
+// token signs an ID token for phone, as the app would send it.
+func (ts *testServer) token(t *testing.T, phone string) string {
+    t.Helper()
+    token, err := ts.verifier.Sign("local:"+phone, phone, time.Hour)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return token
+}
+
+// request serves one request with an optional bearer token and JSON body.
+func (ts *testServer) request(method, path, token, body string) *httptest.ResponseRecorder {
+    req := httptest.NewRequest(method, path, strings.NewReader(body))
+    if token != "" {
+        req.Header.Set("Authorization", "Bearer "+token)
+    }
+    if body != "" {
+        req.Header.Set("Content-Type", "application/json")
+    }
+    w := httptest.NewRecorder()
+    ts.handler.ServeHTTP(w, req)
+    return w
+}
+
+// errorMessage decodes the {"error": ...} body every failure returns.
+func errorMessage(t *testing.T, w *httptest.ResponseRecorder) string {
+    t.Helper()
+    var body struct {
+        Error string `json:"error"`
+    }
+    if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+        t.Errorf("error response has Content-Type %q", ct)
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+        t.Errorf("error response is not JSON: %q", w.Body.String())
+    }
+    return body.Error
+}
+
+func TestRequireUser(t *testing.T) {
+    ts := newTestServer(t)
+    userID := ts.createUser(t, "+15550001", 0)
+    expired, err := signHS256(testLocalSecret, map[string]interface{}{
+        "iss": localTokenIssuer, "sub": "local:+15550001", "phone_number": "+15550001",
+        "iat": time.Now().Add(-2 * time.Hour).Unix(), "exp": time.Now().Add(-time.Hour).Unix(),
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        name   string
+        header string
+        want   int
+    }{
+        {"no header", "", http.StatusUnauthorized},
+        {"not bearer", "Basic abc", http.StatusUnauthorized},
+        {"garbage token", "Bearer abc", http.StatusUnauthorized},
+        {"expired token", "Bearer " + expired, http.StatusUnauthorized},
+        {"forged token", "Bearer " + ts.token(t, "+15550001") + "x", http.StatusUnauthorized},
+        {"unknown phone", "Bearer " + ts.token(t, "+15559999"), http.StatusNotFound},
+        {"valid token", "Bearer " + ts.token(t, "+15550001"), http.StatusOK},
+    }
+    for _, tt := range tests {
+        req := httptest.NewRequest("GET", "/api/v1/me", nil)
+        if tt.header != "" {
+            req.Header.Set("Authorization", tt.header)
+        }
+        w := httptest.NewRecorder()
+        ts.handler.ServeHTTP(w, req)
+        if w.Code != tt.want {
+            t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.want)
+            continue
+        }
+        if w.Code != http.StatusOK && errorMessage(t, w) == "" {
+            t.Errorf("%s: no error message", tt.name)
+        }
+    }
+
+    // The first request linked the token's UID to the user found by phone.
+    u, err := ts.mem.Users().Get(context.Background(), userID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if u.FirebaseUID != "local:+15550001" {
+        t.Errorf("user is linked to UID %q", u.FirebaseUID)
+    }
+    var profile struct {
+        ID    int    `json:"id"`
+        Phone string `json:"phone"`
+    }
+    w := ts.request("GET", "/api/v1/me", ts.token(t, "+15550001"), "")
+    if err := json.Unmarshal(w.Body.Bytes(), &profile); err != nil || profile.ID != userID || profile.Phone != "+15550001" {
+        t.Errorf("got profile %s", w.Body.String())
+    }
+}
+
+func TestCreateInvestmentPaysCommissions(t *testing.T) {
+    ts := newTestServer(t)
+    ctx := context.Background()
+    top := ts.createUser(t, "+15550001", 0)
+    middle := ts.createUser(t, "+15550002", top)
+    sponsor := ts.createUser(t, "+15550003", middle)
+    investor := ts.createUser(t, "+15550004", sponsor)
+    ts.deposit(t, investor, 150000)
+    projectID, err := ts.mem.Projects().Create(ctx, Project{Name: "Dairy", LockDays: 90, ProfitPercent: 1200,
+        MinInvestment: 10000, MaxInvestment: 500000})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    w := ts.request("POST", "/api/v1/me/investments", ts.token(t, "+15550004"),
+        fmt.Sprintf(`{"project_id": %d, "amount": "1000.00"}`, projectID))
+    if w.Code != http.StatusCreated {
+        t.Fatalf("got %d: %s", w.Code, w.Body.String())
+    }
+    if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+        t.Errorf("response has Content-Type %q", ct)
+    }
+
+    investments, err := ts.mem.Investments().ListByUser(ctx, investor)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(investments) != 1 || investments[0].Amount != 100000 || investments[0].ProfitPercent != 1200 ||
+        !investments[0].LockEndDate.Equal(investments[0].InvestedAt.AddDate(0, 0, 90)) {
+        t.Fatalf("got investments %+v", investments)
+    }
+
+    // The default plan pays 5%, 3% and 1% up three levels.
+    for _, tt := range []struct {
+        name   string
+        userID int
+        want   Money
+    }{
+        {"investor", investor, 50000},
+        {"level 1", sponsor, 5000},
+        {"level 2", middle, 3000},
+        {"level 3", top, 1000},
+    } {
+        if got := ts.balance(t, tt.userID); got != tt.want {
+            t.Errorf("%s balance is %v, want %v", tt.name, got, tt.want)
+        }
+    }
+
+    audit, err := ts.mem.Wallet().Audit(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !audit.OK() {
+        t.Errorf("wallet audit failed: %+v", audit)
+    }
+}
+
+func TestCreateInvestmentRollsBackOnInsufficientFunds(t *testing.T) {
+    ts := newTestServer(t)
+    ctx := context.Background()
+    sponsor := ts.createUser(t, "+15550001", 0)
+    investor := ts.createUser(t, "+15550002", sponsor)
+    ts.deposit(t, investor, 5000)
+    projectID, err := ts.mem.Projects().Create(ctx, Project{Name: "Dairy", LockDays: 90, ProfitPercent: 1200,
+        MinInvestment: 1000, MaxInvestment: 500000})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // The investment row is written before the wallet debit fails.
+    w := ts.request("POST", "/api/v1/me/investments", ts.token(t, "+15550002"),
+        fmt.Sprintf(`{"project_id": %d, "amount": 100}`, projectID))
+    if w.Code != http.StatusUnprocessableEntity {
+        t.Fatalf("got %d: %s", w.Code, w.Body.String())
+    }
+    if msg := errorMessage(t, w); msg != "Insufficient wallet balance" {
+        t.Errorf("got error %q", msg)
+    }
+
+    investments, err := ts.mem.Investments().ListByUser(ctx, investor)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(investments) != 0 {
+        t.Errorf("the failed investment was kept: %+v", investments)
+    }
+    if got := ts.balance(t, investor); got != 5000 {
+        t.Errorf("investor balance is %v, want 50.00", got)
+    }
+    if got := ts.balance(t, sponsor); got != 0 {
+        t.Errorf("sponsor was paid %v commission on a failed investment", got)
+    }
+    if len(ts.mem.root.commissions) != 0 {
+        t.Errorf("commissions were kept: %+v", ts.mem.root.commissions)
+    }
+}
+
+func TestMemoryStoreRollbackLeavesNestedValues(t *testing.T) {
+    mem := newMemoryStore()
+    mem.root.products[1] = Product{ID: 1, Prices: map[string]UnitPrices{"kg": {Buy: 500}}}
+    mem.root.orders[1] = Order{ID: 1, Items: []OrderItem{{ProductID: 1, Quantity: 100}}}
+    mem.root.subs[1] = Subscription{ID: 1, Skips: []time.Time{time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)}}
+
+    errRollback := errors.New("roll back")
+    err := mem.WithTx(context.Background(), func(tx Store) error {
+        d := tx.(*storeMemory).tx
+        d.products[1].Prices["kg"] = UnitPrices{Buy: 900}
+        d.orders[1].Items[0].Quantity = 900
+        d.subs[1].Skips[0] = time.Time{}
+        return errRollback
+    })
+    if err != errRollback {
+        t.Fatalf("got %v", err)
+    }
+
+    if got := mem.root.products[1].Prices["kg"].Buy; got != 500 {
+        t.Errorf("rolled back price change is visible: %v", got)
+    }
+    if got := mem.root.orders[1].Items[0].Quantity; got != 100 {
+        t.Errorf("rolled back item change is visible: %v", got)
+    }
+    if got := mem.root.subs[1].Skips[0]; got.IsZero() {
+        t.Error("rolled back skip change is visible")
+    }
+}
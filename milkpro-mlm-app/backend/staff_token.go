@@ -0,0 +1,94 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "strconv"
+    "time"
+)
+
+// staffTokenIssuer is the iss claim of tokens the admin panel mints when it
+// calls the admin API on behalf of a signed-in support_staff account.
+const staffTokenIssuer = "milkpro-admin-panel"
+
+// staffTokenMaxTTL bounds how long a staff token may be valid for. The panel
+// mints one per request, so anything longer is a misconfiguration.
+const staffTokenMaxTTL = 5 * time.Minute
+
+var errStaffTokensDisabled = errors.New("ADMIN_API_SECRET is not set")
+
+type staffClaims struct {
+    Issuer   string `json:"iss"`
+    Subject  string `json:"sub"`
+    Role     string `json:"role"`
+    IssuedAt int64  `json:"iat"`
+    Expires  int64  `json:"exp"`
+}
+
+// staffTokenVerifier accepts the HS256 tokens the admin panel signs with the
+// shared ADMIN_API_SECRET.
+type staffTokenVerifier struct {
+    secret []byte
+    now    func() time.Time
+}
+
+func newStaffTokenVerifier(secret []byte) (*staffTokenVerifier, error) {
+    if len(secret) < localTokenMinSecret {
+        return nil, fmt.Errorf("admin API secret must be at least %d bytes", localTokenMinSecret)
+    }
+    return &staffTokenVerifier{secret: secret, now: time.Now}, nil
+}
+
+// newStaffTokenVerifierFromEnv returns nil, and no error, when
+// ADMIN_API_SECRET is unset: the admin API then only accepts admin users'
+// ID tokens.
+func newStaffTokenVerifierFromEnv() (*staffTokenVerifier, error) {
+    secret := os.Getenv("ADMIN_API_SECRET")
+    if secret == "" {
+        return nil, nil
+    }
+    return newStaffTokenVerifier([]byte(secret))
+}
+
+func (v *staffTokenVerifier) Verify(token string) (*StaffPrincipal, error) {
+    if v == nil {
+        return nil, errStaffTokensDisabled
+    }
+    payload, err := parseHS256(v.secret, token)
+    if err != nil {
+        return nil, err
+    }
+    var c staffClaims
+    if err := json.Unmarshal(payload, &c); err != nil || c.Issuer != staffTokenIssuer {
+        return nil, errMalformedToken
+    }
+    if err := checkTokenTimes(v.now(), c.IssuedAt, c.Expires); err != nil {
+        return nil, err
+    }
+    if time.Duration(c.Expires-c.IssuedAt)*time.Second > staffTokenMaxTTL {
+        return nil, errMalformedToken
+    }
+
+    staffID, err := strconv.Atoi(c.Subject)
+    if err != nil || staffID <= 0 {
+        return nil, errMalformedToken
+    }
+    if _, ok := rolePermissions[c.Role]; !ok {
+        return nil, errMalformedToken
+    }
+    return &StaffPrincipal{StaffID: staffID, Role: c.Role}, nil
+}
+
+// Sign issues a token for a staff account, as the admin panel does.
+func (v *staffTokenVerifier) Sign(staffID int, role string, ttl time.Duration) (string, error) {
+    now := v.now()
+    return signHS256(v.secret, staffClaims{
+        Issuer:   staffTokenIssuer,
+        Subject:  strconv.Itoa(staffID),
+        Role:     role,
+        IssuedAt: now.Unix(),
+        Expires:  now.Add(ttl).Unix(),
+    })
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+    "net/http"
+    "testing"
+    "time"
+)
+
+func TestStaffTokenVerifier(t *testing.T) {
+    now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+    v, err := newStaffTokenVerifier(testLocalSecret)
+    if err != nil {
+        t.Fatal(err)
+    }
+    v.now = func() time.Time { return now }
+    if _, err := newStaffTokenVerifier([]byte("too short")); err == nil {
+        t.Error("accepted a short secret")
+    }
+
+    hs256Header := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+    token := func(secret []byte, change func(c map[string]interface{})) string {
+        c := map[string]interface{}{
+            "iss":  staffTokenIssuer,
+            "sub":  "7",
+            "role": roleSupport,
+            "iat":  now.Add(-time.Minute).Unix(),
+            "exp":  now.Add(time.Minute).Unix(),
+        }
+        if change != nil {
+            change(c)
+        }
+        return signTestJWT(t, secret, hs256Header, c)
+    }
+
+    tests := []struct {
+        name  string
+        token string
+        want  error
+    }{
+        {"valid", token(testLocalSecret, nil), nil},
+        {"longest lifetime", token(testLocalSecret, func(c map[string]interface{}) {
+            c["exp"] = now.Add(staffTokenMaxTTL - time.Minute).Unix()
+        }), nil},
+        {"lifetime too long", token(testLocalSecret, func(c map[string]interface{}) {
+            c["exp"] = now.Add(staffTokenMaxTTL).Unix()
+        }), errMalformedToken},
+        {"expired", token(testLocalSecret, func(c map[string]interface{}) {
+            c["iat"] = now.Add(-3 * time.Minute).Unix()
+            c["exp"] = now.Add(-time.Minute).Unix()
+        }), errTokenExpired},
+        {"issued in the future", token(testLocalSecret, func(c map[string]interface{}) {
+            c["iat"] = now.Add(time.Minute).Unix()
+            c["exp"] = now.Add(2 * time.Minute).Unix()
+        }), errTokenNotYetValid},
+        {"other secret", token([]byte("fedcba9876543210fedcba9876543210"), nil), errTokenSignature},
+        {"other issuer", token(testLocalSecret, func(c map[string]interface{}) {
+            c["iss"] = localTokenIssuer
+        }), errMalformedToken},
+        {"subject not a staff ID", token(testLocalSecret, func(c map[string]interface{}) {
+            c["sub"] = "local:+15550001"
+        }), errMalformedToken},
+        {"subject zero", token(testLocalSecret, func(c map[string]interface{}) { c["sub"] = "0" }), errMalformedToken},
+        {"unknown role", token(testLocalSecret, func(c map[string]interface{}) { c["role"] = "owner" }),
+            errMalformedToken},
+        {"no role", token(testLocalSecret, func(c map[string]interface{}) { delete(c, "role") }), errMalformedToken},
+    }
+    for _, tt := range tests {
+        p, err := v.Verify(tt.token)
+        if err != tt.want {
+            t.Errorf("%s: got error %v, want %v", tt.name, err, tt.want)
+            continue
+        }
+        if err == nil && (p.StaffID != 7 || p.UserID != 0 || p.Role != roleSupport) {
+            t.Errorf("%s: got %+v", tt.name, p)
+        }
+    }
+
+    var disabled *staffTokenVerifier
+    if _, err := disabled.Verify(token(testLocalSecret, nil)); err != errStaffTokensDisabled {
+        t.Errorf("without a secret: got error %v, want %v", err, errStaffTokensDisabled)
+    }
+}
+
+func TestStaffTokenGrantsItsRole(t *testing.T) {
+    ts := newTestServer(t)
+    staffTokens, err := newStaffTokenVerifier(testLocalSecret)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ts.staffTokens = staffTokens
+
+    support, err := staffTokens.Sign(3, roleSupport, time.Minute)
+    if err != nil {
+        t.Fatal(err)
+    }
+    admin, err := staffTokens.Sign(4, roleAdmin, time.Minute)
+    if err != nil {
+        t.Fatal(err)
+    }
+    otherTokens, err := newStaffTokenVerifier([]byte("fedcba9876543210fedcba9876543210"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    forged, err := otherTokens.Sign(4, roleAdmin, time.Minute)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ts.createUser(t, "+15550001", 0)
+
+    tests := []struct {
+        name, token string
+        want        int
+    }{
+        {"support", support, http.StatusForbidden},
+        {"admin", admin, http.StatusOK},
+        {"other secret", forged, http.StatusUnauthorized},
+        {"app user", ts.token(t, "+15550001"), http.StatusForbidden},
+    }
+    for _, tt := range tests {
+        if w := ts.request("GET", "/admin/api/users", tt.token, ""); w.Code != tt.want {
+            t.Errorf("%s: got %d, want %d: %s", tt.name, w.Code, tt.want, w.Body.String())
+        }
+    }
+}
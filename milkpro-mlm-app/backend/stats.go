@@ -0,0 +1,204 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// Intervals a stats series can be broken into.
+const (
+    statsDay   = "day"
+    statsWeek  = "week"
+    statsMonth = "month"
+)
+
+// defaultStatsPeriods is how many periods a series covers when no from date
+// is given.
+var defaultStatsPeriods = map[string]int{statsDay: 30, statsWeek: 12, statsMonth: 12}
+
+const (
+    // maxStatsPoints caps the length of a series, so a wide range of days
+    // cannot ask for an unbounded response.
+    maxStatsPoints = 1000
+
+    defaultStatsCacheTTL = time.Minute
+)
+
+// statsPeriodStart returns the first day of the period holding t's date: the
+// day itself, the Monday of its week or the first of its month.
+func statsPeriodStart(t time.Time, interval string) time.Time {
+    day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+    switch interval {
+    case statsWeek:
+        return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+    case statsMonth:
+        return day.AddDate(0, 0, 1-day.Day())
+    }
+    return day
+}
+
+// nextStatsPeriod returns the first day of the period after the one starting
+// at start.
+func nextStatsPeriod(start time.Time, interval string) time.Time {
+    switch interval {
+    case statsWeek:
+        return start.AddDate(0, 0, 7)
+    case statsMonth:
+        return start.AddDate(0, 1, 0)
+    }
+    return start.AddDate(0, 0, 1)
+}
+
+// statsCache keeps dashboard aggregates for a short while, so reloading the
+// dashboard, or several staff looking at it at once, does not rerun the same
+// queries. Entries are keyed by what was asked for and expire after ttl.
+type statsCache struct {
+    ttl     time.Duration
+    mu      sync.Mutex
+    entries map[string]statsCacheEntry
+}
+
+type statsCacheEntry struct {
+    value   interface{}
+    expires time.Time
+}
+
+func newStatsCache(ttl time.Duration) *statsCache {
+    return &statsCache{ttl: ttl, entries: make(map[string]statsCacheEntry)}
+}
+
+// get returns the value cached under key, or calls load and caches what it
+// returns. Errors are not cached. Two requests that miss at once may both
+// call load; the later result wins.
+func (c *statsCache) get(key string, load func() (interface{}, error)) (interface{}, error) {
+    now := time.Now()
+    c.mu.Lock()
+    e, ok := c.entries[key]
+    c.mu.Unlock()
+    if ok && now.Before(e.expires) {
+        return e.value, nil
+    }
+
+    v, err := load()
+    if err != nil {
+        return nil, err
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    for k, e := range c.entries {
+        if !now.Before(e.expires) {
+            delete(c.entries, k)
+        }
+    }
+    c.entries[key] = statsCacheEntry{value: v, expires: now.Add(c.ttl)}
+    return v, nil
+}
+
+// dashboardStatsResponse is the dashboard's headline figures as of
+// GeneratedAt, which is older than the request when they come from the cache.
+type dashboardStatsResponse struct {
+    DashboardStats
+    GeneratedAt time.Time `json:"generated_at"`
+}
+
+func (s *server) getDashboardStatsHandler(w http.ResponseWriter, r *http.Request) {
+    v, err := s.stats.get("dashboard", func() (interface{}, error) {
+        stats, err := s.store.Stats().Dashboard(r.Context())
+        return dashboardStatsResponse{stats, time.Now()}, err
+    })
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch dashboard stats")
+        return
+    }
+    writeJSON(w, http.StatusOK, v)
+}
+
+type statsPointResponse struct {
+    Start             string `json:"start"`
+    NewUsers          int    `json:"new_users"`
+    Invested          Money  `json:"invested"`
+    TransactionVolume Money  `json:"transaction_volume"`
+    Commissions       Money  `json:"commissions"`
+}
+
+type statsSeriesResponse struct {
+    Interval    string               `json:"interval"`
+    From        string               `json:"from"`
+    To          string               `json:"to"`
+    GeneratedAt time.Time            `json:"generated_at"`
+    Points      []statsPointResponse `json:"points"`
+}
+
+// statsSeriesHandler returns the dashboard's time series per ?interval=
+// (day, week or month; day by default) between the dates ?from= and ?to=,
+// both inclusive. to defaults to today and from to 30 days, 12 weeks or 12
+// months before it.
+func (s *server) statsSeriesHandler(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+    interval := q.Get("interval")
+    if interval == "" {
+        interval = statsDay
+    }
+    periods, ok := defaultStatsPeriods[interval]
+    if !ok {
+        writeError(w, http.StatusBadRequest, "Invalid interval")
+        return
+    }
+    to := dateOf(time.Now(), time.UTC)
+    if v := q.Get("to"); v != "" {
+        d, err := parseDate(v)
+        if err != nil {
+            writeError(w, http.StatusBadRequest, "Invalid to date")
+            return
+        }
+        to = d
+    }
+    from := statsPeriodStart(to, interval)
+    for i := 1; i < periods; i++ {
+        from = statsPeriodStart(from.AddDate(0, 0, -1), interval)
+    }
+    if v := q.Get("from"); v != "" {
+        d, err := parseDate(v)
+        if err != nil {
+            writeError(w, http.StatusBadRequest, "Invalid from date")
+            return
+        }
+        from = d
+    }
+    if from.After(to) {
+        writeValidationErrors(w, ValidationErrors{{"from", "after_to", "from must not be after to"}})
+        return
+    }
+    n := 0
+    for start := statsPeriodStart(from, interval); !start.After(to); start = nextStatsPeriod(start, interval) {
+        n++
+    }
+    if n > maxStatsPoints {
+        writeValidationErrors(w, ValidationErrors{{"from", "too_many_points",
+            fmt.Sprintf("the range covers %d periods; at most %d are allowed", n, maxStatsPoints)}})
+        return
+    }
+
+    key := fmt.Sprintf("series:%s:%s:%s", interval, from.Format(dateLayout), to.Format(dateLayout))
+    v, err := s.stats.get(key, func() (interface{}, error) {
+        points, err := s.store.Stats().Series(r.Context(), interval, from, to.AddDate(0, 0, 1))
+        if err != nil {
+            return nil, err
+        }
+        resp := statsSeriesResponse{Interval: interval, From: from.Format(dateLayout), To: to.Format(dateLayout),
+            GeneratedAt: time.Now(), Points: []statsPointResponse{}}
+        for _, p := range points {
+            resp.Points = append(resp.Points, statsPointResponse{Start: p.Start.Format(dateLayout),
+                NewUsers: p.NewUsers, Invested: p.Invested, TransactionVolume: p.TransactionVolume,
+                Commissions: p.Commissions})
+        }
+        return resp, nil
+    })
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch dashboard series")
+        return
+    }
+    writeJSON(w, http.StatusOK, v)
+}
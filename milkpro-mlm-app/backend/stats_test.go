@@ -0,0 +1,91 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestStatsPeriodStart(t *testing.T) {
+    date := func(s string) time.Time {
+        d, err := time.Parse(dateLayout, s)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return d
+    }
+    tests := []struct {
+        at       time.Time
+        interval string
+        want     string
+    }{
+        {time.Date(2024, 3, 10, 23, 59, 0, 0, time.UTC), statsDay, "2024-03-10"},
+        {date("2024-03-10"), statsWeek, "2024-03-04"},
+        {date("2024-03-04"), statsWeek, "2024-03-04"},
+        {date("2025-01-01"), statsWeek, "2024-12-30"},
+        {date("2024-02-29"), statsMonth, "2024-02-01"},
+        {date("2024-03-01"), statsMonth, "2024-03-01"},
+    }
+    for _, tt := range tests {
+        if got := statsPeriodStart(tt.at, tt.interval).Format(dateLayout); got != tt.want {
+            t.Errorf("%s of %v: got %s, want %s", tt.interval, tt.at, got, tt.want)
+        }
+        start := date(tt.want)
+        if next := nextStatsPeriod(start, tt.interval); statsPeriodStart(next, tt.interval) != next ||
+            statsPeriodStart(next.AddDate(0, 0, -1), tt.interval) != start {
+            t.Errorf("%s after %s: got %s", tt.interval, tt.want, next.Format(dateLayout))
+        }
+    }
+}
+
+func TestStatsSeriesBucketsByUTCDate(t *testing.T) {
+    ts := newTestServer(t)
+    ts.mem.now = func() time.Time { return time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC) }
+    adminID := ts.createUser(t, "+15550000", 0)
+    admin := ts.mem.root.users[adminID]
+    admin.IsAdmin = true
+    ts.mem.root.users[adminID] = admin
+    token := ts.token(t, "+15550000")
+
+    eastern := time.FixedZone("EST", -5*60*60)
+    for i, at := range []time.Time{
+        time.Date(2024, 2, 25, 23, 59, 0, 0, time.UTC),
+        time.Date(2024, 2, 26, 0, 0, 0, 0, time.UTC),
+        time.Date(2024, 3, 3, 23, 30, 0, 0, time.UTC),
+        time.Date(2024, 3, 3, 23, 30, 0, 0, eastern), // 2024-03-04 in UTC
+        time.Date(2024, 3, 10, 23, 59, 0, 0, time.UTC),
+        time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC),
+    } {
+        ts.mem.now = func() time.Time { return at }
+        ts.createUser(t, fmt.Sprintf("+1555000%d", i+1), 0)
+    }
+
+    tests := []struct {
+        query string
+        want  map[string]int
+    }{
+        {"interval=day&from=2024-03-03&to=2024-03-04", map[string]int{"2024-03-03": 1, "2024-03-04": 1}},
+        {"interval=week&from=2024-02-26&to=2024-03-10", map[string]int{"2024-02-26": 2, "2024-03-04": 2}},
+        {"interval=month&from=2024-02-01&to=2024-03-31", map[string]int{"2024-02-01": 2, "2024-03-01": 4}},
+    }
+    for _, tt := range tests {
+        w := ts.request("GET", "/admin/api/dashboard/series?"+tt.query, token, "")
+        if w.Code != http.StatusOK {
+            t.Fatalf("%s: got %d: %s", tt.query, w.Code, w.Body.String())
+        }
+        var series statsSeriesResponse
+        if err := json.Unmarshal(w.Body.Bytes(), &series); err != nil {
+            t.Fatalf("%s: %v: %s", tt.query, err, w.Body.String())
+        }
+        got := make(map[string]int)
+        for _, p := range series.Points {
+            got[p.Start] = p.NewUsers
+        }
+        if !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%s: got new users %v, want %v", tt.query, got, tt.want)
+        }
+    }
+}
@@ -0,0 +1,679 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "time"
+)
+
+// Store gives handlers and background jobs access to persisted data through
+// typed repositories. storePostgres is the production implementation;
+// storeMemory keeps everything in process for tests and local development.
+type Store interface {
+    Users() UserRepo
+    Products() ProductRepo
+    PriceBook() PriceBookRepo
+    Inventory() InventoryRepo
+    Projects() ProjectRepo
+    Investments() InvestmentRepo
+    Transactions() TransactionRepo
+    Orders() OrderRepo
+    Subscriptions() SubscriptionRepo
+    Referrals() ReferralRepo
+    Commissions() CommissionRepo
+    Wallet() WalletRepo
+    KYC() KYCRepo
+    Tickets() TicketRepo
+    Staff() StaffRepo
+    Stats() StatsRepo
+
+    // WithTx runs fn with a Store whose repositories share one transaction,
+    // committing if fn returns nil and rolling back otherwise. Calling WithTx
+    // on the Store passed to fn runs in the same transaction.
+    WithTx(ctx context.Context, fn func(Store) error) error
+}
+
+var (
+    errNotFound          = errors.New("not found")
+    errPhoneTaken        = errors.New("phone number already registered")
+    errReferralCodeTaken = errors.New("referral code already in use")
+    errStockUnitInUse    = errors.New("stock unit cannot change while the product holds stock")
+    errDeliveryExists    = errors.New("delivery already generated for this date")
+    errKYCDocumentExists = errors.New("a document of this type is already pending or approved")
+)
+
+// User is a registered app user.
+type User struct {
+    ID              int
+    Phone           string
+    FirebaseUID     string
+    Name            string
+    Email           string
+    ProfileImageURL string
+    KYCStatus       string
+    IsAdmin         bool
+    Balance         Money
+    ReferralCode    string
+    Region          string
+    PriceTier       string
+    CreatedAt       time.Time
+}
+
+// PriceScope returns the scope of the prices u trades at.
+func (u User) PriceScope() PriceScope {
+    return PriceScope{Region: u.Region, Tier: u.PriceTier}
+}
+
+// UserSummary is a user with the totals shown in admin listings.
+type UserSummary struct {
+    User
+    TotalInvested  Money
+    TotalReferrals int
+}
+
+type UserRepo interface {
+    Get(ctx context.Context, id int) (User, error)
+    GetByPhone(ctx context.Context, phone string) (User, error)
+    GetByReferralCode(ctx context.Context, code string) (User, error)
+    GetByFirebaseUID(ctx context.Context, uid string) (User, error)
+    // Create inserts u and returns its ID. It returns errPhoneTaken or
+    // errReferralCodeTaken, without spoiling an enclosing transaction in
+    // the latter case, so another code can be tried.
+    Create(ctx context.Context, u User) (int, error)
+    // IDsWithoutReferralCode lists users created before codes were issued.
+    IDsWithoutReferralCode(ctx context.Context) ([]int, error)
+    // SetReferralCode gives a user without a code the code given.
+    SetReferralCode(ctx context.Context, id int, code string) error
+    // SetFirebaseUID links a user that has no Firebase UID yet to uid. It
+    // returns errNotFound if the user is missing or already linked.
+    SetFirebaseUID(ctx context.Context, id int, uid string) error
+    SetKYCStatus(ctx context.Context, id int, status string) error
+    // SetPriceScope sets the region and pricing tier a user's prices are
+    // looked up with. Empty fields clear them.
+    SetPriceScope(ctx context.Context, id int, scope PriceScope) error
+    List(ctx context.Context) ([]UserSummary, error)
+}
+
+// Product is something users can buy or sell, priced per unit of measure.
+type Product struct {
+    ID                int
+    Name              string
+    Type              string
+    Prices            map[string]UnitPrices // default prices in effect now, by unit; read only
+    StockUnit         string
+    Density           Density   // kg per litre; 0 if unknown, when only StockUnit can be traded
+    Stock             Quantity  // in StockUnit; read only, changed through the InventoryRepo
+    LowStockThreshold *Quantity // in StockUnit
+    CreatedAt         time.Time
+    UpdatedAt         time.Time
+    ArchivedAt        *time.Time
+}
+
+type ProductRepo interface {
+    // List returns products ordered by type and name, leaving out archived
+    // ones unless includeArchived is set.
+    List(ctx context.Context, includeArchived bool) ([]Product, error)
+    // Get returns a product whether or not it is archived.
+    Get(ctx context.Context, id int) (Product, error)
+    Create(ctx context.Context, p Product) (int, error)
+    // Update replaces the name, type, stock unit, density and low stock
+    // threshold of product p.ID. Prices are changed through the
+    // PriceBookRepo. It returns errStockUnitInUse if p changes the stock unit
+    // of a product that holds stock.
+    Update(ctx context.Context, p Product) error
+    // Archive withdraws a product from sale. Archiving it again is a no-op.
+    Archive(ctx context.Context, id int) error
+}
+
+// UnitPrices are the buy and sell prices of a product in one unit. Zero
+// means the product cannot be traded that way.
+type UnitPrices struct {
+    Buy  Money `json:"buy,omitempty"`
+    Sell Money `json:"sell,omitempty"`
+}
+
+// PriceScope is who a price applies to. Empty fields match everyone.
+type PriceScope struct {
+    Region string
+    Tier   string
+}
+
+// PriceVersion is one entry in a product's price book. Versions are never
+// changed: a later version for the same unit, side and scope supersedes it
+// from its EffectiveFrom.
+// A zero Price withdraws the price from then on.
+type PriceVersion struct {
+    ID             int
+    ProductID      int
+    Unit           string
+    Side           string // sideBuy or sideSell
+    Scope          PriceScope
+    Price          Money
+    EffectiveFrom  time.Time // zero when adding means now
+    EffectiveUntil *time.Time
+    CreatedAt      time.Time
+}
+
+type PriceBookRepo interface {
+    Add(ctx context.Context, v PriceVersion) (int, error)
+    // History returns every version of a product's prices, latest
+    // EffectiveFrom first.
+    History(ctx context.Context, productID int) ([]PriceVersion, error)
+    // Resolve returns the version in effect now that prices a trade of
+    // productID in unit on side for a user in scope. Inside WithTx on
+    // Postgres, now is the start of the transaction. A version for the
+    // user's region and tier beats one for their region, which beats one
+    // for their tier, which beats the default; within the same scope the
+    // latest EffectiveFrom wins. It returns errNotFound if no price applies
+    // or the version that does has been withdrawn.
+    Resolve(ctx context.Context, productID int, unit, side string, scope PriceScope) (PriceVersion, error)
+}
+
+// StockMovement is one entry in a product's stock ledger.
+type StockMovement struct {
+    ID             int
+    ProductID      int
+    Kind           string // stockTransaction or stockAdjustment
+    TransactionID  int
+    TradedQuantity Quantity // as traded or adjusted; negative out of stock
+    TradedUnit     string
+    Quantity       Quantity // TradedQuantity in the product's stock unit
+    Unit           string
+    Balance        Quantity // the product's stock after the movement
+    Reason         string
+    StaffID        int // who made an adjustment: a support_staff account
+    AdminUserID    int // or an admin app user
+    CreatedAt      time.Time
+}
+
+type InventoryRepo interface {
+    // Move converts m.TradedQuantity into the product's stock unit, appends
+    // the movement and applies it to the product's stock, locking the
+    // product until the transaction ends. It returns the movement as
+    // recorded, or errNoDensity, or errInsufficientStock, leaving the caller
+    // to roll back, if stock would go negative. Call it inside WithTx.
+    Move(ctx context.Context, m StockMovement) (StockMovement, error)
+    // Movements returns a product's latest movements, newest first.
+    Movements(ctx context.Context, productID, limit int) ([]StockMovement, error)
+    // LowStock returns the products on sale whose stock is at or below their
+    // threshold, ordered by name.
+    LowStock(ctx context.Context) ([]Product, error)
+}
+
+// Project is an investment opportunity.
+type Project struct {
+    ID            int
+    Name          string
+    Description   string
+    LockDays      int
+    ProfitPercent Percent
+    MinInvestment Money
+    MaxInvestment Money
+    FundingCap    *Money
+    Status        string
+    CreatedAt     time.Time
+}
+
+type ProjectRepo interface {
+    // List returns every project, newest first.
+    List(ctx context.Context) ([]Project, error)
+    Create(ctx context.Context, p Project) (int, error)
+    // LockForInvestment loads a project's terms and funded total, locking
+    // the project so concurrent investments are checked one at a time.
+    LockForInvestment(ctx context.Context, id int) (projectTerms, error)
+    // LockStatus returns a project's status, locking it until the
+    // transaction ends.
+    LockStatus(ctx context.Context, id int) (string, error)
+    SetStatus(ctx context.Context, id int, status string) error
+}
+
+// Investment is money a user has locked into a project.
+type Investment struct {
+    ID             int
+    UserID         int
+    ProjectID      int
+    ProjectName    string
+    Amount         Money
+    ProfitPercent  Percent
+    Reinvest       bool
+    Status         string
+    InvestedAt     time.Time
+    LockEndDate    time.Time
+    ReinvestedFrom int
+}
+
+// NewInvestment is an investment to record on a project's current terms.
+// The lock period starts now.
+type NewInvestment struct {
+    UserID         int
+    ProjectID      int
+    Amount         Money
+    LockDays       int
+    ProfitPercent  Percent
+    Reinvest       bool
+    ReinvestedFrom int
+}
+
+type InvestmentRepo interface {
+    Create(ctx context.Context, inv NewInvestment) (int, error)
+    // ListByUser returns a user's investments, newest first.
+    ListByUser(ctx context.Context, userID int) ([]Investment, error)
+    // ClaimDue locks and returns the active investment whose lock period
+    // ended first, skipping any another transaction has claimed and those
+    // in skip. It returns errNotFound when none are due.
+    ClaimDue(ctx context.Context, skip []int) (Investment, error)
+    // SetStatus changes an investment's status, stamping matured_at the
+    // first time it leaves active.
+    SetStatus(ctx context.Context, id int, status string) error
+}
+
+// Transaction is a purchase or sale of a product by a user.
+type Transaction struct {
+    ID             int
+    UserID         int
+    ProductID      int
+    ProductName    string
+    ProductType    string
+    Type           string
+    Quantity       Quantity
+    Unit           string
+    Price          Money
+    PriceVersionID int // the price book version Price came from; 0 for older transactions
+    OrderID        int // the order the transaction fills; 0 if bought or sold directly
+    Date           time.Time
+}
+
+type TransactionRepo interface {
+    Create(ctx context.Context, t Transaction) (int, error)
+    // ListByUser returns a user's transactions, newest first.
+    ListByUser(ctx context.Context, userID int) ([]Transaction, error)
+}
+
+// Order is a cart of products bought together and delivered as one.
+type Order struct {
+    ID             int
+    UserID         int
+    Status         string
+    Total          Money
+    Items          []OrderItem
+    Events         []OrderEvent // oldest first; only filled in by Get
+    SubscriptionID int          // the subscription a delivery order was generated for
+    DeliveryDate   time.Time    // the date of that delivery, at midnight UTC; zero otherwise
+    CreatedAt      time.Time
+    UpdatedAt      time.Time
+}
+
+// OrderItem is one product on an order, priced when the order was placed.
+type OrderItem struct {
+    ID             int
+    OrderID        int
+    ProductID      int
+    ProductName    string
+    Quantity       Quantity
+    Unit           string
+    Price          Money
+    PriceVersionID int
+}
+
+// OrderEvent records an order entering a status and who moved it there.
+type OrderEvent struct {
+    ID        int
+    OrderID   int
+    Status    string
+    Note      string
+    Actor     string // the role they acted in: actorCustomer, actorAdmin, actorStaff or actorSystem
+    StaffID   int    // a support_staff account
+    UserID    int    // or the customer or an admin app user; neither for the system
+    CreatedAt time.Time
+}
+
+// OrderFilter narrows OrderRepo.List. Zero fields match every order.
+type OrderFilter struct {
+    UserID         int
+    Status         string
+    SubscriptionID int
+    DeliveryDate   time.Time
+    Limit          int
+}
+
+type OrderRepo interface {
+    // Create records o and its items as pending, with placed as the first
+    // event, and returns the order's ID. It returns errDeliveryExists, which
+    // spoils an enclosing Postgres transaction, if o is a subscription
+    // delivery already generated.
+    Create(ctx context.Context, o Order, placed OrderEvent) (int, error)
+    // Get returns an order with its items and events.
+    Get(ctx context.Context, id int) (Order, error)
+    // List returns the orders matching f with their items, newest first.
+    List(ctx context.Context, f OrderFilter) ([]Order, error)
+    // LockStatus returns an order's status, locking it until the
+    // transaction ends.
+    LockStatus(ctx context.Context, id int) (string, error)
+    // SetStatus moves order e.OrderID to e.Status and appends e to its
+    // history.
+    SetStatus(ctx context.Context, e OrderEvent) error
+}
+
+// Subscription is a recurring delivery of one product on some days of the
+// week.
+type Subscription struct {
+    ID          int
+    UserID      int
+    ProductID   int
+    ProductName string
+    Quantity    Quantity // per delivery
+    Unit        string
+    Days        Weekdays
+    Status      string
+    StartDate   time.Time   // a date, at midnight UTC
+    Skips       []time.Time // dates skipped, in order
+    CreatedAt   time.Time
+    UpdatedAt   time.Time
+}
+
+// DeliveryLine is one subscription delivery on a day's manifest.
+type DeliveryLine struct {
+    OrderID        int
+    SubscriptionID int
+    UserID         int
+    CustomerName   string
+    CustomerPhone  string
+    ProductID      int
+    ProductName    string
+    Quantity       Quantity
+    Unit           string
+    Price          Money
+    Total          Money
+    Status         string
+}
+
+type SubscriptionRepo interface {
+    Create(ctx context.Context, sub Subscription) (int, error)
+    Get(ctx context.Context, id int) (Subscription, error)
+    // List returns the subscriptions of userID, or everyone's if it is 0,
+    // newest first.
+    List(ctx context.Context, userID int) ([]Subscription, error)
+    // Lock returns a subscription, locking it until the transaction ends.
+    Lock(ctx context.Context, id int) (Subscription, error)
+    SetStatus(ctx context.Context, id int, status string) error
+    // Skip marks date as skipped; skipping it again is a no-op. Unskip
+    // removes the mark.
+    Skip(ctx context.Context, id int, date time.Time) error
+    Unskip(ctx context.Context, id int, date time.Time) error
+    // Due returns the IDs of active subscriptions to products that are not
+    // archived with a delivery due on date for which no order has been
+    // generated yet.
+    Due(ctx context.Context, date time.Time) ([]int, error)
+    // Manifest returns the deliveries generated for date, by customer name.
+    Manifest(ctx context.Context, date time.Time) ([]DeliveryLine, error)
+}
+
+// Referral is one member of the caller's downline as returned by listReferralsHandler.
+type Referral struct {
+    ID              int       `json:"id"`
+    ReferredPhone   string    `json:"referred_phone"`
+    ReferredName    string    `json:"referred_name"`
+    Level           int       `json:"level"`
+    Commission      Money     `json:"commission"`
+    CreatedAt       time.Time `json:"created_at"`
+    Depth           int       `json:"depth"`
+}
+
+type ReferralRepo interface {
+    // Link makes sponsorID the level 1 sponsor of userID and copies the
+    // sponsor's upline, up to maxReferralDepth levels, as the user's own.
+    Link(ctx context.Context, userID, sponsorID int) error
+    // Upline returns the sponsors of userID, nearest first.
+    Upline(ctx context.Context, userID int) ([]int, error)
+    // Downline returns the members userID sponsors at any level, with the
+    // commission userID has earned from each.
+    Downline(ctx context.Context, userID int) ([]Referral, error)
+}
+
+// CommissionPlan is the percentage paid at one level, optionally scoped to a
+// product or project.
+type CommissionPlan struct {
+    ID        int     `json:"id"`
+    Level     int     `json:"level"`
+    Percent   Percent `json:"percent"`
+    ProductID int     `json:"product_id,omitempty"`
+    ProjectID int     `json:"project_id,omitempty"`
+}
+
+type CommissionRepo interface {
+    // ActivePlans returns every active plan, default plans first.
+    ActivePlans(ctx context.Context) ([]CommissionPlan, error)
+    // ReplacePlan deactivates the active plan with p's level and scope and
+    // records p in its place.
+    ReplacePlan(ctx context.Context, p CommissionPlan) (int, error)
+    // Record stores a commission paid on src and returns its ID.
+    Record(ctx context.Context, src CommissionSource, c Commission) (int, error)
+}
+
+// WalletEntry is one ledger entry as seen from a user's wallet.
+type WalletEntry struct {
+    ID            int       `json:"id"`
+    Kind          string    `json:"kind"`
+    ReferenceType string    `json:"reference_type,omitempty"`
+    ReferenceID   int       `json:"reference_id,omitempty"`
+    Memo          string    `json:"memo,omitempty"`
+    Amount        Money     `json:"amount"`
+    CreatedAt     time.Time `json:"created_at"`
+}
+
+type WalletRepo interface {
+    // Post appends a balanced entry and updates the balance of every user it
+    // touches, returning errInsufficientFunds if one would go negative.
+    // Use postEntry, which validates the entry first.
+    Post(ctx context.Context, e JournalEntry) (int, error)
+    // Statement returns a user's balance and latest entries, newest first.
+    Statement(ctx context.Context, userID, limit int) (Money, []WalletEntry, error)
+    Audit(ctx context.Context) (WalletAudit, error)
+}
+
+// KYCDocument is an identity document uploaded by a user. Type is empty for
+// documents uploaded before types existed. StorageKey names the file in the
+// BlobStore; documents from before uploads hold an external URL there and
+// no ContentType or Size. ReplacesID points to the rejected document of the
+// same type that this one was uploaded in place of.
+type KYCDocument struct {
+    ID          int
+    UserID      int
+    Type        string
+    StorageKey  string
+    ContentType string
+    Size        int64
+    Status      string
+    Reason      string
+    ReplacesID  int
+    ReviewedAt  time.Time
+    UploadedAt  time.Time
+}
+
+// KYCReview is one review decision on a document. The reviewer is a
+// support_staff account (StaffID) or an admin app user (AdminID).
+type KYCReview struct {
+    ID         int
+    DocumentID int
+    UserID     int // the document's owner
+    Status     string
+    Reason     string
+    StaffID    int
+    AdminID    int
+    CreatedAt  time.Time
+}
+
+type KYCRepo interface {
+    // Create stores a pending document, returning errKYCDocumentExists if
+    // the user already has one of its type that is pending or approved.
+    Create(ctx context.Context, d KYCDocument) (int, error)
+    Get(ctx context.Context, id int) (KYCDocument, error)
+    ListByUser(ctx context.Context, userID int) ([]KYCDocument, error)
+    // Lock is ListByUser, holding the user's KYC until the transaction ends
+    // so uploads and reviews for one user run one at a time. It returns
+    // errNotFound if the user does not exist.
+    Lock(ctx context.Context, userID int) ([]KYCDocument, error)
+    // Pending returns documents awaiting review, oldest first.
+    Pending(ctx context.Context, limit int) ([]KYCDocument, error)
+    // Review sets a document's status and reason and records rv in the
+    // audit trail.
+    Review(ctx context.Context, rv KYCReview) error
+    // Reviews returns the decisions on a user's documents, oldest first.
+    Reviews(ctx context.Context, userID int) ([]KYCReview, error)
+}
+
+// Ticket is a support ticket raised by a user. AssignedTo is the
+// support_staff account working it, or 0.
+//
+// Each ticket has two SLA targets, a first response and a resolution, due by
+// the times worked out from its priority's SLAPolicy. A target is met when it
+// is reached by its due time and breached otherwise; the *StaffID fields name
+// who met or missed it (0 for nobody, or an admin app user).
+type Ticket struct {
+    ID           int
+    UserID       int
+    UserName     string
+    Subject      string
+    Status       string
+    Priority     string
+    AssignedTo   int
+    AssigneeName string
+    CreatedAt    time.Time
+    UpdatedAt    time.Time
+
+    FirstResponseDue     time.Time
+    ResolutionDue        time.Time
+    FirstResponseAt      *time.Time
+    ResolvedAt           *time.Time
+    ResponseBreachedAt   *time.Time
+    ResolutionBreachedAt *time.Time
+    ResponseStaffID      int
+    ResolutionStaffID    int
+}
+
+// TicketMessage is one message on a ticket. SenderType is user, staff (a
+// support_staff account) or admin (an admin app user); SenderID is the ID in
+// the matching table.
+type TicketMessage struct {
+    ID            int
+    TicketID      int
+    SenderType    string
+    SenderID      int
+    Message       string
+    AttachmentKey string // blob store key, or the URL of a message sent before uploads
+    CreatedAt     time.Time
+}
+
+// TicketFilter narrows TicketRepo.List. Zero fields match every ticket;
+// Unassigned matches tickets nobody is working.
+type TicketFilter struct {
+    UserID     int
+    Status     string
+    Priority   string
+    AssignedTo int
+    Unassigned bool
+    Limit      int
+}
+
+// SLAPolicy is how long staff have to first respond to and to resolve a
+// ticket of one priority.
+type SLAPolicy struct {
+    Priority             string    `json:"priority"`
+    FirstResponseMinutes int       `json:"first_response_minutes"`
+    ResolutionMinutes    int       `json:"resolution_minutes"`
+    UpdatedAt            time.Time `json:"updated_at"`
+}
+
+// SLAAgentStats counts the SLA targets one staff member met and missed.
+// StaffID 0 collects targets nobody was accountable for.
+type SLAAgentStats struct {
+    StaffID           int    `json:"staff_id"`
+    Username          string `json:"username,omitempty"`
+    ResponsesMet      int    `json:"responses_met"`
+    ResponsesMissed   int    `json:"responses_missed"`
+    ResolutionsMet    int    `json:"resolutions_met"`
+    ResolutionsMissed int    `json:"resolutions_missed"`
+}
+
+type TicketRepo interface {
+    // Create stores a new ticket with its SLA due times.
+    Create(ctx context.Context, t Ticket) (int, error)
+    Get(ctx context.Context, id int) (Ticket, error)
+    // List returns the tickets matching f, most recently updated first.
+    List(ctx context.Context, f TicketFilter) ([]Ticket, error)
+    // Lock is Get, holding the ticket until the transaction ends.
+    Lock(ctx context.Context, id int) (Ticket, error)
+    // Update stores t's status, priority, assignee and SLA fields and bumps
+    // its updated_at.
+    Update(ctx context.Context, t Ticket) error
+    // AddMessage appends m to its ticket and bumps the ticket's updated_at.
+    AddMessage(ctx context.Context, m TicketMessage) (int, error)
+    Messages(ctx context.Context, ticketID int) ([]TicketMessage, error)
+
+    // ClaimBreached locks a ticket with a target that fell due by now and is
+    // neither met nor yet recorded as breached, skipping tickets another
+    // transaction holds and those in skip. It returns errNotFound when there
+    // are none.
+    ClaimBreached(ctx context.Context, now time.Time, skip []int) (Ticket, error)
+    // OpenCounts returns how many unresolved tickets each staff member is
+    // assigned.
+    OpenCounts(ctx context.Context) (map[int]int, error)
+    // SLAReport counts, per accountable staff member, the targets met or
+    // breached in [from, to), by staff ID.
+    SLAReport(ctx context.Context, from, to time.Time) ([]SLAAgentStats, error)
+
+    // SLAPolicies returns the policy of every priority.
+    SLAPolicies(ctx context.Context) ([]SLAPolicy, error)
+    SLAPolicy(ctx context.Context, priority string) (SLAPolicy, error)
+    // SetSLAPolicy replaces the policy of p.Priority. Existing tickets keep
+    // their due times.
+    SetSLAPolicy(ctx context.Context, p SLAPolicy) error
+}
+
+// StaffMember is a support_staff account of the admin panel, which owns
+// them; the API only reads them.
+type StaffMember struct {
+    ID       int
+    Username string
+    Role     string
+    Active   bool
+}
+
+type StaffRepo interface {
+    Get(ctx context.Context, id int) (StaffMember, error)
+    // List returns every account, active or not, by username.
+    List(ctx context.Context) ([]StaffMember, error)
+}
+
+// DashboardStats are the headline figures on the admin dashboard.
+// TransactionVolume is the value of every transaction, price times quantity,
+// and CommissionsPaid the total of every commission.
+type DashboardStats struct {
+    TotalUsers        int   `json:"total_users"`
+    PendingKYC        int   `json:"pending_kyc"`
+    TotalInvestments  Money `json:"total_investments"`
+    TransactionVolume Money `json:"transaction_volume"`
+    CommissionsPaid   Money `json:"commissions_paid"`
+    TotalProducts     int   `json:"total_products"`
+    LowStockProducts  int   `json:"low_stock_products"`
+}
+
+// StatsPoint is one period of a time series: the users who signed up, the
+// amount invested, the transaction volume and the commissions paid in the
+// period starting at Start.
+type StatsPoint struct {
+    Start             time.Time // the period's first day, at midnight UTC
+    NewUsers          int
+    Invested          Money
+    TransactionVolume Money
+    Commissions       Money
+}
+
+type StatsRepo interface {
+    Dashboard(ctx context.Context) (DashboardStats, error)
+    // Series returns a point for every day, week (from Monday) or month,
+    // per interval, that overlaps [from, to), empty ones included. Only what
+    // happened within [from, to) is counted, even when the first period
+    // starts before from.
+    Series(ctx context.Context, interval string, from, to time.Time) ([]StatsPoint, error)
+}
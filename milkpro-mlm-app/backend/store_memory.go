@@ -0,0 +1,1689 @@
+package main
+
+import (
+    "context"
+    "maps"
+    "slices"
+    "sort"
+    "sync"
+    "time"
+)
+
+// storeMemory implements Store in process memory, for handler tests and for
+// running the server without Postgres (STORE=memory). It behaves like the
+// Postgres store but serialises all writes: every change, and every WithTx
+// block, works on a private copy of the data that replaces the shared copy
+// only if it succeeds. Reads share a read lock and use the shared copy.
+type storeMemory struct {
+    mu   *sync.RWMutex
+    root *memData // shared data; nil inside WithTx
+    tx   *memData // the transaction's copy inside WithTx
+    now  func() time.Time
+}
+
+type memData struct {
+    lastID map[string]int
+
+    users        map[int]User
+    products     map[int]Product
+    prices       []PriceVersion
+    stock        []StockMovement
+    projects     map[int]Project
+    investments  map[int]Investment
+    transactions map[int]Transaction
+    orders       map[int]Order
+    orderEvents  []OrderEvent
+    subs         map[int]Subscription
+    referrals    []memReferral
+    plans        map[int]memPlan
+    commissions  []memCommission
+    entries      []memEntry
+    kyc          map[int]KYCDocument
+    kycReviews   []KYCReview
+    tickets      map[int]Ticket
+    messages     []TicketMessage
+    slaPolicies  map[string]SLAPolicy
+    staff        map[int]StaffMember
+}
+
+type memReferral struct {
+    ID             int
+    UserID         int
+    ReferredUserID int
+    Level          int
+    CreatedAt      time.Time
+}
+
+type memPlan struct {
+    CommissionPlan
+    Active bool
+}
+
+type memCommission struct {
+    ID           int
+    SourceUserID int
+    Commission
+    CreatedAt    time.Time
+}
+
+type memEntry struct {
+    ID        int
+    Entry     JournalEntry
+    CreatedAt time.Time
+}
+
+// newMemoryStore returns an empty store holding the default commission plan
+// and SLA policies, like a freshly migrated database.
+func newMemoryStore() *storeMemory {
+    d := &memData{
+        lastID:       make(map[string]int),
+        users:        make(map[int]User),
+        products:     make(map[int]Product),
+        projects:     make(map[int]Project),
+        investments:  make(map[int]Investment),
+        transactions: make(map[int]Transaction),
+        orders:       make(map[int]Order),
+        subs:         make(map[int]Subscription),
+        plans:        make(map[int]memPlan),
+        kyc:          make(map[int]KYCDocument),
+        tickets:      make(map[int]Ticket),
+        slaPolicies:  make(map[string]SLAPolicy),
+        staff:        make(map[int]StaffMember),
+    }
+    for _, p := range defaultSLAPolicies {
+        d.slaPolicies[p.Priority] = p
+    }
+    for level, percent := range []Percent{500, 300, 100} {
+        id := d.nextID("commission_plans")
+        d.plans[id] = memPlan{CommissionPlan{ID: id, Level: level + 1, Percent: percent}, true}
+    }
+    return &storeMemory{mu: &sync.RWMutex{}, root: d, now: time.Now}
+}
+
+func (d *memData) nextID(table string) int {
+    d.lastID[table]++
+    return d.lastID[table]
+}
+
+// clone copies d for a transaction to work on. maps.Clone only copies
+// values, so the slices and maps inside them are copied too: changing one in
+// place must not reach the shared data if the transaction rolls back.
+func (d *memData) clone() *memData {
+    c := &memData{
+        lastID:       maps.Clone(d.lastID),
+        users:        maps.Clone(d.users),
+        products:     maps.Clone(d.products),
+        prices:       append([]PriceVersion(nil), d.prices...),
+        stock:        append([]StockMovement(nil), d.stock...),
+        projects:     maps.Clone(d.projects),
+        investments:  maps.Clone(d.investments),
+        transactions: maps.Clone(d.transactions),
+        orders:       maps.Clone(d.orders),
+        orderEvents:  append([]OrderEvent(nil), d.orderEvents...),
+        subs:         maps.Clone(d.subs),
+        referrals:    append([]memReferral(nil), d.referrals...),
+        plans:        maps.Clone(d.plans),
+        commissions:  append([]memCommission(nil), d.commissions...),
+        entries:      append([]memEntry(nil), d.entries...),
+        kyc:          maps.Clone(d.kyc),
+        kycReviews:   append([]KYCReview(nil), d.kycReviews...),
+        tickets:      maps.Clone(d.tickets),
+        messages:     append([]TicketMessage(nil), d.messages...),
+        slaPolicies:  maps.Clone(d.slaPolicies),
+        staff:        maps.Clone(d.staff),
+    }
+    for id, p := range c.products {
+        p.Prices = maps.Clone(p.Prices)
+        c.products[id] = p
+    }
+    for id, o := range c.orders {
+        o.Items = slices.Clone(o.Items)
+        o.Events = slices.Clone(o.Events)
+        c.orders[id] = o
+    }
+    for id, sub := range c.subs {
+        sub.Skips = slices.Clone(sub.Skips)
+        c.subs[id] = sub
+    }
+    return c
+}
+
+// do runs fn on the data, atomically: outside a transaction fn works on a
+// copy that is kept only if fn succeeds.
+func (s *storeMemory) do(fn func(d *memData) error) error {
+    if s.tx != nil {
+        return fn(s.tx)
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    d := s.root.clone()
+    if err := fn(d); err != nil {
+        return err
+    }
+    *s.root = *d
+    return nil
+}
+
+// read runs fn on the data without copying it, so fn must not change it.
+// Writers never change the shared data in place, only replace it, so what
+// fn hands out may share slices with it but must be treated as read-only.
+func (s *storeMemory) read(fn func(d *memData) error) error {
+    if s.tx != nil {
+        return fn(s.tx)
+    }
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    return fn(s.root)
+}
+
+func (s *storeMemory) WithTx(ctx context.Context, fn func(Store) error) error {
+    if s.tx != nil {
+        return fn(s)
+    }
+    return s.do(func(d *memData) error {
+        return fn(&storeMemory{mu: s.mu, tx: d, now: s.now})
+    })
+}
+
+func (s *storeMemory) Users() UserRepo                 { return memUsers{s} }
+func (s *storeMemory) Products() ProductRepo           { return memProducts{s} }
+func (s *storeMemory) PriceBook() PriceBookRepo        { return memPriceBook{s} }
+func (s *storeMemory) Inventory() InventoryRepo        { return memInventory{s} }
+func (s *storeMemory) Projects() ProjectRepo           { return memProjects{s} }
+func (s *storeMemory) Investments() InvestmentRepo     { return memInvestments{s} }
+func (s *storeMemory) Transactions() TransactionRepo   { return memTransactions{s} }
+func (s *storeMemory) Orders() OrderRepo               { return memOrders{s} }
+func (s *storeMemory) Subscriptions() SubscriptionRepo { return memSubscriptions{s} }
+func (s *storeMemory) Referrals() ReferralRepo         { return memReferrals{s} }
+func (s *storeMemory) Commissions() CommissionRepo     { return memCommissions{s} }
+func (s *storeMemory) Wallet() WalletRepo              { return memWallet{s} }
+func (s *storeMemory) KYC() KYCRepo                    { return memKYC{s} }
+func (s *storeMemory) Tickets() TicketRepo             { return memTickets{s} }
+func (s *storeMemory) Staff() StaffRepo                { return memStaff{s} }
+func (s *storeMemory) Stats() StatsRepo                { return memStats{s} }
+
+type memUsers struct{ s *storeMemory }
+
+func (r memUsers) find(match func(User) bool) (User, error) {
+    var found User
+    err := r.s.read(func(d *memData) error {
+        for _, u := range d.users {
+            if match(u) {
+                found = u
+                return nil
+            }
+        }
+        return errNotFound
+    })
+    return found, err
+}
+
+func (r memUsers) Get(ctx context.Context, id int) (User, error) {
+    return r.find(func(u User) bool { return u.ID == id })
+}
+
+func (r memUsers) GetByPhone(ctx context.Context, phone string) (User, error) {
+    return r.find(func(u User) bool { return u.Phone == phone })
+}
+
+func (r memUsers) GetByReferralCode(ctx context.Context, code string) (User, error) {
+    return r.find(func(u User) bool { return code != "" && u.ReferralCode == code })
+}
+
+func (r memUsers) GetByFirebaseUID(ctx context.Context, uid string) (User, error) {
+    return r.find(func(u User) bool { return uid != "" && u.FirebaseUID == uid })
+}
+
+func (r memUsers) Create(ctx context.Context, u User) (int, error) {
+    err := r.s.do(func(d *memData) error {
+        for _, other := range d.users {
+            if u.ReferralCode != "" && other.ReferralCode == u.ReferralCode {
+                return errReferralCodeTaken
+            }
+            if other.Phone == u.Phone || (u.FirebaseUID != "" && other.FirebaseUID == u.FirebaseUID) {
+                return errPhoneTaken
+            }
+        }
+        u.ID = d.nextID("users")
+        u.KYCStatus = kycIncomplete
+        u.IsAdmin = false
+        u.Balance = 0
+        u.Region, u.PriceTier = "", ""
+        u.CreatedAt = r.s.now()
+        d.users[u.ID] = u
+        return nil
+    })
+    return u.ID, err
+}
+
+func (r memUsers) IDsWithoutReferralCode(ctx context.Context) ([]int, error) {
+    var ids []int
+    err := r.s.read(func(d *memData) error {
+        for id, u := range d.users {
+            if u.ReferralCode == "" {
+                ids = append(ids, id)
+            }
+        }
+        return nil
+    })
+    sort.Ints(ids)
+    return ids, err
+}
+
+func (r memUsers) SetReferralCode(ctx context.Context, id int, code string) error {
+    return r.s.do(func(d *memData) error {
+        for _, other := range d.users {
+            if other.ReferralCode == code {
+                return errReferralCodeTaken
+            }
+        }
+        u, ok := d.users[id]
+        if ok && u.ReferralCode == "" {
+            u.ReferralCode = code
+            d.users[id] = u
+        }
+        return nil
+    })
+}
+
+func (r memUsers) SetFirebaseUID(ctx context.Context, id int, uid string) error {
+    return r.s.do(func(d *memData) error {
+        for _, other := range d.users {
+            if other.FirebaseUID == uid {
+                return errNotFound
+            }
+        }
+        u, ok := d.users[id]
+        if !ok || u.FirebaseUID != "" {
+            return errNotFound
+        }
+        u.FirebaseUID = uid
+        d.users[id] = u
+        return nil
+    })
+}
+
+func (r memUsers) SetKYCStatus(ctx context.Context, id int, status string) error {
+    return r.s.do(func(d *memData) error {
+        u, ok := d.users[id]
+        if !ok {
+            return errNotFound
+        }
+        u.KYCStatus = status
+        d.users[id] = u
+        return nil
+    })
+}
+
+func (r memUsers) SetPriceScope(ctx context.Context, id int, scope PriceScope) error {
+    return r.s.do(func(d *memData) error {
+        u, ok := d.users[id]
+        if !ok {
+            return errNotFound
+        }
+        u.Region, u.PriceTier = scope.Region, scope.Tier
+        d.users[id] = u
+        return nil
+    })
+}
+
+func (r memUsers) List(ctx context.Context) ([]UserSummary, error) {
+    var users []UserSummary
+    err := r.s.read(func(d *memData) error {
+        for _, u := range d.users {
+            summary := UserSummary{User: u}
+            for _, inv := range d.investments {
+                if inv.UserID == u.ID {
+                    summary.TotalInvested += inv.Amount
+                }
+            }
+            for _, ref := range d.referrals {
+                if ref.UserID == u.ID {
+                    summary.TotalReferrals++
+                }
+            }
+            users = append(users, summary)
+        }
+        return nil
+    })
+    sort.Slice(users, func(i, j int) bool { return users[i].ID > users[j].ID })
+    return users, err
+}
+
+type memProducts struct{ s *storeMemory }
+
+func (r memProducts) List(ctx context.Context, includeArchived bool) ([]Product, error) {
+    var products []Product
+    err := r.s.read(func(d *memData) error {
+        now := r.s.now()
+        for _, p := range d.products {
+            if includeArchived || p.ArchivedAt == nil {
+                p.Prices = d.defaultPrices(p.ID, now)
+                products = append(products, p)
+            }
+        }
+        return nil
+    })
+    sort.Slice(products, func(i, j int) bool {
+        if products[i].Type != products[j].Type {
+            return products[i].Type < products[j].Type
+        }
+        return products[i].Name < products[j].Name
+    })
+    return products, err
+}
+
+func (r memProducts) Get(ctx context.Context, id int) (Product, error) {
+    var p Product
+    err := r.s.read(func(d *memData) error {
+        var ok bool
+        if p, ok = d.products[id]; !ok {
+            return errNotFound
+        }
+        p.Prices = d.defaultPrices(id, r.s.now())
+        return nil
+    })
+    return p, err
+}
+
+func (r memProducts) Create(ctx context.Context, p Product) (int, error) {
+    err := r.s.do(func(d *memData) error {
+        p.ID = d.nextID("products")
+        p.Prices = nil
+        p.Stock = 0
+        p.CreatedAt = r.s.now()
+        p.UpdatedAt = p.CreatedAt
+        p.ArchivedAt = nil
+        d.products[p.ID] = p
+        return nil
+    })
+    return p.ID, err
+}
+
+func (r memProducts) Update(ctx context.Context, p Product) error {
+    return r.s.do(func(d *memData) error {
+        current, ok := d.products[p.ID]
+        if !ok {
+            return errNotFound
+        }
+        if current.StockUnit != p.StockUnit && current.Stock != 0 {
+            return errStockUnitInUse
+        }
+        current.Name = p.Name
+        current.Type = p.Type
+        current.StockUnit = p.StockUnit
+        current.Density = p.Density
+        current.LowStockThreshold = p.LowStockThreshold
+        current.UpdatedAt = r.s.now()
+        d.products[p.ID] = current
+        return nil
+    })
+}
+
+func (r memProducts) Archive(ctx context.Context, id int) error {
+    return r.s.do(func(d *memData) error {
+        p, ok := d.products[id]
+        if !ok {
+            return errNotFound
+        }
+        if p.ArchivedAt == nil {
+            now := r.s.now()
+            p.ArchivedAt = &now
+            d.products[id] = p
+        }
+        return nil
+    })
+}
+
+// defaultPrices returns the unscoped prices of a product in effect at now.
+func (d *memData) defaultPrices(productID int, now time.Time) map[string]UnitPrices {
+    prices := map[string]UnitPrices{}
+    for _, unit := range units {
+        for _, side := range sides {
+            if v, ok := d.resolvePrice(productID, unit, side, PriceScope{}, now, true); ok {
+                prices[unit] = prices[unit].with(side, v.Price)
+            }
+        }
+    }
+    return prices
+}
+
+// resolvePrice picks a version as pgPriceBook.Resolve does, reporting false
+// if none applies or the one that does withdraws the price. With defaultOnly
+// set, overrides are ignored even if scope matches them.
+func (d *memData) resolvePrice(productID int, unit, side string, scope PriceScope, now time.Time, defaultOnly bool) (PriceVersion, bool) {
+    specificity := func(v PriceVersion) int {
+        n := 0
+        if v.Scope.Region != "" {
+            n += 2
+        }
+        if v.Scope.Tier != "" {
+            n++
+        }
+        return n
+    }
+    var best PriceVersion
+    found := false
+    for _, v := range d.prices {
+        switch {
+        case v.ProductID != productID || v.Unit != unit || v.Side != side:
+            continue
+        case v.EffectiveFrom.After(now) || (v.EffectiveUntil != nil && !v.EffectiveUntil.After(now)):
+            continue
+        case v.Scope.Region != "" && (defaultOnly || v.Scope.Region != scope.Region):
+            continue
+        case v.Scope.Tier != "" && (defaultOnly || v.Scope.Tier != scope.Tier):
+            continue
+        }
+        if !found || specificity(v) > specificity(best) ||
+            (specificity(v) == specificity(best) && (v.EffectiveFrom.After(best.EffectiveFrom) ||
+                (v.EffectiveFrom.Equal(best.EffectiveFrom) && v.ID > best.ID))) {
+            best, found = v, true
+        }
+    }
+    return best, found && best.Price > 0
+}
+
+type memPriceBook struct{ s *storeMemory }
+
+func (r memPriceBook) Add(ctx context.Context, v PriceVersion) (int, error) {
+    err := r.s.do(func(d *memData) error {
+        if _, ok := d.products[v.ProductID]; !ok {
+            return errNotFound
+        }
+        v.ID = d.nextID("price_versions")
+        v.CreatedAt = r.s.now()
+        if v.EffectiveFrom.IsZero() {
+            v.EffectiveFrom = v.CreatedAt
+        }
+        d.prices = append(d.prices, v)
+        return nil
+    })
+    return v.ID, err
+}
+
+func (r memPriceBook) History(ctx context.Context, productID int) ([]PriceVersion, error) {
+    var versions []PriceVersion
+    err := r.s.read(func(d *memData) error {
+        for _, v := range d.prices {
+            if v.ProductID == productID {
+                versions = append(versions, v)
+            }
+        }
+        return nil
+    })
+    sort.Slice(versions, func(i, j int) bool {
+        if !versions[i].EffectiveFrom.Equal(versions[j].EffectiveFrom) {
+            return versions[i].EffectiveFrom.After(versions[j].EffectiveFrom)
+        }
+        return versions[i].ID > versions[j].ID
+    })
+    return versions, err
+}
+
+func (r memPriceBook) Resolve(ctx context.Context, productID int, unit, side string, scope PriceScope) (PriceVersion, error) {
+    var v PriceVersion
+    err := r.s.read(func(d *memData) error {
+        var ok bool
+        if v, ok = d.resolvePrice(productID, unit, side, scope, r.s.now(), false); !ok {
+            return errNotFound
+        }
+        return nil
+    })
+    return v, err
+}
+
+type memInventory struct{ s *storeMemory }
+
+func (r memInventory) Move(ctx context.Context, m StockMovement) (StockMovement, error) {
+    err := r.s.do(func(d *memData) error {
+        p, ok := d.products[m.ProductID]
+        if !ok {
+            return errNotFound
+        }
+        var err error
+        if m, err = applyStock(m, p.Stock, p.StockUnit, p.Density); err != nil {
+            return err
+        }
+        p.Stock = m.Balance
+        d.products[p.ID] = p
+        m.ID = d.nextID("stock_movements")
+        m.CreatedAt = r.s.now()
+        d.stock = append(d.stock, m)
+        return nil
+    })
+    return m, err
+}
+
+func (r memInventory) Movements(ctx context.Context, productID, limit int) ([]StockMovement, error) {
+    var movements []StockMovement
+    err := r.s.read(func(d *memData) error {
+        for i := len(d.stock) - 1; i >= 0 && len(movements) < limit; i-- {
+            if d.stock[i].ProductID == productID {
+                movements = append(movements, d.stock[i])
+            }
+        }
+        return nil
+    })
+    return movements, err
+}
+
+func (r memInventory) LowStock(ctx context.Context) ([]Product, error) {
+    var products []Product
+    err := r.s.read(func(d *memData) error {
+        now := r.s.now()
+        for _, p := range d.products {
+            if p.ArchivedAt == nil && p.LowStockThreshold != nil && p.Stock <= *p.LowStockThreshold {
+                p.Prices = d.defaultPrices(p.ID, now)
+                products = append(products, p)
+            }
+        }
+        return nil
+    })
+    sort.Slice(products, func(i, j int) bool { return products[i].Name < products[j].Name })
+    return products, err
+}
+
+type memProjects struct{ s *storeMemory }
+
+func (r memProjects) List(ctx context.Context) ([]Project, error) {
+    var projects []Project
+    err := r.s.read(func(d *memData) error {
+        for _, p := range d.projects {
+            projects = append(projects, p)
+        }
+        return nil
+    })
+    sort.Slice(projects, func(i, j int) bool { return projects[i].ID > projects[j].ID })
+    return projects, err
+}
+
+func (r memProjects) Create(ctx context.Context, p Project) (int, error) {
+    err := r.s.do(func(d *memData) error {
+        p.ID = d.nextID("projects")
+        p.Status = projectActive
+        p.CreatedAt = r.s.now()
+        d.projects[p.ID] = p
+        return nil
+    })
+    return p.ID, err
+}
+
+func (r memProjects) LockForInvestment(ctx context.Context, id int) (projectTerms, error) {
+    var terms projectTerms
+    err := r.s.read(func(d *memData) error {
+        p, ok := d.projects[id]
+        if !ok {
+            return errNotFound
+        }
+        terms = projectTerms{
+            ID:            p.ID,
+            LockDays:      p.LockDays,
+            ProfitPercent: p.ProfitPercent,
+            MinInvestment: p.MinInvestment,
+            MaxInvestment: p.MaxInvestment,
+            Status:        p.Status,
+            FundingCap:    p.FundingCap,
+        }
+        for _, inv := range d.investments {
+            if inv.ProjectID == id && inv.Status == investmentActive {
+                terms.Funded += inv.Amount
+            }
+        }
+        return nil
+    })
+    return terms, err
+}
+
+func (r memProjects) LockStatus(ctx context.Context, id int) (string, error) {
+    var status string
+    err := r.s.read(func(d *memData) error {
+        p, ok := d.projects[id]
+        if !ok {
+            return errNotFound
+        }
+        status = p.Status
+        return nil
+    })
+    return status, err
+}
+
+func (r memProjects) SetStatus(ctx context.Context, id int, status string) error {
+    return r.s.do(func(d *memData) error {
+        p, ok := d.projects[id]
+        if !ok {
+            return errNotFound
+        }
+        p.Status = status
+        d.projects[id] = p
+        return nil
+    })
+}
+
+type memInvestments struct{ s *storeMemory }
+
+func (r memInvestments) Create(ctx context.Context, n NewInvestment) (int, error) {
+    var id int
+    err := r.s.do(func(d *memData) error {
+        p, ok := d.projects[n.ProjectID]
+        if !ok {
+            return errNotFound
+        }
+        now := r.s.now()
+        id = d.nextID("investments")
+        d.investments[id] = Investment{
+            ID:             id,
+            UserID:         n.UserID,
+            ProjectID:      n.ProjectID,
+            ProjectName:    p.Name,
+            Amount:         n.Amount,
+            ProfitPercent:  n.ProfitPercent,
+            Reinvest:       n.Reinvest,
+            Status:         investmentActive,
+            InvestedAt:     now,
+            LockEndDate:    now.AddDate(0, 0, n.LockDays),
+            ReinvestedFrom: n.ReinvestedFrom,
+        }
+        return nil
+    })
+    return id, err
+}
+
+func (r memInvestments) ListByUser(ctx context.Context, userID int) ([]Investment, error) {
+    var investments []Investment
+    err := r.s.read(func(d *memData) error {
+        for _, inv := range d.investments {
+            if inv.UserID == userID {
+                investments = append(investments, inv)
+            }
+        }
+        return nil
+    })
+    sort.Slice(investments, func(i, j int) bool { return investments[i].ID > investments[j].ID })
+    return investments, err
+}
+
+func (r memInvestments) ClaimDue(ctx context.Context, skip []int) (Investment, error) {
+    var due Investment
+    err := r.s.read(func(d *memData) error {
+        now := r.s.now()
+        found := false
+        for _, inv := range d.investments {
+            if inv.Status != investmentActive || inv.LockEndDate.After(now) || slices.Contains(skip, inv.ID) {
+                continue
+            }
+            if !found || inv.LockEndDate.Before(due.LockEndDate) ||
+                inv.LockEndDate.Equal(due.LockEndDate) && inv.ID < due.ID {
+                due, found = inv, true
+            }
+        }
+        if !found {
+            return errNotFound
+        }
+        return nil
+    })
+    return due, err
+}
+
+func (r memInvestments) SetStatus(ctx context.Context, id int, status string) error {
+    return r.s.do(func(d *memData) error {
+        inv, ok := d.investments[id]
+        if !ok {
+            return errNotFound
+        }
+        inv.Status = status
+        d.investments[id] = inv
+        return nil
+    })
+}
+
+type memTransactions struct{ s *storeMemory }
+
+func (r memTransactions) Create(ctx context.Context, t Transaction) (int, error) {
+    err := r.s.do(func(d *memData) error {
+        p, ok := d.products[t.ProductID]
+        if !ok {
+            return errNotFound
+        }
+        t.ID = d.nextID("transactions")
+        t.ProductName = p.Name
+        t.ProductType = p.Type
+        t.Date = r.s.now()
+        d.transactions[t.ID] = t
+        return nil
+    })
+    return t.ID, err
+}
+
+func (r memTransactions) ListByUser(ctx context.Context, userID int) ([]Transaction, error) {
+    var transactions []Transaction
+    err := r.s.read(func(d *memData) error {
+        for _, t := range d.transactions {
+            if t.UserID == userID {
+                transactions = append(transactions, t)
+            }
+        }
+        return nil
+    })
+    sort.Slice(transactions, func(i, j int) bool { return transactions[i].ID > transactions[j].ID })
+    return transactions, err
+}
+
+type memOrders struct{ s *storeMemory }
+
+func (r memOrders) Create(ctx context.Context, o Order, placed OrderEvent) (int, error) {
+    err := r.s.do(func(d *memData) error {
+        if _, ok := d.users[o.UserID]; !ok {
+            return errNotFound
+        }
+        if o.SubscriptionID != 0 && d.deliveryOrder(o.SubscriptionID, o.DeliveryDate) != 0 {
+            return errDeliveryExists
+        }
+        o.ID = d.nextID("orders")
+        o.Status = orderPending
+        o.CreatedAt = r.s.now()
+        o.UpdatedAt = o.CreatedAt
+        o.Events = nil
+        items := make([]OrderItem, len(o.Items))
+        for i, item := range o.Items {
+            p, ok := d.products[item.ProductID]
+            if !ok {
+                return errNotFound
+            }
+            item.ID = d.nextID("order_items")
+            item.OrderID = o.ID
+            item.ProductName = p.Name
+            items[i] = item
+        }
+        o.Items = items
+        d.orders[o.ID] = o
+
+        placed.ID = d.nextID("order_events")
+        placed.OrderID = o.ID
+        placed.Status = orderPending
+        placed.CreatedAt = o.CreatedAt
+        d.orderEvents = append(d.orderEvents, placed)
+        return nil
+    })
+    return o.ID, err
+}
+
+func (r memOrders) Get(ctx context.Context, id int) (Order, error) {
+    var o Order
+    err := r.s.read(func(d *memData) error {
+        var ok bool
+        if o, ok = d.orders[id]; !ok {
+            return errNotFound
+        }
+        for _, e := range d.orderEvents {
+            if e.OrderID == id {
+                o.Events = append(o.Events, e)
+            }
+        }
+        return nil
+    })
+    return o, err
+}
+
+func (r memOrders) List(ctx context.Context, f OrderFilter) ([]Order, error) {
+    var orders []Order
+    err := r.s.read(func(d *memData) error {
+        for _, o := range d.orders {
+            switch {
+            case f.UserID != 0 && o.UserID != f.UserID:
+            case f.Status != "" && o.Status != f.Status:
+            case f.SubscriptionID != 0 && o.SubscriptionID != f.SubscriptionID:
+            case !f.DeliveryDate.IsZero() && !o.DeliveryDate.Equal(f.DeliveryDate):
+            default:
+                orders = append(orders, o)
+            }
+        }
+        return nil
+    })
+    sort.Slice(orders, func(i, j int) bool { return orders[i].ID > orders[j].ID })
+    if f.Limit > 0 && len(orders) > f.Limit {
+        orders = orders[:f.Limit]
+    }
+    return orders, err
+}
+
+func (r memOrders) LockStatus(ctx context.Context, id int) (string, error) {
+    var status string
+    err := r.s.read(func(d *memData) error {
+        o, ok := d.orders[id]
+        if !ok {
+            return errNotFound
+        }
+        status = o.Status
+        return nil
+    })
+    return status, err
+}
+
+func (r memOrders) SetStatus(ctx context.Context, e OrderEvent) error {
+    return r.s.do(func(d *memData) error {
+        o, ok := d.orders[e.OrderID]
+        if !ok {
+            return errNotFound
+        }
+        o.Status = e.Status
+        o.UpdatedAt = r.s.now()
+        d.orders[o.ID] = o
+
+        e.ID = d.nextID("order_events")
+        e.CreatedAt = o.UpdatedAt
+        d.orderEvents = append(d.orderEvents, e)
+        return nil
+    })
+}
+
+// deliveryOrder returns the ID of the order generated for a subscription's
+// delivery on date, or 0.
+func (d *memData) deliveryOrder(subscriptionID int, date time.Time) int {
+    for _, o := range d.orders {
+        if o.SubscriptionID == subscriptionID && o.DeliveryDate.Equal(date) {
+            return o.ID
+        }
+    }
+    return 0
+}
+
+type memSubscriptions struct{ s *storeMemory }
+
+func (r memSubscriptions) Create(ctx context.Context, sub Subscription) (int, error) {
+    err := r.s.do(func(d *memData) error {
+        if _, ok := d.products[sub.ProductID]; !ok {
+            return errNotFound
+        }
+        sub.ID = d.nextID("subscriptions")
+        sub.Status = subscriptionActive
+        sub.Skips = nil
+        sub.CreatedAt = r.s.now()
+        sub.UpdatedAt = sub.CreatedAt
+        d.subs[sub.ID] = sub
+        return nil
+    })
+    return sub.ID, err
+}
+
+func (r memSubscriptions) Get(ctx context.Context, id int) (Subscription, error) {
+    var sub Subscription
+    err := r.s.read(func(d *memData) error {
+        var ok bool
+        if sub, ok = d.subs[id]; !ok {
+            return errNotFound
+        }
+        sub.ProductName = d.products[sub.ProductID].Name
+        return nil
+    })
+    return sub, err
+}
+
+func (r memSubscriptions) List(ctx context.Context, userID int) ([]Subscription, error) {
+    var subs []Subscription
+    err := r.s.read(func(d *memData) error {
+        for _, sub := range d.subs {
+            if userID == 0 || sub.UserID == userID {
+                sub.ProductName = d.products[sub.ProductID].Name
+                subs = append(subs, sub)
+            }
+        }
+        return nil
+    })
+    sort.Slice(subs, func(i, j int) bool { return subs[i].ID > subs[j].ID })
+    return subs, err
+}
+
+func (r memSubscriptions) Lock(ctx context.Context, id int) (Subscription, error) {
+    return r.Get(ctx, id)
+}
+
+// update applies fn to subscription id and stamps it updated.
+func (r memSubscriptions) update(id int, fn func(*Subscription)) error {
+    return r.s.do(func(d *memData) error {
+        sub, ok := d.subs[id]
+        if !ok {
+            return errNotFound
+        }
+        fn(&sub)
+        sub.UpdatedAt = r.s.now()
+        d.subs[id] = sub
+        return nil
+    })
+}
+
+func (r memSubscriptions) SetStatus(ctx context.Context, id int, status string) error {
+    return r.update(id, func(sub *Subscription) { sub.Status = status })
+}
+
+func (r memSubscriptions) Skip(ctx context.Context, id int, date time.Time) error {
+    return r.update(id, func(sub *Subscription) {
+        skips := []time.Time{}
+        for _, skip := range sub.Skips {
+            if !skip.Equal(date) {
+                skips = append(skips, skip)
+            }
+        }
+        skips = append(skips, date)
+        sort.Slice(skips, func(i, j int) bool { return skips[i].Before(skips[j]) })
+        sub.Skips = skips
+    })
+}
+
+func (r memSubscriptions) Unskip(ctx context.Context, id int, date time.Time) error {
+    return r.update(id, func(sub *Subscription) {
+        skips := []time.Time{}
+        for _, skip := range sub.Skips {
+            if !skip.Equal(date) {
+                skips = append(skips, skip)
+            }
+        }
+        sub.Skips = skips
+    })
+}
+
+func (r memSubscriptions) Due(ctx context.Context, date time.Time) ([]int, error) {
+    var ids []int
+    err := r.s.read(func(d *memData) error {
+        for _, sub := range d.subs {
+            if sub.Status == subscriptionActive && sub.DeliversOn(date) && d.deliveryOrder(sub.ID, date) == 0 &&
+                d.products[sub.ProductID].ArchivedAt == nil {
+                ids = append(ids, sub.ID)
+            }
+        }
+        return nil
+    })
+    sort.Ints(ids)
+    return ids, err
+}
+
+func (r memSubscriptions) Manifest(ctx context.Context, date time.Time) ([]DeliveryLine, error) {
+    var lines []DeliveryLine
+    err := r.s.read(func(d *memData) error {
+        for _, o := range d.orders {
+            if o.SubscriptionID == 0 || !o.DeliveryDate.Equal(date) {
+                continue
+            }
+            u := d.users[o.UserID]
+            for _, item := range o.Items {
+                lines = append(lines, DeliveryLine{
+                    OrderID:        o.ID,
+                    SubscriptionID: o.SubscriptionID,
+                    UserID:         o.UserID,
+                    CustomerName:   u.Name,
+                    CustomerPhone:  u.Phone,
+                    ProductID:      item.ProductID,
+                    ProductName:    item.ProductName,
+                    Quantity:       item.Quantity,
+                    Unit:           item.Unit,
+                    Price:          item.Price,
+                    Total:          item.Price.MulQuantity(item.Quantity),
+                    Status:         o.Status,
+                })
+            }
+        }
+        return nil
+    })
+    sort.Slice(lines, func(i, j int) bool {
+        if lines[i].CustomerName != lines[j].CustomerName {
+            return lines[i].CustomerName < lines[j].CustomerName
+        }
+        return lines[i].OrderID < lines[j].OrderID
+    })
+    return lines, err
+}
+
+type memReferrals struct{ s *storeMemory }
+
+func (r memReferrals) Link(ctx context.Context, userID, sponsorID int) error {
+    return r.s.do(func(d *memData) error {
+        links := []memReferral{{UserID: sponsorID, ReferredUserID: userID, Level: 1}}
+        for _, ref := range d.referrals {
+            if ref.ReferredUserID == sponsorID && ref.Level < maxReferralDepth {
+                links = append(links, memReferral{UserID: ref.UserID, ReferredUserID: userID, Level: ref.Level + 1})
+            }
+        }
+        for _, link := range links {
+            link.ID = d.nextID("referrals")
+            link.CreatedAt = r.s.now()
+            d.referrals = append(d.referrals, link)
+        }
+        return nil
+    })
+}
+
+func (r memReferrals) Upline(ctx context.Context, userID int) ([]int, error) {
+    var links []memReferral
+    err := r.s.read(func(d *memData) error {
+        for _, ref := range d.referrals {
+            if ref.ReferredUserID == userID && ref.Level <= maxReferralDepth {
+                links = append(links, ref)
+            }
+        }
+        return nil
+    })
+    sort.Slice(links, func(i, j int) bool { return links[i].Level < links[j].Level })
+
+    var upline []int
+    for _, ref := range links {
+        upline = append(upline, ref.UserID)
+    }
+    return upline, err
+}
+
+func (r memReferrals) Downline(ctx context.Context, userID int) ([]Referral, error) {
+    var referrals []Referral
+    err := r.s.read(func(d *memData) error {
+        for _, ref := range d.referrals {
+            if ref.UserID != userID {
+                continue
+            }
+            member := d.users[ref.ReferredUserID]
+            out := Referral{
+                ID:            ref.ID,
+                ReferredPhone: member.Phone,
+                ReferredName:  member.Name,
+                Level:         ref.Level,
+                CreatedAt:     ref.CreatedAt,
+                Depth:         ref.Level,
+            }
+            for _, c := range d.commissions {
+                if c.BeneficiaryID == userID && c.SourceUserID == ref.ReferredUserID {
+                    out.Commission += c.Amount
+                }
+            }
+            referrals = append(referrals, out)
+        }
+        return nil
+    })
+    sort.SliceStable(referrals, func(i, j int) bool {
+        if referrals[i].Level != referrals[j].Level {
+            return referrals[i].Level < referrals[j].Level
+        }
+        return referrals[i].ID < referrals[j].ID
+    })
+    return referrals, err
+}
+
+type memCommissions struct{ s *storeMemory }
+
+func (r memCommissions) ActivePlans(ctx context.Context) ([]CommissionPlan, error) {
+    var plans []CommissionPlan
+    err := r.s.read(func(d *memData) error {
+        for _, p := range d.plans {
+            if p.Active {
+                plans = append(plans, p.CommissionPlan)
+            }
+        }
+        return nil
+    })
+    sort.Slice(plans, func(i, j int) bool {
+        a, b := plans[i], plans[j]
+        if a.ProductID != b.ProductID {
+            return a.ProductID < b.ProductID
+        }
+        if a.ProjectID != b.ProjectID {
+            return a.ProjectID < b.ProjectID
+        }
+        return a.Level < b.Level
+    })
+    return plans, err
+}
+
+func (r memCommissions) ReplacePlan(ctx context.Context, p CommissionPlan) (int, error) {
+    err := r.s.do(func(d *memData) error {
+        for id, old := range d.plans {
+            if old.Active && old.Level == p.Level && old.ProductID == p.ProductID && old.ProjectID == p.ProjectID {
+                old.Active = false
+                d.plans[id] = old
+            }
+        }
+        p.ID = d.nextID("commission_plans")
+        d.plans[p.ID] = memPlan{p, true}
+        return nil
+    })
+    return p.ID, err
+}
+
+func (r memCommissions) Record(ctx context.Context, src CommissionSource, c Commission) (int, error) {
+    err := r.s.do(func(d *memData) error {
+        c.ID = d.nextID("commissions")
+        d.commissions = append(d.commissions, memCommission{ID: c.ID, SourceUserID: src.UserID, Commission: c,
+            CreatedAt: r.s.now()})
+        return nil
+    })
+    return c.ID, err
+}
+
+type memWallet struct{ s *storeMemory }
+
+func (r memWallet) Post(ctx context.Context, e JournalEntry) (int, error) {
+    var id int
+    err := r.s.do(func(d *memData) error {
+        for _, p := range e.Postings {
+            if p.UserID == 0 {
+                if !isSystemAccount(p.Account) {
+                    return errUnknownAccount(p.Account)
+                }
+                continue
+            }
+            u, ok := d.users[p.UserID]
+            if !ok {
+                return errNotFound
+            }
+            u.Balance += p.Amount
+            if u.Balance < 0 {
+                return errInsufficientFunds
+            }
+            d.users[p.UserID] = u
+        }
+        id = d.nextID("journal_entries")
+        e.Postings = append([]Posting(nil), e.Postings...)
+        d.entries = append(d.entries, memEntry{ID: id, Entry: e, CreatedAt: r.s.now()})
+        return nil
+    })
+    return id, err
+}
+
+func (r memWallet) Statement(ctx context.Context, userID, limit int) (Money, []WalletEntry, error) {
+    var balance Money
+    entries := []WalletEntry{}
+    err := r.s.read(func(d *memData) error {
+        u, ok := d.users[userID]
+        if !ok {
+            return errNotFound
+        }
+        balance = u.Balance
+        for i := len(d.entries) - 1; i >= 0 && len(entries) < limit; i-- {
+            e := d.entries[i]
+            for _, p := range e.Entry.Postings {
+                if p.UserID != userID {
+                    continue
+                }
+                entries = append(entries, WalletEntry{
+                    ID:            e.ID,
+                    Kind:          e.Entry.Kind,
+                    ReferenceType: e.Entry.ReferenceType,
+                    ReferenceID:   e.Entry.ReferenceID,
+                    Memo:          e.Entry.Memo,
+                    Amount:        p.Amount,
+                    CreatedAt:     e.CreatedAt,
+                })
+            }
+        }
+        return nil
+    })
+    if len(entries) > limit {
+        entries = entries[:limit]
+    }
+    return balance, entries, err
+}
+
+func (r memWallet) Audit(ctx context.Context) (WalletAudit, error) {
+    audit := WalletAudit{UnbalancedEntries: []int{}, Mismatches: []WalletMismatch{}}
+    err := r.s.read(func(d *memData) error {
+        ledger := make(map[int]Money)
+        for _, e := range d.entries {
+            var sum Money
+            for _, p := range e.Entry.Postings {
+                sum += p.Amount
+                if p.UserID != 0 {
+                    ledger[p.UserID] += p.Amount
+                }
+            }
+            if sum != 0 {
+                audit.UnbalancedEntries = append(audit.UnbalancedEntries, e.ID)
+            }
+        }
+        for id, u := range d.users {
+            if u.Balance != ledger[id] {
+                audit.Mismatches = append(audit.Mismatches, WalletMismatch{id, u.Balance, ledger[id]})
+            }
+        }
+        return nil
+    })
+    sort.Slice(audit.Mismatches, func(i, j int) bool { return audit.Mismatches[i].UserID < audit.Mismatches[j].UserID })
+    return audit, err
+}
+
+type memKYC struct{ s *storeMemory }
+
+func (r memKYC) Create(ctx context.Context, doc KYCDocument) (int, error) {
+    err := r.s.do(func(d *memData) error {
+        for _, other := range d.kyc {
+            if other.UserID == doc.UserID && other.Type == doc.Type && other.Type != "" &&
+                other.Status != kycRejected {
+                return errKYCDocumentExists
+            }
+        }
+        doc.ID = d.nextID("kyc_documents")
+        doc.Status = kycPending
+        doc.UploadedAt = r.s.now()
+        d.kyc[doc.ID] = doc
+        return nil
+    })
+    return doc.ID, err
+}
+
+func (r memKYC) Get(ctx context.Context, id int) (KYCDocument, error) {
+    var doc KYCDocument
+    err := r.s.read(func(d *memData) error {
+        var ok bool
+        if doc, ok = d.kyc[id]; !ok {
+            return errNotFound
+        }
+        return nil
+    })
+    return doc, err
+}
+
+func (r memKYC) Lock(ctx context.Context, userID int) ([]KYCDocument, error) {
+    err := r.s.read(func(d *memData) error {
+        if _, ok := d.users[userID]; !ok {
+            return errNotFound
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return r.ListByUser(ctx, userID)
+}
+
+func (r memKYC) ListByUser(ctx context.Context, userID int) ([]KYCDocument, error) {
+    var docs []KYCDocument
+    err := r.s.read(func(d *memData) error {
+        for _, doc := range d.kyc {
+            if doc.UserID == userID {
+                docs = append(docs, doc)
+            }
+        }
+        return nil
+    })
+    sort.Slice(docs, func(i, j int) bool { return docs[i].ID < docs[j].ID })
+    return docs, err
+}
+
+func (r memKYC) Pending(ctx context.Context, limit int) ([]KYCDocument, error) {
+    var docs []KYCDocument
+    err := r.s.read(func(d *memData) error {
+        for _, doc := range d.kyc {
+            if doc.Status == kycPending {
+                docs = append(docs, doc)
+            }
+        }
+        return nil
+    })
+    sort.Slice(docs, func(i, j int) bool { return docs[i].ID < docs[j].ID })
+    if len(docs) > limit {
+        docs = docs[:limit]
+    }
+    return docs, err
+}
+
+func (r memKYC) Review(ctx context.Context, rv KYCReview) error {
+    return r.s.do(func(d *memData) error {
+        doc, ok := d.kyc[rv.DocumentID]
+        if !ok {
+            return errNotFound
+        }
+        rv.ID = d.nextID("kyc_reviews")
+        rv.UserID = doc.UserID
+        rv.CreatedAt = r.s.now()
+        doc.Status, doc.Reason, doc.ReviewedAt = rv.Status, rv.Reason, rv.CreatedAt
+        d.kyc[doc.ID] = doc
+        d.kycReviews = append(d.kycReviews, rv)
+        return nil
+    })
+}
+
+func (r memKYC) Reviews(ctx context.Context, userID int) ([]KYCReview, error) {
+    var reviews []KYCReview
+    err := r.s.read(func(d *memData) error {
+        for _, rv := range d.kycReviews {
+            if rv.UserID == userID {
+                reviews = append(reviews, rv)
+            }
+        }
+        return nil
+    })
+    return reviews, err
+}
+
+type memTickets struct{ s *storeMemory }
+
+// ticket fills in the names a Postgres query joins onto t.
+func (d *memData) ticket(t Ticket) Ticket {
+    t.UserName = d.users[t.UserID].Name
+    t.AssigneeName = d.staff[t.AssignedTo].Username
+    return t
+}
+
+func (r memTickets) Create(ctx context.Context, t Ticket) (int, error) {
+    err := r.s.do(func(d *memData) error {
+        t.ID = d.nextID("support_tickets")
+        if t.Status == "" {
+            t.Status = "open"
+        }
+        if t.Priority == "" {
+            t.Priority = "medium"
+        }
+        t.CreatedAt = r.s.now()
+        t.UpdatedAt = t.CreatedAt
+        d.tickets[t.ID] = t
+        return nil
+    })
+    return t.ID, err
+}
+
+func (r memTickets) Get(ctx context.Context, id int) (Ticket, error) {
+    var t Ticket
+    err := r.s.read(func(d *memData) error {
+        var ok bool
+        if t, ok = d.tickets[id]; !ok {
+            return errNotFound
+        }
+        t = d.ticket(t)
+        return nil
+    })
+    return t, err
+}
+
+func (r memTickets) List(ctx context.Context, f TicketFilter) ([]Ticket, error) {
+    var tickets []Ticket
+    err := r.s.read(func(d *memData) error {
+        for _, t := range d.tickets {
+            switch {
+            case f.UserID != 0 && t.UserID != f.UserID:
+            case f.Status != "" && t.Status != f.Status:
+            case f.Priority != "" && t.Priority != f.Priority:
+            case f.AssignedTo != 0 && t.AssignedTo != f.AssignedTo:
+            case f.Unassigned && t.AssignedTo != 0:
+            default:
+                tickets = append(tickets, d.ticket(t))
+            }
+        }
+        return nil
+    })
+    sort.Slice(tickets, func(i, j int) bool {
+        if !tickets[i].UpdatedAt.Equal(tickets[j].UpdatedAt) {
+            return tickets[i].UpdatedAt.After(tickets[j].UpdatedAt)
+        }
+        return tickets[i].ID > tickets[j].ID
+    })
+    if f.Limit > 0 && len(tickets) > f.Limit {
+        tickets = tickets[:f.Limit]
+    }
+    return tickets, err
+}
+
+func (r memTickets) Lock(ctx context.Context, id int) (Ticket, error) {
+    return r.Get(ctx, id)
+}
+
+func (r memTickets) Update(ctx context.Context, t Ticket) error {
+    return r.s.do(func(d *memData) error {
+        stored, ok := d.tickets[t.ID]
+        if !ok {
+            return errNotFound
+        }
+        stored.Status, stored.Priority, stored.AssignedTo = t.Status, t.Priority, t.AssignedTo
+        stored.FirstResponseDue, stored.ResolutionDue = t.FirstResponseDue, t.ResolutionDue
+        stored.FirstResponseAt, stored.ResolvedAt = t.FirstResponseAt, t.ResolvedAt
+        stored.ResponseBreachedAt, stored.ResolutionBreachedAt = t.ResponseBreachedAt, t.ResolutionBreachedAt
+        stored.ResponseStaffID, stored.ResolutionStaffID = t.ResponseStaffID, t.ResolutionStaffID
+        stored.UpdatedAt = r.s.now()
+        d.tickets[t.ID] = stored
+        return nil
+    })
+}
+
+func (r memTickets) AddMessage(ctx context.Context, m TicketMessage) (int, error) {
+    err := r.s.do(func(d *memData) error {
+        t, ok := d.tickets[m.TicketID]
+        if !ok {
+            return errNotFound
+        }
+        m.ID = d.nextID("ticket_messages")
+        m.CreatedAt = r.s.now()
+        d.messages = append(d.messages, m)
+        t.UpdatedAt = m.CreatedAt
+        d.tickets[t.ID] = t
+        return nil
+    })
+    return m.ID, err
+}
+
+func (r memTickets) Messages(ctx context.Context, ticketID int) ([]TicketMessage, error) {
+    var messages []TicketMessage
+    err := r.s.read(func(d *memData) error {
+        for _, m := range d.messages {
+            if m.TicketID == ticketID {
+                messages = append(messages, m)
+            }
+        }
+        return nil
+    })
+    return messages, err
+}
+
+func (r memTickets) ClaimBreached(ctx context.Context, now time.Time, skip []int) (Ticket, error) {
+    var t Ticket
+    err := r.s.read(func(d *memData) error {
+        found := false
+        for _, c := range d.tickets {
+            due := c.FirstResponseAt == nil && c.ResponseBreachedAt == nil && !c.FirstResponseDue.After(now) ||
+                c.ResolvedAt == nil && c.ResolutionBreachedAt == nil && !c.ResolutionDue.After(now)
+            if due && !slices.Contains(skip, c.ID) && (!found || c.ID < t.ID) {
+                t, found = c, true
+            }
+        }
+        if !found {
+            return errNotFound
+        }
+        t = d.ticket(t)
+        return nil
+    })
+    return t, err
+}
+
+func (r memTickets) OpenCounts(ctx context.Context) (map[int]int, error) {
+    counts := make(map[int]int)
+    err := r.s.read(func(d *memData) error {
+        for _, t := range d.tickets {
+            if t.AssignedTo != 0 && (t.Status == ticketOpen || t.Status == ticketInProgress) {
+                counts[t.AssignedTo]++
+            }
+        }
+        return nil
+    })
+    return counts, err
+}
+
+func (r memTickets) SLAReport(ctx context.Context, from, to time.Time) ([]SLAAgentStats, error) {
+    var report []SLAAgentStats
+    err := r.s.read(func(d *memData) error {
+        byStaff := make(map[int]*SLAAgentStats)
+        agent := func(staffID int) *SLAAgentStats {
+            a := byStaff[staffID]
+            if a == nil {
+                a = &SLAAgentStats{StaffID: staffID, Username: d.staff[staffID].Username}
+                byStaff[staffID] = a
+            }
+            return a
+        }
+        // settled places a target at when it was met or breached and reports
+        // whether that is in the period.
+        settled := func(at, breachedAt *time.Time) bool {
+            if breachedAt != nil {
+                at = breachedAt
+            }
+            return at != nil && !at.Before(from) && at.Before(to)
+        }
+        for _, t := range d.tickets {
+            if settled(t.FirstResponseAt, t.ResponseBreachedAt) {
+                if a := agent(t.ResponseStaffID); t.ResponseBreachedAt != nil {
+                    a.ResponsesMissed++
+                } else {
+                    a.ResponsesMet++
+                }
+            }
+            if settled(t.ResolvedAt, t.ResolutionBreachedAt) {
+                if a := agent(t.ResolutionStaffID); t.ResolutionBreachedAt != nil {
+                    a.ResolutionsMissed++
+                } else {
+                    a.ResolutionsMet++
+                }
+            }
+        }
+        for _, a := range byStaff {
+            report = append(report, *a)
+        }
+        return nil
+    })
+    sort.Slice(report, func(i, j int) bool { return report[i].StaffID < report[j].StaffID })
+    return report, err
+}
+
+func (r memTickets) SLAPolicies(ctx context.Context) ([]SLAPolicy, error) {
+    var policies []SLAPolicy
+    err := r.s.read(func(d *memData) error {
+        for _, priority := range ticketPriorities {
+            if p, ok := d.slaPolicies[priority]; ok {
+                policies = append(policies, p)
+            }
+        }
+        return nil
+    })
+    return policies, err
+}
+
+func (r memTickets) SLAPolicy(ctx context.Context, priority string) (SLAPolicy, error) {
+    var p SLAPolicy
+    err := r.s.read(func(d *memData) error {
+        var ok bool
+        if p, ok = d.slaPolicies[priority]; !ok {
+            return errNotFound
+        }
+        return nil
+    })
+    return p, err
+}
+
+func (r memTickets) SetSLAPolicy(ctx context.Context, p SLAPolicy) error {
+    return r.s.do(func(d *memData) error {
+        p.UpdatedAt = r.s.now()
+        d.slaPolicies[p.Priority] = p
+        return nil
+    })
+}
+
+type memStaff struct{ s *storeMemory }
+
+// addStaff stands in for the admin panel creating a support_staff account.
+func (s *storeMemory) addStaff(m StaffMember) int {
+    s.do(func(d *memData) error {
+        m.ID = d.nextID("support_staff")
+        d.staff[m.ID] = m
+        return nil
+    })
+    return m.ID
+}
+
+func (r memStaff) Get(ctx context.Context, id int) (StaffMember, error) {
+    var m StaffMember
+    err := r.s.read(func(d *memData) error {
+        var ok bool
+        if m, ok = d.staff[id]; !ok {
+            return errNotFound
+        }
+        return nil
+    })
+    return m, err
+}
+
+func (r memStaff) List(ctx context.Context) ([]StaffMember, error) {
+    var staff []StaffMember
+    err := r.s.read(func(d *memData) error {
+        for _, m := range d.staff {
+            staff = append(staff, m)
+        }
+        return nil
+    })
+    sort.Slice(staff, func(i, j int) bool { return staff[i].Username < staff[j].Username })
+    return staff, err
+}
+
+type memStats struct{ s *storeMemory }
+
+func (r memStats) Dashboard(ctx context.Context) (DashboardStats, error) {
+    var stats DashboardStats
+    err := r.s.read(func(d *memData) error {
+        stats.TotalUsers = len(d.users)
+        for _, u := range d.users {
+            if u.KYCStatus == "pending" {
+                stats.PendingKYC++
+            }
+        }
+        for _, inv := range d.investments {
+            stats.TotalInvestments += inv.Amount
+        }
+        for _, t := range d.transactions {
+            stats.TransactionVolume += t.Price.MulQuantity(t.Quantity)
+        }
+        for _, c := range d.commissions {
+            stats.CommissionsPaid += c.Amount
+        }
+        for _, p := range d.products {
+            if p.ArchivedAt == nil {
+                stats.TotalProducts++
+                if p.LowStockThreshold != nil && p.Stock <= *p.LowStockThreshold {
+                    stats.LowStockProducts++
+                }
+            }
+        }
+        return nil
+    })
+    return stats, err
+}
+
+func (r memStats) Series(ctx context.Context, interval string, from, to time.Time) ([]StatsPoint, error) {
+    var points []StatsPoint
+    index := make(map[string]int)
+    for start := statsPeriodStart(from, interval); start.Before(to); start = nextStatsPeriod(start, interval) {
+        index[start.Format(dateLayout)] = len(points)
+        points = append(points, StatsPoint{Start: start})
+    }
+    // point returns the point counting something that happened at t, or nil
+    // when t is outside [from, to).
+    point := func(t time.Time) *StatsPoint {
+        if t.Before(from) || !t.Before(to) {
+            return nil
+        }
+        return &points[index[statsPeriodStart(t.UTC(), interval).Format(dateLayout)]]
+    }
+    err := r.s.read(func(d *memData) error {
+        for _, u := range d.users {
+            if p := point(u.CreatedAt); p != nil {
+                p.NewUsers++
+            }
+        }
+        for _, inv := range d.investments {
+            if p := point(inv.InvestedAt); p != nil {
+                p.Invested += inv.Amount
+            }
+        }
+        for _, t := range d.transactions {
+            if p := point(t.Date); p != nil {
+                p.TransactionVolume += t.Price.MulQuantity(t.Quantity)
+            }
+        }
+        for _, c := range d.commissions {
+            if p := point(c.CreatedAt); p != nil {
+                p.Commissions += c.Amount
+            }
+        }
+        return nil
+    })
+    return points, err
+}
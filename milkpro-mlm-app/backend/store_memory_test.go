@@ -0,0 +1,55 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "sync"
+    "testing"
+)
+
+func TestMemoryStoreReadsSeeOnlyCommittedWrites(t *testing.T) {
+    ctx := context.Background()
+    s := newMemoryStore()
+
+    errRollback := errors.New("rollback")
+    err := s.WithTx(ctx, func(tx Store) error {
+        id, err := tx.Users().Create(ctx, User{Phone: "+15550001", Name: "Ana"})
+        if err != nil {
+            return err
+        }
+        if u, err := tx.Users().Get(ctx, id); err != nil || u.Phone != "+15550001" {
+            t.Errorf("reading inside the transaction: got %+v, %v", u, err)
+        }
+        return errRollback
+    })
+    if err != errRollback {
+        t.Fatalf("got %v, want %v", err, errRollback)
+    }
+    if _, err := s.Users().GetByPhone(ctx, "+15550001"); err != errNotFound {
+        t.Errorf("reading a rolled back user: got %v, want %v", err, errNotFound)
+    }
+
+    // Readers and writers may run at once; go test -race checks that reads
+    // on the shared data never overlap a write.
+    var wg sync.WaitGroup
+    for i := 0; i < 8; i++ {
+        wg.Add(2)
+        go func(i int) {
+            defer wg.Done()
+            if _, err := s.Users().Create(ctx, User{Phone: fmt.Sprintf("+1555100%d", i)}); err != nil {
+                t.Error(err)
+            }
+        }(i)
+        go func() {
+            defer wg.Done()
+            if _, err := s.Users().List(ctx); err != nil {
+                t.Error(err)
+            }
+        }()
+    }
+    wg.Wait()
+    if users, err := s.Users().List(ctx); err != nil || len(users) != 8 {
+        t.Errorf("got %d users, %v; want 8", len(users), err)
+    }
+}
@@ -0,0 +1,1669 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "sort"
+    "time"
+
+    "github.com/lib/pq"
+)
+
+// dbtx is satisfied by both *sql.DB and *sql.Tx.
+type dbtx interface {
+    ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+    QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+    QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// storePostgres implements Store on the schema in migrations/. Outside WithTx
+// each call runs on its own pooled connection.
+type storePostgres struct {
+    db *sql.DB
+    q  dbtx
+}
+
+func newPostgresStore(db *sql.DB) *storePostgres {
+    return &storePostgres{db: db, q: db}
+}
+
+func (s *storePostgres) Users() UserRepo                 { return pgUsers{s.q} }
+func (s *storePostgres) Products() ProductRepo           { return pgProducts{s.q} }
+func (s *storePostgres) PriceBook() PriceBookRepo        { return pgPriceBook{s.q} }
+func (s *storePostgres) Inventory() InventoryRepo        { return pgInventory{s.q} }
+func (s *storePostgres) Projects() ProjectRepo           { return pgProjects{s.q} }
+func (s *storePostgres) Investments() InvestmentRepo     { return pgInvestments{s.q} }
+func (s *storePostgres) Transactions() TransactionRepo   { return pgTransactions{s.q} }
+func (s *storePostgres) Orders() OrderRepo               { return pgOrders{s.q} }
+func (s *storePostgres) Subscriptions() SubscriptionRepo { return pgSubscriptions{s.q} }
+func (s *storePostgres) Referrals() ReferralRepo         { return pgReferrals{s.q} }
+func (s *storePostgres) Commissions() CommissionRepo     { return pgCommissions{s.q} }
+func (s *storePostgres) Wallet() WalletRepo              { return pgWallet{s.q} }
+func (s *storePostgres) KYC() KYCRepo                    { return pgKYC{s.q} }
+func (s *storePostgres) Tickets() TicketRepo             { return pgTickets{s.q} }
+func (s *storePostgres) Staff() StaffRepo                { return pgStaff{s.q} }
+func (s *storePostgres) Stats() StatsRepo                { return pgStats{s.q} }
+
+func (s *storePostgres) WithTx(ctx context.Context, fn func(Store) error) error {
+    if _, inTx := s.q.(*sql.Tx); inTx {
+        return fn(s)
+    }
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    if err := fn(&storePostgres{db: s.db, q: tx}); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+func isUniqueViolation(err error) bool {
+    var pqErr *pq.Error
+    return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// notFound maps sql.ErrNoRows to errNotFound.
+func notFound(err error) error {
+    if err == sql.ErrNoRows {
+        return errNotFound
+    }
+    return err
+}
+
+// requireRow returns errNotFound if an UPDATE or DELETE matched nothing.
+func requireRow(res sql.Result, err error) error {
+    if err != nil {
+        return err
+    }
+    n, err := res.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if n == 0 {
+        return errNotFound
+    }
+    return nil
+}
+
+type pgUsers struct{ q dbtx }
+
+const userColumns = `id, phone, COALESCE(firebase_uid, ''), COALESCE(name, ''), COALESCE(email, ''), COALESCE(profile_image_url, ''),
+    COALESCE(kyc_status, 'pending'), COALESCE(is_admin, FALSE), COALESCE(balance, 0),
+    COALESCE(referral_code, ''), COALESCE(region, ''), COALESCE(price_tier, ''), created_at`
+
+func scanUser(row interface{ Scan(...interface{}) error }, u *User) error {
+    return row.Scan(&u.ID, &u.Phone, &u.FirebaseUID, &u.Name, &u.Email, &u.ProfileImageURL,
+        &u.KYCStatus, &u.IsAdmin, &u.Balance, &u.ReferralCode, &u.Region, &u.PriceTier, &u.CreatedAt)
+}
+
+func (r pgUsers) getBy(ctx context.Context, where string, arg interface{}) (User, error) {
+    var u User
+    err := scanUser(r.q.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE "+where, arg), &u)
+    return u, notFound(err)
+}
+
+func (r pgUsers) Get(ctx context.Context, id int) (User, error) {
+    return r.getBy(ctx, "id = $1", id)
+}
+
+func (r pgUsers) GetByPhone(ctx context.Context, phone string) (User, error) {
+    return r.getBy(ctx, "phone = $1", phone)
+}
+
+func (r pgUsers) GetByReferralCode(ctx context.Context, code string) (User, error) {
+    return r.getBy(ctx, "referral_code = $1", code)
+}
+
+func (r pgUsers) GetByFirebaseUID(ctx context.Context, uid string) (User, error) {
+    return r.getBy(ctx, "firebase_uid = $1", uid)
+}
+
+func (r pgUsers) Create(ctx context.Context, u User) (int, error) {
+    // A clash on referral_code leaves no row and no error, so the caller can
+    // try another code without aborting its transaction.
+    var id int
+    err := r.q.QueryRowContext(ctx, `
+        INSERT INTO users (phone, firebase_uid, name, email, referral_code)
+        VALUES ($1, NULLIF($2, ''), $3, $4, NULLIF($5, ''))
+        ON CONFLICT (referral_code) DO NOTHING
+        RETURNING id`,
+        u.Phone, u.FirebaseUID, u.Name, u.Email, u.ReferralCode).Scan(&id)
+    switch {
+    case err == sql.ErrNoRows:
+        return 0, errReferralCodeTaken
+    case isUniqueViolation(err):
+        return 0, errPhoneTaken
+    }
+    return id, err
+}
+
+func (r pgUsers) IDsWithoutReferralCode(ctx context.Context) ([]int, error) {
+    rows, err := r.q.QueryContext(ctx, "SELECT id FROM users WHERE referral_code IS NULL ORDER BY id")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var ids []int
+    for rows.Next() {
+        var id int
+        if err := rows.Scan(&id); err != nil {
+            return nil, err
+        }
+        ids = append(ids, id)
+    }
+    return ids, rows.Err()
+}
+
+func (r pgUsers) SetReferralCode(ctx context.Context, id int, code string) error {
+    _, err := r.q.ExecContext(ctx,
+        "UPDATE users SET referral_code = $1 WHERE id = $2 AND referral_code IS NULL", code, id)
+    if isUniqueViolation(err) {
+        return errReferralCodeTaken
+    }
+    return err
+}
+
+func (r pgUsers) SetFirebaseUID(ctx context.Context, id int, uid string) error {
+    err := requireRow(r.q.ExecContext(ctx,
+        "UPDATE users SET firebase_uid = $1 WHERE id = $2 AND firebase_uid IS NULL", uid, id))
+    if isUniqueViolation(err) {
+        return errNotFound
+    }
+    return err
+}
+
+func (r pgUsers) SetKYCStatus(ctx context.Context, id int, status string) error {
+    return requireRow(r.q.ExecContext(ctx, "UPDATE users SET kyc_status = $1 WHERE id = $2", status, id))
+}
+
+func (r pgUsers) SetPriceScope(ctx context.Context, id int, scope PriceScope) error {
+    return requireRow(r.q.ExecContext(ctx,
+        "UPDATE users SET region = NULLIF($1, ''), price_tier = NULLIF($2, '') WHERE id = $3",
+        scope.Region, scope.Tier, id))
+}
+
+func (r pgUsers) List(ctx context.Context) ([]UserSummary, error) {
+    rows, err := r.q.QueryContext(ctx, `
+        SELECT `+userColumns+`,
+            COALESCE((SELECT SUM(amount) FROM investments WHERE user_id = users.id), 0) as total_invested,
+            COALESCE((SELECT COUNT(*) FROM referrals WHERE user_id = users.id), 0) as total_referrals
+        FROM users
+        ORDER BY created_at DESC
+    `)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var users []UserSummary
+    for rows.Next() {
+        var u UserSummary
+        err := rows.Scan(&u.ID, &u.Phone, &u.FirebaseUID, &u.Name, &u.Email, &u.ProfileImageURL,
+            &u.KYCStatus, &u.IsAdmin, &u.Balance, &u.ReferralCode, &u.Region, &u.PriceTier, &u.CreatedAt,
+            &u.TotalInvested, &u.TotalReferrals)
+        if err != nil {
+            return nil, err
+        }
+        users = append(users, u)
+    }
+    return users, rows.Err()
+}
+
+type pgProducts struct{ q dbtx }
+
+// query loads the products matching where, with the default prices in effect now.
+func (r pgProducts) query(ctx context.Context, where string, args ...interface{}) ([]Product, error) {
+    rows, err := r.q.QueryContext(ctx, `
+        SELECT p.id, p.name, p.type, p.stock_unit, COALESCE(p.density, 0), p.stock, p.low_stock_threshold,
+            p.created_at, COALESCE(p.updated_at, p.created_at), p.archived_at,
+            pv.unit, pv.side, pv.price
+        FROM products p
+        LEFT JOIN (
+            SELECT DISTINCT ON (product_id, unit, side) product_id, unit, side, price
+            FROM price_versions
+            WHERE region IS NULL AND tier IS NULL
+              AND effective_from <= NOW() AND (effective_until IS NULL OR effective_until > NOW())
+            ORDER BY product_id, unit, side, effective_from DESC, id DESC
+        ) pv ON pv.product_id = p.id AND pv.price > 0
+        WHERE `+where+`
+        ORDER BY p.type, p.name, p.id`, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var products []Product
+    for rows.Next() {
+        var p Product
+        var unit, side sql.NullString
+        var price *Money
+        err := rows.Scan(&p.ID, &p.Name, &p.Type, &p.StockUnit, &p.Density, &p.Stock, &p.LowStockThreshold,
+            &p.CreatedAt, &p.UpdatedAt, &p.ArchivedAt, &unit, &side, &price)
+        if err != nil {
+            return nil, err
+        }
+        if n := len(products); n == 0 || products[n-1].ID != p.ID {
+            p.Prices = map[string]UnitPrices{}
+            products = append(products, p)
+        }
+        if unit.Valid && price != nil {
+            products[len(products)-1].Prices[unit.String] =
+                products[len(products)-1].Prices[unit.String].with(side.String, *price)
+        }
+    }
+    return products, rows.Err()
+}
+
+func (r pgProducts) List(ctx context.Context, includeArchived bool) ([]Product, error) {
+    return r.query(ctx, "$1 OR p.archived_at IS NULL", includeArchived)
+}
+
+func (r pgProducts) Get(ctx context.Context, id int) (Product, error) {
+    products, err := r.query(ctx, "p.id = $1", id)
+    if err != nil {
+        return Product{}, err
+    }
+    if len(products) == 0 {
+        return Product{}, errNotFound
+    }
+    return products[0], nil
+}
+
+func (r pgProducts) Create(ctx context.Context, p Product) (int, error) {
+    var id int
+    err := r.q.QueryRowContext(ctx, `
+        INSERT INTO products (name, type, stock_unit, density, low_stock_threshold)
+        VALUES ($1, $2, $3, NULLIF($4::numeric, 0), $5)
+        RETURNING id`,
+        p.Name, p.Type, p.StockUnit, p.Density, p.LowStockThreshold).Scan(&id)
+    return id, err
+}
+
+func (r pgProducts) Update(ctx context.Context, p Product) error {
+    err := requireRow(r.q.ExecContext(ctx, `
+        UPDATE products
+        SET name = $1, type = $2, stock_unit = $3, density = NULLIF($4::numeric, 0),
+            low_stock_threshold = $5, updated_at = NOW()
+        WHERE id = $6 AND (stock_unit = $3 OR stock = 0)`,
+        p.Name, p.Type, p.StockUnit, p.Density, p.LowStockThreshold, p.ID))
+    if err != errNotFound {
+        return err
+    }
+    var exists bool
+    if err := r.q.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM products WHERE id = $1)", p.ID).Scan(&exists); err != nil {
+        return err
+    }
+    if exists {
+        return errStockUnitInUse
+    }
+    return errNotFound
+}
+
+func (r pgProducts) Archive(ctx context.Context, id int) error {
+    return requireRow(r.q.ExecContext(ctx,
+        "UPDATE products SET archived_at = COALESCE(archived_at, NOW()) WHERE id = $1", id))
+}
+
+type pgPriceBook struct{ q dbtx }
+
+const priceVersionColumns = `id, product_id, unit, side, COALESCE(region, ''), COALESCE(tier, ''), price,
+    effective_from, effective_until, created_at`
+
+func scanPriceVersion(row interface{ Scan(...interface{}) error }, v *PriceVersion) error {
+    return row.Scan(&v.ID, &v.ProductID, &v.Unit, &v.Side, &v.Scope.Region, &v.Scope.Tier, &v.Price,
+        &v.EffectiveFrom, &v.EffectiveUntil, &v.CreatedAt)
+}
+
+func (r pgPriceBook) Add(ctx context.Context, v PriceVersion) (int, error) {
+    var effectiveFrom *time.Time
+    if !v.EffectiveFrom.IsZero() {
+        effectiveFrom = &v.EffectiveFrom
+    }
+    var id int
+    err := r.q.QueryRowContext(ctx, `
+        INSERT INTO price_versions (product_id, unit, side, region, tier, price, effective_from, effective_until)
+        VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), $6, COALESCE($7, NOW()), $8)
+        RETURNING id`,
+        v.ProductID, v.Unit, v.Side, v.Scope.Region, v.Scope.Tier, v.Price, effectiveFrom, v.EffectiveUntil).Scan(&id)
+    return id, err
+}
+
+func (r pgPriceBook) History(ctx context.Context, productID int) ([]PriceVersion, error) {
+    rows, err := r.q.QueryContext(ctx, `
+        SELECT `+priceVersionColumns+`
+        FROM price_versions
+        WHERE product_id = $1
+        ORDER BY effective_from DESC, id DESC
+    `, productID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var versions []PriceVersion
+    for rows.Next() {
+        var v PriceVersion
+        if err := scanPriceVersion(rows, &v); err != nil {
+            return nil, err
+        }
+        versions = append(versions, v)
+    }
+    return versions, rows.Err()
+}
+
+func (r pgPriceBook) Resolve(ctx context.Context, productID int, unit, side string, scope PriceScope) (PriceVersion, error) {
+    var v PriceVersion
+    err := scanPriceVersion(r.q.QueryRowContext(ctx, `
+        SELECT `+priceVersionColumns+`
+        FROM price_versions
+        WHERE product_id = $1 AND unit = $2 AND side = $3
+          AND (region IS NULL OR region = NULLIF($4, ''))
+          AND (tier IS NULL OR tier = NULLIF($5, ''))
+          AND effective_from <= NOW() AND (effective_until IS NULL OR effective_until > NOW())
+        ORDER BY region IS NOT NULL DESC, tier IS NOT NULL DESC, effective_from DESC, id DESC
+        LIMIT 1
+    `, productID, unit, side, scope.Region, scope.Tier), &v)
+    if err == nil && v.Price == 0 {
+        return v, errNotFound
+    }
+    return v, notFound(err)
+}
+
+type pgInventory struct{ q dbtx }
+
+const stockMovementColumns = `id, product_id, kind, COALESCE(transaction_id, 0), traded_quantity, traded_unit,
+    quantity, unit, balance, COALESCE(reason, ''), COALESCE(created_by_staff_id, 0),
+    COALESCE(created_by_user_id, 0), created_at`
+
+func (r pgInventory) Move(ctx context.Context, m StockMovement) (StockMovement, error) {
+    var unit string
+    var density Density
+    var stock Quantity
+    err := r.q.QueryRowContext(ctx,
+        "SELECT stock_unit, COALESCE(density, 0), stock FROM products WHERE id = $1 FOR UPDATE",
+        m.ProductID).Scan(&unit, &density, &stock)
+    if err != nil {
+        return m, notFound(err)
+    }
+    m, err = applyStock(m, stock, unit, density)
+    if err != nil {
+        return m, err
+    }
+
+    if _, err := r.q.ExecContext(ctx, "UPDATE products SET stock = $1 WHERE id = $2", m.Balance, m.ProductID); err != nil {
+        return m, err
+    }
+    err = r.q.QueryRowContext(ctx, `
+        INSERT INTO stock_movements
+        (product_id, kind, transaction_id, traded_quantity, traded_unit, quantity, unit, balance,
+         reason, created_by_staff_id, created_by_user_id)
+        VALUES ($1, $2, NULLIF($3, 0), $4, $5, $6, $7, $8, NULLIF($9, ''), NULLIF($10, 0), NULLIF($11, 0))
+        RETURNING id, created_at`,
+        m.ProductID, m.Kind, m.TransactionID, m.TradedQuantity, m.TradedUnit, m.Quantity, m.Unit, m.Balance,
+        m.Reason, m.StaffID, m.AdminUserID).Scan(&m.ID, &m.CreatedAt)
+    return m, err
+}
+
+func (r pgInventory) Movements(ctx context.Context, productID, limit int) ([]StockMovement, error) {
+    rows, err := r.q.QueryContext(ctx, `
+        SELECT `+stockMovementColumns+`
+        FROM stock_movements
+        WHERE product_id = $1
+        ORDER BY id DESC
+        LIMIT $2
+    `, productID, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var movements []StockMovement
+    for rows.Next() {
+        var m StockMovement
+        err := rows.Scan(&m.ID, &m.ProductID, &m.Kind, &m.TransactionID, &m.TradedQuantity, &m.TradedUnit,
+            &m.Quantity, &m.Unit, &m.Balance, &m.Reason, &m.StaffID, &m.AdminUserID, &m.CreatedAt)
+        if err != nil {
+            return nil, err
+        }
+        movements = append(movements, m)
+    }
+    return movements, rows.Err()
+}
+
+func (r pgInventory) LowStock(ctx context.Context) ([]Product, error) {
+    products, err := pgProducts{r.q}.query(ctx, "p.archived_at IS NULL AND p.stock <= p.low_stock_threshold")
+    if err != nil {
+        return nil, err
+    }
+    sort.SliceStable(products, func(i, j int) bool { return products[i].Name < products[j].Name })
+    return products, nil
+}
+
+type pgProjects struct{ q dbtx }
+
+func (r pgProjects) List(ctx context.Context) ([]Project, error) {
+    rows, err := r.q.QueryContext(ctx, `
+        SELECT
+            id, name, COALESCE(description, ''), lock_days, profit_percent,
+            min_investment, max_investment, funding_cap, COALESCE(status, 'active'), created_at
+        FROM projects
+        ORDER BY created_at DESC
+    `)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var projects []Project
+    for rows.Next() {
+        var p Project
+        if err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.LockDays, &p.ProfitPercent,
+            &p.MinInvestment, &p.MaxInvestment, &p.FundingCap, &p.Status, &p.CreatedAt); err != nil {
+            return nil, err
+        }
+        projects = append(projects, p)
+    }
+    return projects, rows.Err()
+}
+
+func (r pgProjects) Create(ctx context.Context, p Project) (int, error) {
+    var id int
+    err := r.q.QueryRowContext(ctx, `
+        INSERT INTO projects
+        (name, description, lock_days, profit_percent, min_investment, max_investment, funding_cap, status, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, 'active', NOW())
+        RETURNING id
+    `, p.Name, p.Description, p.LockDays, p.ProfitPercent, p.MinInvestment, p.MaxInvestment, p.FundingCap,
+    ).Scan(&id)
+    return id, err
+}
+
+func (r pgProjects) LockForInvestment(ctx context.Context, id int) (projectTerms, error) {
+    p := projectTerms{ID: id}
+    err := r.q.QueryRowContext(ctx, `
+        SELECT lock_days, profit_percent, min_investment, max_investment,
+               COALESCE(status, 'active'), funding_cap
+        FROM projects
+        WHERE id = $1
+        FOR UPDATE
+    `, id).Scan(&p.LockDays, &p.ProfitPercent, &p.MinInvestment, &p.MaxInvestment, &p.Status, &p.FundingCap)
+    if err != nil {
+        return p, notFound(err)
+    }
+
+    err = r.q.QueryRowContext(ctx,
+        "SELECT COALESCE(SUM(amount), 0) FROM investments WHERE project_id = $1 AND status = $2",
+        id, investmentActive).Scan(&p.Funded)
+    return p, err
+}
+
+func (r pgProjects) LockStatus(ctx context.Context, id int) (string, error) {
+    var status string
+    err := r.q.QueryRowContext(ctx,
+        "SELECT COALESCE(status, 'active') FROM projects WHERE id = $1 FOR UPDATE", id).Scan(&status)
+    return status, notFound(err)
+}
+
+func (r pgProjects) SetStatus(ctx context.Context, id int, status string) error {
+    return requireRow(r.q.ExecContext(ctx, "UPDATE projects SET status = $1 WHERE id = $2", status, id))
+}
+
+type pgInvestments struct{ q dbtx }
+
+func (r pgInvestments) Create(ctx context.Context, inv NewInvestment) (int, error) {
+    var id int
+    err := r.q.QueryRowContext(ctx, `
+        INSERT INTO investments
+        (user_id, project_id, amount, lock_end_date, profit_percent, reinvest, reinvested_from, invested_at)
+        VALUES ($1, $2, $3, NOW() + $4 * INTERVAL '1 day', $5, $6, NULLIF($7, 0), NOW())
+        RETURNING id`,
+        inv.UserID, inv.ProjectID, inv.Amount, inv.LockDays, inv.ProfitPercent, inv.Reinvest, inv.ReinvestedFrom,
+    ).Scan(&id)
+    return id, err
+}
+
+func (r pgInvestments) ListByUser(ctx context.Context, userID int) ([]Investment, error) {
+    rows, err := r.q.QueryContext(ctx, `
+        SELECT i.id, i.user_id, i.project_id, p.name, i.amount, i.profit_percent, COALESCE(i.reinvest, FALSE),
+               COALESCE(i.status, 'active'), i.invested_at, i.lock_end_date, COALESCE(i.reinvested_from, 0)
+        FROM investments i
+        JOIN projects p ON i.project_id = p.id
+        WHERE i.user_id = $1
+        ORDER BY i.invested_at DESC
+    `, userID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var investments []Investment
+    for rows.Next() {
+        var inv Investment
+        err := rows.Scan(&inv.ID, &inv.UserID, &inv.ProjectID, &inv.ProjectName, &inv.Amount, &inv.ProfitPercent,
+            &inv.Reinvest, &inv.Status, &inv.InvestedAt, &inv.LockEndDate, &inv.ReinvestedFrom)
+        if err != nil {
+            return nil, err
+        }
+        investments = append(investments, inv)
+    }
+    return investments, rows.Err()
+}
+
+func (r pgInvestments) ClaimDue(ctx context.Context, skip []int) (Investment, error) {
+    inv := Investment{Status: investmentActive}
+    err := r.q.QueryRowContext(ctx, `
+        SELECT id, user_id, project_id, amount, profit_percent, COALESCE(reinvest, FALSE),
+               invested_at, lock_end_date
+        FROM investments
+        WHERE status = $1 AND lock_end_date <= NOW()
+          AND NOT (id = ANY(COALESCE($2::int[], '{}')))
+        ORDER BY lock_end_date, id
+        LIMIT 1
+        FOR UPDATE SKIP LOCKED
+    `, investmentActive, pq.Array(skip)).Scan(&inv.ID, &inv.UserID, &inv.ProjectID, &inv.Amount, &inv.ProfitPercent,
+        &inv.Reinvest, &inv.InvestedAt, &inv.LockEndDate)
+    return inv, notFound(err)
+}
+
+func (r pgInvestments) SetStatus(ctx context.Context, id int, status string) error {
+    return requireRow(r.q.ExecContext(ctx, `
+        UPDATE investments
+        SET status = $1, matured_at = COALESCE(matured_at, NOW())
+        WHERE id = $2`, status, id))
+}
+
+type pgTransactions struct{ q dbtx }
+
+func (r pgTransactions) Create(ctx context.Context, t Transaction) (int, error) {
+    var id int
+    err := r.q.QueryRowContext(ctx, `
+        INSERT INTO transactions
+        (user_id, product_id, type, quantity, unit, price, price_version_id, order_id, transaction_date)
+        VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, 0), NULLIF($8, 0), NOW())
+        RETURNING id`,
+        t.UserID, t.ProductID, t.Type, t.Quantity, t.Unit, t.Price, t.PriceVersionID, t.OrderID).Scan(&id)
+    return id, err
+}
+
+func (r pgTransactions) ListByUser(ctx context.Context, userID int) ([]Transaction, error) {
+    rows, err := r.q.QueryContext(ctx, `
+        SELECT t.id, t.user_id, t.product_id, p.name, p.type, t.type, t.quantity, t.unit, t.price,
+            COALESCE(t.price_version_id, 0), COALESCE(t.order_id, 0), t.transaction_date
+        FROM transactions t
+        JOIN products p ON t.product_id = p.id
+        WHERE t.user_id = $1
+        ORDER BY t.transaction_date DESC
+    `, userID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var transactions []Transaction
+    for rows.Next() {
+        var t Transaction
+        err := rows.Scan(&t.ID, &t.UserID, &t.ProductID, &t.ProductName, &t.ProductType,
+            &t.Type, &t.Quantity, &t.Unit, &t.Price, &t.PriceVersionID, &t.OrderID, &t.Date)
+        if err != nil {
+            return nil, err
+        }
+        transactions = append(transactions, t)
+    }
+    return transactions, rows.Err()
+}
+
+type pgOrders struct{ q dbtx }
+
+const orderColumns = `id, user_id, status, total_amount, COALESCE(subscription_id, 0),
+    COALESCE(delivery_date, '0001-01-01'), created_at, updated_at`
+
+func scanOrder(row interface{ Scan(...interface{}) error }, o *Order) error {
+    return row.Scan(&o.ID, &o.UserID, &o.Status, &o.Total, &o.SubscriptionID, &o.DeliveryDate,
+        &o.CreatedAt, &o.UpdatedAt)
+}
+
+// nullDate returns t as a date parameter, or NULL if it is zero.
+func nullDate(t time.Time) interface{} {
+    if t.IsZero() {
+        return nil
+    }
+    return t.Format(dateLayout)
+}
+
+func (r pgOrders) Create(ctx context.Context, o Order, placed OrderEvent) (int, error) {
+    var id int
+    err := r.q.QueryRowContext(ctx, `
+        INSERT INTO orders (user_id, status, total_amount, subscription_id, delivery_date)
+        VALUES ($1, 'pending', $2, NULLIF($3, 0), $4::date)
+        RETURNING id`,
+        o.UserID, o.Total, o.SubscriptionID, nullDate(o.DeliveryDate)).Scan(&id)
+    if isUniqueViolation(err) {
+        return 0, errDeliveryExists
+    }
+    if err != nil {
+        return 0, err
+    }
+    for _, item := range o.Items {
+        _, err := r.q.ExecContext(ctx, `
+            INSERT INTO order_items (order_id, product_id, quantity, unit, price, price_version_id)
+            VALUES ($1, $2, $3, $4, $5, $6)`,
+            id, item.ProductID, item.Quantity, item.Unit, item.Price, item.PriceVersionID)
+        if err != nil {
+            return 0, err
+        }
+    }
+    placed.OrderID = id
+    placed.Status = orderPending
+    return id, r.addEvent(ctx, placed)
+}
+
+func (r pgOrders) addEvent(ctx context.Context, e OrderEvent) error {
+    _, err := r.q.ExecContext(ctx, `
+        INSERT INTO order_events (order_id, status, note, actor, created_by_staff_id, created_by_user_id)
+        VALUES ($1, $2, NULLIF($3, ''), $4, NULLIF($5, 0), NULLIF($6, 0))`,
+        e.OrderID, e.Status, e.Note, e.Actor, e.StaffID, e.UserID)
+    return err
+}
+
+func (r pgOrders) Get(ctx context.Context, id int) (Order, error) {
+    var o Order
+    err := scanOrder(r.q.QueryRowContext(ctx, "SELECT "+orderColumns+" FROM orders WHERE id = $1", id), &o)
+    if err != nil {
+        return o, notFound(err)
+    }
+    orders := []Order{o}
+    if err := r.loadItems(ctx, orders); err != nil {
+        return o, err
+    }
+    o = orders[0]
+
+    rows, err := r.q.QueryContext(ctx, `
+        SELECT id, order_id, status, COALESCE(note, ''), actor, COALESCE(created_by_staff_id, 0),
+            COALESCE(created_by_user_id, 0), created_at
+        FROM order_events
+        WHERE order_id = $1
+        ORDER BY id`, id)
+    if err != nil {
+        return o, err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var e OrderEvent
+        if err := rows.Scan(&e.ID, &e.OrderID, &e.Status, &e.Note, &e.Actor, &e.StaffID, &e.UserID, &e.CreatedAt); err != nil {
+            return o, err
+        }
+        o.Events = append(o.Events, e)
+    }
+    return o, rows.Err()
+}
+
+func (r pgOrders) List(ctx context.Context, f OrderFilter) ([]Order, error) {
+    rows, err := r.q.QueryContext(ctx, `
+        SELECT `+orderColumns+`
+        FROM orders
+        WHERE ($1::int = 0 OR user_id = $1) AND ($2::text = '' OR status = $2)
+          AND ($3::int = 0 OR subscription_id = $3) AND ($4::date IS NULL OR delivery_date = $4)
+        ORDER BY id DESC
+        LIMIT NULLIF($5::int, 0)
+    `, f.UserID, f.Status, f.SubscriptionID, nullDate(f.DeliveryDate), f.Limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var orders []Order
+    for rows.Next() {
+        var o Order
+        if err := scanOrder(rows, &o); err != nil {
+            return nil, err
+        }
+        orders = append(orders, o)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    return orders, r.loadItems(ctx, orders)
+}
+
+// loadItems fills in the items of orders.
+func (r pgOrders) loadItems(ctx context.Context, orders []Order) error {
+    if len(orders) == 0 {
+        return nil
+    }
+    ids := make([]int64, len(orders))
+    index := make(map[int]int, len(orders))
+    for i, o := range orders {
+        ids[i] = int64(o.ID)
+        index[o.ID] = i
+    }
+
+    rows, err := r.q.QueryContext(ctx, `
+        SELECT i.id, i.order_id, i.product_id, p.name, i.quantity, i.unit, i.price, i.price_version_id
+        FROM order_items i
+        JOIN products p ON i.product_id = p.id
+        WHERE i.order_id = ANY($1)
+        ORDER BY i.id`, pq.Array(ids))
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var item OrderItem
+        err := rows.Scan(&item.ID, &item.OrderID, &item.ProductID, &item.ProductName, &item.Quantity, &item.Unit,
+            &item.Price, &item.PriceVersionID)
+        if err != nil {
+            return err
+        }
+        o := &orders[index[item.OrderID]]
+        o.Items = append(o.Items, item)
+    }
+    return rows.Err()
+}
+
+func (r pgOrders) LockStatus(ctx context.Context, id int) (string, error) {
+    var status string
+    err := r.q.QueryRowContext(ctx, "SELECT status FROM orders WHERE id = $1 FOR UPDATE", id).Scan(&status)
+    return status, notFound(err)
+}
+
+func (r pgOrders) SetStatus(ctx context.Context, e OrderEvent) error {
+    err := requireRow(r.q.ExecContext(ctx,
+        "UPDATE orders SET status = $1, updated_at = NOW() WHERE id = $2", e.Status, e.OrderID))
+    if err != nil {
+        return err
+    }
+    return r.addEvent(ctx, e)
+}
+
+type pgSubscriptions struct{ q dbtx }
+
+const subscriptionColumns = `s.id, s.user_id, s.product_id, p.name, s.quantity, s.unit, s.delivery_days,
+    s.status, s.start_date, s.created_at, s.updated_at`
+
+func (r pgSubscriptions) query(ctx context.Context, where string, args ...interface{}) ([]Subscription, error) {
+    rows, err := r.q.QueryContext(ctx, `
+        SELECT `+subscriptionColumns+`
+        FROM subscriptions s
+        JOIN products p ON s.product_id = p.id
+        WHERE `+where+`
+        ORDER BY s.id DESC`, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var subs []Subscription
+    index := make(map[int]int)
+    for rows.Next() {
+        var sub Subscription
+        err := rows.Scan(&sub.ID, &sub.UserID, &sub.ProductID, &sub.ProductName, &sub.Quantity, &sub.Unit,
+            &sub.Days, &sub.Status, &sub.StartDate, &sub.CreatedAt, &sub.UpdatedAt)
+        if err != nil {
+            return nil, err
+        }
+        index[sub.ID] = len(subs)
+        subs = append(subs, sub)
+    }
+    if err := rows.Err(); err != nil || len(subs) == 0 {
+        return subs, err
+    }
+
+    ids := make([]int64, 0, len(subs))
+    for _, sub := range subs {
+        ids = append(ids, int64(sub.ID))
+    }
+    skips, err := r.q.QueryContext(ctx, `
+        SELECT subscription_id, skip_date FROM subscription_skips
+        WHERE subscription_id = ANY($1)
+        ORDER BY skip_date`, pq.Array(ids))
+    if err != nil {
+        return nil, err
+    }
+    defer skips.Close()
+
+    for skips.Next() {
+        var id int
+        var date time.Time
+        if err := skips.Scan(&id, &date); err != nil {
+            return nil, err
+        }
+        sub := &subs[index[id]]
+        sub.Skips = append(sub.Skips, date)
+    }
+    return subs, skips.Err()
+}
+
+func (r pgSubscriptions) Create(ctx context.Context, sub Subscription) (int, error) {
+    var id int
+    err := r.q.QueryRowContext(ctx, `
+        INSERT INTO subscriptions (user_id, product_id, quantity, unit, delivery_days, status, start_date)
+        VALUES ($1, $2, $3, $4, $5, 'active', $6::date)
+        RETURNING id`,
+        sub.UserID, sub.ProductID, sub.Quantity, sub.Unit, sub.Days, sub.StartDate.Format(dateLayout)).Scan(&id)
+    return id, err
+}
+
+func (r pgSubscriptions) Get(ctx context.Context, id int) (Subscription, error) {
+    subs, err := r.query(ctx, "s.id = $1", id)
+    if err != nil {
+        return Subscription{}, err
+    }
+    if len(subs) == 0 {
+        return Subscription{}, errNotFound
+    }
+    return subs[0], nil
+}
+
+func (r pgSubscriptions) List(ctx context.Context, userID int) ([]Subscription, error) {
+    return r.query(ctx, "($1::int = 0 OR s.user_id = $1)", userID)
+}
+
+func (r pgSubscriptions) Lock(ctx context.Context, id int) (Subscription, error) {
+    var locked int
+    err := r.q.QueryRowContext(ctx, "SELECT id FROM subscriptions WHERE id = $1 FOR UPDATE", id).Scan(&locked)
+    if err != nil {
+        return Subscription{}, notFound(err)
+    }
+    return r.Get(ctx, id)
+}
+
+func (r pgSubscriptions) SetStatus(ctx context.Context, id int, status string) error {
+    return requireRow(r.q.ExecContext(ctx,
+        "UPDATE subscriptions SET status = $1, updated_at = NOW() WHERE id = $2", status, id))
+}
+
+func (r pgSubscriptions) Skip(ctx context.Context, id int, date time.Time) error {
+    _, err := r.q.ExecContext(ctx, `
+        INSERT INTO subscription_skips (subscription_id, skip_date)
+        VALUES ($1, $2::date)
+        ON CONFLICT DO NOTHING`, id, date.Format(dateLayout))
+    if err != nil {
+        return err
+    }
+    _, err = r.q.ExecContext(ctx, "UPDATE subscriptions SET updated_at = NOW() WHERE id = $1", id)
+    return err
+}
+
+func (r pgSubscriptions) Unskip(ctx context.Context, id int, date time.Time) error {
+    _, err := r.q.ExecContext(ctx,
+        "DELETE FROM subscription_skips WHERE subscription_id = $1 AND skip_date = $2::date",
+        id, date.Format(dateLayout))
+    if err != nil {
+        return err
+    }
+    _, err = r.q.ExecContext(ctx, "UPDATE subscriptions SET updated_at = NOW() WHERE id = $1", id)
+    return err
+}
+
+func (r pgSubscriptions) Due(ctx context.Context, date time.Time) ([]int, error) {
+    rows, err := r.q.QueryContext(ctx, `
+        SELECT s.id
+        FROM subscriptions s
+        JOIN products p ON p.id = s.product_id
+        WHERE s.status = 'active' AND p.archived_at IS NULL
+          AND s.start_date <= $1::date
+          AND s.delivery_days & (1 << EXTRACT(DOW FROM $1::date)::int) <> 0
+          AND NOT EXISTS (
+              SELECT 1 FROM subscription_skips k WHERE k.subscription_id = s.id AND k.skip_date = $1::date)
+          AND NOT EXISTS (
+              SELECT 1 FROM orders o WHERE o.subscription_id = s.id AND o.delivery_date = $1::date)
+        ORDER BY s.id`, date.Format(dateLayout))
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var ids []int
+    for rows.Next() {
+        var id int
+        if err := rows.Scan(&id); err != nil {
+            return nil, err
+        }
+        ids = append(ids, id)
+    }
+    return ids, rows.Err()
+}
+
+func (r pgSubscriptions) Manifest(ctx context.Context, date time.Time) ([]DeliveryLine, error) {
+    rows, err := r.q.QueryContext(ctx, `
+        SELECT o.id, o.subscription_id, o.user_id, COALESCE(u.name, ''), u.phone, i.product_id, p.name,
+            i.quantity, i.unit, i.price, o.status
+        FROM orders o
+        JOIN users u ON o.user_id = u.id
+        JOIN order_items i ON i.order_id = o.id
+        JOIN products p ON i.product_id = p.id
+        WHERE o.delivery_date = $1::date
+        ORDER BY u.name, o.id`, date.Format(dateLayout))
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var lines []DeliveryLine
+    for rows.Next() {
+        var l DeliveryLine
+        err := rows.Scan(&l.OrderID, &l.SubscriptionID, &l.UserID, &l.CustomerName, &l.CustomerPhone,
+            &l.ProductID, &l.ProductName, &l.Quantity, &l.Unit, &l.Price, &l.Status)
+        if err != nil {
+            return nil, err
+        }
+        l.Total = l.Price.MulQuantity(l.Quantity)
+        lines = append(lines, l)
+    }
+    return lines, rows.Err()
+}
+
+type pgReferrals struct{ q dbtx }
+
+func (r pgReferrals) Link(ctx context.Context, userID, sponsorID int) error {
+    _, err := r.q.ExecContext(ctx, `
+        INSERT INTO referrals (user_id, referred_user_id, level)
+        SELECT $1, $2, 1
+        UNION ALL
+        SELECT user_id, $2, level + 1
+        FROM referrals
+        WHERE referred_user_id = $1 AND level < $3
+    `, sponsorID, userID, maxReferralDepth)
+    return err
+}
+
+func (r pgReferrals) Upline(ctx context.Context, userID int) ([]int, error) {
+    rows, err := r.q.QueryContext(ctx, `
+        SELECT user_id FROM referrals
+        WHERE referred_user_id = $1 AND level <= $2
+        ORDER BY level
+    `, userID, maxReferralDepth)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var upline []int
+    for rows.Next() {
+        var id int
+        if err := rows.Scan(&id); err != nil {
+            return nil, err
+        }
+        upline = append(upline, id)
+    }
+    return upline, rows.Err()
+}
+
+func (r pgReferrals) Downline(ctx context.Context, userID int) ([]Referral, error) {
+    // referrals holds a row for every ancestor within maxReferralDepth, so the
+    // downline is every row naming userID as user_id.
+    rows, err := r.q.QueryContext(ctx, `
+        SELECT r.id, r.level,
+               -- commission userID has earned from this member
+               COALESCE((SELECT SUM(c.amount) FROM commissions c
+                         WHERE c.beneficiary_id = r.user_id AND c.source_user_id = r.referred_user_id), 0),
+               r.created_at, u.phone, COALESCE(u.name, '')
+        FROM referrals r
+        JOIN users u ON r.referred_user_id = u.id
+        WHERE r.user_id = $1
+        ORDER BY r.level, r.created_at
+    `, userID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var referrals []Referral
+    for rows.Next() {
+        var ref Referral
+        err := rows.Scan(&ref.ID, &ref.Level, &ref.Commission, &ref.CreatedAt, &ref.ReferredPhone, &ref.ReferredName)
+        if err != nil {
+            return nil, err
+        }
+        ref.Depth = ref.Level
+        referrals = append(referrals, ref)
+    }
+    return referrals, rows.Err()
+}
+
+type pgCommissions struct{ q dbtx }
+
+func (r pgCommissions) ActivePlans(ctx context.Context) ([]CommissionPlan, error) {
+    rows, err := r.q.QueryContext(ctx, `
+        SELECT id, level, percent, COALESCE(product_id, 0), COALESCE(project_id, 0)
+        FROM commission_plans
+        WHERE is_active
+        ORDER BY COALESCE(product_id, 0), COALESCE(project_id, 0), level
+    `)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var plans []CommissionPlan
+    for rows.Next() {
+        var p CommissionPlan
+        if err := rows.Scan(&p.ID, &p.Level, &p.Percent, &p.ProductID, &p.ProjectID); err != nil {
+            return nil, err
+        }
+        plans = append(plans, p)
+    }
+    return plans, rows.Err()
+}
+
+func (r pgCommissions) ReplacePlan(ctx context.Context, p CommissionPlan) (int, error) {
+    _, err := r.q.ExecContext(ctx, `
+        UPDATE commission_plans SET is_active = FALSE
+        WHERE is_active AND level = $1
+          AND COALESCE(product_id, 0) = $2 AND COALESCE(project_id, 0) = $3
+    `, p.Level, p.ProductID, p.ProjectID)
+    if err != nil {
+        return 0, err
+    }
+
+    var id int
+    err = r.q.QueryRowContext(ctx, `
+        INSERT INTO commission_plans (level, percent, product_id, project_id)
+        VALUES ($1, $2, NULLIF($3, 0), NULLIF($4, 0))
+        RETURNING id
+    `, p.Level, p.Percent, p.ProductID, p.ProjectID).Scan(&id)
+    return id, err
+}
+
+func (r pgCommissions) Record(ctx context.Context, src CommissionSource, c Commission) (int, error) {
+    var id int
+    err := r.q.QueryRowContext(ctx, `
+        INSERT INTO commissions
+        (beneficiary_id, source_user_id, level, source_type, source_id, base_amount, percent, amount, plan_id)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+        RETURNING id`,
+        c.BeneficiaryID, src.UserID, c.Level, src.Type, src.ID, src.Amount, c.Percent, c.Amount, c.PlanID,
+    ).Scan(&id)
+    return id, err
+}
+
+type pgWallet struct{ q dbtx }
+
+func (r pgWallet) Post(ctx context.Context, e JournalEntry) (int, error) {
+    var entryID int
+    err := r.q.QueryRowContext(ctx, `
+        INSERT INTO journal_entries (kind, reference_type, reference_id, memo, created_by, created_by_staff_id)
+        VALUES ($1, NULLIF($2, ''), NULLIF($3, 0), NULLIF($4, ''), NULLIF($5, 0), NULLIF($6, 0))
+        RETURNING id`,
+        e.Kind, e.ReferenceType, e.ReferenceID, e.Memo, e.CreatedBy, e.CreatedByStaff).Scan(&entryID)
+    if err != nil {
+        return 0, err
+    }
+
+    // Apply user postings in user ID order so concurrent entries lock the
+    // users rows in the same order.
+    postings := append([]Posting(nil), e.Postings...)
+    sort.SliceStable(postings, func(i, j int) bool { return postings[i].UserID < postings[j].UserID })
+
+    for _, p := range postings {
+        accountID, err := r.accountID(ctx, p)
+        if err != nil {
+            return 0, err
+        }
+        _, err = r.q.ExecContext(ctx,
+            "INSERT INTO journal_postings (entry_id, account_id, amount) VALUES ($1, $2, $3)",
+            entryID, accountID, p.Amount)
+        if err != nil {
+            return 0, err
+        }
+        if p.UserID == 0 {
+            continue
+        }
+
+        var balance Money
+        err = r.q.QueryRowContext(ctx,
+            "UPDATE users SET balance = balance + $1 WHERE id = $2 RETURNING balance",
+            p.Amount, p.UserID).Scan(&balance)
+        if err != nil {
+            return 0, err
+        }
+        if balance < 0 {
+            return 0, errInsufficientFunds
+        }
+    }
+    return entryID, nil
+}
+
+func (r pgWallet) accountID(ctx context.Context, p Posting) (int, error) {
+    var id int
+    if p.UserID == 0 {
+        err := r.q.QueryRowContext(ctx, "SELECT id FROM wallet_accounts WHERE code = $1", p.Account).Scan(&id)
+        if err == sql.ErrNoRows {
+            return 0, errUnknownAccount(p.Account)
+        }
+        return id, err
+    }
+
+    _, err := r.q.ExecContext(ctx,
+        "INSERT INTO wallet_accounts (user_id) VALUES ($1) ON CONFLICT (user_id) DO NOTHING", p.UserID)
+    if err != nil {
+        return 0, err
+    }
+    err = r.q.QueryRowContext(ctx, "SELECT id FROM wallet_accounts WHERE user_id = $1", p.UserID).Scan(&id)
+    return id, err
+}
+
+func (r pgWallet) Statement(ctx context.Context, userID, limit int) (Money, []WalletEntry, error) {
+    var balance Money
+    err := r.q.QueryRowContext(ctx, "SELECT balance FROM users WHERE id = $1", userID).Scan(&balance)
+    if err != nil {
+        return 0, nil, notFound(err)
+    }
+
+    rows, err := r.q.QueryContext(ctx, `
+        SELECT e.id, e.kind, COALESCE(e.reference_type, ''), COALESCE(e.reference_id, 0),
+               COALESCE(e.memo, ''), p.amount, e.created_at
+        FROM journal_postings p
+        JOIN journal_entries e ON e.id = p.entry_id
+        JOIN wallet_accounts a ON a.id = p.account_id
+        WHERE a.user_id = $1
+        ORDER BY e.id DESC
+        LIMIT $2
+    `, userID, limit)
+    if err != nil {
+        return 0, nil, err
+    }
+    defer rows.Close()
+
+    entries := []WalletEntry{}
+    for rows.Next() {
+        var e WalletEntry
+        err := rows.Scan(&e.ID, &e.Kind, &e.ReferenceType, &e.ReferenceID, &e.Memo, &e.Amount, &e.CreatedAt)
+        if err != nil {
+            return 0, nil, err
+        }
+        entries = append(entries, e)
+    }
+    return balance, entries, rows.Err()
+}
+
+func (r pgWallet) Audit(ctx context.Context) (WalletAudit, error) {
+    audit := WalletAudit{UnbalancedEntries: []int{}, Mismatches: []WalletMismatch{}}
+
+    rows, err := r.q.QueryContext(ctx, `
+        SELECT entry_id FROM journal_postings
+        GROUP BY entry_id
+        HAVING SUM(amount) <> 0
+        ORDER BY entry_id`)
+    if err != nil {
+        return audit, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var id int
+        if err := rows.Scan(&id); err != nil {
+            return audit, err
+        }
+        audit.UnbalancedEntries = append(audit.UnbalancedEntries, id)
+    }
+    if err := rows.Err(); err != nil {
+        return audit, err
+    }
+
+    rows, err = r.q.QueryContext(ctx, `
+        SELECT u.id, u.balance, COALESCE(SUM(p.amount), 0)
+        FROM users u
+        LEFT JOIN wallet_accounts a ON a.user_id = u.id
+        LEFT JOIN journal_postings p ON p.account_id = a.id
+        GROUP BY u.id, u.balance
+        HAVING u.balance <> COALESCE(SUM(p.amount), 0)
+        ORDER BY u.id`)
+    if err != nil {
+        return audit, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var m WalletMismatch
+        if err := rows.Scan(&m.UserID, &m.Balance, &m.LedgerBalance); err != nil {
+            return audit, err
+        }
+        audit.Mismatches = append(audit.Mismatches, m)
+    }
+    return audit, rows.Err()
+}
+
+type pgKYC struct{ q dbtx }
+
+const kycColumns = `id, user_id, COALESCE(document_type, ''), storage_key, COALESCE(content_type, ''),
+    COALESCE(size_bytes, 0), status, COALESCE(reason, ''), COALESCE(replaces_id, 0),
+    COALESCE(reviewed_at, '0001-01-01'), uploaded_at`
+
+func (r pgKYC) Create(ctx context.Context, d KYCDocument) (int, error) {
+    var id int
+    err := r.q.QueryRowContext(ctx, `
+        INSERT INTO kyc_documents (user_id, document_type, storage_key, content_type, size_bytes, status, replaces_id)
+        VALUES ($1, NULLIF($2, ''), $3, $4, $5, 'pending', NULLIF($6, 0)) RETURNING id`,
+        d.UserID, d.Type, d.StorageKey, d.ContentType, d.Size, d.ReplacesID).Scan(&id)
+    if isUniqueViolation(err) {
+        return 0, errKYCDocumentExists
+    }
+    return id, err
+}
+
+func (r pgKYC) Get(ctx context.Context, id int) (KYCDocument, error) {
+    docs, err := r.query(ctx, "SELECT "+kycColumns+" FROM kyc_documents WHERE id = $1", id)
+    if err != nil {
+        return KYCDocument{}, err
+    }
+    if len(docs) == 0 {
+        return KYCDocument{}, errNotFound
+    }
+    return docs[0], nil
+}
+
+func (r pgKYC) ListByUser(ctx context.Context, userID int) ([]KYCDocument, error) {
+    return r.query(ctx, "SELECT "+kycColumns+" FROM kyc_documents WHERE user_id = $1 ORDER BY id", userID)
+}
+
+// Lock takes the user's row, which every KYC change for the user also
+// updates through users.kyc_status.
+func (r pgKYC) Lock(ctx context.Context, userID int) ([]KYCDocument, error) {
+    var locked int
+    err := r.q.QueryRowContext(ctx, "SELECT id FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&locked)
+    if err != nil {
+        return nil, notFound(err)
+    }
+    return r.ListByUser(ctx, userID)
+}
+
+func (r pgKYC) Pending(ctx context.Context, limit int) ([]KYCDocument, error) {
+    return r.query(ctx,
+        "SELECT "+kycColumns+" FROM kyc_documents WHERE status = 'pending' ORDER BY id LIMIT $1", limit)
+}
+
+func (r pgKYC) query(ctx context.Context, query string, args ...interface{}) ([]KYCDocument, error) {
+    rows, err := r.q.QueryContext(ctx, query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var docs []KYCDocument
+    for rows.Next() {
+        var d KYCDocument
+        if err := rows.Scan(&d.ID, &d.UserID, &d.Type, &d.StorageKey, &d.ContentType, &d.Size, &d.Status,
+            &d.Reason, &d.ReplacesID, &d.ReviewedAt, &d.UploadedAt); err != nil {
+            return nil, err
+        }
+        docs = append(docs, d)
+    }
+    return docs, rows.Err()
+}
+
+func (r pgKYC) Review(ctx context.Context, rv KYCReview) error {
+    var userID int
+    err := r.q.QueryRowContext(ctx, `
+        UPDATE kyc_documents SET status = $1, reason = NULLIF($2, ''), reviewed_at = NOW()
+        WHERE id = $3 RETURNING user_id`,
+        rv.Status, rv.Reason, rv.DocumentID).Scan(&userID)
+    if err != nil {
+        return notFound(err)
+    }
+    _, err = r.q.ExecContext(ctx, `
+        INSERT INTO kyc_reviews (document_id, user_id, status, reason, reviewed_by_staff_id, reviewed_by_user_id)
+        VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, 0), NULLIF($6, 0))`,
+        rv.DocumentID, userID, rv.Status, rv.Reason, rv.StaffID, rv.AdminID)
+    return err
+}
+
+func (r pgKYC) Reviews(ctx context.Context, userID int) ([]KYCReview, error) {
+    rows, err := r.q.QueryContext(ctx, `
+        SELECT id, document_id, user_id, status, COALESCE(reason, ''),
+            COALESCE(reviewed_by_staff_id, 0), COALESCE(reviewed_by_user_id, 0), created_at
+        FROM kyc_reviews WHERE user_id = $1 ORDER BY id`, userID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var reviews []KYCReview
+    for rows.Next() {
+        var rv KYCReview
+        if err := rows.Scan(&rv.ID, &rv.DocumentID, &rv.UserID, &rv.Status, &rv.Reason,
+            &rv.StaffID, &rv.AdminID, &rv.CreatedAt); err != nil {
+            return nil, err
+        }
+        reviews = append(reviews, rv)
+    }
+    return reviews, rows.Err()
+}
+
+type pgTickets struct{ q dbtx }
+
+const ticketColumns = `t.id, t.user_id, COALESCE(u.name, ''), t.subject, t.status, t.priority,
+    COALESCE(t.assigned_to, 0), COALESCE(st.username, ''), t.created_at, t.updated_at,
+    t.first_response_due, t.resolution_due, t.first_response_at, t.resolved_at, t.response_breached_at,
+    t.resolution_breached_at, COALESCE(t.response_staff_id, 0), COALESCE(t.resolution_staff_id, 0)`
+
+const ticketFrom = `
+    FROM support_tickets t
+    JOIN users u ON t.user_id = u.id
+    LEFT JOIN support_staff st ON t.assigned_to = st.id`
+
+func scanTicket(row interface{ Scan(...interface{}) error }, t *Ticket) error {
+    return row.Scan(&t.ID, &t.UserID, &t.UserName, &t.Subject, &t.Status, &t.Priority, &t.AssignedTo,
+        &t.AssigneeName, &t.CreatedAt, &t.UpdatedAt, &t.FirstResponseDue, &t.ResolutionDue, &t.FirstResponseAt,
+        &t.ResolvedAt, &t.ResponseBreachedAt, &t.ResolutionBreachedAt, &t.ResponseStaffID, &t.ResolutionStaffID)
+}
+
+func (r pgTickets) Create(ctx context.Context, t Ticket) (int, error) {
+    var id int
+    err := r.q.QueryRowContext(ctx, `
+        INSERT INTO support_tickets (user_id, subject, status, priority, assigned_to, first_response_due, resolution_due)
+        VALUES ($1, $2, COALESCE(NULLIF($3, ''), 'open'), COALESCE(NULLIF($4, ''), 'medium'), NULLIF($5, 0), $6, $7)
+        RETURNING id`,
+        t.UserID, t.Subject, t.Status, t.Priority, t.AssignedTo, t.FirstResponseDue, t.ResolutionDue).Scan(&id)
+    return id, err
+}
+
+func (r pgTickets) Get(ctx context.Context, id int) (Ticket, error) {
+    var t Ticket
+    err := scanTicket(r.q.QueryRowContext(ctx, "SELECT "+ticketColumns+ticketFrom+" WHERE t.id = $1", id), &t)
+    return t, notFound(err)
+}
+
+func (r pgTickets) List(ctx context.Context, f TicketFilter) ([]Ticket, error) {
+    rows, err := r.q.QueryContext(ctx, `
+        SELECT `+ticketColumns+ticketFrom+`
+        WHERE ($1::int = 0 OR t.user_id = $1) AND ($2::text = '' OR t.status = $2)
+          AND ($3::text = '' OR t.priority = $3) AND ($4::int = 0 OR t.assigned_to = $4)
+          AND (NOT $5::bool OR t.assigned_to IS NULL)
+        ORDER BY t.updated_at DESC, t.id DESC
+        LIMIT NULLIF($6::int, 0)
+    `, f.UserID, f.Status, f.Priority, f.AssignedTo, f.Unassigned, f.Limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var tickets []Ticket
+    for rows.Next() {
+        var t Ticket
+        if err := scanTicket(rows, &t); err != nil {
+            return nil, err
+        }
+        tickets = append(tickets, t)
+    }
+    return tickets, rows.Err()
+}
+
+func (r pgTickets) Lock(ctx context.Context, id int) (Ticket, error) {
+    err := r.q.QueryRowContext(ctx, "SELECT id FROM support_tickets WHERE id = $1 FOR UPDATE", id).Scan(&id)
+    if err != nil {
+        return Ticket{}, notFound(err)
+    }
+    return r.Get(ctx, id)
+}
+
+func (r pgTickets) Update(ctx context.Context, t Ticket) error {
+    return requireRow(r.q.ExecContext(ctx, `
+        UPDATE support_tickets
+        SET status = $1, priority = $2, assigned_to = NULLIF($3, 0), updated_at = NOW(),
+            first_response_due = $4, resolution_due = $5, first_response_at = $6, resolved_at = $7,
+            response_breached_at = $8, resolution_breached_at = $9, response_staff_id = NULLIF($10, 0),
+            resolution_staff_id = NULLIF($11, 0)
+        WHERE id = $12`,
+        t.Status, t.Priority, t.AssignedTo, t.FirstResponseDue, t.ResolutionDue, t.FirstResponseAt, t.ResolvedAt,
+        t.ResponseBreachedAt, t.ResolutionBreachedAt, t.ResponseStaffID, t.ResolutionStaffID, t.ID))
+}
+
+func (r pgTickets) AddMessage(ctx context.Context, m TicketMessage) (int, error) {
+    var id int
+    err := r.q.QueryRowContext(ctx, `
+        INSERT INTO ticket_messages (ticket_id, sender_type, sender_id, message, attachment_key)
+        VALUES ($1, $2, $3, $4, NULLIF($5, ''))
+        RETURNING id`,
+        m.TicketID, m.SenderType, m.SenderID, m.Message, m.AttachmentKey).Scan(&id)
+    if err != nil {
+        return 0, err
+    }
+    _, err = r.q.ExecContext(ctx, "UPDATE support_tickets SET updated_at = NOW() WHERE id = $1", m.TicketID)
+    return id, err
+}
+
+func (r pgTickets) Messages(ctx context.Context, ticketID int) ([]TicketMessage, error) {
+    rows, err := r.q.QueryContext(ctx, `
+        SELECT id, ticket_id, sender_type, sender_id, message, COALESCE(attachment_key, ''), created_at
+        FROM ticket_messages
+        WHERE ticket_id = $1
+        ORDER BY id`, ticketID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var messages []TicketMessage
+    for rows.Next() {
+        var m TicketMessage
+        err := rows.Scan(&m.ID, &m.TicketID, &m.SenderType, &m.SenderID, &m.Message, &m.AttachmentKey, &m.CreatedAt)
+        if err != nil {
+            return nil, err
+        }
+        messages = append(messages, m)
+    }
+    return messages, rows.Err()
+}
+
+func (r pgTickets) ClaimBreached(ctx context.Context, now time.Time, skip []int) (Ticket, error) {
+    var id int
+    err := r.q.QueryRowContext(ctx, `
+        SELECT id FROM support_tickets
+        WHERE ((first_response_at IS NULL AND response_breached_at IS NULL AND first_response_due <= $1)
+            OR (resolved_at IS NULL AND resolution_breached_at IS NULL AND resolution_due <= $1))
+          AND NOT (id = ANY(COALESCE($2::int[], '{}')))
+        ORDER BY id
+        LIMIT 1
+        FOR UPDATE SKIP LOCKED
+    `, now, pq.Array(skip)).Scan(&id)
+    if err != nil {
+        return Ticket{}, notFound(err)
+    }
+    return r.Get(ctx, id)
+}
+
+func (r pgTickets) OpenCounts(ctx context.Context) (map[int]int, error) {
+    rows, err := r.q.QueryContext(ctx, `
+        SELECT assigned_to, COUNT(*)
+        FROM support_tickets
+        WHERE assigned_to IS NOT NULL AND status IN ('open', 'in_progress')
+        GROUP BY assigned_to`)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    counts := make(map[int]int)
+    for rows.Next() {
+        var staffID, n int
+        if err := rows.Scan(&staffID, &n); err != nil {
+            return nil, err
+        }
+        counts[staffID] = n
+    }
+    return counts, rows.Err()
+}
+
+// SLAReport places each target at the time it was met or, if it was
+// breached, at the breach.
+func (r pgTickets) SLAReport(ctx context.Context, from, to time.Time) ([]SLAAgentStats, error) {
+    rows, err := r.q.QueryContext(ctx, `
+        SELECT o.staff_id, COALESCE(st.username, ''),
+               COUNT(*) FILTER (WHERE o.target = 'response' AND NOT o.breached),
+               COUNT(*) FILTER (WHERE o.target = 'response' AND o.breached),
+               COUNT(*) FILTER (WHERE o.target = 'resolution' AND NOT o.breached),
+               COUNT(*) FILTER (WHERE o.target = 'resolution' AND o.breached)
+        FROM (
+            SELECT 'response' AS target, COALESCE(response_staff_id, 0) AS staff_id,
+                   response_breached_at IS NOT NULL AS breached,
+                   COALESCE(response_breached_at, first_response_at) AS settled_at
+            FROM support_tickets
+            UNION ALL
+            SELECT 'resolution', COALESCE(resolution_staff_id, 0),
+                   resolution_breached_at IS NOT NULL, COALESCE(resolution_breached_at, resolved_at)
+            FROM support_tickets
+        ) o
+        LEFT JOIN support_staff st ON st.id = o.staff_id
+        WHERE o.settled_at >= $1 AND o.settled_at < $2
+        GROUP BY o.staff_id, st.username
+        ORDER BY o.staff_id`, from, to)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var report []SLAAgentStats
+    for rows.Next() {
+        var a SLAAgentStats
+        err := rows.Scan(&a.StaffID, &a.Username, &a.ResponsesMet, &a.ResponsesMissed, &a.ResolutionsMet,
+            &a.ResolutionsMissed)
+        if err != nil {
+            return nil, err
+        }
+        report = append(report, a)
+    }
+    return report, rows.Err()
+}
+
+const slaPolicyColumns = `priority, first_response_minutes, resolution_minutes, updated_at`
+
+func (r pgTickets) SLAPolicies(ctx context.Context) ([]SLAPolicy, error) {
+    rows, err := r.q.QueryContext(ctx, `
+        SELECT `+slaPolicyColumns+`
+        FROM ticket_sla_policies
+        ORDER BY array_position($1::text[], priority::text)`, pq.Array(ticketPriorities))
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var policies []SLAPolicy
+    for rows.Next() {
+        var p SLAPolicy
+        if err := rows.Scan(&p.Priority, &p.FirstResponseMinutes, &p.ResolutionMinutes, &p.UpdatedAt); err != nil {
+            return nil, err
+        }
+        policies = append(policies, p)
+    }
+    return policies, rows.Err()
+}
+
+func (r pgTickets) SLAPolicy(ctx context.Context, priority string) (SLAPolicy, error) {
+    var p SLAPolicy
+    err := r.q.QueryRowContext(ctx, "SELECT "+slaPolicyColumns+" FROM ticket_sla_policies WHERE priority = $1",
+        priority).Scan(&p.Priority, &p.FirstResponseMinutes, &p.ResolutionMinutes, &p.UpdatedAt)
+    return p, notFound(err)
+}
+
+func (r pgTickets) SetSLAPolicy(ctx context.Context, p SLAPolicy) error {
+    _, err := r.q.ExecContext(ctx, `
+        INSERT INTO ticket_sla_policies (priority, first_response_minutes, resolution_minutes)
+        VALUES ($1, $2, $3)
+        ON CONFLICT (priority) DO UPDATE
+        SET first_response_minutes = EXCLUDED.first_response_minutes,
+            resolution_minutes = EXCLUDED.resolution_minutes, updated_at = NOW()`,
+        p.Priority, p.FirstResponseMinutes, p.ResolutionMinutes)
+    return err
+}
+
+type pgStaff struct{ q dbtx }
+
+const staffColumns = `id, username, role, COALESCE(is_active, TRUE)`
+
+func (r pgStaff) Get(ctx context.Context, id int) (StaffMember, error) {
+    var m StaffMember
+    err := r.q.QueryRowContext(ctx, "SELECT "+staffColumns+" FROM support_staff WHERE id = $1", id).
+        Scan(&m.ID, &m.Username, &m.Role, &m.Active)
+    return m, notFound(err)
+}
+
+func (r pgStaff) List(ctx context.Context) ([]StaffMember, error) {
+    rows, err := r.q.QueryContext(ctx, "SELECT "+staffColumns+" FROM support_staff ORDER BY username")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var staff []StaffMember
+    for rows.Next() {
+        var m StaffMember
+        if err := rows.Scan(&m.ID, &m.Username, &m.Role, &m.Active); err != nil {
+            return nil, err
+        }
+        staff = append(staff, m)
+    }
+    return staff, rows.Err()
+}
+
+type pgStats struct{ q dbtx }
+
+func (r pgStats) Dashboard(ctx context.Context) (DashboardStats, error) {
+    var stats DashboardStats
+    err := r.q.QueryRowContext(ctx, `
+        SELECT
+            (SELECT COUNT(*) FROM users),
+            (SELECT COUNT(*) FROM users WHERE kyc_status = 'pending'),
+            COALESCE((SELECT SUM(amount) FROM investments), 0),
+            COALESCE((SELECT SUM(ROUND(price * quantity, 2)) FROM transactions), 0),
+            COALESCE((SELECT SUM(amount) FROM commissions), 0),
+            (SELECT COUNT(*) FROM products WHERE archived_at IS NULL),
+            (SELECT COUNT(*) FROM products WHERE archived_at IS NULL AND stock <= low_stock_threshold)
+    `).Scan(&stats.TotalUsers, &stats.PendingKYC, &stats.TotalInvestments, &stats.TransactionVolume,
+        &stats.CommissionsPaid, &stats.TotalProducts, &stats.LowStockProducts)
+    return stats, err
+}
+
+func (r pgStats) Series(ctx context.Context, interval string, from, to time.Time) ([]StatsPoint, error) {
+    // Periods are UTC days, weeks and months whatever the session's
+    // TimeZone: each source column holds the session's local time, so it is
+    // read back as an instant and bucketed by its UTC date.
+    rows, err := r.q.QueryContext(ctx, `
+        SELECT p.start, COALESCE(u.n, 0), COALESCE(i.amount, 0), COALESCE(t.amount, 0), COALESCE(c.amount, 0)
+        FROM generate_series(date_trunc($1::text, $2::timestamptz AT TIME ZONE 'UTC'),
+            $3::timestamptz AT TIME ZONE 'UTC', ('1 ' || $1)::interval) AS p(start)
+        LEFT JOIN (
+            SELECT date_trunc($1, created_at::timestamptz AT TIME ZONE 'UTC') AS start, COUNT(*) AS n
+            FROM users WHERE created_at >= $2 AND created_at < $3
+            GROUP BY 1
+        ) u ON u.start = p.start
+        LEFT JOIN (
+            SELECT date_trunc($1, invested_at::timestamptz AT TIME ZONE 'UTC') AS start, SUM(amount) AS amount
+            FROM investments WHERE invested_at >= $2 AND invested_at < $3
+            GROUP BY 1
+        ) i ON i.start = p.start
+        LEFT JOIN (
+            SELECT date_trunc($1, transaction_date::timestamptz AT TIME ZONE 'UTC') AS start,
+                SUM(ROUND(price * quantity, 2)) AS amount
+            FROM transactions WHERE transaction_date >= $2 AND transaction_date < $3
+            GROUP BY 1
+        ) t ON t.start = p.start
+        LEFT JOIN (
+            SELECT date_trunc($1, created_at::timestamptz AT TIME ZONE 'UTC') AS start, SUM(amount) AS amount
+            FROM commissions WHERE created_at >= $2 AND created_at < $3
+            GROUP BY 1
+        ) c ON c.start = p.start
+        WHERE p.start < $3::timestamptz AT TIME ZONE 'UTC'
+        ORDER BY p.start
+    `, interval, from, to)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var points []StatsPoint
+    for rows.Next() {
+        var p StatsPoint
+        if err := rows.Scan(&p.Start, &p.NewUsers, &p.Invested, &p.TransactionVolume, &p.Commissions); err != nil {
+            return nil, err
+        }
+        p.Start = dateOf(p.Start, time.UTC)
+        points = append(points, p)
+    }
+    return points, rows.Err()
+}
@@ -0,0 +1,595 @@
+package main
+
+import (
+    "context"
+    "database/sql/driver"
+    "encoding/csv"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// Subscription statuses. Only active subscriptions generate deliveries;
+// cancelled is final.
+const (
+    subscriptionActive    = "active"
+    subscriptionPaused    = "paused"
+    subscriptionCancelled = "cancelled"
+)
+
+var subscriptionTransitions = map[string][]string{
+    subscriptionActive: {subscriptionPaused, subscriptionCancelled},
+    subscriptionPaused: {subscriptionActive, subscriptionCancelled},
+}
+
+// dateLayout is how delivery dates are written in requests and responses.
+const dateLayout = "2006-01-02"
+
+const defaultDeliveryInterval = 5 * time.Minute
+
+// Weekdays is a set of days of the week, bit i standing for time.Weekday(i).
+// It is written as a list of day names such as ["mon", "wed"].
+type Weekdays uint8
+
+const everyDay Weekdays = 1<<7 - 1
+
+var weekdayNames = [...]string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func (d Weekdays) Has(day time.Weekday) bool {
+    return d&(1<<uint(day)) != 0
+}
+
+func (d Weekdays) MarshalJSON() ([]byte, error) {
+    names := []string{}
+    for day, name := range weekdayNames {
+        if d.Has(time.Weekday(day)) {
+            names = append(names, name)
+        }
+    }
+    return json.Marshal(names)
+}
+
+func (d *Weekdays) UnmarshalJSON(b []byte) error {
+    var names []string
+    if err := json.Unmarshal(b, &names); err != nil {
+        return err
+    }
+    *d = 0
+    for _, name := range names {
+        day := -1
+        for i, n := range weekdayNames {
+            if strings.EqualFold(name, n) {
+                day = i
+            }
+        }
+        if day < 0 {
+            return fmt.Errorf("unknown day %q", name)
+        }
+        *d |= 1 << uint(day)
+    }
+    return nil
+}
+
+func (d *Weekdays) Scan(src interface{}) error {
+    n, ok := src.(int64)
+    if !ok {
+        return fmt.Errorf("cannot scan %T into Weekdays", src)
+    }
+    *d = Weekdays(n)
+    return nil
+}
+
+func (d Weekdays) Value() (driver.Value, error) {
+    return int64(d), nil
+}
+
+// dateOf returns the calendar date of t in loc, as midnight UTC.
+func dateOf(t time.Time, loc *time.Location) time.Time {
+    y, m, d := t.In(loc).Date()
+    return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+func parseDate(s string) (time.Time, error) {
+    return time.Parse(dateLayout, s)
+}
+
+// deliveryLocation reads DELIVERY_TIMEZONE, the IANA zone whose calendar
+// decides which day's deliveries are due. It defaults to UTC.
+func deliveryLocation() *time.Location {
+    if v := os.Getenv("DELIVERY_TIMEZONE"); v != "" {
+        loc, err := time.LoadLocation(v)
+        if err == nil {
+            return loc
+        }
+        log.Printf("Invalid DELIVERY_TIMEZONE %q, using UTC", v)
+    }
+    return time.UTC
+}
+
+// DeliversOn reports whether sub has a delivery due on date, whatever its
+// status.
+func (sub Subscription) DeliversOn(date time.Time) bool {
+    if date.Before(sub.StartDate) || !sub.Days.Has(date.Weekday()) {
+        return false
+    }
+    for _, skip := range sub.Skips {
+        if skip.Equal(date) {
+            return false
+        }
+    }
+    return true
+}
+
+// runDeliveryScheduler generates each day's deliveries every interval until
+// ctx is cancelled. Orders are unique per subscription and date, so several
+// instances may run at once.
+func runDeliveryScheduler(ctx context.Context, s Store, interval time.Duration, loc *time.Location) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        date := dateOf(time.Now(), loc)
+        n, err := generateDeliveries(ctx, s, date)
+        if err != nil {
+            log.Printf("Delivery scheduler: %v", err)
+        } else if n > 0 {
+            log.Printf("Delivery scheduler: generated %d orders for %s", n, date.Format(dateLayout))
+        }
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+// generateDeliveries creates the pending order of every subscription
+// delivery due on date that does not have one yet, and returns how many it
+// created. A subscription that cannot be priced is logged and retried on the
+// next run.
+func generateDeliveries(ctx context.Context, s Store, date time.Time) (int, error) {
+    due, err := s.Subscriptions().Due(ctx, date)
+    if err != nil {
+        return 0, err
+    }
+    generated := 0
+    for _, id := range due {
+        var created bool
+        err := s.WithTx(ctx, func(tx Store) error {
+            var err error
+            created, err = generateDelivery(ctx, tx, id, date)
+            return err
+        })
+        switch {
+        case err == errDeliveryExists:
+        case err != nil:
+            log.Printf("Subscription %d: %v", id, err)
+        case created:
+            generated++
+        }
+    }
+    return generated, nil
+}
+
+// generateDelivery creates the order for subscription id's delivery on date,
+// priced from the customer's price book now. The order is pending: its total
+// is what the customer owes, charged when it is confirmed. Nothing is
+// generated once the product is archived.
+func generateDelivery(ctx context.Context, tx Store, id int, date time.Time) (bool, error) {
+    sub, err := tx.Subscriptions().Lock(ctx, id)
+    if err != nil {
+        return false, err
+    }
+    if sub.Status != subscriptionActive || !sub.DeliversOn(date) {
+        return false, nil
+    }
+    product, err := tx.Products().Get(ctx, sub.ProductID)
+    if err != nil {
+        return false, err
+    }
+    if product.ArchivedAt != nil {
+        return false, nil
+    }
+    user, err := tx.Users().Get(ctx, sub.UserID)
+    if err != nil {
+        return false, err
+    }
+    version, err := tx.PriceBook().Resolve(ctx, sub.ProductID, sub.Unit, sideBuy, user.PriceScope())
+    if err == errNotFound {
+        return false, fmt.Errorf("product %d has no buy price in unit %q", sub.ProductID, sub.Unit)
+    }
+    if err != nil {
+        return false, err
+    }
+
+    o := Order{
+        UserID:         sub.UserID,
+        Total:          version.Price.MulQuantity(sub.Quantity),
+        SubscriptionID: sub.ID,
+        DeliveryDate:   date,
+        Items: []OrderItem{{
+            ProductID:      sub.ProductID,
+            Quantity:       sub.Quantity,
+            Unit:           sub.Unit,
+            Price:          version.Price,
+            PriceVersionID: version.ID,
+        }},
+    }
+    _, err = tx.Orders().Create(ctx, o, OrderEvent{
+        Actor: actorSystem,
+        Note:  fmt.Sprintf("Delivery for %s from subscription %d", date.Format(dateLayout), sub.ID),
+    })
+    return err == nil, err
+}
+
+// subscriptionResponse is how subscriptions are returned by the API. Only
+// skips from today on are listed.
+type subscriptionResponse struct {
+    ID          int       `json:"id"`
+    UserID      int       `json:"user_id"`
+    ProductID   int       `json:"product_id"`
+    ProductName string    `json:"product_name"`
+    Quantity    Quantity  `json:"quantity"`
+    Unit        string    `json:"unit"`
+    Days        Weekdays  `json:"days"`
+    Status      string    `json:"status"`
+    StartDate   string    `json:"start_date"`
+    Skips       []string  `json:"skips"`
+    CreatedAt   time.Time `json:"created_at"`
+    UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func newSubscriptionResponse(sub Subscription, today time.Time) subscriptionResponse {
+    skips := []string{}
+    for _, d := range sub.Skips {
+        if !d.Before(today) {
+            skips = append(skips, d.Format(dateLayout))
+        }
+    }
+    return subscriptionResponse{sub.ID, sub.UserID, sub.ProductID, sub.ProductName, sub.Quantity, sub.Unit,
+        sub.Days, sub.Status, sub.StartDate.Format(dateLayout), skips, sub.CreatedAt, sub.UpdatedAt}
+}
+
+// today is the current delivery date.
+func (s *server) today() time.Time {
+    return dateOf(time.Now(), s.deliveryTZ)
+}
+
+// createSubscriptionHandler starts a subscription. days defaults to every day
+// and start_date to today.
+func (s *server) createSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+    userID := mustPrincipal(r).UserID
+
+    var req struct {
+        ProductID int       `json:"product_id"`
+        Quantity  Quantity  `json:"quantity"`
+        Unit      string    `json:"unit"`
+        Days      *Weekdays `json:"days"`
+        StartDate string    `json:"start_date"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid request body")
+        return
+    }
+
+    today := s.today()
+    sub := Subscription{UserID: userID, ProductID: req.ProductID, Quantity: req.Quantity, Unit: req.Unit,
+        Days: everyDay, StartDate: today}
+    var errs ValidationErrors
+    if req.Quantity <= 0 {
+        errs = append(errs, FieldError{"quantity", "invalid", "quantity must be positive"})
+    }
+    if !contains(units, req.Unit) {
+        errs = append(errs, FieldError{"unit", "invalid_unit",
+            fmt.Sprintf("unit must be one of %s", strings.Join(units, ", "))})
+    }
+    if req.Days != nil {
+        sub.Days = *req.Days
+        if sub.Days == 0 {
+            errs = append(errs, FieldError{"days", "required", "at least one delivery day is required"})
+        }
+    }
+    if req.StartDate != "" {
+        start, err := parseDate(req.StartDate)
+        switch {
+        case err != nil:
+            errs = append(errs, FieldError{"start_date", "invalid", "start_date must be a date such as 2024-01-31"})
+        case start.Before(today):
+            errs = append(errs, FieldError{"start_date", "in_past", "start_date cannot be in the past"})
+        default:
+            sub.StartDate = start
+        }
+    }
+    if len(errs) > 0 {
+        writeValidationErrors(w, errs)
+        return
+    }
+
+    product, err := s.store.Products().Get(r.Context(), req.ProductID)
+    if err == errNotFound || (err == nil && product.ArchivedAt != nil) {
+        writeValidationErrors(w, ValidationErrors{{"product_id", "not_found", "product not found"}})
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to create subscription")
+        return
+    }
+    user, err := s.store.Users().Get(r.Context(), userID)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to create subscription")
+        return
+    }
+    _, err = s.store.PriceBook().Resolve(r.Context(), req.ProductID, req.Unit, sideBuy, user.PriceScope())
+    if err == errNotFound {
+        writeValidationErrors(w, ValidationErrors{{"unit", "unit_not_offered",
+            fmt.Sprintf("%s cannot be bought in unit %q", product.Name, req.Unit)}})
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to create subscription")
+        return
+    }
+
+    id, err := s.store.Subscriptions().Create(r.Context(), sub)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to create subscription")
+        return
+    }
+    sub, err = s.store.Subscriptions().Get(r.Context(), id)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch subscription")
+        return
+    }
+    writeJSON(w, http.StatusCreated, newSubscriptionResponse(sub, today))
+}
+
+func (s *server) listSubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+    s.writeSubscriptions(w, r, mustPrincipal(r).UserID)
+}
+
+func (s *server) adminListSubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+    userID := 0
+    if v := r.URL.Query().Get("user_id"); v != "" {
+        id, err := strconv.Atoi(v)
+        if err != nil {
+            writeError(w, http.StatusBadRequest, "Invalid user ID")
+            return
+        }
+        userID = id
+    }
+    s.writeSubscriptions(w, r, userID)
+}
+
+func (s *server) writeSubscriptions(w http.ResponseWriter, r *http.Request, userID int) {
+    list, err := s.store.Subscriptions().List(r.Context(), userID)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch subscriptions")
+        return
+    }
+
+    today := s.today()
+    subscriptions := []subscriptionResponse{}
+    for _, sub := range list {
+        subscriptions = append(subscriptions, newSubscriptionResponse(sub, today))
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(subscriptions)
+}
+
+// changeUserSubscription runs fn on the caller's subscription, locked, in a
+// transaction, and answers with the subscription as it then stands. Another
+// user's subscription is not found.
+func (s *server) changeUserSubscription(w http.ResponseWriter, r *http.Request,
+    fn func(tx Store, sub Subscription) (ValidationErrors, error)) {
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid subscription ID")
+        return
+    }
+    userID := mustPrincipal(r).UserID
+
+    var errs ValidationErrors
+    err = s.store.WithTx(r.Context(), func(tx Store) error {
+        sub, err := tx.Subscriptions().Lock(r.Context(), id)
+        if err != nil {
+            return err
+        }
+        if sub.UserID != userID {
+            return errNotFound
+        }
+        if errs, err = fn(tx, sub); len(errs) > 0 {
+            return errs
+        }
+        return err
+    })
+    switch {
+    case len(errs) > 0:
+        writeValidationErrors(w, errs)
+        return
+    case err == errNotFound:
+        writeError(w, http.StatusNotFound, "Subscription not found")
+        return
+    case err != nil:
+        writeError(w, http.StatusInternalServerError, "Failed to update subscription")
+        return
+    }
+
+    sub, err := s.store.Subscriptions().Get(r.Context(), id)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch subscription")
+        return
+    }
+    writeJSON(w, http.StatusOK, newSubscriptionResponse(sub, s.today()))
+}
+
+// subscriptionStatusHandler returns the handler that pauses, resumes or
+// cancels the caller's subscription. Deliveries already generated are not
+// affected.
+func (s *server) subscriptionStatusHandler(status string) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        s.changeUserSubscription(w, r, func(tx Store, sub Subscription) (ValidationErrors, error) {
+            if !contains(subscriptionTransitions[sub.Status], status) {
+                return ValidationErrors{{"status", "invalid_transition",
+                    fmt.Sprintf("cannot change subscription status from %s to %s", sub.Status, status)}}, nil
+            }
+            return nil, tx.Subscriptions().SetStatus(r.Context(), sub.ID, status)
+        })
+    }
+}
+
+// deliveryOrder returns the order generated for sub's delivery on date, if
+// any.
+func deliveryOrder(ctx context.Context, tx Store, sub Subscription, date time.Time) (Order, bool, error) {
+    orders, err := tx.Orders().List(ctx, OrderFilter{SubscriptionID: sub.ID, DeliveryDate: date})
+    if err != nil || len(orders) == 0 {
+        return Order{}, false, err
+    }
+    return orders[0], true, nil
+}
+
+// skipDeliveryHandler skips one delivery of the caller's subscription. If
+// the day's order has already been generated it is cancelled, as long as it
+// is still pending.
+func (s *server) skipDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+    var req struct {
+        Date string `json:"date"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid request body")
+        return
+    }
+    date, err := parseDate(req.Date)
+    if err != nil {
+        writeValidationErrors(w, ValidationErrors{{"date", "invalid", "date must be a date such as 2024-01-31"}})
+        return
+    }
+
+    s.changeUserSubscription(w, r, func(tx Store, sub Subscription) (ValidationErrors, error) {
+        switch {
+        case sub.Status == subscriptionCancelled:
+            return ValidationErrors{{"status", "cancelled", "subscription is cancelled"}}, nil
+        case date.Before(s.today()):
+            return ValidationErrors{{"date", "in_past", "date cannot be in the past"}}, nil
+        case !sub.DeliversOn(date):
+            return ValidationErrors{{"date", "no_delivery", "there is no delivery on this date"}}, nil
+        }
+
+        o, found, err := deliveryOrder(r.Context(), tx, sub, date)
+        if err != nil {
+            return nil, err
+        }
+        if found {
+            if o.Status != orderPending {
+                return ValidationErrors{{"date", "already_confirmed",
+                    fmt.Sprintf("the delivery for this date is already %s", o.Status)}}, nil
+            }
+            errs, err := moveOrder(r.Context(), tx, OrderEvent{OrderID: o.ID, Status: orderCancelled,
+                Note: "Delivery skipped", Actor: actorCustomer, UserID: sub.UserID})
+            if len(errs) > 0 || err != nil {
+                return errs, err
+            }
+        }
+        return nil, tx.Subscriptions().Skip(r.Context(), sub.ID, date)
+    })
+}
+
+// unskipDeliveryHandler restores a skipped delivery whose order has not been
+// generated yet.
+func (s *server) unskipDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+    date, err := parseDate(mux.Vars(r)["date"])
+    if err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid date")
+        return
+    }
+
+    s.changeUserSubscription(w, r, func(tx Store, sub Subscription) (ValidationErrors, error) {
+        if date.Before(s.today()) {
+            return ValidationErrors{{"date", "in_past", "date cannot be in the past"}}, nil
+        }
+        _, found, err := deliveryOrder(r.Context(), tx, sub, date)
+        if err != nil {
+            return nil, err
+        }
+        if found {
+            return ValidationErrors{{"date", "already_generated",
+                "the delivery for this date has already been generated"}}, nil
+        }
+        return nil, tx.Subscriptions().Unskip(r.Context(), sub.ID, date)
+    })
+}
+
+// deliveryManifestHandler lists the deliveries generated for ?date= (default
+// today), as JSON or, with ?format=csv, as a CSV download.
+func (s *server) deliveryManifestHandler(w http.ResponseWriter, r *http.Request) {
+    date := s.today()
+    if v := r.URL.Query().Get("date"); v != "" {
+        d, err := parseDate(v)
+        if err != nil {
+            writeError(w, http.StatusBadRequest, "Invalid date")
+            return
+        }
+        date = d
+    }
+
+    lines, err := s.store.Subscriptions().Manifest(r.Context(), date)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch deliveries")
+        return
+    }
+
+    if r.URL.Query().Get("format") == "csv" {
+        w.Header().Set("Content-Type", "text/csv")
+        w.Header().Set("Content-Disposition",
+            fmt.Sprintf(`attachment; filename="deliveries-%s.csv"`, date.Format(dateLayout)))
+        cw := csv.NewWriter(w)
+        cw.Write([]string{"order_id", "subscription_id", "user_id", "customer_name", "customer_phone",
+            "product", "quantity", "unit", "price", "total_amount", "status"})
+        for _, l := range lines {
+            cw.Write([]string{strconv.Itoa(l.OrderID), strconv.Itoa(l.SubscriptionID), strconv.Itoa(l.UserID),
+                l.CustomerName, l.CustomerPhone, l.ProductName, l.Quantity.String(), l.Unit, l.Price.String(),
+                l.Total.String(), l.Status})
+        }
+        cw.Flush()
+        return
+    }
+
+    type delivery struct {
+        OrderID        int      `json:"order_id"`
+        SubscriptionID int      `json:"subscription_id"`
+        UserID         int      `json:"user_id"`
+        CustomerName   string   `json:"customer_name"`
+        CustomerPhone  string   `json:"customer_phone"`
+        ProductID      int      `json:"product_id"`
+        ProductName    string   `json:"product_name"`
+        Quantity       Quantity `json:"quantity"`
+        Unit           string   `json:"unit"`
+        Price          Money    `json:"price"`
+        TotalAmount    Money    `json:"total_amount"`
+        Status         string   `json:"status"`
+    }
+
+    deliveries := []delivery{}
+    var total Money
+    for _, l := range lines {
+        deliveries = append(deliveries, delivery{l.OrderID, l.SubscriptionID, l.UserID, l.CustomerName,
+            l.CustomerPhone, l.ProductID, l.ProductName, l.Quantity, l.Unit, l.Price, l.Total, l.Status})
+        if l.Status != orderCancelled {
+            total += l.Total
+        }
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "date":         date.Format(dateLayout),
+        "deliveries":   deliveries,
+        "total_amount": total,
+    })
+}
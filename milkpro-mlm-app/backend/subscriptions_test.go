@@ -0,0 +1,66 @@
+package main
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+func TestArchivedProductsGenerateNoDeliveries(t *testing.T) {
+    ctx := context.Background()
+    s := newMemoryStore()
+    date := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+    userID, err := s.Users().Create(ctx, User{Phone: "+15550001", Name: "Customer"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    subscribe := func(name string) int {
+        productID, err := s.Products().Create(ctx, Product{Name: name, Type: "milk", StockUnit: unitLitre})
+        if err != nil {
+            t.Fatal(err)
+        }
+        if _, err := s.PriceBook().Add(ctx, PriceVersion{ProductID: productID, Unit: unitLitre, Side: sideBuy,
+            Price: 250}); err != nil {
+            t.Fatal(err)
+        }
+        id, err := s.Subscriptions().Create(ctx, Subscription{UserID: userID, ProductID: productID, Quantity: 200,
+            Unit: unitLitre, Days: everyDay, StartDate: date})
+        if err != nil {
+            t.Fatal(err)
+        }
+        return id
+    }
+    keptID := subscribe("Milk")
+    archivedID := subscribe("Cream")
+    sub, err := s.Subscriptions().Get(ctx, archivedID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Products().Archive(ctx, sub.ProductID); err != nil {
+        t.Fatal(err)
+    }
+
+    due, err := s.Subscriptions().Due(ctx, date)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(due) != 1 || due[0] != keptID {
+        t.Errorf("due subscriptions are %v, want [%d]", due, keptID)
+    }
+    // The product may be archived after Due has listed the subscription.
+    if created, err := generateDelivery(ctx, s, archivedID, date); created || err != nil {
+        t.Errorf("generating an archived product's delivery: got %v, %v", created, err)
+    }
+
+    n, err := generateDeliveries(ctx, s, date)
+    if err != nil || n != 1 {
+        t.Errorf("generated %d deliveries, %v; want 1", n, err)
+    }
+    orders, err := s.Orders().List(ctx, OrderFilter{DeliveryDate: date})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(orders) != 1 || orders[0].SubscriptionID != keptID {
+        t.Errorf("got orders %+v", orders)
+    }
+}
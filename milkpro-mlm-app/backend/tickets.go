@@ -0,0 +1,666 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "mime"
+    "mime/multipart"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+    "unicode/utf8"
+
+    "github.com/gorilla/mux"
+)
+
+// Ticket statuses. Staff move tickets along ticketTransitions; a message
+// from the user reopens a resolved ticket, and closed is final.
+const (
+    ticketOpen       = "open"
+    ticketInProgress = "in_progress"
+    ticketResolved   = "resolved"
+    ticketClosed     = "closed"
+)
+
+var ticketStatuses = []string{ticketOpen, ticketInProgress, ticketResolved, ticketClosed}
+
+var ticketTransitions = map[string][]string{
+    ticketOpen:       {ticketInProgress, ticketResolved, ticketClosed},
+    ticketInProgress: {ticketOpen, ticketResolved, ticketClosed},
+    ticketResolved:   {ticketOpen, ticketClosed},
+}
+
+var ticketPriorities = []string{"low", "medium", "high", "urgent"}
+
+// Who sent a ticket message: the ticket's user, a support_staff account or
+// an admin app user.
+const (
+    senderUser  = "user"
+    senderStaff = "staff"
+    senderAdmin = "admin"
+)
+
+// maxTickets caps how many tickets one listing returns; the others bound
+// what users and staff type, in characters.
+const (
+    maxTickets       = 200
+    maxTicketSubject = 200
+    maxTicketMessage = 5000
+)
+
+// ticketMessageResponse is one message of a ticket's thread. sender_name is
+// only filled in for staff.
+type ticketMessageResponse struct {
+    ID            int       `json:"id"`
+    SenderType    string    `json:"sender_type"`
+    SenderID      int       `json:"sender_id"`
+    SenderName    string    `json:"sender_name,omitempty"`
+    Message       string    `json:"message"`
+    AttachmentURL string    `json:"attachment_url,omitempty"`
+    CreatedAt     time.Time `json:"created_at"`
+}
+
+// ticketResponse is how tickets are returned by the API. Messages are only
+// included for a single ticket, and the SLA only for staff.
+type ticketResponse struct {
+    ID           int                     `json:"id"`
+    UserID       int                     `json:"user_id"`
+    UserName     string                  `json:"user_name,omitempty"`
+    Subject      string                  `json:"subject"`
+    Status       string                  `json:"status"`
+    Priority     string                  `json:"priority"`
+    AssignedTo   int                     `json:"assigned_to,omitempty"`
+    AssigneeName string                  `json:"assignee_name,omitempty"`
+    SLA          *ticketSLAResponse      `json:"sla,omitempty"`
+    Messages     []ticketMessageResponse `json:"messages,omitempty"`
+    CreatedAt    time.Time               `json:"created_at"`
+    UpdatedAt    time.Time               `json:"updated_at"`
+}
+
+func newTicketResponse(t Ticket) ticketResponse {
+    return ticketResponse{
+        ID:           t.ID,
+        UserID:       t.UserID,
+        UserName:     t.UserName,
+        Subject:      t.Subject,
+        Status:       t.Status,
+        Priority:     t.Priority,
+        AssignedTo:   t.AssignedTo,
+        AssigneeName: t.AssigneeName,
+        CreatedAt:    t.CreatedAt,
+        UpdatedAt:    t.UpdatedAt,
+    }
+}
+
+// writeTicket answers with t and its thread. For staff, messages carry the
+// sender's name.
+func (s *server) writeTicket(w http.ResponseWriter, r *http.Request, status int, t Ticket, forStaff bool) {
+    messages, err := s.store.Tickets().Messages(r.Context(), t.ID)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch ticket messages")
+        return
+    }
+    var staffNames map[int]string
+    if forStaff {
+        staff, err := s.store.Staff().List(r.Context())
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, "Failed to fetch ticket messages")
+            return
+        }
+        staffNames = make(map[int]string, len(staff))
+        for _, m := range staff {
+            staffNames[m.ID] = m.Username
+        }
+    }
+
+    resp := newTicketResponse(t)
+    if forStaff {
+        resp.SLA = newTicketSLAResponse(t)
+    }
+    resp.Messages = []ticketMessageResponse{}
+    for _, m := range messages {
+        msg := ticketMessageResponse{m.ID, m.SenderType, m.SenderID, "", m.Message,
+            s.downloadURL(m.AttachmentKey), m.CreatedAt}
+        if forStaff {
+            switch m.SenderType {
+            case senderUser:
+                msg.SenderName = t.UserName
+            case senderStaff:
+                msg.SenderName = staffNames[m.SenderID]
+            case senderAdmin:
+                msg.SenderName = "Admin"
+            }
+        }
+        resp.Messages = append(resp.Messages, msg)
+    }
+    writeJSON(w, status, resp)
+}
+
+func ticketIDFromPath(w http.ResponseWriter, r *http.Request) (int, bool) {
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid ticket ID")
+        return 0, false
+    }
+    return id, true
+}
+
+// ticketForm is a ticket or message as posted, either as JSON or as a
+// multipart form that may carry an attachment.
+type ticketForm struct {
+    Subject  string `json:"subject"`
+    Priority string `json:"priority"`
+    Message  string `json:"message"`
+
+    file        multipart.File
+    header      *multipart.FileHeader
+    contentType string
+}
+
+// readTicketForm reads and checks the message and attachment of a request,
+// answering it and returning false on any problem. The caller must call
+// close on the form it gets.
+func readTicketForm(w http.ResponseWriter, r *http.Request) (*ticketForm, bool) {
+    f := &ticketForm{}
+    mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+    if mediaType != "multipart/form-data" {
+        if err := json.NewDecoder(r.Body).Decode(f); err != nil {
+            writeError(w, http.StatusBadRequest, "Invalid request body")
+            return nil, false
+        }
+    } else {
+        if !parseUploadForm(w, r, "attachment") {
+            return nil, false
+        }
+        f.Subject, f.Priority, f.Message = r.FormValue("subject"), r.FormValue("priority"), r.FormValue("message")
+        if file, header, err := r.FormFile("attachment"); err == nil {
+            f.file, f.header = file, header
+        }
+    }
+    f.Subject, f.Message = strings.TrimSpace(f.Subject), strings.TrimSpace(f.Message)
+
+    var errs ValidationErrors
+    switch {
+    case f.Message == "" && f.file == nil:
+        errs = append(errs, FieldError{"message", "required", "message or attachment is required"})
+    case utf8.RuneCountInString(f.Message) > maxTicketMessage:
+        errs = append(errs, FieldError{"message", "too_long",
+            fmt.Sprintf("message must be at most %d characters", maxTicketMessage)})
+    }
+    if f.file != nil {
+        f.contentType, errs = checkUploadFile(f.file, f.header, "attachment", errs)
+    }
+    if len(errs) > 0 {
+        f.close(r)
+        writeValidationErrors(w, errs)
+        return nil, false
+    }
+    return f, true
+}
+
+func (f *ticketForm) close(r *http.Request) {
+    if f.file != nil {
+        f.file.Close()
+    }
+    if r.MultipartForm != nil {
+        r.MultipartForm.RemoveAll()
+    }
+}
+
+// storeAttachment puts the form's attachment, if any, in the blob store
+// under the ticket owner's prefix and returns its key.
+func (s *server) storeAttachment(ctx context.Context, f *ticketForm, userID int) (string, error) {
+    if f.file == nil {
+        return "", nil
+    }
+    key, err := newBlobKey(fmt.Sprintf("tickets/%d", userID), f.contentType)
+    if err != nil {
+        return "", err
+    }
+    if err := s.blobs.Put(ctx, key, f.file, f.header.Size, f.contentType); err != nil {
+        log.Printf("Error storing ticket attachment %s: %v", key, err)
+        return "", err
+    }
+    return key, nil
+}
+
+// dropAttachment removes an attachment whose message was not recorded.
+func (s *server) dropAttachment(key string) {
+    if key == "" {
+        return
+    }
+    if err := s.blobs.Delete(context.Background(), key); err != nil {
+        log.Printf("Error removing ticket attachment %s: %v", key, err)
+    }
+}
+
+func ticketClosedError() ValidationErrors {
+    return ValidationErrors{{"status", "closed", "the ticket is closed"}}
+}
+
+// openTicketHandler opens a ticket for the caller with its first message.
+func (s *server) openTicketHandler(w http.ResponseWriter, r *http.Request) {
+    userID := mustPrincipal(r).UserID
+
+    f, ok := readTicketForm(w, r)
+    if !ok {
+        return
+    }
+    defer f.close(r)
+
+    var errs ValidationErrors
+    switch {
+    case f.Subject == "":
+        errs = append(errs, FieldError{"subject", "required", "subject is required"})
+    case utf8.RuneCountInString(f.Subject) > maxTicketSubject:
+        errs = append(errs, FieldError{"subject", "too_long",
+            fmt.Sprintf("subject must be at most %d characters", maxTicketSubject)})
+    }
+    if f.Priority == "" {
+        f.Priority = "medium"
+    } else if !contains(ticketPriorities, f.Priority) {
+        errs = append(errs, FieldError{"priority", "invalid",
+            "priority must be one of " + strings.Join(ticketPriorities, ", ")})
+    }
+    if len(errs) > 0 {
+        writeValidationErrors(w, errs)
+        return
+    }
+
+    key, err := s.storeAttachment(r.Context(), f, userID)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to open ticket")
+        return
+    }
+    var t Ticket
+    err = s.store.WithTx(r.Context(), func(tx Store) error {
+        policy, err := tx.Tickets().SLAPolicy(r.Context(), f.Priority)
+        if err != nil {
+            return err
+        }
+        t = Ticket{UserID: userID, Subject: f.Subject, Status: ticketOpen, Priority: f.Priority}
+        startSLA(&t, policy, time.Now())
+        id, err := tx.Tickets().Create(r.Context(), t)
+        if err != nil {
+            return err
+        }
+        _, err = tx.Tickets().AddMessage(r.Context(), TicketMessage{TicketID: id, SenderType: senderUser,
+            SenderID: userID, Message: f.Message, AttachmentKey: key})
+        if err != nil {
+            return err
+        }
+        t, err = tx.Tickets().Get(r.Context(), id)
+        return err
+    })
+    if err != nil {
+        s.dropAttachment(key)
+        writeError(w, http.StatusInternalServerError, "Failed to open ticket")
+        return
+    }
+    s.writeTicket(w, r, http.StatusCreated, t, false)
+}
+
+func (s *server) listTicketsHandler(w http.ResponseWriter, r *http.Request) {
+    userID := mustPrincipal(r).UserID
+
+    list, err := s.store.Tickets().List(r.Context(), TicketFilter{UserID: userID, Limit: maxTickets})
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch tickets")
+        return
+    }
+
+    tickets := []ticketResponse{}
+    for _, t := range list {
+        tickets = append(tickets, newTicketResponse(t))
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(tickets)
+}
+
+func (s *server) getTicketHandler(w http.ResponseWriter, r *http.Request) {
+    id, ok := ticketIDFromPath(w, r)
+    if !ok {
+        return
+    }
+    t, err := s.store.Tickets().Get(r.Context(), id)
+    if err == errNotFound || (err == nil && t.UserID != mustPrincipal(r).UserID) {
+        writeError(w, http.StatusNotFound, "Ticket not found")
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch ticket")
+        return
+    }
+    s.writeTicket(w, r, http.StatusOK, t, false)
+}
+
+// postTicketMessageHandler adds the caller's message to their ticket. A
+// message on a resolved ticket reopens it; closed tickets take no more.
+func (s *server) postTicketMessageHandler(w http.ResponseWriter, r *http.Request) {
+    userID := mustPrincipal(r).UserID
+    s.postTicketMessage(w, r, userID, TicketMessage{SenderType: senderUser, SenderID: userID},
+        func(tx Store, t *Ticket) error {
+            if t.Status == ticketResolved {
+                return reopenTicket(r.Context(), tx, t, time.Now())
+            }
+            return nil
+        })
+}
+
+// staffTicketMessageHandler replies to a ticket on behalf of the calling
+// staff member. Replying to an open ticket puts it in progress, and the
+// first reply meets the ticket's first-response target.
+func (s *server) staffTicketMessageHandler(w http.ResponseWriter, r *http.Request) {
+    staff := staffFromContext(r.Context())
+    m := TicketMessage{SenderType: senderStaff, SenderID: staff.StaffID}
+    if staff.StaffID == 0 {
+        m.SenderType, m.SenderID = senderAdmin, staff.UserID
+    }
+    s.postTicketMessage(w, r, 0, m, func(tx Store, t *Ticket) error {
+        if t.Status == ticketOpen {
+            t.Status = ticketInProgress
+        }
+        recordResponse(t, staff.StaffID, time.Now())
+        return nil
+    })
+}
+
+// postTicketMessage records m on the ticket in the path, which must belong
+// to ownerID unless that is 0, after letting advance move the ticket on.
+func (s *server) postTicketMessage(w http.ResponseWriter, r *http.Request, ownerID int, m TicketMessage,
+    advance func(tx Store, t *Ticket) error) {
+    id, ok := ticketIDFromPath(w, r)
+    if !ok {
+        return
+    }
+    t, err := s.store.Tickets().Get(r.Context(), id)
+    if err == errNotFound || (err == nil && ownerID != 0 && t.UserID != ownerID) {
+        writeError(w, http.StatusNotFound, "Ticket not found")
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch ticket")
+        return
+    }
+    if t.Status == ticketClosed {
+        writeValidationErrors(w, ticketClosedError())
+        return
+    }
+
+    f, ok := readTicketForm(w, r)
+    if !ok {
+        return
+    }
+    defer f.close(r)
+    if m.AttachmentKey, err = s.storeAttachment(r.Context(), f, t.UserID); err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to send message")
+        return
+    }
+    m.TicketID, m.Message = id, f.Message
+
+    err = s.changeTicket(w, r, id, ownerID == 0, "Failed to send message", http.StatusCreated,
+        func(tx Store, t *Ticket) (ValidationErrors, error) {
+            if t.Status == ticketClosed {
+                return ticketClosedError(), nil
+            }
+            if err := advance(tx, t); err != nil {
+                return nil, err
+            }
+            _, err := tx.Tickets().AddMessage(r.Context(), m)
+            return nil, err
+        })
+    if err != nil {
+        s.dropAttachment(m.AttachmentKey)
+    }
+}
+
+// changeTicket runs fn on the locked ticket id in a transaction, stores the
+// ticket as fn leaves it and answers with it. It returns the error it
+// answered with, if any.
+func (s *server) changeTicket(w http.ResponseWriter, r *http.Request, id int, forStaff bool, failure string,
+    status int, fn func(tx Store, t *Ticket) (ValidationErrors, error)) error {
+    var errs ValidationErrors
+    err := s.store.WithTx(r.Context(), func(tx Store) error {
+        t, err := tx.Tickets().Lock(r.Context(), id)
+        if err != nil {
+            return err
+        }
+        if errs, err = fn(tx, &t); len(errs) > 0 {
+            return errs
+        }
+        if err != nil {
+            return err
+        }
+        return tx.Tickets().Update(r.Context(), t)
+    })
+    switch {
+    case len(errs) > 0:
+        writeValidationErrors(w, errs)
+        return errs
+    case err == errNotFound:
+        writeError(w, http.StatusNotFound, "Ticket not found")
+        return err
+    case err != nil:
+        writeError(w, http.StatusInternalServerError, failure)
+        return err
+    }
+
+    t, err := s.store.Tickets().Get(r.Context(), id)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch ticket")
+        return nil
+    }
+    s.writeTicket(w, r, status, t, forStaff)
+    return nil
+}
+
+// adminListTicketsHandler lists tickets for staff, filtered by status,
+// priority, user_id and assigned_to: a staff ID, "me" or "none".
+func (s *server) adminListTicketsHandler(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+    f := TicketFilter{Status: q.Get("status"), Priority: q.Get("priority"), Limit: maxTickets}
+    if f.Status != "" && !contains(ticketStatuses, f.Status) {
+        writeError(w, http.StatusBadRequest, "Invalid status")
+        return
+    }
+    if f.Priority != "" && !contains(ticketPriorities, f.Priority) {
+        writeError(w, http.StatusBadRequest, "Invalid priority")
+        return
+    }
+    if v := q.Get("user_id"); v != "" {
+        id, err := strconv.Atoi(v)
+        if err != nil {
+            writeError(w, http.StatusBadRequest, "Invalid user ID")
+            return
+        }
+        f.UserID = id
+    }
+    switch v := q.Get("assigned_to"); v {
+    case "":
+    case "none":
+        f.Unassigned = true
+    case "me":
+        f.AssignedTo = staffFromContext(r.Context()).StaffID
+        if f.AssignedTo == 0 {
+            writeError(w, http.StatusBadRequest, "assigned_to=me needs a staff account")
+            return
+        }
+    default:
+        id, err := strconv.Atoi(v)
+        if err != nil {
+            writeError(w, http.StatusBadRequest, "Invalid assigned_to")
+            return
+        }
+        f.AssignedTo = id
+    }
+
+    list, err := s.store.Tickets().List(r.Context(), f)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch tickets")
+        return
+    }
+
+    tickets := []ticketResponse{}
+    for _, t := range list {
+        resp := newTicketResponse(t)
+        resp.SLA = newTicketSLAResponse(t)
+        tickets = append(tickets, resp)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(tickets)
+}
+
+func (s *server) adminGetTicketHandler(w http.ResponseWriter, r *http.Request) {
+    id, ok := ticketIDFromPath(w, r)
+    if !ok {
+        return
+    }
+    t, err := s.store.Tickets().Get(r.Context(), id)
+    if err == errNotFound {
+        writeError(w, http.StatusNotFound, "Ticket not found")
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch ticket")
+        return
+    }
+    s.writeTicket(w, r, http.StatusOK, t, true)
+}
+
+// ticketStatusHandler moves a ticket along ticketTransitions. Resolving or
+// closing it meets its resolution target; reopening it undoes that.
+func (s *server) ticketStatusHandler(w http.ResponseWriter, r *http.Request) {
+    id, ok := ticketIDFromPath(w, r)
+    if !ok {
+        return
+    }
+    var req struct {
+        Status string `json:"status"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid request body")
+        return
+    }
+
+    s.changeTicket(w, r, id, true, "Failed to update ticket", http.StatusOK,
+        func(tx Store, t *Ticket) (ValidationErrors, error) {
+            if !contains(ticketTransitions[t.Status], req.Status) {
+                return ValidationErrors{{"status", "invalid_transition",
+                    fmt.Sprintf("cannot change ticket status from %s to %q", t.Status, req.Status)}}, nil
+            }
+            switch req.Status {
+            case ticketResolved, ticketClosed:
+                recordResolution(t, staffFromContext(r.Context()).StaffID, time.Now())
+            case ticketOpen:
+                if t.Status == ticketResolved {
+                    if err := reopenTicket(r.Context(), tx, t, time.Now()); err != nil {
+                        return nil, err
+                    }
+                }
+            }
+            t.Status = req.Status
+            return nil, nil
+        })
+}
+
+// ticketPriorityHandler changes a ticket's priority, moving the due times
+// of its outstanding SLA targets to the new priority's.
+func (s *server) ticketPriorityHandler(w http.ResponseWriter, r *http.Request) {
+    id, ok := ticketIDFromPath(w, r)
+    if !ok {
+        return
+    }
+    var req struct {
+        Priority string `json:"priority"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid request body")
+        return
+    }
+    if !contains(ticketPriorities, req.Priority) {
+        writeValidationErrors(w, ValidationErrors{{"priority", "invalid",
+            "priority must be one of " + strings.Join(ticketPriorities, ", ")}})
+        return
+    }
+
+    s.changeTicket(w, r, id, true, "Failed to update ticket", http.StatusOK,
+        func(tx Store, t *Ticket) (ValidationErrors, error) {
+            if t.Status == ticketClosed {
+                return ticketClosedError(), nil
+            }
+            policy, err := tx.Tickets().SLAPolicy(r.Context(), req.Priority)
+            if err != nil {
+                return nil, err
+            }
+            t.Priority = req.Priority
+            retargetSLA(t, policy)
+            return nil, nil
+        })
+}
+
+// assignTicketHandler hands a ticket to an active support_staff account, or
+// back to the queue when staff_id is 0 or null.
+func (s *server) assignTicketHandler(w http.ResponseWriter, r *http.Request) {
+    id, ok := ticketIDFromPath(w, r)
+    if !ok {
+        return
+    }
+    var req struct {
+        StaffID int `json:"staff_id"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid request body")
+        return
+    }
+
+    s.changeTicket(w, r, id, true, "Failed to assign ticket", http.StatusOK,
+        func(tx Store, t *Ticket) (ValidationErrors, error) {
+            if t.Status == ticketClosed {
+                return ticketClosedError(), nil
+            }
+            if req.StaffID != 0 {
+                m, err := tx.Staff().Get(r.Context(), req.StaffID)
+                if err == errNotFound {
+                    return ValidationErrors{{"staff_id", "not_found", "staff member not found"}}, nil
+                }
+                if err != nil {
+                    return nil, err
+                }
+                if !m.Active {
+                    return ValidationErrors{{"staff_id", "inactive",
+                        fmt.Sprintf("%s is deactivated", m.Username)}}, nil
+                }
+            }
+            t.AssignedTo = req.StaffID
+            return nil, nil
+        })
+}
+
+// staffResponse is a support_staff account as listed for assignment.
+type staffResponse struct {
+    ID       int    `json:"id"`
+    Username string `json:"username"`
+    Role     string `json:"role"`
+    Active   bool   `json:"active"`
+}
+
+func (s *server) listStaffHandler(w http.ResponseWriter, r *http.Request) {
+    list, err := s.store.Staff().List(r.Context())
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch staff")
+        return
+    }
+
+    staff := []staffResponse{}
+    for _, m := range list {
+        staff = append(staff, staffResponse{m.ID, m.Username, m.Role, m.Active})
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(staff)
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// defaultSLAPolicies are the targets a new database starts with; migration
+// 0014 seeds the same.
+var defaultSLAPolicies = []SLAPolicy{
+    {Priority: "low", FirstResponseMinutes: 24 * 60, ResolutionMinutes: 7 * 24 * 60},
+    {Priority: "medium", FirstResponseMinutes: 8 * 60, ResolutionMinutes: 3 * 24 * 60},
+    {Priority: "high", FirstResponseMinutes: 2 * 60, ResolutionMinutes: 24 * 60},
+    {Priority: "urgent", FirstResponseMinutes: 30, ResolutionMinutes: 4 * 60},
+}
+
+const defaultSLAInterval = time.Minute
+
+// maxSLAMinutes bounds a target at 90 days; defaultSLAReportDays is the
+// period an SLA report covers when it is not given one.
+const (
+    maxSLAMinutes        = 90 * 24 * 60
+    defaultSLAReportDays = 30
+)
+
+func (p SLAPolicy) firstResponse() time.Duration {
+    return time.Duration(p.FirstResponseMinutes) * time.Minute
+}
+
+func (p SLAPolicy) resolution() time.Duration {
+    return time.Duration(p.ResolutionMinutes) * time.Minute
+}
+
+// startSLA sets the due times of a new ticket from p, counted from start.
+func startSLA(t *Ticket, p SLAPolicy, start time.Time) {
+    t.FirstResponseDue = start.Add(p.firstResponse())
+    t.ResolutionDue = start.Add(p.resolution())
+}
+
+// retargetSLA moves the due times of t's targets that are neither met nor
+// breached to what p gives, counted from when t was opened. It is used when
+// staff change t's priority.
+func retargetSLA(t *Ticket, p SLAPolicy) {
+    if t.FirstResponseAt == nil && t.ResponseBreachedAt == nil {
+        t.FirstResponseDue = t.CreatedAt.Add(p.firstResponse())
+    }
+    if t.ResolvedAt == nil && t.ResolutionBreachedAt == nil {
+        t.ResolutionDue = t.CreatedAt.Add(p.resolution())
+    }
+}
+
+// recordResponse notes the first staff reply to t, by staffID (0 for an
+// admin app user). A reply after the due time breaches the target then,
+// unless the checker got there first.
+func recordResponse(t *Ticket, staffID int, now time.Time) {
+    if t.FirstResponseAt != nil {
+        return
+    }
+    t.FirstResponseAt = &now
+    if t.ResponseBreachedAt == nil {
+        t.ResponseStaffID = staffID
+        if now.After(t.FirstResponseDue) {
+            t.ResponseBreachedAt = &now
+        }
+    }
+}
+
+// recordResolution notes that staffID resolved or closed t. A ticket closed
+// without a reply counts as answered at the same time.
+func recordResolution(t *Ticket, staffID int, now time.Time) {
+    recordResponse(t, staffID, now)
+    if t.ResolvedAt != nil {
+        return
+    }
+    t.ResolvedAt = &now
+    if t.ResolutionBreachedAt == nil {
+        t.ResolutionStaffID = staffID
+        if now.After(t.ResolutionDue) {
+            t.ResolutionBreachedAt = &now
+        }
+    }
+}
+
+// reopenTicket moves a resolved ticket back to open. Its resolution no
+// longer counts; unless that was already breached, the ticket gets a new
+// resolution target from now.
+func reopenTicket(ctx context.Context, s Store, t *Ticket, now time.Time) error {
+    t.Status = ticketOpen
+    t.ResolvedAt = nil
+    if t.ResolutionBreachedAt != nil {
+        return nil
+    }
+    p, err := s.Tickets().SLAPolicy(ctx, t.Priority)
+    if err != nil {
+        return err
+    }
+    t.ResolutionStaffID = 0
+    t.ResolutionDue = now.Add(p.resolution())
+    return nil
+}
+
+// runSLAScheduler checks tickets for breached targets every interval until
+// ctx is cancelled. Tickets are claimed with a row lock, so several
+// instances may run at once.
+func runSLAScheduler(ctx context.Context, s Store, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        n, err := checkTicketSLAs(ctx, s)
+        if err != nil {
+            log.Printf("SLA scheduler: %v", err)
+        } else if n > 0 {
+            log.Printf("SLA scheduler: escalated %d tickets", n)
+        }
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+// checkTicketSLAs escalates every ticket with a target that fell due unmet
+// and returns how many it escalated. A ticket that cannot be escalated is
+// logged, skipped for the rest of the run and retried on the next one.
+func checkTicketSLAs(ctx context.Context, s Store) (int, error) {
+    escalated := 0
+    var failed []int
+    for {
+        id, err := checkNextTicketSLA(ctx, s, failed)
+        switch {
+        case err != nil && id == 0:
+            return escalated, err
+        case err != nil:
+            log.Printf("Ticket %d: %v", id, err)
+            failed = append(failed, id)
+        case id == 0:
+            return escalated, nil
+        default:
+            escalated++
+        }
+    }
+}
+
+// checkNextTicketSLA claims one ticket with a missed target, not in skip,
+// and escalates it. It returns the ID of the ticket it claimed, or 0 when
+// there are none.
+func checkNextTicketSLA(ctx context.Context, s Store, skip []int) (int, error) {
+    claimed := 0
+    err := s.WithTx(ctx, func(tx Store) error {
+        now := time.Now()
+        t, err := tx.Tickets().ClaimBreached(ctx, now, skip)
+        if err == errNotFound {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        claimed = t.ID
+        if err := escalateTicket(ctx, tx, &t, now); err != nil {
+            return err
+        }
+        return tx.Tickets().Update(ctx, t)
+    })
+    return claimed, err
+}
+
+// escalateTicket records t's missed targets as breached, holding whoever
+// is assigned accountable. A missed first response raises t's priority one
+// step, keeping its due times; a missed resolution hands t to the active
+// admin with the fewest open tickets.
+func escalateTicket(ctx context.Context, s Store, t *Ticket, now time.Time) error {
+    if t.FirstResponseAt == nil && t.ResponseBreachedAt == nil && !t.FirstResponseDue.After(now) {
+        t.ResponseBreachedAt, t.ResponseStaffID = &now, t.AssignedTo
+        t.Priority = raisedPriority(t.Priority)
+    }
+    if t.ResolvedAt == nil && t.ResolutionBreachedAt == nil && !t.ResolutionDue.After(now) {
+        t.ResolutionBreachedAt, t.ResolutionStaffID = &now, t.AssignedTo
+        adminID, err := leastLoadedAdmin(ctx, s, t.AssignedTo)
+        if err != nil {
+            return err
+        }
+        if adminID == 0 {
+            log.Printf("Ticket %d missed its resolution target but no other admin is active", t.ID)
+        } else {
+            t.AssignedTo = adminID
+        }
+    }
+    return nil
+}
+
+// raisedPriority is the priority after p, or p if it is the highest.
+func raisedPriority(p string) string {
+    for i, priority := range ticketPriorities[:len(ticketPriorities)-1] {
+        if priority == p {
+            return ticketPriorities[i+1]
+        }
+    }
+    return p
+}
+
+// leastLoadedAdmin returns the active admin staff account, other than
+// except, with the fewest open tickets, or 0 if there is none. Ties go to
+// the first by username.
+func leastLoadedAdmin(ctx context.Context, s Store, except int) (int, error) {
+    staff, err := s.Staff().List(ctx)
+    if err != nil {
+        return 0, err
+    }
+    open, err := s.Tickets().OpenCounts(ctx)
+    if err != nil {
+        return 0, err
+    }
+    best := 0
+    for _, m := range staff {
+        if !m.Active || m.Role != roleAdmin || m.ID == except {
+            continue
+        }
+        if best == 0 || open[m.ID] < open[best] {
+            best = m.ID
+        }
+    }
+    return best, nil
+}
+
+// ticketSLAResponse is a ticket's SLA targets as shown to staff.
+type ticketSLAResponse struct {
+    FirstResponseDue     time.Time  `json:"first_response_due"`
+    ResolutionDue        time.Time  `json:"resolution_due"`
+    FirstResponseAt      *time.Time `json:"first_response_at"`
+    ResolvedAt           *time.Time `json:"resolved_at"`
+    ResponseBreachedAt   *time.Time `json:"response_breached_at"`
+    ResolutionBreachedAt *time.Time `json:"resolution_breached_at"`
+}
+
+func newTicketSLAResponse(t Ticket) *ticketSLAResponse {
+    return &ticketSLAResponse{t.FirstResponseDue, t.ResolutionDue, t.FirstResponseAt, t.ResolvedAt,
+        t.ResponseBreachedAt, t.ResolutionBreachedAt}
+}
+
+func (s *server) listSLAPoliciesHandler(w http.ResponseWriter, r *http.Request) {
+    policies, err := s.store.Tickets().SLAPolicies(r.Context())
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch SLA policies")
+        return
+    }
+    writeJSON(w, http.StatusOK, append([]SLAPolicy{}, policies...))
+}
+
+// setSLAPolicyHandler replaces the targets of the priority in the path.
+// Tickets already open keep their due times until their priority changes.
+func (s *server) setSLAPolicyHandler(w http.ResponseWriter, r *http.Request) {
+    priority := mux.Vars(r)["priority"]
+    if !contains(ticketPriorities, priority) {
+        writeError(w, http.StatusNotFound, "Unknown priority")
+        return
+    }
+    var req struct {
+        FirstResponseMinutes int `json:"first_response_minutes"`
+        ResolutionMinutes    int `json:"resolution_minutes"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeError(w, http.StatusBadRequest, "Invalid request body")
+        return
+    }
+
+    var errs ValidationErrors
+    for _, f := range []struct {
+        name    string
+        minutes int
+    }{{"first_response_minutes", req.FirstResponseMinutes}, {"resolution_minutes", req.ResolutionMinutes}} {
+        if f.minutes < 1 || f.minutes > maxSLAMinutes {
+            errs = append(errs, FieldError{f.name, "out_of_range",
+                fmt.Sprintf("%s must be between 1 and %d", f.name, maxSLAMinutes)})
+        }
+    }
+    if len(errs) == 0 && req.ResolutionMinutes < req.FirstResponseMinutes {
+        errs = append(errs, FieldError{"resolution_minutes", "before_first_response",
+            "resolution_minutes must be at least first_response_minutes"})
+    }
+    if len(errs) > 0 {
+        writeValidationErrors(w, errs)
+        return
+    }
+
+    err := s.store.Tickets().SetSLAPolicy(r.Context(), SLAPolicy{Priority: priority,
+        FirstResponseMinutes: req.FirstResponseMinutes, ResolutionMinutes: req.ResolutionMinutes})
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to save SLA policy")
+        return
+    }
+    p, err := s.store.Tickets().SLAPolicy(r.Context(), priority)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch SLA policy")
+        return
+    }
+    writeJSON(w, http.StatusOK, p)
+}
+
+// slaAgentResponse is one staff member's line of the SLA report. The
+// compliance figures are the share of targets met, or null when there were
+// none.
+type slaAgentResponse struct {
+    SLAAgentStats
+    ResponseCompliance   *Percent `json:"response_compliance"`
+    ResolutionCompliance *Percent `json:"resolution_compliance"`
+}
+
+func newSLAAgentResponse(a SLAAgentStats) slaAgentResponse {
+    return slaAgentResponse{a, compliance(a.ResponsesMet, a.ResponsesMissed),
+        compliance(a.ResolutionsMet, a.ResolutionsMissed)}
+}
+
+// compliance is met as a percentage of met plus missed, rounded to the
+// hundredth.
+func compliance(met, missed int) *Percent {
+    total := met + missed
+    if total == 0 {
+        return nil
+    }
+    p := Percent((int64(met)*100*100*2 + int64(total)) / (int64(total) * 2))
+    return &p
+}
+
+// slaReportHandler reports SLA compliance per staff member for the targets
+// met or breached between ?from= and ?to=, both dates and inclusive. It
+// covers the last 30 days by default.
+func (s *server) slaReportHandler(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+    to := dateOf(time.Now(), time.UTC)
+    if v := q.Get("to"); v != "" {
+        d, err := parseDate(v)
+        if err != nil {
+            writeError(w, http.StatusBadRequest, "Invalid to date")
+            return
+        }
+        to = d
+    }
+    from := to.AddDate(0, 0, 1-defaultSLAReportDays)
+    if v := q.Get("from"); v != "" {
+        d, err := parseDate(v)
+        if err != nil {
+            writeError(w, http.StatusBadRequest, "Invalid from date")
+            return
+        }
+        from = d
+    }
+    if from.After(to) {
+        writeValidationErrors(w, ValidationErrors{{"from", "after_to", "from must not be after to"}})
+        return
+    }
+
+    stats, err := s.store.Tickets().SLAReport(r.Context(), from, to.AddDate(0, 0, 1))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch SLA report")
+        return
+    }
+
+    resp := struct {
+        From   string             `json:"from"`
+        To     string             `json:"to"`
+        Agents []slaAgentResponse `json:"agents"`
+        Total  slaAgentResponse   `json:"total"`
+    }{From: from.Format(dateLayout), To: to.Format(dateLayout), Agents: []slaAgentResponse{}}
+    var total SLAAgentStats
+    for _, a := range stats {
+        resp.Agents = append(resp.Agents, newSLAAgentResponse(a))
+        total.ResponsesMet += a.ResponsesMet
+        total.ResponsesMissed += a.ResponsesMissed
+        total.ResolutionsMet += a.ResolutionsMet
+        total.ResolutionsMissed += a.ResolutionsMissed
+    }
+    resp.Total = newSLAAgentResponse(total)
+    writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "testing"
+    "time"
+)
+
+// failingTicketStore refuses to update ticket failID, as a database
+// rejecting the write would.
+type failingTicketStore struct {
+    Store
+    failID int
+}
+
+func (s failingTicketStore) Tickets() TicketRepo {
+    return failingTickets{s.Store.Tickets(), s.failID}
+}
+
+func (s failingTicketStore) WithTx(ctx context.Context, fn func(Store) error) error {
+    return s.Store.WithTx(ctx, func(tx Store) error { return fn(failingTicketStore{tx, s.failID}) })
+}
+
+type failingTickets struct {
+    TicketRepo
+    failID int
+}
+
+func (r failingTickets) Update(ctx context.Context, t Ticket) error {
+    if t.ID == r.failID {
+        return errors.New("update refused")
+    }
+    return r.TicketRepo.Update(ctx, t)
+}
+
+func TestTicketSLAsSkipTicketsThatFailToEscalate(t *testing.T) {
+    ctx := context.Background()
+    mem := newMemoryStore()
+    userID, err := mem.Users().Create(ctx, User{Phone: "+15550001", Name: "Customer"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    now := time.Now()
+    var ids []int
+    for i := 0; i < 3; i++ {
+        id, err := mem.Tickets().Create(ctx, Ticket{UserID: userID, Subject: "Help", Priority: "medium",
+            FirstResponseDue: now.Add(-time.Minute), ResolutionDue: now.Add(time.Hour)})
+        if err != nil {
+            t.Fatal(err)
+        }
+        ids = append(ids, id)
+    }
+
+    // The first ticket claimed fails every time.
+    s := failingTicketStore{mem, ids[0]}
+    for run := 1; run <= 2; run++ {
+        n, err := checkTicketSLAs(ctx, s)
+        if err != nil {
+            t.Fatalf("run %d: %v", run, err)
+        }
+        if want := 2 * (2 - run); n != want {
+            t.Errorf("run %d escalated %d tickets, want %d", run, n, want)
+        }
+    }
+
+    for _, id := range ids {
+        ticket, err := mem.Tickets().Get(ctx, id)
+        if err != nil {
+            t.Fatal(err)
+        }
+        breached, priority := true, "high"
+        if id == ids[0] {
+            breached, priority = false, "medium"
+        }
+        if (ticket.ResponseBreachedAt != nil) != breached || ticket.Priority != priority {
+            t.Errorf("ticket %d: breached at %v with priority %s, want breached %v and %s",
+                id, ticket.ResponseBreachedAt, ticket.Priority, breached, priority)
+        }
+    }
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "testing"
+    "time"
+)
+
+func TestTicketStatusTransitions(t *testing.T) {
+    ts := newTestServer(t)
+    staffTokens, err := newStaffTokenVerifier(testLocalSecret)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ts.staffTokens = staffTokens
+    staff, err := staffTokens.Sign(ts.mem.addStaff(StaffMember{Username: "agent", Role: roleSupport}), roleSupport,
+        time.Minute)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ts.createUser(t, "+15550001", 0)
+    user := ts.token(t, "+15550001")
+
+    // ticketIn opens a ticket and puts it straight into status.
+    ticketIn := func(status string) int {
+        t.Helper()
+        w := ts.request("POST", "/api/v1/me/tickets", user, `{"subject": "Late delivery", "message": "Where is it?"}`)
+        if w.Code != http.StatusCreated {
+            t.Fatalf("opening a ticket: got %d: %s", w.Code, w.Body.String())
+        }
+        var opened struct {
+            ID int `json:"id"`
+        }
+        if err := json.Unmarshal(w.Body.Bytes(), &opened); err != nil {
+            t.Fatal(err)
+        }
+        tk := ts.mem.root.tickets[opened.ID]
+        tk.Status = status
+        ts.mem.root.tickets[opened.ID] = tk
+        return opened.ID
+    }
+    statusOf := func(id int) string {
+        t.Helper()
+        tk, err := ts.mem.Tickets().Get(context.Background(), id)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return tk.Status
+    }
+
+    allowed := map[[2]string]bool{
+        {ticketOpen, ticketInProgress}:     true,
+        {ticketOpen, ticketResolved}:       true,
+        {ticketOpen, ticketClosed}:         true,
+        {ticketInProgress, ticketOpen}:     true,
+        {ticketInProgress, ticketResolved}: true,
+        {ticketInProgress, ticketClosed}:   true,
+        {ticketResolved, ticketOpen}:       true,
+        {ticketResolved, ticketClosed}:     true,
+    }
+    targets := append([]string{"reopened"}, ticketStatuses...)
+    for _, from := range ticketStatuses {
+        for _, to := range targets {
+            id := ticketIn(from)
+            w := ts.request("POST", fmt.Sprintf("/admin/api/tickets/%d/status", id), staff,
+                fmt.Sprintf(`{"status": %q}`, to))
+            switch {
+            case allowed[[2]string{from, to}]:
+                if w.Code != http.StatusOK || statusOf(id) != to {
+                    t.Errorf("%s to %s: got %d, now %s: %s", from, to, w.Code, statusOf(id), w.Body.String())
+                }
+            case w.Code != http.StatusUnprocessableEntity || statusOf(id) != from:
+                t.Errorf("%s to %s: got %d, now %s, want it refused", from, to, w.Code, statusOf(id))
+            }
+        }
+    }
+
+    // Messages move tickets too: a user's reopens a resolved ticket, a
+    // staff reply starts work on an open one, and a closed ticket takes none.
+    tests := []struct {
+        from, token string
+        want        string
+        code        int
+    }{
+        {ticketResolved, user, ticketOpen, http.StatusCreated},
+        {ticketInProgress, user, ticketInProgress, http.StatusCreated},
+        {ticketOpen, staff, ticketInProgress, http.StatusCreated},
+        {ticketResolved, staff, ticketResolved, http.StatusCreated},
+        {ticketClosed, user, ticketClosed, http.StatusUnprocessableEntity},
+        {ticketClosed, staff, ticketClosed, http.StatusUnprocessableEntity},
+    }
+    for _, tt := range tests {
+        id := ticketIn(tt.from)
+        path := fmt.Sprintf("/api/v1/me/tickets/%d/messages", id)
+        sender := "user"
+        if tt.token == staff {
+            path, sender = fmt.Sprintf("/admin/api/tickets/%d/messages", id), "staff"
+        }
+        w := ts.request("POST", path, tt.token, `{"message": "Any news?"}`)
+        if w.Code != tt.code || statusOf(id) != tt.want {
+            t.Errorf("%s message on a %s ticket: got %d, now %s; want %d, %s: %s", sender, tt.from, w.Code,
+                statusOf(id), tt.code, tt.want, w.Body.String())
+        }
+    }
+}
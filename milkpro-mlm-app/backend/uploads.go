@@ -0,0 +1,97 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "mime/multipart"
+    "net/http"
+    "strings"
+    "time"
+)
+
+const (
+    maxUploadSize = 10 << 20
+    // signedURLTTL is how long a download URL handed to a client stays valid.
+    signedURLTTL = 10 * time.Minute
+)
+
+// uploadFileTypes maps the content types accepted for uploaded files, as
+// sniffed from their first bytes, to the extension they are stored with.
+var uploadFileTypes = map[string]string{
+    "image/jpeg":      ".jpg",
+    "image/png":       ".png",
+    "image/webp":      ".webp",
+    "application/pdf": ".pdf",
+}
+
+// parseUploadForm reads a multipart request of at most one file of
+// maxUploadSize plus its fields, answering 422 on field when the body is
+// too large and 400 when it is not a multipart form. Callers must remove
+// r.MultipartForm's temporary files when done.
+func parseUploadForm(w http.ResponseWriter, r *http.Request, field string) bool {
+    r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+1<<20)
+    if err := r.ParseMultipartForm(1 << 20); err != nil {
+        var tooLarge *http.MaxBytesError
+        if errors.As(err, &tooLarge) {
+            writeValidationErrors(w, ValidationErrors{uploadTooLarge(field)})
+            return false
+        }
+        writeError(w, http.StatusBadRequest, "Invalid multipart form")
+        return false
+    }
+    return true
+}
+
+func uploadTooLarge(field string) FieldError {
+    return FieldError{field, "too_large", fmt.Sprintf("%s must be at most %d MB", field, maxUploadSize>>20)}
+}
+
+// checkUploadFile checks an uploaded file's size and, from its first bytes,
+// its type, appending any problems on field to errs. The file is left at its
+// start.
+func checkUploadFile(file multipart.File, header *multipart.FileHeader, field string, errs ValidationErrors) (string, ValidationErrors) {
+    if header.Size > maxUploadSize {
+        return "", append(errs, uploadTooLarge(field))
+    }
+    if header.Size == 0 {
+        return "", append(errs, FieldError{field, "required", field + " is empty"})
+    }
+    head := make([]byte, 512)
+    n, err := io.ReadFull(file, head)
+    if err != nil && err != io.ErrUnexpectedEOF {
+        return "", append(errs, FieldError{field, "invalid", field + " could not be read"})
+    }
+    contentType := http.DetectContentType(head[:n])
+    if _, ok := uploadFileTypes[contentType]; !ok {
+        return "", append(errs, FieldError{field, "unsupported_type",
+            field + " must be a JPEG, PNG or WebP image or a PDF"})
+    }
+    if _, err := file.Seek(0, io.SeekStart); err != nil {
+        return "", append(errs, FieldError{field, "invalid", field + " could not be read"})
+    }
+    return contentType, errs
+}
+
+// newBlobKey returns an unguessable key under prefix for a file of
+// contentType.
+func newBlobKey(prefix, contentType string) (string, error) {
+    name, err := randomHex(16)
+    if err != nil {
+        return "", err
+    }
+    return prefix + "/" + name + uploadFileTypes[contentType], nil
+}
+
+// downloadURL signs key for signedURLTTL. Rows written before files were
+// uploaded hold the URL the client sent, which is returned as it is.
+func (s *server) downloadURL(key string) string {
+    if key == "" || strings.Contains(key, "://") {
+        return key
+    }
+    u, err := s.blobs.SignedURL(key, signedURLTTL)
+    if err != nil {
+        return ""
+    }
+    return u
+}
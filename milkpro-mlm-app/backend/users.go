@@ -0,0 +1,141 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "errors"
+    "log"
+    "math/big"
+    "strings"
+)
+
+const (
+    referralCodeLength   = 8
+    referralCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789" // no 0/O or 1/I
+    referralCodeAttempts = 5
+)
+
+var (
+    errUnknownReferralCode = errors.New("unknown referral code")
+    errReferralCodeSpace   = errors.New("could not allocate a unique referral code")
+)
+
+func generateReferralCode() (string, error) {
+    var b strings.Builder
+    max := big.NewInt(int64(len(referralCodeAlphabet)))
+    for i := 0; i < referralCodeLength; i++ {
+        n, err := rand.Int(rand.Reader, max)
+        if err != nil {
+            return "", err
+        }
+        b.WriteByte(referralCodeAlphabet[n.Int64()])
+    }
+    return b.String(), nil
+}
+
+func normalizeReferralCode(code string) string {
+    return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// NewUser is the data needed to register an app user.
+type NewUser struct {
+    Phone        string
+    FirebaseUID  string // empty for users registered without a token
+    Name         string
+    Email        string
+    ReferralCode string // sponsor's code, optional
+}
+
+// createUser inserts a user with a fresh referral code through s and, when a
+// sponsor code is given, links the user into the sponsor tree. It returns
+// errUnknownReferralCode if the code matches nobody. Call it inside
+// Store.WithTx so the user and their links are created together.
+func createUser(ctx context.Context, s Store, u NewUser) (int, string, error) {
+    sponsorID := 0
+    if code := normalizeReferralCode(u.ReferralCode); code != "" {
+        sponsor, err := s.Users().GetByReferralCode(ctx, code)
+        if err == errNotFound {
+            return 0, "", errUnknownReferralCode
+        }
+        if err != nil {
+            return 0, "", err
+        }
+        sponsorID = sponsor.ID
+    }
+
+    var userID int
+    var code string
+    for attempt := 0; attempt < referralCodeAttempts && userID == 0; attempt++ {
+        candidate, err := generateReferralCode()
+        if err != nil {
+            return 0, "", err
+        }
+        userID, err = s.Users().Create(ctx, User{
+            Phone:        u.Phone,
+            FirebaseUID:  u.FirebaseUID,
+            Name:         u.Name,
+            Email:        u.Email,
+            ReferralCode: candidate,
+        })
+        if err != nil && err != errReferralCodeTaken {
+            return 0, "", err
+        }
+        code = candidate
+    }
+    if userID == 0 {
+        return 0, "", errReferralCodeSpace
+    }
+
+    if sponsorID != 0 {
+        if err := s.Referrals().Link(ctx, userID, sponsorID); err != nil {
+            return 0, "", err
+        }
+    }
+    return userID, code, nil
+}
+
+// registerUser creates a user and their sponsor links in one transaction.
+func registerUser(ctx context.Context, s Store, u NewUser) (int, string, error) {
+    var userID int
+    var code string
+    err := s.WithTx(ctx, func(tx Store) error {
+        var err error
+        userID, code, err = createUser(ctx, tx, u)
+        return err
+    })
+    return userID, code, err
+}
+
+// backfillReferralCodes gives a referral code to users created before codes
+// were generated, such as the seeded admin.
+func backfillReferralCodes(ctx context.Context, s Store) error {
+    ids, err := s.Users().IDsWithoutReferralCode(ctx)
+    if err != nil {
+        return err
+    }
+
+    for _, id := range ids {
+        assigned := false
+        for attempt := 0; attempt < referralCodeAttempts && !assigned; attempt++ {
+            code, err := generateReferralCode()
+            if err != nil {
+                return err
+            }
+            err = s.Users().SetReferralCode(ctx, id, code)
+            if err == errReferralCodeTaken {
+                continue
+            }
+            if err != nil {
+                return err
+            }
+            assigned = true
+        }
+        if !assigned {
+            return errReferralCodeSpace
+        }
+    }
+    if len(ids) > 0 {
+        log.Printf("Assigned referral codes to %d existing users", len(ids))
+    }
+    return nil
+}
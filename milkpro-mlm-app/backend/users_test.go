@@ -0,0 +1,96 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// registered is the body of a successful register response.
+type registered struct {
+    UserID       int    `json:"user_id"`
+    ReferralCode string `json:"referral_code"`
+}
+
+// register signs phone up through the app's register route.
+func (ts *testServer) register(t *testing.T, phone, referralCode string) (*httptest.ResponseRecorder, registered) {
+    t.Helper()
+    w := ts.request("POST", "/api/v1/register", "", fmt.Sprintf(`{"firebase_token": %q, "name": "User %s", "referral_code": %q}`,
+        ts.token(t, phone), phone, referralCode))
+    var u registered
+    if w.Code == http.StatusOK {
+        if err := json.Unmarshal(w.Body.Bytes(), &u); err != nil {
+            t.Fatalf("registering %s: %v: %s", phone, err, w.Body.String())
+        }
+    }
+    return w, u
+}
+
+func TestRegisterBuildsSponsorTree(t *testing.T) {
+    ts := newTestServer(t)
+    ctx := context.Background()
+
+    w, top := ts.register(t, "+15550001", "")
+    if w.Code != http.StatusOK {
+        t.Fatalf("registering without a code: got %d: %s", w.Code, w.Body.String())
+    }
+    if len(top.ReferralCode) != referralCodeLength || strings.Trim(top.ReferralCode, referralCodeAlphabet) != "" {
+        t.Errorf("got referral code %q", top.ReferralCode)
+    }
+
+    // Codes are matched whatever their case and surrounding space.
+    w, middle := ts.register(t, "+15550002", " "+strings.ToLower(top.ReferralCode)+" ")
+    if w.Code != http.StatusOK {
+        t.Fatalf("registering with a code: got %d: %s", w.Code, w.Body.String())
+    }
+    w, bottom := ts.register(t, "+15550003", middle.ReferralCode)
+    if w.Code != http.StatusOK {
+        t.Fatalf("registering with a code: got %d: %s", w.Code, w.Body.String())
+    }
+    if bottom.ReferralCode == top.ReferralCode || bottom.ReferralCode == middle.ReferralCode {
+        t.Errorf("referral codes are not unique: %q, %q, %q", top.ReferralCode, middle.ReferralCode, bottom.ReferralCode)
+    }
+
+    upline := func(userID int) []int {
+        t.Helper()
+        ids, err := ts.mem.Referrals().Upline(ctx, userID)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return ids
+    }
+    if got, want := upline(bottom.UserID), []int{middle.UserID, top.UserID}; !reflect.DeepEqual(got, want) {
+        t.Errorf("bottom's upline is %v, want %v", got, want)
+    }
+    if got, want := upline(middle.UserID), []int{top.UserID}; !reflect.DeepEqual(got, want) {
+        t.Errorf("middle's upline is %v, want %v", got, want)
+    }
+
+    // An unknown code is refused and nobody is created.
+    if w, _ := ts.register(t, "+15550004", "ZZZZZZZZ"); w.Code != http.StatusBadRequest ||
+        errorMessage(t, w) != "Unknown referral code" {
+        t.Errorf("registering with an unknown code: got %d: %s", w.Code, w.Body.String())
+    }
+    if _, err := ts.mem.Users().GetByPhone(ctx, "+15550004"); err != errNotFound {
+        t.Errorf("a user refused for their code was created: %v", err)
+    }
+
+    // A user can never sponsor themselves: registering again with their own
+    // code changes nothing, and the legacy route refuses the phone.
+    if w, again := ts.register(t, "+15550003", bottom.ReferralCode); w.Code != http.StatusOK || again.UserID != bottom.UserID {
+        t.Errorf("registering again: got %d: %s", w.Code, w.Body.String())
+    }
+    w = ts.request("POST", "/api/register", "", fmt.Sprintf(`{"phone_number": "+15550003", "name": "Again", "referral_code": %q}`,
+        bottom.ReferralCode))
+    if w.Code != http.StatusConflict {
+        t.Errorf("registering again on the legacy route: got %d: %s", w.Code, w.Body.String())
+    }
+    if got, want := upline(bottom.UserID), []int{middle.UserID, top.UserID}; !reflect.DeepEqual(got, want) {
+        t.Errorf("after registering again, bottom's upline is %v, want %v", got, want)
+    }
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "os"
+    "strings"
+    "time"
+
+    "firebase.google.com/go/auth"
+)
+
+// TokenVerifier checks a bearer ID token and returns its claims. Both
+// implementations return the Firebase claim layout: the user ID in UID and
+// the verified phone number in Claims["phone_number"].
+type TokenVerifier interface {
+    VerifyIDToken(ctx context.Context, idToken string) (*auth.Token, error)
+}
+
+var errNoTokenVerifier = errors.New("no token verifier configured")
+
+// verifyIDToken checks idToken with the verifier selected by AUTH_MODE.
+func (s *server) verifyIDToken(ctx context.Context, idToken string) (*auth.Token, error) {
+    if s.verifier == nil {
+        return nil, errNoTokenVerifier
+    }
+    return s.verifier.VerifyIDToken(ctx, idToken)
+}
+
+// newTokenVerifier builds the verifier named by AUTH_MODE: "firebase" (the
+// default) or "local".
+func newTokenVerifier(ctx context.Context) (TokenVerifier, error) {
+    switch mode := os.Getenv("AUTH_MODE"); mode {
+    case "", "firebase":
+        return newFirebaseVerifier(ctx)
+    case "local":
+        return newLocalVerifierFromEnv()
+    default:
+        return nil, fmt.Errorf("unknown AUTH_MODE %q", mode)
+    }
+}
+
+const (
+    localTokenIssuer    = "milkpro-local"
+    localTokenMinSecret = 32
+    localTokenLeeway    = 30 * time.Second
+)
+
+var (
+    errMalformedToken   = errors.New("malformed token")
+    errTokenSignature   = errors.New("invalid token signature")
+    errTokenExpired     = errors.New("token expired")
+    errTokenNotYetValid = errors.New("token used before issued")
+)
+
+// localVerifier accepts HS256 JWTs signed with a shared secret. It stands in
+// for Firebase during development and integration tests so the authenticated
+// API can be exercised offline.
+type localVerifier struct {
+    secret []byte
+    now    func() time.Time
+}
+
+func newLocalVerifier(secret []byte) (*localVerifier, error) {
+    if len(secret) < localTokenMinSecret {
+        return nil, fmt.Errorf("local token secret must be at least %d bytes", localTokenMinSecret)
+    }
+    return &localVerifier{secret: secret, now: time.Now}, nil
+}
+
+func newLocalVerifierFromEnv() (*localVerifier, error) {
+    return newLocalVerifier([]byte(os.Getenv("AUTH_LOCAL_SECRET")))
+}
+
+type jwtHeader struct {
+    Alg string `json:"alg"`
+    Typ string `json:"typ"`
+}
+
+func (v *localVerifier) VerifyIDToken(ctx context.Context, idToken string) (*auth.Token, error) {
+    payload, err := parseHS256(v.secret, idToken)
+    if err != nil {
+        return nil, err
+    }
+    var token auth.Token
+    if err := json.Unmarshal(payload, &token); err != nil {
+        return nil, errMalformedToken
+    }
+    if err := json.Unmarshal(payload, &token.Claims); err != nil {
+        return nil, errMalformedToken
+    }
+
+    if token.Issuer != localTokenIssuer || token.Subject == "" {
+        return nil, errMalformedToken
+    }
+    if err := checkTokenTimes(v.now(), token.IssuedAt, token.Expires); err != nil {
+        return nil, err
+    }
+
+    token.UID = token.Subject
+    return &token, nil
+}
+
+// Sign issues a token that VerifyIDToken accepts for the given user.
+func (v *localVerifier) Sign(uid, phone string, ttl time.Duration) (string, error) {
+    now := v.now()
+    return signHS256(v.secret, map[string]interface{}{
+        "iss":          localTokenIssuer,
+        "sub":          uid,
+        "iat":          now.Unix(),
+        "exp":          now.Add(ttl).Unix(),
+        "phone_number": phone,
+    })
+}
+
+// parseHS256 checks a compact JWS signed with HS256 under secret and returns
+// its payload. Claims are left to the caller.
+func parseHS256(secret []byte, token string) ([]byte, error) {
+    parts := strings.Split(token, ".")
+    if len(parts) != 3 {
+        return nil, errMalformedToken
+    }
+
+    headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+    if err != nil {
+        return nil, errMalformedToken
+    }
+    var header jwtHeader
+    if err := json.Unmarshal(headerJSON, &header); err != nil || header.Alg != "HS256" {
+        return nil, errMalformedToken
+    }
+
+    signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil {
+        return nil, errMalformedToken
+    }
+    if !hmac.Equal(signature, hs256(secret, parts[0]+"."+parts[1])) {
+        return nil, errTokenSignature
+    }
+
+    payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+    if err != nil {
+        return nil, errMalformedToken
+    }
+    return payload, nil
+}
+
+func signHS256(secret []byte, claims interface{}) (string, error) {
+    headerJSON, err := json.Marshal(jwtHeader{Alg: "HS256", Typ: "JWT"})
+    if err != nil {
+        return "", err
+    }
+    payload, err := json.Marshal(claims)
+    if err != nil {
+        return "", err
+    }
+
+    signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." +
+        base64.RawURLEncoding.EncodeToString(payload)
+    return signingInput + "." + base64.RawURLEncoding.EncodeToString(hs256(secret, signingInput)), nil
+}
+
+func hs256(secret []byte, signingInput string) []byte {
+    mac := hmac.New(sha256.New, secret)
+    mac.Write([]byte(signingInput))
+    return mac.Sum(nil)
+}
+
+// checkTokenTimes rejects tokens outside [iat, exp], allowing localTokenLeeway
+// of clock skew either way.
+func checkTokenTimes(now time.Time, issuedAt, expires int64) error {
+    if now.After(time.Unix(expires, 0).Add(localTokenLeeway)) {
+        return errTokenExpired
+    }
+    if now.Add(localTokenLeeway).Before(time.Unix(issuedAt, 0)) {
+        return errTokenNotYetValid
+    }
+    return nil
+}
+
+// runTokenCommand implements "backend token": it prints a token signed with
+// AUTH_LOCAL_SECRET for calling a server running with AUTH_MODE=local.
+func runTokenCommand(args []string) error {
+    fs := flag.NewFlagSet("token", flag.ExitOnError)
+    phone := fs.String("phone", "", "phone_number claim (required)")
+    uid := fs.String("uid", "", "user ID claim (defaults to local:<phone>)")
+    ttl := fs.Duration("ttl", time.Hour, "token lifetime")
+    fs.Parse(args)
+
+    if *phone == "" {
+        return errors.New("token: -phone is required")
+    }
+    if *uid == "" {
+        *uid = "local:" + *phone
+    }
+
+    verifier, err := newLocalVerifierFromEnv()
+    if err != nil {
+        return err
+    }
+    token, err := verifier.Sign(*uid, *phone, *ttl)
+    if err != nil {
+        return err
+    }
+    fmt.Println(token)
+    return nil
+}
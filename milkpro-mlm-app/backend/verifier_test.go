@@ -0,0 +1,137 @@
+package main
+
+import (
+    "context"
+    "encoding/base64"
+    "encoding/json"
+    "strings"
+    "testing"
+    "time"
+)
+
+var testLocalSecret = []byte("0123456789abcdef0123456789abcdef")
+
+// signTestJWT builds a compact JWS with the given header and claims, signed
+// with HMAC-SHA256 under secret whatever the header's alg says.
+func signTestJWT(t *testing.T, secret []byte, header, claims map[string]interface{}) string {
+    t.Helper()
+    headerJSON, err := json.Marshal(header)
+    if err != nil {
+        t.Fatal(err)
+    }
+    payload, err := json.Marshal(claims)
+    if err != nil {
+        t.Fatal(err)
+    }
+    input := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(payload)
+    return input + "." + base64.RawURLEncoding.EncodeToString(hs256(secret, input))
+}
+
+func TestLocalVerifier(t *testing.T) {
+    now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+    v, err := newLocalVerifier(testLocalSecret)
+    if err != nil {
+        t.Fatal(err)
+    }
+    v.now = func() time.Time { return now }
+
+    hs256Header := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+    claims := func(change func(c map[string]interface{})) map[string]interface{} {
+        c := map[string]interface{}{
+            "iss":          localTokenIssuer,
+            "sub":          "local:+15550001",
+            "iat":          now.Add(-time.Minute).Unix(),
+            "exp":          now.Add(time.Hour).Unix(),
+            "phone_number": "+15550001",
+        }
+        if change != nil {
+            change(c)
+        }
+        return c
+    }
+    valid := signTestJWT(t, testLocalSecret, hs256Header, claims(nil))
+    parts := strings.Split(valid, ".")
+
+    otherPayload, _ := json.Marshal(claims(func(c map[string]interface{}) { c["sub"] = "local:+15550002" }))
+    signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+    signature[0] ^= 1
+
+    tests := []struct {
+        name  string
+        token string
+        want  error
+    }{
+        {"valid", valid, nil},
+        {"expired within leeway", signTestJWT(t, testLocalSecret, hs256Header, claims(func(c map[string]interface{}) {
+            c["exp"] = now.Add(-localTokenLeeway / 2).Unix()
+        })), nil},
+        {"expired", signTestJWT(t, testLocalSecret, hs256Header, claims(func(c map[string]interface{}) {
+            c["exp"] = now.Add(-time.Minute).Unix()
+        })), errTokenExpired},
+        {"issued in the future", signTestJWT(t, testLocalSecret, hs256Header, claims(func(c map[string]interface{}) {
+            c["iat"] = now.Add(time.Minute).Unix()
+        })), errTokenNotYetValid},
+        {"other secret", signTestJWT(t, []byte("fedcba9876543210fedcba9876543210"), hs256Header, claims(nil)),
+            errTokenSignature},
+        {"tampered payload", parts[0] + "." + base64.RawURLEncoding.EncodeToString(otherPayload) + "." + parts[2],
+            errTokenSignature},
+        {"tampered signature", parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(signature),
+            errTokenSignature},
+        {"other issuer", signTestJWT(t, testLocalSecret, hs256Header, claims(func(c map[string]interface{}) {
+            c["iss"] = "someone-else"
+        })), errMalformedToken},
+        {"no subject", signTestJWT(t, testLocalSecret, hs256Header, claims(func(c map[string]interface{}) {
+            delete(c, "sub")
+        })), errMalformedToken},
+        {"alg none", signTestJWT(t, testLocalSecret, map[string]interface{}{"alg": "none"}, claims(nil)),
+            errMalformedToken},
+        {"alg none unsigned", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + ".",
+            errMalformedToken},
+        {"alg HS512", signTestJWT(t, testLocalSecret, map[string]interface{}{"alg": "HS512"}, claims(nil)),
+            errMalformedToken},
+        {"alg RS256", signTestJWT(t, testLocalSecret, map[string]interface{}{"alg": "RS256"}, claims(nil)),
+            errMalformedToken},
+        {"two parts", parts[0] + "." + parts[1], errMalformedToken},
+        {"signature not base64", parts[0] + "." + parts[1] + ".!!!", errMalformedToken},
+        {"empty", "", errMalformedToken},
+    }
+    for _, tt := range tests {
+        token, err := v.VerifyIDToken(context.Background(), tt.token)
+        if err != tt.want {
+            t.Errorf("%s: got error %v, want %v", tt.name, err, tt.want)
+            continue
+        }
+        if err == nil && (token.UID != "local:+15550001" || token.Claims["phone_number"] != "+15550001") {
+            t.Errorf("%s: got UID %q and claims %v", tt.name, token.UID, token.Claims)
+        }
+    }
+}
+
+func TestLocalVerifierSignRoundTrip(t *testing.T) {
+    v, err := newLocalVerifier(testLocalSecret)
+    if err != nil {
+        t.Fatal(err)
+    }
+    token, err := v.Sign("local:+15550001", "+15550001", time.Minute)
+    if err != nil {
+        t.Fatal(err)
+    }
+    got, err := v.VerifyIDToken(context.Background(), token)
+    if err != nil {
+        t.Fatalf("verifying a signed token: %v", err)
+    }
+    if got.UID != "local:+15550001" || got.Claims["phone_number"] != "+15550001" {
+        t.Errorf("got UID %q and claims %v", got.UID, got.Claims)
+    }
+
+    v.now = func() time.Time { return time.Now().Add(time.Minute + 2*localTokenLeeway) }
+    if _, err := v.VerifyIDToken(context.Background(), token); err != errTokenExpired {
+        t.Errorf("after its ttl: got %v, want %v", err, errTokenExpired)
+    }
+}
+
+func TestNewLocalVerifierRejectsShortSecrets(t *testing.T) {
+    if _, err := newLocalVerifier(testLocalSecret[:localTokenMinSecret-1]); err == nil {
+        t.Error("accepted a secret shorter than the minimum")
+    }
+}
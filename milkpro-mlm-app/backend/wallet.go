@@ -0,0 +1,125 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+)
+
+// System wallet accounts created by the migrations. Their balances are the
+// platform's side of every movement, so most of them run negative.
+const (
+    accountCash              = "cash"
+    accountInvestmentsHeld   = "investments_held"
+    accountInvestmentProfit  = "investment_profit"
+    accountCommissionExpense = "commission_expense"
+    accountSales             = "sales"
+    accountPurchases         = "purchases"
+)
+
+// Journal entry kinds.
+const (
+    entryDeposit    = "deposit"
+    entryWithdrawal = "withdrawal"
+    entryInvestment = "investment"
+    entryPayout     = "payout"
+    entryCommission = "commission"
+    entryPurchase   = "purchase"
+    entrySale       = "sale"
+)
+
+var (
+    errInsufficientFunds = errors.New("insufficient wallet balance")
+    errUnbalancedEntry   = errors.New("journal entry postings do not sum to zero")
+)
+
+// Posting moves Amount into (positive) or out of (negative) exactly one
+// account: a user's wallet when UserID is set, otherwise the system account
+// named by Account.
+type Posting struct {
+    UserID  int
+    Account string
+    Amount  Money
+}
+
+// JournalEntry is a balanced set of postings recorded atomically.
+type JournalEntry struct {
+    Kind           string
+    ReferenceType  string
+    ReferenceID    int
+    Memo           string
+    CreatedBy      int // who made a manual entry: an admin app user
+    CreatedByStaff int // or a support_staff account
+    Postings       []Posting
+}
+
+// postEntry validates e and appends it to the ledger through s, updating
+// users.balance for every user account it touches. It returns
+// errInsufficientFunds, leaving the caller to roll back, if any user balance
+// would go negative. Call it inside Store.WithTx together with whatever the
+// entry pays for.
+func postEntry(ctx context.Context, s Store, e JournalEntry) (int, error) {
+    if len(e.Postings) < 2 {
+        return 0, errUnbalancedEntry
+    }
+    var sum Money
+    for _, p := range e.Postings {
+        if p.Amount == 0 || (p.UserID == 0) == (p.Account == "") {
+            return 0, fmt.Errorf("invalid posting %+v", p)
+        }
+        sum += p.Amount
+    }
+    if sum != 0 {
+        return 0, errUnbalancedEntry
+    }
+    return s.Wallet().Post(ctx, e)
+}
+
+func isSystemAccount(code string) bool {
+    switch code {
+    case accountCash, accountInvestmentsHeld, accountInvestmentProfit, accountCommissionExpense, accountSales,
+        accountPurchases:
+        return true
+    }
+    return false
+}
+
+func errUnknownAccount(code string) error {
+    return fmt.Errorf("system wallet account %q does not exist", code)
+}
+
+// WalletMismatch reports a user whose projected balance disagrees with the ledger.
+type WalletMismatch struct {
+    UserID        int   `json:"user_id"`
+    Balance       Money `json:"balance"`
+    LedgerBalance Money `json:"ledger_balance"`
+}
+
+// WalletAudit is the result of checking that every journal entry balances and
+// that each users.balance equals the sum of that user's postings.
+type WalletAudit struct {
+    UnbalancedEntries []int            `json:"unbalanced_entries"`
+    Mismatches        []WalletMismatch `json:"mismatches"`
+}
+
+func (a WalletAudit) OK() bool {
+    return len(a.UnbalancedEntries) == 0 && len(a.Mismatches) == 0
+}
+
+func (s *server) walletHandler(w http.ResponseWriter, r *http.Request) {
+    userID := mustPrincipal(r).UserID
+
+    balance, entries, err := s.store.Wallet().Statement(r.Context(), userID, 100)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, "Failed to fetch wallet")
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "balance": balance,
+        "entries": entries,
+    })
+}
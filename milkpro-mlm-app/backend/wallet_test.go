@@ -0,0 +1,57 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "testing"
+    "time"
+)
+
+func TestWalletAdjustmentRecordsWhoMadeIt(t *testing.T) {
+    ts := newTestServer(t)
+    adminID := ts.createUser(t, "+15550001", 0)
+    admin := ts.mem.root.users[adminID]
+    admin.IsAdmin = true
+    ts.mem.root.users[adminID] = admin
+    userID := ts.createUser(t, "+15550002", 0)
+
+    staffTokens, err := newStaffTokenVerifier(testLocalSecret)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ts.staffTokens = staffTokens
+    staffToken, err := staffTokens.Sign(7, roleAdmin, time.Minute)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    for _, tt := range []struct {
+        name    string
+        token   string
+        body    string
+        userID  int
+        staffID int
+        balance Money
+    }{
+        {"admin user", ts.token(t, "+15550001"), `"kind": "deposit", "amount": 25`, adminID, 0, 2500},
+        {"staff", staffToken, `"kind": "withdrawal", "amount": 10`, 0, 7, 1500},
+    } {
+        w := ts.request("POST", "/admin/api/wallet/adjustments", tt.token,
+            fmt.Sprintf(`{"user_id": %d, %s}`, userID, tt.body))
+        if w.Code != http.StatusCreated {
+            t.Fatalf("%s: got %d: %s", tt.name, w.Code, w.Body.String())
+        }
+        if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+            t.Errorf("%s: response has Content-Type %q", tt.name, ct)
+        }
+        if got := ts.balance(t, userID); got != tt.balance {
+            t.Errorf("%s: balance is %v, want %v", tt.name, got, tt.balance)
+        }
+        entries := ts.mem.root.entries
+        e := entries[len(entries)-1].Entry
+        if e.CreatedBy != tt.userID || e.CreatedByStaff != tt.staffID {
+            t.Errorf("%s: entry made by user %d, staff %d; want user %d, staff %d", tt.name,
+                e.CreatedBy, e.CreatedByStaff, tt.userID, tt.staffID)
+        }
+    }
+}